@@ -7,6 +7,7 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -14,12 +15,23 @@ import (
 )
 
 var (
-	addr        = flag.String("addr", "localhost:8080", "Server address")
-	duration    = flag.Duration("duration", 30*time.Second, "Benchmark duration")
-	concurrency = flag.Int("concurrency", 10, "Number of concurrent clients")
-	readRatio   = flag.Float64("read-ratio", 0.8, "Read ratio (0.0-1.0)")
-	keyCount    = flag.Int("key-count", 10000, "Total number of unique keys")
-	hotKeyRatio = flag.Float64("hot-key-ratio", 0.2, "Hot key ratio (80/20 pattern)")
+	addr              = flag.String("addr", "localhost:8080", "Server address")
+	duration          = flag.Duration("duration", 30*time.Second, "Benchmark duration")
+	concurrency       = flag.Int("concurrency", 10, "Number of concurrent clients")
+	readRatio         = flag.Float64("read-ratio", 0.8, "Read ratio (0.0-1.0)")
+	keyCount          = flag.Int("key-count", 10000, "Total number of unique keys")
+	hotKeyRatio       = flag.Float64("hot-key-ratio", 0.2, "Hot key ratio (80/20 pattern)")
+	scanRatio         = flag.Float64("scan-ratio", 0, "Fraction of operations that are prefix scans (0.0-1.0)")
+	scanPrefixes      = flag.Int("scan-prefixes", 100, "Number of distinct scan prefixes")
+	scanKeysPerPrefix = flag.Int("scan-keys-per-prefix", 50, "Keys stored under each scan prefix")
+	scanLimit         = flag.Int("scan-limit", 0, "LIMIT passed to each scan (0 returns all keys of the prefix)")
+	scanValueSize     = flag.Int("scan-value-size", 100, "Value size in bytes for scan keys")
+	rate              = flag.Float64("rate", 0, "Open-loop mode: target ops/sec sent regardless of responses (0 uses closed-loop workers)")
+	window            = flag.Int("window", 64, "Open-loop mode: max in-flight pipelined requests per connection")
+	output            = flag.String("output", "", "Write results as JSON to this file")
+	compare           = flag.String("compare", "", "Compare results against a previous JSON result file")
+	maxTputDrop       = flag.Float64("max-throughput-drop", 0.10, "Fail the comparison if throughput drops by more than this fraction")
+	maxLatRise        = flag.Float64("max-latency-rise", 0.20, "Fail the comparison if P50/P99 latency rises by more than this fraction")
 )
 
 // KeySizeDistribution: 70% small, 20% medium, 10% large
@@ -36,12 +48,22 @@ var keySizeDist = KeySizeDistribution{
 }
 
 type Stats struct {
-	reads       int64
-	writes      int64
-	deletes     int64
-	errors      int64
-	readLatency int64 // nanoseconds
+	reads        int64
+	writes       int64
+	deletes      int64
+	errors       int64
+	readLatency  int64 // nanoseconds
 	writeLatency int64
+	scans        int64
+	scanResults  int64
+	scanLatency  int64
+	windowStalls int64 // open loop: sends that waited for a full window
+
+	// Individual latencies, merged from the workers for percentiles
+	mu             sync.Mutex
+	readLatencies  []time.Duration
+	writeLatencies []time.Duration
+	scanLatencies  []time.Duration
 }
 
 func main() {
@@ -54,19 +76,53 @@ func main() {
 	log.Printf("  Read Ratio: %.2f", *readRatio)
 	log.Printf("  Key Count: %d", *keyCount)
 	log.Printf("  Hot Key Ratio: %.2f", *hotKeyRatio)
+	if *rate > 0 {
+		log.Printf("  Open Loop: %.0f ops/sec, window %d per connection", *rate, *window)
+	}
+	if *scanRatio > 0 {
+		log.Printf("  Scan Ratio: %.2f (%d prefixes x %d keys, limit %d)",
+			*scanRatio, *scanPrefixes, *scanKeysPerPrefix, *scanLimit)
+	}
 
 	// Pre-populate some keys
 	log.Println("Pre-populating keys...")
 	if err := prepopulate(*addr, *keyCount/10); err != nil {
 		log.Fatalf("Prepopulation failed: %v", err)
 	}
+	if *scanRatio > 0 {
+		if err := prepopulateScans(*addr); err != nil {
+			log.Fatalf("Scan prepopulation failed: %v", err)
+		}
+	}
 
 	// Run benchmark
 	log.Println("Starting benchmark...")
-	stats := runBenchmark()
+	var stats *Stats
+	if *rate > 0 {
+		stats = runOpenLoop()
+	} else {
+		stats = runBenchmark()
+	}
 
 	// Print results
 	printResults(stats)
+
+	result := newResult(stats)
+	if *output != "" {
+		if err := result.save(*output); err != nil {
+			log.Fatalf("Failed to write results: %v", err)
+		}
+		log.Printf("Results written to %s", *output)
+	}
+	if *compare != "" {
+		baseline, err := loadResult(*compare)
+		if err != nil {
+			log.Fatalf("Failed to load baseline: %v", err)
+		}
+		if !compareResults(baseline, result) {
+			os.Exit(1)
+		}
+	}
 }
 
 func prepopulate(addr string, count int) error {
@@ -138,13 +194,35 @@ func worker(id int, stats *Stats, stopCh chan struct{}, wg *sync.WaitGroup) {
 
 	rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))
 
+	var readLatencies, writeLatencies, scanLatencies []time.Duration
+	defer func() {
+		stats.mu.Lock()
+		stats.readLatencies = append(stats.readLatencies, readLatencies...)
+		stats.writeLatencies = append(stats.writeLatencies, writeLatencies...)
+		stats.scanLatencies = append(stats.scanLatencies, scanLatencies...)
+		stats.mu.Unlock()
+	}()
+
 	for {
 		select {
 		case <-stopCh:
 			return
 		default:
 			// Decide operation
-			if rng.Float64() < *readRatio {
+			if *scanRatio > 0 && rng.Float64() < *scanRatio {
+				start := time.Now()
+				n, err := doScan(rng, writer, reader)
+				if err != nil {
+					atomic.AddInt64(&stats.errors, 1)
+					continue
+				}
+
+				latency := time.Since(start)
+				atomic.AddInt64(&stats.scans, 1)
+				atomic.AddInt64(&stats.scanResults, int64(n))
+				atomic.AddInt64(&stats.scanLatency, latency.Nanoseconds())
+				scanLatencies = append(scanLatencies, latency)
+			} else if rng.Float64() < *readRatio {
 				// Read operation
 				key := selectKey(rng)
 				start := time.Now()
@@ -161,9 +239,10 @@ func worker(id int, stats *Stats, stopCh chan struct{}, wg *sync.WaitGroup) {
 					continue
 				}
 
-				latency := time.Since(start).Nanoseconds()
+				latency := time.Since(start)
 				atomic.AddInt64(&stats.reads, 1)
-				atomic.AddInt64(&stats.readLatency, latency)
+				atomic.AddInt64(&stats.readLatency, latency.Nanoseconds())
+				readLatencies = append(readLatencies, latency)
 			} else {
 				// Write operation (90% writes, 10% deletes)
 				if rng.Float64() < 0.9 {
@@ -183,9 +262,10 @@ func worker(id int, stats *Stats, stopCh chan struct{}, wg *sync.WaitGroup) {
 						continue
 					}
 
-					latency := time.Since(start).Nanoseconds()
+					latency := time.Since(start)
 					atomic.AddInt64(&stats.writes, 1)
-					atomic.AddInt64(&stats.writeLatency, latency)
+					atomic.AddInt64(&stats.writeLatency, latency.Nanoseconds())
+					writeLatencies = append(writeLatencies, latency)
 				} else {
 					// Delete operation
 					key := selectKey(rng)
@@ -203,9 +283,10 @@ func worker(id int, stats *Stats, stopCh chan struct{}, wg *sync.WaitGroup) {
 						continue
 					}
 
-					latency := time.Since(start).Nanoseconds()
+					latency := time.Since(start)
 					atomic.AddInt64(&stats.deletes, 1)
-					atomic.AddInt64(&stats.writeLatency, latency)
+					atomic.AddInt64(&stats.writeLatency, latency.Nanoseconds())
+					writeLatencies = append(writeLatencies, latency)
 				}
 			}
 		}
@@ -259,8 +340,11 @@ func printResults(stats *Stats) {
 	errors := atomic.LoadInt64(&stats.errors)
 	readLatency := atomic.LoadInt64(&stats.readLatency)
 	writeLatency := atomic.LoadInt64(&stats.writeLatency)
+	scans := atomic.LoadInt64(&stats.scans)
+	scanResults := atomic.LoadInt64(&stats.scanResults)
+	scanLatency := atomic.LoadInt64(&stats.scanLatency)
 
-	totalOps := reads + writes + deletes
+	totalOps := reads + writes + deletes + scans
 	durationSec := duration.Seconds()
 
 	fmt.Println("\n" + strings.Repeat("=", 60))
@@ -272,12 +356,24 @@ func printResults(stats *Stats) {
 	fmt.Printf("  Reads:            %d (%.1f%%)\n", reads, float64(reads)/float64(totalOps)*100)
 	fmt.Printf("  Writes:           %d (%.1f%%)\n", writes, float64(writes)/float64(totalOps)*100)
 	fmt.Printf("  Deletes:          %d (%.1f%%)\n", deletes, float64(deletes)/float64(totalOps)*100)
+	if scans > 0 {
+		fmt.Printf("  Scans:            %d (%.1f%%, %.1f results avg)\n",
+			scans, float64(scans)/float64(totalOps)*100, float64(scanResults)/float64(scans))
+	}
 	fmt.Printf("  Errors:           %d\n", errors)
 
 	fmt.Printf("\nThroughput:\n")
 	fmt.Printf("  Total:            %.2f ops/sec\n", float64(totalOps)/durationSec)
+	if *rate > 0 {
+		fmt.Printf("  Offered:          %.2f ops/sec (%d window stalls)\n",
+			*rate, atomic.LoadInt64(&stats.windowStalls))
+	}
 	fmt.Printf("  Reads:            %.2f ops/sec\n", float64(reads)/durationSec)
 	fmt.Printf("  Writes:           %.2f ops/sec\n", float64(writes)/durationSec)
+	if scans > 0 {
+		fmt.Printf("  Scans:            %.2f ops/sec (%.2f results/sec)\n",
+			float64(scans)/durationSec, float64(scanResults)/durationSec)
+	}
 
 	fmt.Printf("\nLatency (Average):\n")
 	if reads > 0 {
@@ -288,6 +384,25 @@ func printResults(stats *Stats) {
 		avgWriteLatency := time.Duration(writeLatency / (writes + deletes))
 		fmt.Printf("  Write:            %v\n", avgWriteLatency)
 	}
+	if scans > 0 {
+		fmt.Printf("  Scan:             %v\n", time.Duration(scanLatency/scans))
+	}
+
+	stats.mu.Lock()
+	fmt.Printf("\nLatency (P50 / P99):\n")
+	if len(stats.readLatencies) > 0 {
+		fmt.Printf("  Read:             %v / %v\n",
+			percentile(stats.readLatencies, 0.50), percentile(stats.readLatencies, 0.99))
+	}
+	if len(stats.writeLatencies) > 0 {
+		fmt.Printf("  Write:            %v / %v\n",
+			percentile(stats.writeLatencies, 0.50), percentile(stats.writeLatencies, 0.99))
+	}
+	if len(stats.scanLatencies) > 0 {
+		fmt.Printf("  Scan:             %v / %v\n",
+			percentile(stats.scanLatencies, 0.50), percentile(stats.scanLatencies, 0.99))
+	}
+	stats.mu.Unlock()
 
 	fmt.Println(strings.Repeat("=", 60))
 }
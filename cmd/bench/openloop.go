@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Operation kinds issued by the open-loop generator
+const (
+	opRead = iota
+	opWrite
+	opDelete
+	opScan
+)
+
+// pendingOp is a request sent on a pipelined connection and not yet answered
+type pendingOp struct {
+	kind      int
+	intended  time.Time // when the schedule wanted it sent
+	responses int       // '\r'-terminated responses to read
+}
+
+// runOpenLoop sends requests at a fixed rate regardless of how fast the server
+// answers. Each connection pipelines up to -window requests; latency is
+// measured from the scheduled send time, so queueing under overload shows up
+// instead of being hidden by workers that wait for each response.
+func runOpenLoop() *Stats {
+	stats := &Stats{}
+	var wg sync.WaitGroup
+
+	stopCh := make(chan struct{})
+
+	// Spread the target rate evenly over the connections
+	interval := time.Duration(float64(time.Second) * float64(*concurrency) / *rate)
+
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go openLoopConn(i, interval, stats, stopCh, &wg)
+	}
+
+	time.Sleep(*duration)
+	close(stopCh)
+
+	wg.Wait()
+	return stats
+}
+
+// openLoopConn drives one pipelined connection: a sender issues requests on
+// schedule while a receiver matches responses to them in order
+func openLoopConn(id int, interval time.Duration, stats *Stats, stopCh chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	conn, err := net.Dial("tcp", *addr)
+	if err != nil {
+		log.Printf("Connection %d: connection failed: %v", id, err)
+		return
+	}
+	defer conn.Close()
+
+	writer := bufio.NewWriter(conn)
+	reader := bufio.NewReader(conn)
+	rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))
+
+	// The channel is both the in-flight window and the FIFO of pending requests
+	inflight := make(chan pendingOp, *window)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		receiveOpenLoop(reader, inflight, stats)
+	}()
+
+	// Give outstanding requests a bounded time to be answered
+	defer func() {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		close(inflight)
+		<-done
+	}()
+
+	next := time.Now()
+	for {
+		wait := time.Until(next)
+		if wait < 0 {
+			wait = 0
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(wait):
+		}
+
+		op, cmd := nextOpenLoopOp(rng)
+		op.intended = next
+		next = next.Add(interval)
+
+		// A full window means the server is behind; waiting here counts
+		// towards the latency of this request
+		select {
+		case inflight <- op:
+		default:
+			atomic.AddInt64(&stats.windowStalls, 1)
+			inflight <- op
+		}
+
+		writer.WriteString(cmd + "\r")
+		if err := writer.Flush(); err != nil {
+			// The pending request will never be answered; closing the
+			// connection fails the receiver's read
+			atomic.AddInt64(&stats.errors, 1)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// receiveOpenLoop reads responses for pending requests in send order
+func receiveOpenLoop(reader *bufio.Reader, inflight chan pendingOp, stats *Stats) {
+	var readLatencies, writeLatencies, scanLatencies []time.Duration
+	defer func() {
+		stats.mu.Lock()
+		stats.readLatencies = append(stats.readLatencies, readLatencies...)
+		stats.writeLatencies = append(stats.writeLatencies, writeLatencies...)
+		stats.scanLatencies = append(stats.scanLatencies, scanLatencies...)
+		stats.mu.Unlock()
+	}()
+
+	for op := range inflight {
+		for i := 0; i < op.responses; i++ {
+			if _, err := reader.ReadString('\r'); err != nil {
+				atomic.AddInt64(&stats.errors, 1)
+				// The connection is unusable; drain so the sender can finish
+				for range inflight {
+				}
+				return
+			}
+		}
+
+		latency := time.Since(op.intended)
+		switch op.kind {
+		case opRead:
+			atomic.AddInt64(&stats.reads, 1)
+			atomic.AddInt64(&stats.readLatency, latency.Nanoseconds())
+			readLatencies = append(readLatencies, latency)
+		case opWrite, opDelete:
+			if op.kind == opWrite {
+				atomic.AddInt64(&stats.writes, 1)
+			} else {
+				atomic.AddInt64(&stats.deletes, 1)
+			}
+			atomic.AddInt64(&stats.writeLatency, latency.Nanoseconds())
+			writeLatencies = append(writeLatencies, latency)
+		case opScan:
+			atomic.AddInt64(&stats.scans, 1)
+			atomic.AddInt64(&stats.scanResults, int64(op.responses))
+			atomic.AddInt64(&stats.scanLatency, latency.Nanoseconds())
+			scanLatencies = append(scanLatencies, latency)
+		}
+	}
+}
+
+// nextOpenLoopOp picks the next operation with the same mix as the
+// closed-loop workers
+func nextOpenLoopOp(rng *rand.Rand) (pendingOp, string) {
+	if *scanRatio > 0 && rng.Float64() < *scanRatio {
+		cmd := fmt.Sprintf("reads %s", scanPrefix(rng.Intn(*scanPrefixes)))
+		if *scanLimit > 0 {
+			cmd += fmt.Sprintf(" LIMIT %d", *scanLimit)
+		}
+		return pendingOp{kind: opScan, responses: scanResultCount()}, cmd
+	}
+
+	key := selectKey(rng)
+	if rng.Float64() < *readRatio {
+		return pendingOp{kind: opRead, responses: 1}, fmt.Sprintf("read %s", key)
+	}
+	if rng.Float64() < 0.9 {
+		return pendingOp{kind: opWrite, responses: 1}, fmt.Sprintf("write %s|%s", key, generateValue())
+	}
+	return pendingOp{kind: opDelete, responses: 1}, fmt.Sprintf("delete %s", key)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Result is the machine-readable summary of a benchmark run
+type Result struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Duration    string    `json:"duration"`
+	Concurrency int       `json:"concurrency"`
+	ReadRatio   float64   `json:"read_ratio"`
+	KeyCount    int       `json:"key_count"`
+	ScanRatio   float64   `json:"scan_ratio,omitempty"`
+	Rate        float64   `json:"rate,omitempty"` // open-loop target, 0 for closed loop
+
+	TotalOps   int64   `json:"total_ops"`
+	Errors     int64   `json:"errors"`
+	Throughput float64 `json:"throughput"` // ops/sec
+
+	ReadP50  time.Duration `json:"read_p50_ns"`
+	ReadP99  time.Duration `json:"read_p99_ns"`
+	WriteP50 time.Duration `json:"write_p50_ns"`
+	WriteP99 time.Duration `json:"write_p99_ns"`
+	ScanP50  time.Duration `json:"scan_p50_ns,omitempty"`
+	ScanP99  time.Duration `json:"scan_p99_ns,omitempty"`
+}
+
+// newResult summarizes the collected stats
+func newResult(stats *Stats) *Result {
+	reads := atomic.LoadInt64(&stats.reads)
+	writes := atomic.LoadInt64(&stats.writes)
+	deletes := atomic.LoadInt64(&stats.deletes)
+	scans := atomic.LoadInt64(&stats.scans)
+	totalOps := reads + writes + deletes + scans
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	return &Result{
+		Timestamp:   time.Now(),
+		Duration:    duration.String(),
+		Concurrency: *concurrency,
+		ReadRatio:   *readRatio,
+		KeyCount:    *keyCount,
+		ScanRatio:   *scanRatio,
+		Rate:        *rate,
+		TotalOps:    totalOps,
+		Errors:      atomic.LoadInt64(&stats.errors),
+		Throughput:  float64(totalOps) / duration.Seconds(),
+		ReadP50:     percentile(stats.readLatencies, 0.50),
+		ReadP99:     percentile(stats.readLatencies, 0.99),
+		WriteP50:    percentile(stats.writeLatencies, 0.50),
+		WriteP99:    percentile(stats.writeLatencies, 0.99),
+		ScanP50:     percentile(stats.scanLatencies, 0.50),
+		ScanP99:     percentile(stats.scanLatencies, 0.99),
+	}
+}
+
+// percentile returns the p-th percentile (0-1) of latencies, sorting them in place
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	idx := int(float64(len(latencies)-1) * p)
+	return latencies[idx]
+}
+
+// save writes the result as JSON
+func (r *Result) save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// loadResult reads a result written by a previous run
+func loadResult(path string) (*Result, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r Result
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("invalid result file %s: %w", path, err)
+	}
+	return &r, nil
+}
+
+// compareResults prints the deltas between baseline and current, and
+// reports whether current stays within the regression thresholds
+func compareResults(baseline, current *Result) bool {
+	fmt.Println("\n" + strings.Repeat("=", 60))
+	fmt.Printf("COMPARISON (baseline from %s)\n", baseline.Timestamp.Format(time.RFC3339))
+	fmt.Println(strings.Repeat("=", 60))
+
+	if baseline.Concurrency != current.Concurrency || baseline.ReadRatio != current.ReadRatio ||
+		baseline.KeyCount != current.KeyCount || baseline.ScanRatio != current.ScanRatio ||
+		baseline.Rate != current.Rate {
+		fmt.Printf("\nWarning: workload differs from baseline (concurrency %d vs %d, read ratio %.2f vs %.2f, keys %d vs %d, scan ratio %.2f vs %.2f, rate %.0f vs %.0f)\n",
+			baseline.Concurrency, current.Concurrency, baseline.ReadRatio, current.ReadRatio,
+			baseline.KeyCount, current.KeyCount, baseline.ScanRatio, current.ScanRatio,
+			baseline.Rate, current.Rate)
+	}
+
+	pass := true
+	fmt.Println()
+
+	// Throughput regresses when it goes down
+	change := relativeChange(baseline.Throughput, current.Throughput)
+	ok := -change <= *maxTputDrop
+	pass = pass && ok
+	fmt.Printf("  %-12s %14.2f -> %14.2f ops/sec  %+7.1f%%  %s\n",
+		"Throughput:", baseline.Throughput, current.Throughput, change*100, verdict(ok))
+
+	// Latencies regress when they go up
+	latencies := []struct {
+		name              string
+		baseline, current time.Duration
+	}{
+		{"Read P50:", baseline.ReadP50, current.ReadP50},
+		{"Read P99:", baseline.ReadP99, current.ReadP99},
+		{"Write P50:", baseline.WriteP50, current.WriteP50},
+		{"Write P99:", baseline.WriteP99, current.WriteP99},
+		{"Scan P50:", baseline.ScanP50, current.ScanP50},
+		{"Scan P99:", baseline.ScanP99, current.ScanP99},
+	}
+	for _, l := range latencies {
+		if l.baseline == 0 || l.current == 0 {
+			continue // operation not exercised in one of the runs
+		}
+		change := relativeChange(float64(l.baseline), float64(l.current))
+		ok := change <= *maxLatRise
+		pass = pass && ok
+		fmt.Printf("  %-12s %14v -> %14v          %+7.1f%%  %s\n",
+			l.name, l.baseline, l.current, change*100, verdict(ok))
+	}
+
+	fmt.Println()
+	if pass {
+		fmt.Println("Result: PASS")
+	} else {
+		fmt.Printf("Result: FAIL (max throughput drop %.0f%%, max latency rise %.0f%%)\n",
+			*maxTputDrop*100, *maxLatRise*100)
+	}
+	fmt.Println(strings.Repeat("=", 60))
+
+	return pass
+}
+
+// relativeChange returns (current-baseline)/baseline
+func relativeChange(baseline, current float64) float64 {
+	if baseline == 0 {
+		return 0
+	}
+	return (current - baseline) / baseline
+}
+
+// verdict labels a compared metric
+func verdict(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "REGRESSION"
+}
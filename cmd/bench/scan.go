@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+)
+
+// Scan keys live in their own keyspace, "scan-<prefix>-<n>", so that the
+// number of results per prefix is known and not disturbed by the main workload
+
+// scanKey returns the n-th key under a scan prefix
+func scanKey(prefix, n int) string {
+	return fmt.Sprintf("%s%06d", scanPrefix(prefix), n)
+}
+
+// scanPrefix returns the scan prefix with the given number
+func scanPrefix(prefix int) string {
+	return fmt.Sprintf("scan-%d-", prefix)
+}
+
+// scanResultCount is the number of values a scan of one prefix returns
+func scanResultCount() int {
+	if *scanLimit > 0 && *scanLimit < *scanKeysPerPrefix {
+		return *scanLimit
+	}
+	return *scanKeysPerPrefix
+}
+
+// prepopulateScans writes the keys read by scan operations
+func prepopulateScans(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	writer := bufio.NewWriter(conn)
+	reader := bufio.NewReader(conn)
+
+	total := *scanPrefixes * *scanKeysPerPrefix
+	for p := 0; p < *scanPrefixes; p++ {
+		for n := 0; n < *scanKeysPerPrefix; n++ {
+			value := fmt.Sprintf("%0*d", *scanValueSize, n)
+			cmd := fmt.Sprintf("write %s|%s\r", scanKey(p, n), value)
+
+			if _, err := writer.WriteString(cmd); err != nil {
+				return err
+			}
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+			if _, err := reader.ReadString('\r'); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Printf("  Prepopulated %d scan keys (%d prefixes)", total, *scanPrefixes)
+	return nil
+}
+
+// doScan issues a prefix scan on a random prefix and reads every result.
+// Results are separated by '\r' like the terminator, so the expected count
+// is what tells where the response ends.
+func doScan(rng *rand.Rand, writer *bufio.Writer, reader *bufio.Reader) (int, error) {
+	cmd := fmt.Sprintf("reads %s", scanPrefix(rng.Intn(*scanPrefixes)))
+	if *scanLimit > 0 {
+		cmd += fmt.Sprintf(" LIMIT %d", *scanLimit)
+	}
+
+	if _, err := writer.WriteString(cmd + "\r"); err != nil {
+		return 0, err
+	}
+	if err := writer.Flush(); err != nil {
+		return 0, err
+	}
+
+	count := scanResultCount()
+	for i := 0; i < count; i++ {
+		resp, err := reader.ReadString('\r')
+		if err != nil {
+			return i, err
+		}
+		if i == 0 && (resp == "\r" || strings.HasPrefix(resp, "error:")) {
+			return 0, fmt.Errorf("unexpected scan response: %q", resp)
+		}
+	}
+	return count, nil
+}
@@ -16,6 +16,18 @@ var (
 func main() {
 	flag.Parse()
 
+	// Subcommands; without one the client runs interactively
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "stat":
+			runStat(flag.Args()[1:])
+			return
+		default:
+			fmt.Printf("Unknown command: %s (available: stat)\n", flag.Arg(0))
+			os.Exit(1)
+		}
+	}
+
 	// Connect to server
 	conn, err := net.Dial("tcp", *addr)
 	if err != nil {
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"escabelo/pkg/client"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statHeaderEvery repeats the table header after this many rows
+const statHeaderEvery = 20
+
+// runStat prints server statistics once, or as an updating table with -watch
+func runStat(args []string) {
+	fs := flag.NewFlagSet("stat", flag.ExitOnError)
+	watch := fs.Duration("watch", 0, "Refresh interval (0 prints once)")
+	fs.Parse(args)
+
+	c, err := client.Dial(*addr, 5*time.Second)
+	if err != nil {
+		fmt.Printf("Failed to connect to %s: %v\n", *addr, err)
+		os.Exit(1)
+	}
+	defer c.Close()
+
+	prev, err := fetchStats(c)
+	if err != nil {
+		fmt.Printf("Status failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *watch <= 0 {
+		printStatHeader(false)
+		printStatRow(prev, nil, 0)
+		return
+	}
+
+	printStatHeader(true)
+	prevTime := time.Now()
+	for rows := 1; ; rows++ {
+		time.Sleep(*watch)
+
+		cur, err := fetchStats(c)
+		if err != nil {
+			fmt.Printf("Status failed: %v\n", err)
+			os.Exit(1)
+		}
+		now := time.Now()
+
+		if rows%statHeaderEvery == 0 {
+			printStatHeader(true)
+		}
+		printStatRow(cur, prev, now.Sub(prevTime))
+
+		prev, prevTime = cur, now
+	}
+}
+
+// fetchStats issues status and parses its key=value line
+func fetchStats(c *client.Client) (map[string]int64, error) {
+	resp, err := c.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(resp, "\n")
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("unexpected status response: %q", resp)
+	}
+
+	stats := make(map[string]int64)
+	for _, field := range strings.Fields(lines[1]) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if n, err := strconv.ParseInt(kv[1], 10, 64); err == nil {
+			stats[kv[0]] = n
+		}
+	}
+	return stats, nil
+}
+
+// printStatHeader prints the column names; rates replace totals when watching
+func printStatHeader(rates bool) {
+	if rates {
+		fmt.Printf("%-8s %10s %10s %10s %8s %12s %6s %12s\n",
+			"time", "writes/s", "reads/s", "deletes/s", "flushes", "memtable", "ssts", "wal")
+		return
+	}
+	fmt.Printf("%-8s %10s %10s %10s %8s %12s %6s %12s\n",
+		"time", "writes", "reads", "deletes", "flushes", "memtable", "ssts", "wal")
+}
+
+// printStatRow prints one row; with a previous sample, operation counters
+// become per-second rates over elapsed
+func printStatRow(cur, prev map[string]int64, elapsed time.Duration) {
+	ops := func(name string) string {
+		if prev == nil {
+			return strconv.FormatInt(cur[name], 10)
+		}
+		rate := float64(cur[name]-prev[name]) / elapsed.Seconds()
+		return strconv.FormatFloat(rate, 'f', 1, 64)
+	}
+
+	fmt.Printf("%-8s %10s %10s %10s %8d %12s %6d %12s\n",
+		time.Now().Format("15:04:05"), ops("writes"), ops("reads"), ops("deletes"),
+		cur["flushes"], formatBytes(cur["memtable_size"]), cur["sst_count"], formatBytes(cur["wal_size"]))
+}
+
+// formatBytes renders a byte count with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"escabelo/internal/engine"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// archiveCommand returns a WAL archive hook running command with sh for each
+// archived segment. The segment is described in the environment:
+// ESCABELO_WAL_SEGMENT holds its path in the archive directory, and
+// ESCABELO_WAL_FIRST_SEQ and ESCABELO_WAL_LAST_SEQ the sequence numbers of
+// its first and last entries. Failures are logged; the segment stays in the
+// archive.
+func archiveCommand(command string) func(engine.ArchivedSegment) {
+	return func(seg engine.ArchivedSegment) {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = append(os.Environ(),
+			"ESCABELO_WAL_SEGMENT="+seg.Path,
+			fmt.Sprintf("ESCABELO_WAL_FIRST_SEQ=%d", seg.FirstSeq),
+			fmt.Sprintf("ESCABELO_WAL_LAST_SEQ=%d", seg.LastSeq))
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			slog.Error("WAL archive command failed", "segment", seg.Path, "err", err,
+				"output", strings.TrimSpace(string(output)))
+			return
+		}
+		slog.Debug("WAL archive command ran", "segment", seg.Path)
+	}
+}
@@ -1,56 +1,490 @@
 package main
 
 import (
+	"escabelo/internal/cluster"
+	"escabelo/internal/debugserver"
 	"escabelo/internal/engine"
+	"escabelo/internal/grpcserver"
+	"escabelo/internal/httpserver"
+	"escabelo/internal/raft"
 	"escabelo/internal/server"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// stringList collects the values of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, " ") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+var indexSpecs stringList
+
 var (
 	port               = flag.String("port", "8080", "TCP port to listen on")
+	listen             = flag.String("listen", "", "Comma-separated listen addresses, e.g. 0.0.0.0:8080,[::]:8080 (overrides -port)")
+	adminAddr          = flag.String("admin-addr", "", "Serve administrative commands only on this address")
+	grpcPort           = flag.String("grpc-port", "", "Also serve the gRPC API on this TCP port (disabled when empty)")
+	httpPort           = flag.String("http-port", "", "Also serve the JSON REST gateway on this TCP port (disabled when empty)")
+	debugPort          = flag.String("debug-port", "", "Serve pprof, expvar and /debug/engine on this TCP port (disabled when empty; keep it private)")
 	dataDir            = flag.String("data-dir", "./data", "Directory for data storage")
+	inMemory           = flag.Bool("in-memory", false, "Keep all data in memory and never touch disk (for tests)")
 	memtableSize       = flag.Int64("memtable-size", 64*1024*1024, "Max memtable size in bytes (default 64MB)")
+	adaptiveMemtable   = flag.Bool("adaptive-memtable", false, "Size the memtable to available memory (1/4x to 4x -memtable-size)")
+	memoryLimit        = flag.Int64("memory-limit", 0, "Memory limit for -adaptive-memtable in bytes (0 uses the cgroup limit)")
 	compactionInterval = flag.Duration("compaction-interval", 5*time.Minute, "Compaction interval")
+	compactionStrategy = flag.String("compaction-strategy", "size-tiered", "How SSTs are grouped for compaction: size-tiered or leveled")
+	compactionFiles    = flag.Int("compaction-file-trigger", 4, "Compact a tier (size-tiered) or level 0 (leveled) once it holds this many SSTs")
+	compactionLevel    = flag.Int64("compaction-level-bytes", 256*1024*1024, "Byte budget of level 1 with -compaction-strategy=leveled, 10x more per deeper level")
+	compactionWorkers  = flag.Int("compaction-workers", 1, "Run up to this many compactions of disjoint SSTs at once, e.g. one per level")
+	compactionRate     = flag.Int64("compaction-rate-limit", 0, "Cap compaction writes to this many bytes per second (0 disables)")
+	flushRate          = flag.Int64("flush-rate-limit", 0, "Cap memtable flush writes to this many bytes per second (0 disables)")
+	backgroundJobs     = flag.Int("max-background-jobs", 0, "Run at most this many flushes and compactions at once; 1 keeps them from overlapping (0 disables)")
 	walSyncInterval    = flag.Duration("wal-sync-interval", 100*time.Millisecond, "WAL sync interval")
+	durability         = flag.String("durability", "interval", "When to fsync the WAL: always (every write), interval (every -wal-sync-interval) or never")
+	blockCacheSize     = flag.Int64("block-cache-size", 32*1024*1024, "Bytes of SST data blocks cached for point lookups (0 disables)")
+	maxOpenFiles       = flag.Int("max-open-files", 512, "SST files kept open between reads (0 opens a file per read)")
+	maxKeySize         = flag.Int("max-key-size", engine.DefaultMaxKeySize, "Reject writes of keys longer than this many bytes")
+	maxValueSize       = flag.Int64("max-value-size", engine.DefaultMaxValueSize, "Reject writes of values larger than this many bytes (up to 4GB)")
+	compression        = flag.String("compression", "none", "Codec for values of 256 bytes or more in SSTs: none, gzip or flate")
+	walMaxSize         = flag.Int64("wal-max-size", 0, "Rotate the memtable after this many WAL bytes (0 disables)")
+	memtableMaxAge     = flag.Duration("memtable-max-age", 0, "Flush the memtable this long after its first write (0 disables)")
+	memtableIdleFlush  = flag.Duration("memtable-idle-flush", 0, "Flush the memtable after this long without writes (0 disables)")
+	walTailRetention   = flag.Int64("wal-tail-retention", 0, "Keep up to this many WAL bytes for tail consumers that haven't acknowledged them (0 disables)")
+	walArchiveDir      = flag.String("wal-archive-dir", "", "Copy WAL segments to this directory before releasing them")
+	walArchiveCommand  = flag.String("wal-archive-command", "", "Shell command run for each archived WAL segment (with -wal-archive-dir)")
+	tombstoneRatio     = flag.Float64("tombstone-ratio", 0, "Prioritize compacting SSTs with at least this fraction of tombstones (0 disables)")
+	staleRatio         = flag.Float64("stale-ratio", 0, "Rewrite SSTs with at least this fraction of versions beyond -max-versions (0 disables)")
+	writeSlowdownSSTs  = flag.Int("write-slowdown-ssts", 0, "Delay writes once there are this many SSTs (0 disables)")
+	writeStopSSTs      = flag.Int("write-stop-ssts", 0, "Stall writes until compaction catches up at this many SSTs (0 disables)")
+	writeSlowdownBytes = flag.Int64("write-slowdown-bytes", 0, "Delay writes once this many SST bytes await compaction (0 disables)")
+	writeStopBytes     = flag.Int64("write-stop-bytes", 0, "Stall writes once this many SST bytes await compaction (0 disables)")
+	writeMaxDelay      = flag.Duration("write-max-delay", 100*time.Millisecond, "Longest delay applied to a throttled write")
+	maxVersions        = flag.Int("max-versions", 1, "Versions retained per key for time-travel reads")
+	versionRetention   = flag.Duration("version-retention", time.Hour, "How long superseded versions survive compaction")
+	deleteRetention    = flag.Duration("delete-retention", 0, "How long deleted values can be undeleted (0 disables)")
+	minFreeDisk        = flag.Int64("min-free-disk", 0, "Reject writes when free disk space drops below this many bytes (0 disables)")
+	diskCheckInterval  = flag.Duration("disk-check-interval", 5*time.Second, "Free disk space check interval")
+	diskBudget         = flag.Int64("disk-budget", 0, "On-disk budget for SSTs plus WAL in bytes (0 disables)")
+	budgetCompaction   = flag.Bool("budget-compaction", false, "Compact all SSTs when disk usage nears the budget")
+	commandTimeout     = flag.Duration("command-timeout", 0, "Cancel keys/reads/scan/count commands running longer than this (0 disables)")
+	maxConnections     = flag.Int("max-connections", 0, "Refuse client connections past this many open ones (0 disables)")
+	idleTimeout        = flag.Duration("idle-timeout", 0, "Close connections that send no request for this long (0 disables)")
+	readTimeout        = flag.Duration("read-timeout", 0, "Close connections taking longer than this to send a whole request (0 disables)")
+	writeTimeout       = flag.Duration("write-timeout", 0, "Close connections taking longer than this to accept a response (0 disables)")
+	mirrorAddr         = flag.String("mirror-addr", "", "Asynchronously mirror write commands to this secondary server")
+	mirrorReads        = flag.Bool("mirror-reads", false, "Mirror read commands too (with -mirror-addr)")
+	mirrorQueue        = flag.Int("mirror-queue", 10000, "Commands buffered for mirroring before new ones are dropped")
+	auditLog           = flag.String("audit-log", "", "Append client writes and deletes to this audit log file")
+	auditMaxSize       = flag.Int64("audit-max-size", 64*1024*1024, "Rotate the audit log past this many bytes")
+	auditMaxFiles      = flag.Int("audit-max-files", 10, "Rotated audit log files kept")
+	authFile           = flag.String("auth-file", "", "Require clients to authenticate with a token or user from this file")
+	authToken          = flag.String("auth-token", "", "Require clients to authenticate; accept this read-write token and present it to the leader, peers and mirror")
+	replicaOf          = flag.String("replica-of", "", "Run as a read-only replica of the given leader address")
+	readOnly           = flag.Bool("read-only", false, "Reject writes until \"readonly off\", and create no WAL segment until the first write")
+	hintMaxBytes       = flag.Int64("hint-max-bytes", 0, "Keep up to this many bytes of truncated WAL entries per lagging consumer (0 disables)")
+	replicaName        = flag.String("replica-name", "", "Pull the leader's WAL under this consumer name (with -replica-of)")
+	replicas           = flag.String("replicas", "", "Comma-separated consumer names of this leader's replicas, for write acks")
+	writeAck           = flag.String("write-ack", "leader", "Default write acknowledgement level: leader, quorum or all")
+	writeAckTimeout    = flag.Duration("write-ack-timeout", 5*time.Second, "How long a write waits for replica acknowledgements")
+	clusterAddr        = flag.String("cluster-addr", "", "Address advertised to cluster peers (enables membership gossip)")
+	seeds              = flag.String("seeds", "", "Comma-separated list of cluster seed addresses")
+	gossipInterval     = flag.Duration("gossip-interval", time.Second, "Cluster gossip heartbeat interval")
+	sharding           = flag.String("sharding", "off", "Partition keys across cluster members: off, redirect (answer moved) or proxy (forward) (with -cluster-addr)")
+	shardVnodes        = flag.Int("shard-vnodes", 160, "Virtual nodes per cluster member on the shard ring")
+	raftAddr           = flag.String("raft-addr", "", "Address of this node's data listener advertised to Raft peers (enables Raft consensus mode)")
+	raftPeers          = flag.String("raft-peers", "", "Comma-separated data addresses of the Raft group's initial members, this node included")
+	raftElection       = flag.Duration("raft-election-timeout", time.Second, "How long Raft followers wait for the leader before electing a new one")
+	logLevel           = flag.String("log-level", "info", "Minimum level logged: debug, info, warn or error")
+	logFormat          = flag.String("log-format", "text", "Log output format: text or json")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(runRestore(os.Args[2:]))
+	}
+
+	flag.Var(&indexSpecs, "index", "Declare a sorted index as name,prefix,path,numeric|lex (repeatable)")
 	flag.Parse()
 
-	log.Printf("Starting Escabelo Key-Value Store")
-	log.Printf("Configuration:")
-	log.Printf("  Port: %s", *port)
-	log.Printf("  Data Directory: %s", *dataDir)
-	log.Printf("  Memtable Size: %d bytes", *memtableSize)
-	log.Printf("  Compaction Interval: %v", *compactionInterval)
-	log.Printf("  WAL Sync Interval: %v", *walSyncInterval)
+	logger, err := newLogger(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	// The configuration is logged as a single record
+	config := []any{}
+	if *listen != "" {
+		config = append(config, "listen", *listen)
+	} else {
+		config = append(config, "port", *port)
+	}
+	if *adminAddr != "" {
+		config = append(config, "admin_addr", *adminAddr)
+	}
+	if *inMemory {
+		config = append(config, "storage", "in-memory")
+	} else {
+		config = append(config, "data_dir", *dataDir)
+	}
+	config = append(config, "memtable_size", *memtableSize)
+	if *adaptiveMemtable {
+		config = append(config, "adaptive_memtable_limit", *memoryLimit)
+	}
+	config = append(config,
+		"compaction_interval", *compactionInterval,
+		"compaction_strategy", *compactionStrategy,
+		"durability", *durability,
+		"wal_sync_interval", *walSyncInterval,
+		"compression", *compression,
+		"block_cache_size", *blockCacheSize,
+		"max_open_files", *maxOpenFiles)
+	if *walMaxSize > 0 {
+		config = append(config, "wal_max_size", *walMaxSize)
+	}
+	if *memtableMaxAge > 0 || *memtableIdleFlush > 0 {
+		config = append(config, "memtable_max_age", *memtableMaxAge, "memtable_idle_flush", *memtableIdleFlush)
+	}
+	if *walTailRetention > 0 {
+		config = append(config, "wal_tail_retention", *walTailRetention)
+	}
+	if *hintMaxBytes > 0 {
+		config = append(config, "hint_max_bytes", *hintMaxBytes)
+	}
+	if *walArchiveDir != "" {
+		config = append(config, "wal_archive_dir", *walArchiveDir)
+	}
+	if *tombstoneRatio > 0 {
+		config = append(config, "tombstone_ratio", *tombstoneRatio)
+	}
+	if *staleRatio > 0 {
+		config = append(config, "stale_ratio", *staleRatio)
+	}
+	if *compactionWorkers > 1 {
+		config = append(config, "compaction_workers", *compactionWorkers)
+	}
+	if *compactionRate > 0 || *flushRate > 0 || *backgroundJobs > 0 {
+		config = append(config,
+			"compaction_rate_limit", *compactionRate, "flush_rate_limit", *flushRate,
+			"max_background_jobs", *backgroundJobs)
+	}
+	if *writeSlowdownSSTs > 0 || *writeStopSSTs > 0 || *writeSlowdownBytes > 0 || *writeStopBytes > 0 {
+		config = append(config,
+			"write_slowdown_ssts", *writeSlowdownSSTs, "write_slowdown_bytes", *writeSlowdownBytes,
+			"write_stop_ssts", *writeStopSSTs, "write_stop_bytes", *writeStopBytes,
+			"write_max_delay", *writeMaxDelay)
+	}
+	if *maxVersions > 1 {
+		config = append(config, "max_versions", *maxVersions, "version_retention", *versionRetention)
+	}
+	if *deleteRetention > 0 {
+		config = append(config, "delete_retention", *deleteRetention)
+	}
+	if *minFreeDisk > 0 {
+		config = append(config, "min_free_disk", *minFreeDisk, "disk_check_interval", *diskCheckInterval)
+	}
+	if *diskBudget > 0 {
+		config = append(config, "disk_budget", *diskBudget, "budget_compaction", *budgetCompaction)
+	}
+	if *commandTimeout > 0 {
+		config = append(config, "command_timeout", *commandTimeout)
+	}
+	if *replicaOf != "" {
+		config = append(config, "replica_of", *replicaOf)
+	}
+	if *readOnly {
+		config = append(config, "read_only", true)
+	}
+	if *raftAddr != "" {
+		config = append(config, "raft_addr", *raftAddr)
+	}
+	slog.Info("Starting Escabelo Key-Value Store", config...)
+
+	if *raftAddr != "" && *replicaOf != "" {
+		fatal("-raft-addr and -replica-of can't be combined")
+	}
+	if *walArchiveCommand != "" && *walArchiveDir == "" {
+		fatal("-wal-archive-command requires -wal-archive-dir")
+	}
+	validSharding := false
+	for _, mode := range server.ShardModes {
+		validSharding = validSharding || mode == *sharding
+	}
+	if !validSharding {
+		fatal("Invalid -sharding", "sharding", *sharding, "valid", server.ShardModes)
+	}
+	if *sharding != server.ShardOff && *clusterAddr == "" {
+		fatal("-sharding requires -cluster-addr")
+	}
+
+	validDurability := false
+	for _, mode := range engine.Durabilities {
+		validDurability = validDurability || mode == *durability
+	}
+	if !validDurability {
+		fatal("Invalid -durability", "durability", *durability, "valid", engine.Durabilities)
+	}
+	validStrategy := false
+	for _, strategy := range engine.CompactionStrategies {
+		validStrategy = validStrategy || strategy == *compactionStrategy
+	}
+	if !validStrategy {
+		fatal("Invalid -compaction-strategy", "compaction_strategy", *compactionStrategy, "valid", engine.CompactionStrategies)
+	}
+	validCompression := false
+	for _, codec := range engine.Compressions {
+		validCompression = validCompression || codec == *compression
+	}
+	if !validCompression {
+		fatal("Invalid -compression", "compression", *compression, "valid", engine.Compressions)
+	}
 
 	// Create engine
 	engineConfig := engine.Config{
-		DataDir:            *dataDir,
-		MemTableMaxSize:    *memtableSize,
-		CompactionInterval: *compactionInterval,
-		WALSyncInterval:    *walSyncInterval,
+		DataDir:               *dataDir,
+		MemTableMaxSize:       *memtableSize,
+		AdaptiveMemTable:      *adaptiveMemtable,
+		MemoryLimit:           *memoryLimit,
+		CompactionInterval:    *compactionInterval,
+		WALSyncInterval:       *walSyncInterval,
+		Durability:            *durability,
+		Compression:           *compression,
+		BlockCacheSize:        *blockCacheSize,
+		MaxOpenFiles:          *maxOpenFiles,
+		MaxKeySize:            *maxKeySize,
+		MaxValueSize:          *maxValueSize,
+		WALMaxSize:            *walMaxSize,
+		MemTableMaxAge:        *memtableMaxAge,
+		MemTableIdleFlush:     *memtableIdleFlush,
+		WALTailRetention:      *walTailRetention,
+		HintMaxBytes:          *hintMaxBytes,
+		WALArchiveDir:         *walArchiveDir,
+		TombstoneRatio:        *tombstoneRatio,
+		StaleRatio:            *staleRatio,
+		CompactionStrategy:    *compactionStrategy,
+		CompactionFileTrigger: *compactionFiles,
+		CompactionLevelBytes:  *compactionLevel,
+		CompactionWorkers:     *compactionWorkers,
+		CompactionBytesPerSec: *compactionRate,
+		FlushBytesPerSec:      *flushRate,
+		MaxBackgroundJobs:     *backgroundJobs,
+		WriteSlowdownSSTs:     *writeSlowdownSSTs,
+		WriteStopSSTs:         *writeStopSSTs,
+		WriteSlowdownBytes:    *writeSlowdownBytes,
+		WriteStopBytes:        *writeStopBytes,
+		WriteMaxDelay:         *writeMaxDelay,
+		MaxVersions:           *maxVersions,
+		VersionRetention:      *versionRetention,
+		DeleteRetention:       *deleteRetention,
+		MinFreeDiskBytes:      *minFreeDisk,
+		DiskCheckInterval:     *diskCheckInterval,
+		DiskBudgetBytes:       *diskBudget,
+		BudgetCompaction:      *budgetCompaction,
+		DeferWAL:              *readOnly,
+	}
+	if *walArchiveCommand != "" {
+		engineConfig.WALArchiveHook = archiveCommand(*walArchiveCommand)
 	}
 
-	eng, err := engine.NewEngine(engineConfig)
-	if err != nil {
-		log.Fatalf("Failed to create engine: %v", err)
+	var eng engine.Store
+	if *inMemory {
+		eng = engine.NewMemStore(engineConfig)
+	} else {
+		lsm, err := engine.NewEngine(engineConfig)
+		if err != nil {
+			fatal("Failed to create engine", "err", err)
+		}
+		eng = lsm
 	}
 	defer eng.Close()
 
 	// Create server
-	addr := fmt.Sprintf(":%s", *port)
-	srv := server.NewServer(addr, eng)
+	// Listeners inherited from a process manager (socket activation) take
+	// the place of -port/-listen, so the socket outlives restarts
+	inherited, inheritedAdmin, err := server.InheritedListeners()
+	if err != nil {
+		fatal("Failed to inherit listeners", "err", err)
+	}
+	addrs := []string{fmt.Sprintf(":%s", *port)}
+	if *listen != "" {
+		addrs = strings.Split(*listen, ",")
+	}
+	if len(inherited) > 0 {
+		addrs = nil
+		slog.Info("Inherited listeners from the process manager", "count", len(inherited))
+	}
+	admin := *adminAddr
+	if inheritedAdmin != nil {
+		admin = ""
+	}
+	serverConfig := server.Config{
+		Addrs:           addrs,
+		AdminAddr:       admin,
+		Listeners:       inherited,
+		AdminListener:   inheritedAdmin,
+		LeaderAddr:      *replicaOf,
+		ReadOnly:        *readOnly,
+		ReplicaName:     *replicaName,
+		WriteAck:        *writeAck,
+		WriteAckTimeout: *writeAckTimeout,
+		CommandTimeout:  *commandTimeout,
+		MaxConnections:  *maxConnections,
+		IdleTimeout:     *idleTimeout,
+		ReadTimeout:     *readTimeout,
+		WriteTimeout:    *writeTimeout,
+		PeerToken:       *authToken,
+	}
+
+	validAck := false
+	for _, level := range server.AckLevels {
+		validAck = validAck || level == *writeAck
+	}
+	if !validAck {
+		fatal("Invalid -write-ack", "write_ack", *writeAck, "valid", server.AckLevels)
+	}
+	if *replicas != "" {
+		serverConfig.Replicas = strings.Split(*replicas, ",")
+		slog.Info("Write acks enabled", "default_level", *writeAck, "replicas", serverConfig.Replicas)
+	}
+
+	// Optional authentication
+	if *authFile != "" || *authToken != "" {
+		auth := server.NewAuth()
+		if *authFile != "" {
+			var err error
+			if auth, err = server.LoadAuthFile(*authFile); err != nil {
+				fatal("Failed to load auth file", "err", err)
+			}
+		}
+		if *authToken != "" {
+			auth.AddToken(*authToken, server.RoleReadWrite)
+		}
+		serverConfig.Auth = auth
+		slog.Info("Authentication required")
+	}
+
+	// Secondary indexes
+	for _, spec := range indexSpecs {
+		def, err := engine.ParseIndexDef(spec)
+		if err != nil {
+			fatal("Invalid -index", "index", spec, "err", err)
+		}
+		serverConfig.Indexes = append(serverConfig.Indexes, def)
+	}
+
+	// Optional cluster membership
+	if *clusterAddr != "" {
+		var seedList []string
+		if *seeds != "" {
+			seedList = strings.Split(*seeds, ",")
+		}
+		membership := cluster.NewMembership(cluster.Config{
+			Self:           *clusterAddr,
+			Seeds:          seedList,
+			GossipInterval: *gossipInterval,
+			Token:          *authToken,
+		})
+		membership.Start()
+		defer membership.Stop()
+		serverConfig.Membership = membership
+		serverConfig.Sharding = *sharding
+		serverConfig.ShardVirtualNodes = *shardVnodes
+		slog.Info("Cluster membership enabled", "addr", *clusterAddr, "seeds", seedList, "sharding", *sharding)
+	}
+
+	// Optional Raft consensus
+	if *raftAddr != "" {
+		var peerList []string
+		if *raftPeers != "" {
+			peerList = strings.Split(*raftPeers, ",")
+		}
+		raftDir := ""
+		if !*inMemory {
+			raftDir = filepath.Join(*dataDir, "raft")
+		}
+		node, err := raft.NewNode(raft.Config{
+			Self:            *raftAddr,
+			Peers:           peerList,
+			Dir:             raftDir,
+			ElectionTimeout: *raftElection,
+			Token:           *authToken,
+			Store:           eng,
+		})
+		if err != nil {
+			fatal("Failed to start Raft", "err", err)
+		}
+		serverConfig.Raft = node
+		slog.Info("Raft consensus enabled", "addr", *raftAddr, "peers", peerList)
+	}
+
+	// Optional shadow traffic mirroring
+	if *mirrorAddr != "" {
+		mirror := server.NewMirror(server.MirrorConfig{
+			Addr:      *mirrorAddr,
+			QueueSize: *mirrorQueue,
+			Token:     *authToken,
+		})
+		mirror.Start()
+		defer mirror.Stop()
+		serverConfig.Mirror = mirror
+		serverConfig.MirrorReads = *mirrorReads
+		slog.Info("Shadow mirroring enabled", "addr", *mirrorAddr, "reads", *mirrorReads, "queue", *mirrorQueue)
+	}
+
+	// Optional audit log
+	if *auditLog != "" {
+		audit, err := server.NewAuditLog(server.AuditConfig{
+			Path:     *auditLog,
+			MaxSize:  *auditMaxSize,
+			MaxFiles: *auditMaxFiles,
+		})
+		if err != nil {
+			fatal("Failed to open audit log", "err", err)
+		}
+		defer audit.Close()
+		serverConfig.Audit = audit
+		slog.Info("Audit log enabled", "path", *auditLog, "max_size", *auditMaxSize, "max_files", *auditMaxFiles)
+	}
+	srv := server.NewServer(serverConfig, eng)
 
 	if err := srv.Start(); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+		fatal("Failed to start server", "err", err)
+	}
+
+	// Optional gRPC API
+	var grpcSrv *grpcserver.Server
+	if *grpcPort != "" {
+		grpcSrv = grpcserver.New(eng, srv)
+		if err := grpcSrv.Start(":" + *grpcPort); err != nil {
+			fatal("Failed to start gRPC server", "err", err)
+		}
+	}
+
+	// Optional REST gateway
+	var httpSrv *httpserver.Server
+	if *httpPort != "" {
+		httpSrv = httpserver.New(eng, srv)
+		if err := httpSrv.Start(":" + *httpPort); err != nil {
+			fatal("Failed to start HTTP gateway", "err", err)
+		}
+	}
+
+	// Optional debug endpoints
+	var debugSrv *debugserver.Server
+	if *debugPort != "" {
+		debugSrv = debugserver.New(eng)
+		if err := debugSrv.Start(":" + *debugPort); err != nil {
+			fatal("Failed to start debug server", "err", err)
+		}
 	}
 
 	// Wait for interrupt signal
@@ -58,11 +492,25 @@ func main() {
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
 	<-sigCh
-	log.Println("Shutting down...")
+	slog.Info("Shutting down")
+
+	if grpcSrv != nil {
+		grpcSrv.Stop()
+	}
+	if httpSrv != nil {
+		if err := httpSrv.Stop(5 * time.Second); err != nil {
+			slog.Error("HTTP gateway stop failed", "err", err)
+		}
+	}
+	if debugSrv != nil {
+		if err := debugSrv.Stop(time.Second); err != nil {
+			slog.Error("Debug server stop failed", "err", err)
+		}
+	}
 
 	if err := srv.Stop(); err != nil {
-		log.Printf("Server stop error: %v", err)
+		slog.Error("Server stop failed", "err", err)
 	}
 
-	log.Println("Shutdown complete")
+	slog.Info("Shutdown complete")
 }
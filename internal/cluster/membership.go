@@ -0,0 +1,290 @@
+package cluster
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NodeState describes the health of a cluster node
+type NodeState string
+
+const (
+	StateAlive   NodeState = "alive"
+	StateSuspect NodeState = "suspect"
+	StateDead    NodeState = "dead"
+)
+
+// Config holds membership configuration
+type Config struct {
+	// Self is the address other nodes use to reach this node
+	Self           string
+	Seeds          []string
+	GossipInterval time.Duration
+	SuspectTimeout time.Duration
+	DeadTimeout    time.Duration
+
+	// Token, when set, authenticates gossip with peers that require it
+	Token string
+}
+
+// Node is a cluster member as seen by the local node
+type Node struct {
+	Addr      string
+	Heartbeat uint64
+	State     NodeState
+	LastSeen  time.Time
+}
+
+// Membership tracks cluster peers using a seed list and gossip heartbeats
+type Membership struct {
+	mu     sync.RWMutex
+	config Config
+	nodes  map[string]*Node
+	rng    *rand.Rand
+	stopCh chan struct{}
+}
+
+// NewMembership creates a membership list containing only the local node
+func NewMembership(config Config) *Membership {
+	if config.GossipInterval <= 0 {
+		config.GossipInterval = time.Second
+	}
+	if config.SuspectTimeout <= 0 {
+		config.SuspectTimeout = 5 * config.GossipInterval
+	}
+	if config.DeadTimeout <= 0 {
+		config.DeadTimeout = 30 * config.GossipInterval
+	}
+
+	m := &Membership{
+		config: config,
+		nodes:  make(map[string]*Node),
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		stopCh: make(chan struct{}),
+	}
+	m.nodes[config.Self] = &Node{
+		Addr:     config.Self,
+		State:    StateAlive,
+		LastSeen: time.Now(),
+	}
+	return m
+}
+
+// Self returns the local node address
+func (m *Membership) Self() string {
+	return m.config.Self
+}
+
+// Start begins the background gossip loop
+func (m *Membership) Start() {
+	go m.run()
+}
+
+// Stop stops the gossip loop
+func (m *Membership) Stop() {
+	close(m.stopCh)
+}
+
+// run is the main gossip loop
+func (m *Membership) run() {
+	ticker := time.NewTicker(m.config.GossipInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.tick()
+		case <-m.stopCh:
+			return
+		}
+	}
+}
+
+// tick bumps the local heartbeat, updates peer health and gossips with one peer
+func (m *Membership) tick() {
+	m.mu.Lock()
+	self := m.nodes[m.config.Self]
+	self.Heartbeat++
+	self.LastSeen = time.Now()
+	m.updateStatesLocked()
+	peer := m.pickPeerLocked()
+	m.mu.Unlock()
+
+	if peer == "" {
+		return
+	}
+
+	if err := m.gossipWith(peer); err != nil {
+		slog.Debug("Gossip failed", "peer", peer, "err", err)
+	}
+}
+
+// pickPeerLocked chooses a random non-dead peer, falling back to seeds
+func (m *Membership) pickPeerLocked() string {
+	var candidates []string
+	for addr, node := range m.nodes {
+		if addr != m.config.Self && node.State != StateDead {
+			candidates = append(candidates, addr)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, seed := range m.config.Seeds {
+			if seed != m.config.Self {
+				candidates = append(candidates, seed)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[m.rng.Intn(len(candidates))]
+}
+
+// updateStatesLocked derives peer health from the time since their last heartbeat
+func (m *Membership) updateStatesLocked() {
+	now := time.Now()
+	for addr, node := range m.nodes {
+		if addr == m.config.Self {
+			continue
+		}
+		age := now.Sub(node.LastSeen)
+		switch {
+		case age >= m.config.DeadTimeout:
+			node.State = StateDead
+		case age >= m.config.SuspectTimeout:
+			node.State = StateSuspect
+		default:
+			node.State = StateAlive
+		}
+	}
+}
+
+// gossipWith exchanges digests with a peer over the text protocol
+func (m *Membership) gossipWith(peer string) error {
+	conn, err := net.DialTimeout("tcp", peer, m.config.GossipInterval)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(m.config.GossipInterval))
+	reader := bufio.NewReader(conn)
+
+	if m.config.Token != "" {
+		if err := Authenticate(conn, reader, m.config.Token); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintf(conn, "gossip %s\r", m.Digest()); err != nil {
+		return err
+	}
+
+	resp, err := reader.ReadString('\r')
+	if err != nil {
+		return err
+	}
+	resp = strings.TrimSuffix(resp, "\r")
+	if strings.HasPrefix(resp, "error") {
+		return fmt.Errorf("peer rejected gossip: %s", resp)
+	}
+
+	return m.Merge(resp)
+}
+
+// Authenticate sends auth with token over a text protocol connection
+func Authenticate(conn net.Conn, reader *bufio.Reader, token string) error {
+	if _, err := fmt.Fprintf(conn, "auth %s\r", token); err != nil {
+		return err
+	}
+	resp, err := reader.ReadString('\r')
+	if err != nil {
+		return err
+	}
+	if resp = strings.TrimSuffix(resp, "\r"); resp != "success" {
+		return fmt.Errorf("peer rejected auth: %s", resp)
+	}
+	return nil
+}
+
+// Digest encodes the known heartbeats as "addr@heartbeat,..."
+func (m *Membership) Digest() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	parts := make([]string, 0, len(m.nodes))
+	for addr, node := range m.nodes {
+		if node.State == StateDead {
+			continue
+		}
+		parts = append(parts, addr+"@"+strconv.FormatUint(node.Heartbeat, 10))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Merge applies a digest received from a peer, keeping the highest heartbeat per node
+func (m *Membership) Merge(digest string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, part := range strings.Split(digest, ",") {
+		if part == "" {
+			continue
+		}
+		at := strings.LastIndex(part, "@")
+		if at <= 0 {
+			return fmt.Errorf("invalid digest entry: %s", part)
+		}
+		addr := part[:at]
+		heartbeat, err := strconv.ParseUint(part[at+1:], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid heartbeat for %s: %w", addr, err)
+		}
+
+		if addr == m.config.Self {
+			continue
+		}
+
+		node, exists := m.nodes[addr]
+		if !exists {
+			m.nodes[addr] = &Node{
+				Addr:      addr,
+				Heartbeat: heartbeat,
+				State:     StateAlive,
+				LastSeen:  now,
+			}
+			continue
+		}
+		if heartbeat > node.Heartbeat {
+			node.Heartbeat = heartbeat
+			node.LastSeen = now
+			node.State = StateAlive
+		}
+	}
+
+	return nil
+}
+
+// Nodes returns a snapshot of all known nodes sorted by address
+func (m *Membership) Nodes() []Node {
+	m.mu.Lock()
+	m.updateStatesLocked()
+	nodes := make([]Node, 0, len(m.nodes))
+	for _, node := range m.nodes {
+		nodes = append(nodes, *node)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Addr < nodes[j].Addr
+	})
+	return nodes
+}
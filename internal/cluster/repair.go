@@ -0,0 +1,198 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/hex"
+	"escabelo/internal/engine"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMerkleDepth is the tree depth used when none is requested (256 leaves)
+const DefaultMerkleDepth = 8
+
+// RepairResult summarizes an anti-entropy repair run
+type RepairResult struct {
+	DivergentBuckets int
+	EntriesReceived  int
+	EntriesApplied   int
+}
+
+// Repair compares the local merkle tree with a peer's and pulls newer
+// entries for every divergent bucket. Running it on both nodes converges them.
+// A non-empty token authenticates the connection to the peer.
+func Repair(eng engine.Store, peer, token string, depth int, timeout time.Duration) (RepairResult, error) {
+	var result RepairResult
+
+	local, err := eng.MerkleTree(depth)
+	if err != nil {
+		return result, err
+	}
+
+	conn, err := net.DialTimeout("tcp", peer, timeout)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	if token != "" {
+		conn.SetDeadline(time.Now().Add(timeout))
+		if err := Authenticate(conn, reader, token); err != nil {
+			return result, err
+		}
+	}
+
+	request := func(cmd string) (string, error) {
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := fmt.Fprintf(conn, "%s\r", cmd); err != nil {
+			return "", err
+		}
+		resp, err := reader.ReadString('\r')
+		if err != nil {
+			return "", err
+		}
+		resp = strings.TrimSuffix(resp, "\r")
+		if strings.HasPrefix(resp, "error") {
+			return "", fmt.Errorf("peer: %s", resp)
+		}
+		return resp, nil
+	}
+
+	resp, err := request(fmt.Sprintf("merkle %d", depth))
+	if err != nil {
+		return result, err
+	}
+	remote, err := DecodeMerkleTree(resp, depth)
+	if err != nil {
+		return result, err
+	}
+
+	for _, bucket := range divergentBuckets(local, remote) {
+		result.DivergentBuckets++
+
+		resp, err := request(fmt.Sprintf("merkle %d %d", depth, bucket))
+		if err != nil {
+			return result, err
+		}
+		entries, err := DecodeEntries(resp)
+		if err != nil {
+			return result, err
+		}
+
+		for _, entry := range entries {
+			result.EntriesReceived++
+			applied, err := eng.ApplyEntry(entry)
+			if err != nil {
+				return result, err
+			}
+			if applied {
+				result.EntriesApplied++
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// divergentBuckets walks both trees top-down and returns leaves whose hashes differ
+func divergentBuckets(local, remote *engine.MerkleTree) []int {
+	var buckets []int
+	leafStart := local.Leaves() - 1
+
+	var walk func(i int)
+	walk = func(i int) {
+		if string(local.Nodes[i]) == string(remote.Nodes[i]) {
+			return
+		}
+		if i >= leafStart {
+			buckets = append(buckets, i-leafStart)
+			return
+		}
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+
+	return buckets
+}
+
+// EncodeMerkleTree renders tree node hashes as comma-separated hex
+func EncodeMerkleTree(tree *engine.MerkleTree) string {
+	parts := make([]string, len(tree.Nodes))
+	for i, node := range tree.Nodes {
+		parts[i] = hex.EncodeToString(node)
+	}
+	return strings.Join(parts, ",")
+}
+
+// DecodeMerkleTree parses the output of EncodeMerkleTree
+func DecodeMerkleTree(s string, depth int) (*engine.MerkleTree, error) {
+	parts := strings.Split(s, ",")
+	tree := &engine.MerkleTree{Depth: depth}
+	if len(parts) != 2*tree.Leaves()-1 {
+		return nil, fmt.Errorf("merkle tree has %d nodes, expected %d", len(parts), 2*tree.Leaves()-1)
+	}
+
+	tree.Nodes = make([][]byte, len(parts))
+	for i, part := range parts {
+		node, err := hex.DecodeString(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid merkle node %d: %w", i, err)
+		}
+		tree.Nodes[i] = node
+	}
+	return tree, nil
+}
+
+// EncodeEntries renders entries as "key|timestamp|deleted|hexvalue" lines,
+// keys path-escaped so they can't hold the separators
+func EncodeEntries(entries []*engine.Entry) string {
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		deleted := "0"
+		if entry.Deleted {
+			deleted = "1"
+		}
+		lines[i] = url.PathEscape(entry.Key) + "|" + strconv.FormatInt(entry.Timestamp, 10) + "|" + deleted + "|" + hex.EncodeToString(entry.Value)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// DecodeEntries parses the output of EncodeEntries
+func DecodeEntries(s string) ([]*engine.Entry, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var entries []*engine.Entry
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.SplitN(line, "|", 4)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid entry line: %q", line)
+		}
+		timestamp, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp for %s: %w", fields[0], err)
+		}
+		value, err := hex.DecodeString(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", fields[0], err)
+		}
+		key, err := url.PathUnescape(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", fields[0], err)
+		}
+		entries = append(entries, &engine.Entry{
+			Key:       key,
+			Value:     value,
+			Timestamp: timestamp,
+			Deleted:   fields[2] == "1",
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,87 @@
+// Package debugserver serves runtime profiles, expvar counters and a dump of
+// the engine's internal state, for diagnosing a live server without
+// attaching a debugger. It must only be exposed to operators: profiles
+// reveal memory contents and the dump lists key ranges.
+package debugserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"escabelo/internal/engine"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// debugStater is implemented by stores that can dump their internals
+type debugStater interface {
+	DebugState() engine.DebugState
+}
+
+// Server serves the debug endpoints
+type Server struct {
+	store  engine.Store
+	server *http.Server
+}
+
+// New creates a debug server over store. Its stats are published to expvar
+// as "escabelo".
+func New(store engine.Store) *Server {
+	s := &Server{store: store}
+	if expvar.Get("escabelo") == nil {
+		expvar.Publish("escabelo", expvar.Func(func() any { return store.GetStats() }))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	mux.HandleFunc("GET /debug/engine", s.engineState)
+	s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return s
+}
+
+// Start begins serving on addr in the background
+func (s *Server) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	slog.Info("Debug server listening", "addr", listener.Addr().String())
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Debug server failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+// Stop waits up to timeout for requests in flight, such as a CPU profile
+// being taken, to finish, then stops serving
+func (s *Server) Stop(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// engineState answers GET /debug/engine with the engine's levels, SST
+// files, memtables, pending flushes, WAL and snapshots
+func (s *Server) engineState(w http.ResponseWriter, r *http.Request) {
+	stater, ok := s.store.(debugStater)
+	if !ok {
+		http.Error(w, "engine state isn't available for this storage engine", http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(stater.DebugState())
+}
@@ -0,0 +1,300 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// walArchiveIndex names the file in the archive directory listing the
+// sequence numbers each archived segment holds
+const walArchiveIndex = "wal.archive"
+
+// ArchivedSegment describes a WAL segment copied to the archive directory
+type ArchivedSegment struct {
+	ID   int64
+	Path string // in the archive directory
+
+	// FirstSeq and LastSeq are the sequence numbers of the segment's first
+	// and last entries; an empty segment has FirstSeq past LastSeq
+	FirstSeq uint64
+	LastSeq  uint64
+}
+
+// walArchive keeps released WAL segments in a directory instead of deleting
+// them, under their names in the data directory so restore can replay them
+type walArchive struct {
+	fs   FS
+	dir  string
+	hook func(ArchivedSegment)
+
+	// limits bound the key and value lengths records may hold
+	limits SizeLimits
+
+	mu       sync.Mutex
+	segments []ArchivedSegment // by ID
+
+	// Hooks run in archive order, outside the WAL's lock
+	hooks chan ArchivedSegment
+	done  chan struct{}
+}
+
+// openWALArchive loads the archive index in dir, creating dir if needed. hook,
+// when set, is called with every segment archived from then on. Archived
+// records of keys or values past limits read as corrupt.
+func openWALArchive(fs FS, dir string, hook func(ArchivedSegment), limits SizeLimits) (*walArchive, error) {
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	a := &walArchive{fs: fs, dir: dir, hook: hook, limits: limits, hooks: make(chan ArchivedSegment, 64), done: make(chan struct{})}
+
+	file, err := fs.Open(filepath.Join(dir, walArchiveIndex))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer file.Close()
+
+		// Format: one "<id> <first-seq> <last-seq>" line per segment. A
+		// segment archived again after a crash appears twice; the last line
+		// wins.
+		byID := make(map[int64]ArchivedSegment)
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var seg ArchivedSegment
+			if _, err := fmt.Sscanf(scanner.Text(), "%d %d %d", &seg.ID, &seg.FirstSeq, &seg.LastSeq); err != nil {
+				continue
+			}
+			seg.Path = walSegmentPath(dir, seg.ID)
+			byID[seg.ID] = seg
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		for _, seg := range byID {
+			a.segments = append(a.segments, seg)
+		}
+		sort.Slice(a.segments, func(i, j int) bool {
+			return a.segments[i].ID < a.segments[j].ID
+		})
+	}
+
+	go a.runHooks()
+	return a, nil
+}
+
+// add copies segments to the archive and records them in the index
+func (a *walArchive) add(segments []ArchivedSegment) error {
+	if len(segments) == 0 {
+		return nil
+	}
+
+	var index strings.Builder
+	archived := make([]ArchivedSegment, len(segments))
+	for i, seg := range segments {
+		dst := walSegmentPath(a.dir, seg.ID)
+		if err := copyFile(a.fs, seg.Path, dst); err != nil {
+			return fmt.Errorf("failed to archive WAL segment %d: %w", seg.ID, err)
+		}
+		seg.Path = dst
+		archived[i] = seg
+		fmt.Fprintf(&index, "%d %d %d\n", seg.ID, seg.FirstSeq, seg.LastSeq)
+	}
+	if err := a.fs.SyncDir(a.dir); err != nil {
+		return err
+	}
+	if err := a.appendIndex(index.String()); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	for _, seg := range archived {
+		n := len(a.segments)
+		if n > 0 && a.segments[n-1].ID >= seg.ID {
+			// Archived again after a crash
+			a.segments = a.segments[:sort.Search(n, func(i int) bool { return a.segments[i].ID >= seg.ID })]
+		}
+		a.segments = append(a.segments, seg)
+	}
+	a.mu.Unlock()
+
+	if a.hook != nil {
+		for _, seg := range archived {
+			a.hooks <- seg
+		}
+	}
+	return nil
+}
+
+// appendIndex appends lines to the index file and syncs it
+func (a *walArchive) appendIndex(lines string) error {
+	file, err := a.fs.OpenFile(filepath.Join(a.dir, walArchiveIndex), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write([]byte(lines)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// read returns up to limit archived entries with sequence numbers from from
+// onwards, and the sequence number reading can continue from. It returns
+// false if the archive doesn't hold from.
+func (a *walArchive) read(from uint64, limit int) ([]*WALEntry, uint64, bool, error) {
+	a.mu.Lock()
+	i := sort.Search(len(a.segments), func(i int) bool { return a.segments[i].LastSeq >= from })
+	if i == len(a.segments) || a.segments[i].FirstSeq > from {
+		a.mu.Unlock()
+		return nil, 0, false, nil
+	}
+	segments := append([]ArchivedSegment(nil), a.segments[i:]...)
+	a.mu.Unlock()
+
+	var entries []*WALEntry
+	next := from
+	for _, seg := range segments {
+		if len(entries) >= limit || seg.FirstSeq > next {
+			break // a gap: the rest isn't contiguous
+		}
+		if seg.LastSeq < next {
+			continue
+		}
+		read, err := a.readSegment(seg, next, limit-len(entries))
+		if err != nil {
+			return nil, 0, false, err
+		}
+		entries = append(entries, read...)
+		if len(entries) >= limit {
+			next = entries[len(entries)-1].Seq + 1
+		} else {
+			next = seg.LastSeq + 1
+		}
+	}
+	return entries, next, true, nil
+}
+
+// readSegment returns up to limit entries of seg with sequence numbers from
+// from onwards
+func (a *walArchive) readSegment(seg ArchivedSegment, from uint64, limit int) ([]*WALEntry, error) {
+	file, err := a.fs.Open(seg.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	reader := newRecordReader(bufio.NewReader(file), info.Size(), a.limits)
+	if err := readWALHeader(reader); err != nil {
+		return nil, fmt.Errorf("archived WAL segment %d: %w", seg.ID, noEOF(err))
+	}
+
+	var entries []*WALEntry
+	for seq := seg.FirstSeq - 1; seq < seg.LastSeq && len(entries) < limit; {
+		entry, err := readWALEntry(reader)
+		if err != nil {
+			return nil, fmt.Errorf("archived WAL segment %d: %w", seg.ID, err)
+		}
+		if entry.OpType == OpTypeBatch {
+			continue
+		}
+		seq++
+		if seq >= from {
+			entry.Seq = seq
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// runHooks calls the hook with archived segments until close
+func (a *walArchive) runHooks() {
+	defer close(a.done)
+	for seg := range a.hooks {
+		if a.hook != nil {
+			a.hook(seg)
+		}
+	}
+}
+
+// close waits for pending hooks
+func (a *walArchive) close() {
+	close(a.hooks)
+	<-a.done
+}
+
+// archiveSegments copies the segments Release would delete up to and
+// including segment through to the archive, before they're released. They're
+// no longer written to, so this doesn't hold up appends.
+func (w *WAL) archiveSegments(through int64) error {
+	if w.archive == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	var segments []ArchivedSegment
+	prev := w.baseSeq
+	for _, seg := range w.segments[:len(w.segments)-1] {
+		if seg.id > through {
+			break
+		}
+		segments = append(segments, ArchivedSegment{ID: seg.id, Path: seg.path, FirstSeq: prev + 1, LastSeq: seg.lastSeq})
+		prev = seg.lastSeq
+	}
+	w.mu.Unlock()
+
+	if err := w.archive.add(segments); err != nil {
+		return err
+	}
+	if len(segments) > 0 {
+		slog.Debug("WAL segments archived", "count", len(segments), "through_seq", prev)
+	}
+	return nil
+}
+
+// ReadWAL returns up to limit WAL entries with sequence numbers from from
+// onwards, reading released entries from the archive when one is configured,
+// without registering a tail consumer
+func (e *Engine) ReadWAL(from uint64, limit int) ([]*WALEntry, error) {
+	if from == 0 {
+		from = 1
+	}
+	if limit <= 0 {
+		limit = math.MaxInt
+	}
+	if e.wal.archive == nil || from >= e.wal.FirstSeq() {
+		return e.wal.ReadFrom(from, limit)
+	}
+
+	entries, next, ok, err := e.wal.archive.read(from, limit)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// Let the WAL report how far back it goes
+		return e.wal.ReadFrom(from, limit)
+	}
+
+	// Continue into the live WAL when the archive ran out
+	if len(entries) < limit && next >= e.wal.FirstSeq() {
+		more, err := e.wal.ReadFrom(next, limit-len(entries))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, more...)
+	}
+	return entries, nil
+}
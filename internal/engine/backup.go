@@ -0,0 +1,256 @@
+package engine
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrBackupUnsupported is returned by Backup on a store with no files to
+// copy
+var ErrBackupUnsupported = errors.New("backup needs an on-disk engine")
+
+// backupName is the file in a backup describing it. The other files are
+// laid out like a data directory (SSTs, MANIFEST, WAL segments and
+// wal.seq), so a copy of the backup can be opened as one.
+const backupName = "BACKUP"
+
+// backupHeader is the first line of the BACKUP file. The next one is
+//
+//	seq <n>
+//
+// the version of the last mutation the backup holds.
+const backupHeader = "escabelo-backup 1"
+
+// BackupInfo describes a finished backup
+type BackupInfo struct {
+	// Seq is the version of the last mutation the backup holds: it has
+	// every mutation up to it and none after
+	Seq int64
+
+	SSTs        int
+	WALSegments int
+	Bytes       int64
+}
+
+// backupFile is a file a backup copies, opened while nothing could delete
+// it
+type backupFile struct {
+	name string
+	file File
+	size int64
+}
+
+// backupSink receives the files of a backup
+type backupSink interface {
+	add(name string, size int64, r io.Reader) error
+	close() error
+}
+
+// Backup copies a consistent snapshot of the engine to path without
+// blocking writes: to a directory, which must be empty or not exist yet,
+// or to a tar archive if path ends in ".tar".
+func (e *Engine) Backup(path string) (*BackupInfo, error) {
+	if strings.HasSuffix(path, ".tar") {
+		return e.backupTar(path)
+	}
+
+	files, err := e.config.FS.ReadDir(path)
+	if err == nil && len(files) > 0 {
+		return nil, fmt.Errorf("backup directory %s is not empty", path)
+	}
+	if err := e.config.FS.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	return e.backup(&dirSink{fs: e.config.FS, dir: path})
+}
+
+// backupTar writes a backup archive to path, next to it first so a failed
+// backup never leaves a partial archive behind
+func (e *Engine) backupTar(path string) (*BackupInfo, error) {
+	tmpPath := path + ".tmp"
+	file, err := e.config.FS.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := e.BackupTo(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = e.config.FS.Rename(tmpPath, path)
+	}
+	if err != nil {
+		e.config.FS.Remove(tmpPath)
+		return nil, err
+	}
+	return info, nil
+}
+
+// BackupTo writes a consistent snapshot of the engine to w as a tar
+// archive, e.g. to stream it elsewhere
+func (e *Engine) BackupTo(w io.Writer) (*BackupInfo, error) {
+	return e.backup(&tarSink{writer: tar.NewWriter(w), clock: e.config.Clock})
+}
+
+// backup pins the files holding every mutation up to now, then copies them
+// to sink. Files are opened while flushes and compactions are held off, as
+// those delete them; copying happens after, through the open files, while
+// the engine carries on.
+func (e *Engine) backup(sink backupSink) (*BackupInfo, error) {
+	e.flushing.Lock()
+	e.compactor.running.Lock()
+
+	// Versions are assigned and WAL entries appended under e.mu, so the
+	// checkpoint holds exactly the mutations up to seq not yet in an SST
+	e.mu.Lock()
+	seq := e.lastVersion
+	segments, baseSeq, err := e.wal.Checkpoint()
+	if err == nil {
+		// The memtable's entries now start in the new segment as well, so
+		// flushing it releases the one closed by the checkpoint
+		e.memtable.walSegment = e.wal.Active()
+	}
+	sstables := e.sstManager.acquire()
+	e.mu.Unlock()
+	defer e.sstManager.release(sstables)
+
+	var files []backupFile
+	var manifest []byte
+	if err == nil {
+		manifest = encodeManifest(sstables)
+		files, err = e.openBackupFiles(sstables, segments)
+	}
+	e.compactor.running.Unlock()
+	e.flushing.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("backup failed: %w", err)
+	}
+
+	info := &BackupInfo{Seq: seq, SSTs: len(sstables), WALSegments: len(segments)}
+	err = copyBackupFiles(sink, files, info)
+	if err == nil {
+		err = sink.add(manifestName, int64(len(manifest)), bytes.NewReader(manifest))
+	}
+	if err == nil {
+		walSeq := strconv.FormatUint(baseSeq, 10)
+		err = sink.add("wal.seq", int64(len(walSeq)), strings.NewReader(walSeq))
+	}
+	if err == nil {
+		// Written last, so only a complete backup has one
+		meta := fmt.Sprintf("%s\nseq %d\n", backupHeader, seq)
+		err = sink.add(backupName, int64(len(meta)), strings.NewReader(meta))
+	}
+	if closeErr := sink.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("backup failed: %w", err)
+	}
+	return info, nil
+}
+
+// openBackupFiles opens the SSTs and WAL segments of a backup
+func (e *Engine) openBackupFiles(sstables []*SSTable, segments []walSegment) ([]backupFile, error) {
+	files := make([]backupFile, 0, len(sstables)+len(segments))
+	open := func(path string, size int64) error {
+		file, err := e.config.FS.Open(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, backupFile{name: filepath.Base(path), file: file, size: size})
+		return nil
+	}
+
+	for _, sst := range sstables {
+		if err := open(sst.FilePath, sst.Size); err != nil {
+			closeBackupFiles(files)
+			return nil, err
+		}
+	}
+	for _, seg := range segments {
+		if err := open(seg.path, seg.size); err != nil {
+			closeBackupFiles(files)
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// copyBackupFiles copies files to sink, closing them, and adds their bytes
+// to info
+func copyBackupFiles(sink backupSink, files []backupFile, info *BackupInfo) error {
+	defer closeBackupFiles(files)
+	for _, f := range files {
+		if err := sink.add(f.name, f.size, f.file); err != nil {
+			return err
+		}
+		info.Bytes += f.size
+	}
+	return nil
+}
+
+// closeBackupFiles closes the files of a backup
+func closeBackupFiles(files []backupFile) {
+	for _, f := range files {
+		f.file.Close()
+	}
+}
+
+// dirSink writes backup files to a directory
+type dirSink struct {
+	fs  FS
+	dir string
+}
+
+func (s *dirSink) add(name string, size int64, r io.Reader) error {
+	file, err := s.fs.Create(filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(file, r, size); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (s *dirSink) close() error {
+	return s.fs.SyncDir(s.dir)
+}
+
+// tarSink writes backup files to a tar archive
+type tarSink struct {
+	writer *tar.Writer
+	clock  Clock
+}
+
+func (s *tarSink) add(name string, size int64, r io.Reader) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: s.clock.Now(),
+	}
+	if err := s.writer.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.CopyN(s.writer, r, size)
+	return err
+}
+
+func (s *tarSink) close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,204 @@
+package engine
+
+import "fmt"
+
+// BatchOp is one write or delete of a batch
+type BatchOp struct {
+	Key    string
+	Value  []byte
+	Delete bool
+}
+
+// WriteBatch applies ops atomically: they are appended to the WAL as one
+// batch, which recovery restores whole or not at all, and applied to the
+// memtable under a single lock, so readers see all of them or none. Ops are
+// applied in order, so a later op on a key supersedes an earlier one.
+// Deletes write a tombstone whether or not the key exists.
+func (e *Engine) WriteBatch(ops []BatchOp) error {
+	_, err := e.writeBatch(ops, nil)
+	return err
+}
+
+// writeBatch implements WriteBatch, returning the version of the last op.
+// check, when set, runs under e.mu before the batch is appended, and its
+// error cancels the batch.
+func (e *Engine) writeBatch(ops []BatchOp, check func() error) (int64, error) {
+	if len(ops) == 0 {
+		return 0, nil
+	}
+	for _, op := range ops {
+		if err := e.config.checkSize(op.Key, op.Value); err != nil {
+			return 0, err
+		}
+	}
+	if err := e.checkWritable(); err != nil {
+		return 0, err
+	}
+	e.throttleWrites()
+
+	retained, err := e.retainedValues(ops)
+	if err != nil {
+		return 0, err
+	}
+
+	walEntries := make([]*WALEntry, len(ops))
+	var writes, deletes int64
+	for i, op := range ops {
+		walEntries[i] = &WALEntry{OpType: OpTypePut, Key: op.Key, Value: op.Value}
+		if op.Delete {
+			walEntries[i].OpType = OpTypeDelete
+			walEntries[i].Value = retained[i]
+			deletes++
+		} else {
+			writes++
+		}
+	}
+
+	// Each op gets its own version, so ops on the same key keep their order
+	e.mu.Lock()
+	if check != nil {
+		if err := check(); err != nil {
+			e.mu.Unlock()
+			return 0, err
+		}
+	}
+	for _, entry := range walEntries {
+		entry.Timestamp = e.nextVersion()
+	}
+	if err := e.wal.AppendBatch(walEntries); err != nil {
+		e.mu.Unlock()
+		return 0, fmt.Errorf("WAL append failed: %w", err)
+	}
+	for _, entry := range walEntries {
+		e.memtable.Apply(&Entry{
+			Key:       entry.Key,
+			Value:     entry.Value,
+			Timestamp: entry.Timestamp,
+			Deleted:   entry.OpType == OpTypeDelete,
+		})
+	}
+	if e.needsRotation() {
+		e.rotateMemTable()
+	}
+	e.mu.Unlock()
+
+	if err := e.syncWrite(); err != nil {
+		return 0, err
+	}
+
+	e.stats.mu.Lock()
+	e.stats.Writes += writes
+	e.stats.Deletes += deletes
+	e.stats.mu.Unlock()
+	return walEntries[len(walEntries)-1].Timestamp, nil
+}
+
+// retainedValues returns the values soft deletes keep on the tombstones of
+// ops, indexed like ops: the value an earlier op of the batch wrote, or the
+// stored one. They are all nil with soft deletes disabled.
+func (e *Engine) retainedValues(ops []BatchOp) ([][]byte, error) {
+	retained := make([][]byte, len(ops))
+	if e.config.DeleteRetention <= 0 {
+		return retained, nil
+	}
+
+	latest := make(map[string][]byte)
+	for i, op := range ops {
+		if !op.Delete {
+			latest[op.Key] = op.Value
+			continue
+		}
+		value, ok := latest[op.Key]
+		if !ok {
+			var err error
+			if value, _, err = e.Get(op.Key); err != nil {
+				return nil, err
+			}
+		}
+		retained[i] = value
+		latest[op.Key] = nil
+	}
+	return retained, nil
+}
+
+// ApplyBatch applies entries made elsewhere, such as by a Stage, keeping
+// their versions, under a single lock like WriteBatch. An entry that isn't
+// newer than its key's current version is skipped, so applying entries
+// again is harmless.
+func (e *Engine) ApplyBatch(entries []*Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	current := make(map[string]int64)
+	var walEntries []*WALEntry
+	var writes, deletes int64
+	for _, entry := range entries {
+		version, ok := current[entry.Key]
+		if !ok {
+			latest, err := e.latestLocked(entry.Key)
+			if err != nil {
+				e.mu.Unlock()
+				return err
+			}
+			if latest != nil {
+				version = latest.Timestamp
+			}
+		}
+		if entry.Timestamp <= version {
+			continue
+		}
+		current[entry.Key] = entry.Timestamp
+
+		walEntry := &WALEntry{
+			OpType:    OpTypePut,
+			Key:       entry.Key,
+			Value:     entry.Value,
+			Timestamp: entry.Timestamp,
+			ExpiresAt: entry.ExpiresAt,
+		}
+		if entry.Deleted {
+			walEntry.OpType = OpTypeDelete
+			deletes++
+		} else {
+			writes++
+		}
+		walEntries = append(walEntries, walEntry)
+	}
+	if len(walEntries) == 0 {
+		e.mu.Unlock()
+		return nil
+	}
+	if err := e.wal.AppendBatch(walEntries); err != nil {
+		e.mu.Unlock()
+		return fmt.Errorf("WAL append failed: %w", err)
+	}
+	for _, entry := range walEntries {
+		e.observeVersion(entry.Timestamp)
+		e.memtable.Apply(&Entry{
+			Key:       entry.Key,
+			Value:     entry.Value,
+			Timestamp: entry.Timestamp,
+			Deleted:   entry.OpType == OpTypeDelete,
+			ExpiresAt: entry.ExpiresAt,
+		})
+	}
+	if e.needsRotation() {
+		e.rotateMemTable()
+	}
+	e.mu.Unlock()
+
+	if err := e.syncWrite(); err != nil {
+		return err
+	}
+
+	e.stats.mu.Lock()
+	e.stats.Writes += writes
+	e.stats.Deletes += deletes
+	e.stats.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"container/list"
+	"sync"
+)
+
+// blockCache is an LRU cache of SST data blocks, bounded by the bytes it
+// holds. Blocks are keyed by their file's *SSTable rather than its ID, as a
+// compaction's output takes over the ID of a file it replaces.
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List // of *cachedBlock, most recently used first
+	blocks   map[blockKey]*list.Element
+
+	hits      int64
+	misses    int64
+	evictions int64 // blocks dropped to make room
+}
+
+// blockKey identifies a data block by its file and offset
+type blockKey struct {
+	sst    *SSTable
+	offset int64
+}
+
+type cachedBlock struct {
+	key  blockKey
+	data []byte
+}
+
+// newBlockCache creates a cache holding up to capacity bytes of blocks, or
+// nil, which caches nothing, if capacity isn't positive
+func newBlockCache(capacity int64) *blockCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &blockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		blocks:   make(map[blockKey]*list.Element),
+	}
+}
+
+// get returns the block of sst at offset if it is cached
+func (c *blockCache) get(sst *SSTable, offset int64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.blocks[blockKey{sst, offset}]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cachedBlock).data, true
+}
+
+// put caches the block of sst at offset, evicting the least recently used
+// blocks to make room. Blocks larger than the whole cache aren't kept.
+func (c *blockCache) put(sst *SSTable, offset int64, data []byte) {
+	if c == nil || int64(len(data)) > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := blockKey{sst, offset}
+	if _, ok := c.blocks[key]; ok {
+		return // cached by a concurrent read
+	}
+	c.blocks[key] = c.lru.PushFront(&cachedBlock{key: key, data: data})
+	c.size += int64(len(data))
+	for c.size > c.capacity {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+// evict drops every cached block of sst, once the file is gone
+func (c *blockCache) evict(sst *SSTable) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*cachedBlock).key.sst == sst {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// remove drops a cached block. Must hold c.mu.
+func (c *blockCache) remove(elem *list.Element) {
+	block := c.lru.Remove(elem).(*cachedBlock)
+	delete(c.blocks, block.key)
+	c.size -= int64(len(block.data))
+}
+
+// stats returns the cache's hits, misses, evictions and size in bytes
+func (c *blockCache) stats() (hits, misses, evictions, size int64) {
+	if c == nil {
+		return 0, 0, 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.evictions, c.size
+}
@@ -0,0 +1,138 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// DefaultBucket names the keyspace of the engine itself
+const DefaultBucket = "default"
+
+// bucketsDir is the directory under DataDir holding one data directory per
+// bucket
+const bucketsDir = "buckets"
+
+// maxBucketName bounds the length of bucket names
+const maxBucketName = 64
+
+// ErrEngineClosed is returned when opening a bucket of a closed engine
+var ErrEngineClosed = errors.New("engine is closed")
+
+// Bucket is a handle on a named keyspace of an engine. Each bucket other
+// than DefaultBucket is an engine of its own in a directory under DataDir,
+// with its own memtable, SST files and WAL, so the data of different tenants
+// or types is never flushed or compacted together. Watching a bucket sees
+// only its own changes; replication and backups cover DefaultBucket alone.
+type Bucket struct {
+	*Engine
+	name string
+}
+
+// Name returns the bucket's name
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// Close does nothing: buckets are closed along with their engine
+func (b *Bucket) Close() error {
+	return nil
+}
+
+// ValidBucketName reports whether name can name a bucket: 1 to 64 letters,
+// digits, '-' or '_'
+func ValidBucketName(name string) bool {
+	if len(name) == 0 || len(name) > maxBucketName {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Bucket returns the bucket called name, opening it with the engine's
+// configuration on first use, and creating it if it doesn't exist
+func (e *Engine) Bucket(name string) (*Bucket, error) {
+	if e.parent != nil {
+		return e.parent.Bucket(name)
+	}
+	if name == DefaultBucket {
+		return &Bucket{Engine: e, name: name}, nil
+	}
+	if !ValidBucketName(name) {
+		return nil, fmt.Errorf("invalid bucket name: %q", name)
+	}
+
+	e.bucketsMu.Lock()
+	defer e.bucketsMu.Unlock()
+	if e.buckets == nil {
+		return nil, ErrEngineClosed
+	}
+	if b, ok := e.buckets[name]; ok {
+		return b, nil
+	}
+
+	config := e.config
+	config.DataDir = filepath.Join(e.config.DataDir, bucketsDir, name)
+	if config.WALArchiveDir != "" {
+		config.WALArchiveDir = filepath.Join(config.WALArchiveDir, bucketsDir, name)
+	}
+	child, err := NewEngine(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bucket %s: %w", name, err)
+	}
+	child.parent = e
+
+	b := &Bucket{Engine: child, name: name}
+	e.buckets[name] = b
+	slog.Info("Bucket opened", "bucket", name)
+	return b, nil
+}
+
+// OpenBucket is Bucket for callers that only know the engine as a Store
+func (e *Engine) OpenBucket(name string) (Store, error) {
+	b, err := e.Bucket(name)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Buckets returns the names of the engine's buckets, including those not
+// opened since startup, DefaultBucket first and the others sorted
+func (e *Engine) Buckets() ([]string, error) {
+	if e.parent != nil {
+		return e.parent.Buckets()
+	}
+	files, err := e.config.FS.ReadDir(filepath.Join(e.config.DataDir, bucketsDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if file.IsDir() && ValidBucketName(file.Name()) && file.Name() != DefaultBucket {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return append([]string{DefaultBucket}, names...), nil
+}
+
+// closeBuckets closes every open bucket, after which none can be opened
+func (e *Engine) closeBuckets() {
+	e.bucketsMu.Lock()
+	defer e.bucketsMu.Unlock()
+	for name, b := range e.buckets {
+		if err := b.Engine.Close(); err != nil {
+			slog.Error("Bucket close failed", "bucket", name, "err", err)
+		}
+	}
+	e.buckets = nil
+}
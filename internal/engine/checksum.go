@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"hash/crc32"
+)
+
+// ErrCorrupt is returned when a WAL or SST record fails its checksum, which
+// points to a torn write or bit rot
+var ErrCorrupt = errors.New("corrupt record")
+
+// crcTable is the CRC-32C (Castagnoli) table record checksums use
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the CRC-32C of b
+func checksum(b []byte) uint32 {
+	return crc32.Checksum(b, crcTable)
+}
+
+// recordReader reads the records of a WAL segment, hint log, SST file or
+// data block, counting the bytes left in it, so that a corrupted length is
+// caught before the key or value it claims is allocated
+type recordReader struct {
+	*bufio.Reader
+	left int64
+
+	// maxKey and maxValue bound the key and value lengths records may hold
+	maxKey   int64
+	maxValue int64
+}
+
+// newRecordReader reads size bytes of records from r. Lengths past limits
+// are reported as corrupt; a zero limit only bounds them by what the
+// formats can hold.
+func newRecordReader(r *bufio.Reader, size int64, limits SizeLimits) *recordReader {
+	rr := &recordReader{Reader: r, left: size, maxKey: maxEncodedSize, maxValue: maxEncodedSize}
+	if limits.MaxKeySize > 0 {
+		rr.maxKey = int64(limits.MaxKeySize)
+	}
+	if limits.MaxValueSize > 0 {
+		rr.maxValue = limits.MaxValueSize
+	}
+	return rr
+}
+
+// Read implements io.Reader, counting the bytes read
+func (r *recordReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.left -= int64(n)
+	return n, err
+}
+
+// Discard skips the next n bytes, counting them as read
+func (r *recordReader) Discard(n int) (int, error) {
+	discarded, err := r.Reader.Discard(n)
+	r.left -= int64(discarded)
+	return discarded, err
+}
+
+// checkKey returns ErrCorrupt if a key length read from a record is past
+// the key size limit or, with the length field of the value that follows,
+// past the end of the data
+func (r *recordReader) checkKey(keyLen uint32) error {
+	if int64(keyLen) > r.maxKey || int64(keyLen)+4 > r.left {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// checkValue returns ErrCorrupt if a value length read from a record is
+// past the value size limit or past the end of the data. rawLen is the
+// value's length once decompressed, which is only bounded by the limit.
+func (r *recordReader) checkValue(valueLen, rawLen uint32) error {
+	if int64(valueLen) > r.maxValue || int64(rawLen) > r.maxValue || int64(valueLen) > r.left {
+		return ErrCorrupt
+	}
+	return nil
+}
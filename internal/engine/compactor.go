@@ -1,184 +1,646 @@
 package engine
 
 import (
-	"bufio"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"os"
+	"log/slog"
+	"math"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrCompactionPaused is returned by TriggerNow while compaction is paused
+var ErrCompactionPaused = errors.New("compaction is paused")
+
+// Compaction strategies
+const (
+	// CompactionSizeTiered merges the files of a tier once it holds
+	// CompactionFileTrigger of them, into one file of the next tier
+	CompactionSizeTiered = "size-tiered"
+
+	// CompactionLeveled merges level 0 into level 1 once it holds
+	// CompactionFileTrigger files, and each level past its byte budget into
+	// the next one
+	CompactionLeveled = "leveled"
+)
+
+// CompactionStrategies lists the compaction strategies
+var CompactionStrategies = []string{CompactionSizeTiered, CompactionLeveled}
+
+// Compaction trigger defaults
+const (
+	defaultCompactionFileTrigger = 4
+	defaultCompactionLevelBytes  = 256 * 1024 * 1024
+
+	// levelGrowth is how many times larger each level's budget is than the
+	// previous one's, and maxLevel the deepest level of the leveled strategy
+	levelGrowth = 10
+	maxLevel    = 6
+)
+
 // Compactor handles background compaction of SST files
 type Compactor struct {
 	sstManager *SSTManager
 	interval   time.Duration
 	stopCh     chan struct{}
+	done       chan struct{} // closed once run returns
+	triggerCh  chan struct{}
+
+	// Version retention policy
+	maxVersions      int
+	versionRetention time.Duration
+	deleteRetention  time.Duration
+
+	// hasSpace reports whether the disk can take n more bytes
+	hasSpace func(n int64) bool
+
+	// pinned returns the oldest sequence number a live snapshot reads at
+	pinned func() int64
+
+	// Strategy and the triggers that start a compaction
+	strategy    string
+	fileTrigger int
+	levelBytes  int64
+
+	// workers is how many jobs over disjoint files a cycle may run at once
+	workers int
+
+	// tombstoneRatio prioritizes files whose share of tombstones reaches it,
+	// staleRatio rewrites files whose share of stale versions reaches it
+	tombstoneRatio float64
+	staleRatio     float64
+
+	clock Clock
+
+	// running is held while a compaction runs, so Pause can wait for it;
+	// merges also take one of the engine's background job slots
+	running sync.Mutex
+	jobs    *jobSlots
+
+	// paused skips compactions; a full compaction requested meanwhile runs
+	// on Resume
+	paused      int32
+	pendingFull int32
 }
 
 // NewCompactor creates a new compactor
-func NewCompactor(sstManager *SSTManager, interval time.Duration) *Compactor {
+func NewCompactor(sstManager *SSTManager, config Config) *Compactor {
+	if config.Clock == nil {
+		config.Clock = SystemClock
+	}
+	if config.CompactionStrategy == "" {
+		config.CompactionStrategy = CompactionSizeTiered
+	}
+	if config.CompactionFileTrigger <= 0 {
+		config.CompactionFileTrigger = defaultCompactionFileTrigger
+	}
+	if config.CompactionLevelBytes <= 0 {
+		config.CompactionLevelBytes = defaultCompactionLevelBytes
+	}
+	if config.CompactionWorkers <= 0 {
+		config.CompactionWorkers = 1
+	}
 	return &Compactor{
-		sstManager: sstManager,
-		interval:   interval,
-		stopCh:     make(chan struct{}),
+		sstManager:       sstManager,
+		interval:         config.CompactionInterval,
+		stopCh:           make(chan struct{}),
+		done:             make(chan struct{}),
+		triggerCh:        make(chan struct{}, 1),
+		maxVersions:      config.MaxVersions,
+		versionRetention: config.VersionRetention,
+		deleteRetention:  config.DeleteRetention,
+		hasSpace:         func(int64) bool { return true },
+		pinned:           func() int64 { return math.MaxInt64 },
+		strategy:         config.CompactionStrategy,
+		fileTrigger:      config.CompactionFileTrigger,
+		levelBytes:       config.CompactionLevelBytes,
+		workers:          config.CompactionWorkers,
+		tombstoneRatio:   config.TombstoneRatio,
+		staleRatio:       config.StaleRatio,
+		clock:            config.Clock,
 	}
 }
 
 // Start begins the background compaction process
 func (c *Compactor) Start() {
-	go c.run()
+	// Created here rather than in run, so a simulated clock sees the ticker
+	// as soon as Start returns
+	go c.run(c.clock.NewTicker(c.interval))
 }
 
-// Stop stops the compaction process
+// Stop stops the compaction process, waiting for a running compaction to
+// finish
 func (c *Compactor) Stop() {
 	close(c.stopCh)
+	<-c.done
+	c.running.Lock()
+	c.running.Unlock()
+}
+
+// TriggerFull requests an immediate compaction of all SST files into one.
+// It doesn't block; requests made while one is pending are coalesced.
+func (c *Compactor) TriggerFull() {
+	select {
+	case c.triggerCh <- struct{}{}:
+	default:
+	}
+}
+
+// TriggerNow runs a compaction cycle right away, or a full compaction of
+// all SST files into one, and waits for it. It returns the number of files
+// merged, 0 when there was nothing to compact.
+func (c *Compactor) TriggerNow(full bool) (int, error) {
+	c.running.Lock()
+	defer c.running.Unlock()
+	if c.Paused() {
+		return 0, ErrCompactionPaused
+	}
+	if full {
+		return c.compactAll()
+	}
+	return c.compact()
 }
 
 // run is the main compaction loop
-func (c *Compactor) run() {
-	ticker := time.NewTicker(c.interval)
+func (c *Compactor) run(ticker Ticker) {
+	defer close(c.done)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
-			if err := c.compact(); err != nil {
-				log.Printf("Compaction error: %v", err)
+		case <-ticker.C():
+			c.runLocked(c.compact)
+		case <-c.triggerCh:
+			if c.Paused() {
+				atomic.StoreInt32(&c.pendingFull, 1)
+				continue
 			}
+			c.runLocked(c.compactAll)
 		case <-c.stopCh:
 			return
 		}
 	}
 }
 
-// compact performs a compaction cycle
-func (c *Compactor) compact() error {
-	sstables := c.sstManager.GetAllSSTables()
+// runLocked runs a compaction unless compaction is paused
+func (c *Compactor) runLocked(compact func() (int, error)) {
+	c.running.Lock()
+	defer c.running.Unlock()
+	if c.Paused() {
+		return
+	}
+	if _, err := compact(); err != nil {
+		slog.Error("Compaction failed", "err", err)
+	}
+}
 
-	// Simple strategy: merge oldest SSTs if we have more than 4
-	if len(sstables) <= 4 {
-		return nil
+// Pause stops new compactions from starting and waits for a running one
+// to finish
+func (c *Compactor) Pause() {
+	atomic.StoreInt32(&c.paused, 1)
+	c.running.Lock()
+	c.running.Unlock()
+}
+
+// Resume lets compactions run again, starting a full compaction if one was
+// requested while paused
+func (c *Compactor) Resume() {
+	atomic.StoreInt32(&c.paused, 0)
+	if atomic.CompareAndSwapInt32(&c.pendingFull, 1, 0) {
+		c.TriggerFull()
+	}
+}
+
+// Paused reports whether compaction is paused
+func (c *Compactor) Paused() bool {
+	return atomic.LoadInt32(&c.paused) == 1
+}
+
+// compactJob is a merge planned by a compaction cycle: files, a contiguous
+// run of the newest-first file list, merged into one file at level, or with
+// move just moved to level without being rewritten
+type compactJob struct {
+	files []*SSTable
+	level int
+	move  bool
+}
+
+// compact performs a compaction cycle, returning the number of files
+// merged. It plans up to workers jobs over disjoint files and runs them
+// concurrently: as each merged file takes the place of its inputs in the
+// list, merges of disjoint runs don't affect each other.
+func (c *Compactor) compact() (int, error) {
+	sstables := c.sstManager.acquire()
+	defer c.sstManager.release(sstables)
+	busy := make(map[int64]bool)
+	var jobs []compactJob
+	for len(jobs) < c.workers {
+		job, ok := c.plan(sstables, busy)
+		if !ok {
+			break
+		}
+		for _, sst := range job.files {
+			busy[sst.ID] = true
+		}
+		jobs = append(jobs, job)
 	}
 
-	// Take the 4 oldest SSTs
-	toMerge := sstables[len(sstables)-4:]
+	switch len(jobs) {
+	case 0:
+		return 0, nil
+	case 1:
+		return c.runJob(jobs[0])
+	}
 
-	log.Printf("Compacting %d SST files...", len(toMerge))
+	merged := make([]int, len(jobs))
+	errs := make([]error, len(jobs))
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			merged[i], errs[i] = c.runJob(job)
+		}()
+	}
+	wg.Wait()
 
-	// Merge entries
-	mergedEntries, err := c.mergeSSTs(toMerge)
-	if err != nil {
-		return fmt.Errorf("merge failed: %w", err)
+	total := 0
+	for _, n := range merged {
+		total += n
 	}
+	return total, errors.Join(errs...)
+}
 
-	// Write merged SST
-	if err := c.sstManager.Flush(mergedEntries); err != nil {
-		return fmt.Errorf("flush failed: %w", err)
+// runJob merges or moves the files of a job
+func (c *Compactor) runJob(job compactJob) (int, error) {
+	if job.move {
+		slog.Debug("Moving SSTs a level down", "level", job.level, "files", len(job.files), "bytes", levelSize(job.files))
+		return 0, c.sstManager.SetLevel(job.files, job.level)
 	}
+	return c.merge(job.files, job.level)
+}
 
-	// Remove old SSTs
-	for _, sst := range toMerge {
-		if err := c.sstManager.RemoveSSTable(sst); err != nil {
-			log.Printf("Failed to remove SST %d: %v", sst.ID, err)
-		}
+// plan picks the next job of a cycle among files that aren't busy, already
+// taken by another job of the cycle
+func (c *Compactor) plan(sstables []*SSTable, busy map[int64]bool) (compactJob, bool) {
+	// Files dominated by tombstones go first: merging the newest such file
+	// with everything older lets its tombstones be purged safely
+	if i := c.tombstoneHeavy(sstables); i >= 0 && !anyBusy(sstables[i:], busy) {
+		slog.Debug("SST prioritized for its tombstones", "sst", sstables[i].ID, "tombstone_ratio", sstables[i].TombstoneRatio())
+		return compactJob{files: sstables[i:], level: bottomLevel(sstables[i:])}, true
 	}
 
-	log.Printf("Compaction complete: merged %d files into 1", len(toMerge))
-	return nil
+	// Then files holding mostly versions nothing reads anymore are rewritten
+	if i := c.staleHeavy(sstables, busy); i >= 0 {
+		slog.Debug("SST rewritten for its stale versions", "sst", sstables[i].ID, "stale_ratio", sstables[i].StaleRatio(c.maxVersions))
+		return compactJob{files: sstables[i : i+1], level: sstables[i].Level}, true
+	}
+
+	if c.strategy == CompactionLeveled {
+		return c.planLeveled(sstables, busy)
+	}
+	return c.planTiered(sstables, busy)
+}
+
+// planTiered merges the newest tier holding fileTrigger files or more into
+// one file of the next tier
+func (c *Compactor) planTiered(sstables []*SSTable, busy map[int64]bool) (compactJob, bool) {
+	for _, run := range levelRuns(sstables) {
+		files := sstables[run.start:run.end]
+		if len(files) >= c.fileTrigger && !anyBusy(files, busy) {
+			return compactJob{files: files, level: run.level + 1}, true
+		}
+	}
+	return compactJob{}, false
 }
 
-// mergeSSTs merges multiple SST files, keeping the newest version of each key
-func (c *Compactor) mergeSSTs(sstables []*SSTable) ([]*Entry, error) {
-	// Map to hold the latest entry for each key
-	entryMap := make(map[string]*Entry)
+// planLeveled merges level 0 into level 1 once it holds fileTrigger files,
+// or else the shallowest level past its byte budget into the next one. A
+// level with no next level yet simply moves down, without rewriting.
+func (c *Compactor) planLeveled(sstables []*SSTable, busy map[int64]bool) (compactJob, bool) {
+	runs := levelRuns(sstables)
+	for i, run := range runs {
+		files := sstables[run.start:run.end]
+		switch {
+		case run.level == 0 && len(files) < c.fileTrigger:
+			continue
+		case run.level > 0 && (run.level >= maxLevel || levelSize(files) <= levelBudget(c.levelBytes, run.level)):
+			continue
+		}
+		job := compactJob{files: files, level: run.level + 1, move: run.level > 0}
+
+		// Level 0 merges with level 1, and level n with level n+1
+		if i+1 < len(runs) && runs[i+1].level == job.level {
+			job.files = sstables[run.start:runs[i+1].end]
+			job.move = false
+		}
+		if !anyBusy(job.files, busy) {
+			return job, true
+		}
+	}
+	return compactJob{}, false
+}
 
+// anyBusy reports whether any of sstables is in busy
+func anyBusy(sstables []*SSTable, busy map[int64]bool) bool {
 	for _, sst := range sstables {
-		entries, err := c.readAllEntries(sst)
-		if err != nil {
-			return nil, err
+		if busy[sst.ID] {
+			return true
 		}
+	}
+	return false
+}
 
-		for _, entry := range entries {
-			existing, exists := entryMap[entry.Key]
-			if !exists || entry.Timestamp > existing.Timestamp {
-				entryMap[entry.Key] = entry
-			}
+// levelRun is a run of files at the same level, sstables[start:end]
+type levelRun struct {
+	level      int
+	start, end int
+}
+
+// levelRuns splits files, newest first, into runs of the same level
+func levelRuns(sstables []*SSTable) []levelRun {
+	var runs []levelRun
+	for i, sst := range sstables {
+		if len(runs) == 0 || runs[len(runs)-1].level != sst.Level {
+			runs = append(runs, levelRun{level: sst.Level, start: i})
 		}
+		runs[len(runs)-1].end = i + 1
 	}
+	return runs
+}
+
+// levelSize returns the total size of files
+func levelSize(sstables []*SSTable) int64 {
+	var size int64
+	for _, sst := range sstables {
+		size += sst.Size
+	}
+	return size
+}
 
-	// Convert map to slice and remove tombstones
-	var result []*Entry
-	for _, entry := range entryMap {
-		if !entry.Deleted {
-			result = append(result, entry)
+// levelBudget returns the byte budget of level (1 or deeper), base for level
+// 1 and levelGrowth times more for each level below
+func levelBudget(base int64, level int) int64 {
+	budget := base
+	for ; level > 1 && budget < math.MaxInt64/levelGrowth; level-- {
+		budget *= levelGrowth
+	}
+	return budget
+}
+
+// bottomLevel returns the deepest level among files
+func bottomLevel(sstables []*SSTable) int {
+	level := 0
+	for _, sst := range sstables {
+		level = max(level, sst.Level)
+	}
+	return level
+}
+
+// tombstoneHeavy returns the index of the newest SST (in newest-first order)
+// whose tombstone ratio reaches the threshold, or -1
+func (c *Compactor) tombstoneHeavy(sstables []*SSTable) int {
+	if c.tombstoneRatio <= 0 {
+		return -1
+	}
+
+	// Retention policies may keep tombstones through compaction; don't keep
+	// rewriting a lone oldest file that would come out the same
+	retains := c.maxVersions > 1 || c.deleteRetention > 0
+
+	for i, sst := range sstables {
+		if sst.TombstoneRatio() < c.tombstoneRatio {
+			continue
 		}
+		if i == len(sstables)-1 && retains {
+			continue
+		}
+		return i
 	}
+	return -1
+}
 
-	// Sort by key
-	sort.Slice(result, func(i, j int) bool {
-		return result[i].Key < result[j].Key
-	})
+// staleHeavy returns the index of the newest SST (in newest-first order)
+// whose stale ratio reaches the threshold, or -1. Files are only picked once
+// VersionRetention has passed since they were written and no snapshot is
+// live, as rewriting them wouldn't drop anything before. Busy files are
+// skipped.
+func (c *Compactor) staleHeavy(sstables []*SSTable, busy map[int64]bool) int {
+	if c.staleRatio <= 0 || c.pinned() != math.MaxInt64 {
+		return -1
+	}
+	cutoff := c.clock.Now().Add(-c.versionRetention)
+	for i, sst := range sstables {
+		if !busy[sst.ID] && sst.StaleRatio(c.maxVersions) >= c.staleRatio && !sst.CreatedAt.After(cutoff) {
+			return i
+		}
+	}
+	return -1
+}
 
-	return result, nil
+// compactAll merges every SST file into one at the deepest level, returning
+// the number of files merged
+func (c *Compactor) compactAll() (int, error) {
+	sstables := c.sstManager.acquire()
+	defer c.sstManager.release(sstables)
+	if len(sstables) <= 1 {
+		return 0, nil
+	}
+	return c.merge(sstables, bottomLevel(sstables))
 }
 
-// readAllEntries reads all entries from an SST file
-func (c *Compactor) readAllEntries(sst *SSTable) ([]*Entry, error) {
-	file, err := os.Open(sst.FilePath)
+// merge compacts the given SST files, a contiguous run of the newest-first
+// file list, into a single new file at level, returning how many it merged
+func (c *Compactor) merge(toMerge []*SSTable, level int) (int, error) {
+	c.jobs.acquire()
+	defer c.jobs.release()
+
+	// The merged file can be as large as its inputs, which are only removed
+	// once it has been written
+	var mergeSize int64
+	for _, sst := range toMerge {
+		mergeSize += sst.Size
+	}
+	if !c.hasSpace(mergeSize) {
+		return 0, fmt.Errorf("insufficient disk space to compact %d bytes", mergeSize)
+	}
+
+	slog.Info("Compacting", "files", len(toMerge), "level", level)
+
+	// Merge entries
+	merged, err := c.mergeSSTs(toMerge, c.olderThan(toMerge))
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("merge failed: %w", err)
 	}
-	defer file.Close()
+	defer merged.close()
 
-	reader := bufio.NewReader(file)
-	var entries []*Entry
+	// Swap the inputs for the merged SST, written as the merge goes
+	if err := c.sstManager.Replace(toMerge, merged.next, level); err != nil {
+		return 0, fmt.Errorf("replace failed: %w", err)
+	}
 
-	for {
-		var timestamp int64
-		if err := binary.Read(reader, binary.LittleEndian, &timestamp); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
+	slog.Info("Compaction complete", "files", len(toMerge))
+	return len(toMerge), nil
+}
+
+// olderThan returns the files older than every file of a merge, those after
+// its last input in the newest-first list. New files are only ever added as
+// the newest or in place of the files they merge, so the files older than a
+// running merge stay older.
+func (c *Compactor) olderThan(toMerge []*SSTable) []*SSTable {
+	merging := make(map[int64]bool, len(toMerge))
+	for _, sst := range toMerge {
+		merging[sst.ID] = true
+	}
+
+	sstables := c.sstManager.GetAllSSTables()
+	for i := len(sstables) - 1; i >= 0; i-- {
+		if merging[sstables[i].ID] {
+			return sstables[i+1:]
 		}
+	}
+	return nil
+}
 
-		var deleted byte
-		deleted, err = reader.ReadByte()
-		if err != nil {
-			return nil, err
+// mayHold reports whether any of sstables may hold a version of key
+func mayHold(sstables []*SSTable, key string) bool {
+	for _, sst := range sstables {
+		if sst.MayContain(key) {
+			return true
 		}
+	}
+	return false
+}
 
-		var keyLen uint32
-		if err := binary.Read(reader, binary.LittleEndian, &keyLen); err != nil {
+// sstMerge streams the entries of several SST files that survive their
+// compaction, in key order. The inputs are read side by side, one key's
+// versions at a time, so a merge holds a block per input rather than the
+// files' contents, however large they are.
+type sstMerge struct {
+	c       *Compactor
+	older   []*SSTable     // files older than the inputs
+	inputs  []*sstIterator // newest file first, which breaks timestamp ties
+	cursors []*rangeCursor
+	pending []*Entry // the current key's surviving versions not yet returned
+
+	cutoff       int64
+	deleteCutoff int64
+	pinned       int64
+}
+
+// mergeSSTs starts merging multiple SST files, keeping the newest version of
+// each key plus any older versions still inside the retention window. older
+// are the files older than the merged ones, whose values tombstones may still
+// hide. Close the merge once done.
+func (c *Compactor) mergeSSTs(sstables []*SSTable, older []*SSTable) (*sstMerge, error) {
+	now := c.clock.Now()
+	m := &sstMerge{
+		c:            c,
+		older:        older,
+		cutoff:       now.Add(-c.versionRetention).UnixNano(),
+		deleteCutoff: now.Add(-c.deleteRetention).UnixNano(),
+		pinned:       c.pinned(),
+	}
+
+	for _, sst := range sstables {
+		it, err := c.sstManager.newSSTIterator(sst, "", "")
+		if err != nil {
+			m.close()
 			return nil, err
 		}
+		it.versions = true
+		m.inputs = append(m.inputs, it)
 
-		keyBytes := make([]byte, keyLen)
-		if _, err := io.ReadFull(reader, keyBytes); err != nil {
+		entry, err := it.next()
+		if err != nil {
+			m.close()
 			return nil, err
 		}
+		m.cursors = append(m.cursors, &rangeCursor{entry: entry, next: it.next})
+	}
+	return m, nil
+}
 
-		var valueLen uint32
-		if err := binary.Read(reader, binary.LittleEndian, &valueLen); err != nil {
-			return nil, err
+// next returns the following surviving entry, or nil once the inputs are
+// exhausted. The retention policy is applied to every version of a key at
+// once, dropping tombstones and expired keys.
+func (m *sstMerge) next() (*Entry, error) {
+	for len(m.pending) == 0 {
+		// The smallest key across the inputs
+		var key string
+		found := false
+		for _, c := range m.cursors {
+			if c.entry != nil && (!found || c.entry.Key < key) {
+				key, found = c.entry.Key, true
+			}
+		}
+		if !found {
+			return nil, nil
 		}
 
-		valueBytes := make([]byte, valueLen)
-		if _, err := io.ReadFull(reader, valueBytes); err != nil {
-			return nil, err
+		// Collect every version of it, newest first
+		var versions []*Entry
+		for _, c := range m.cursors {
+			for c.entry != nil && c.entry.Key == key {
+				versions = append(versions, c.entry)
+				entry, err := c.next()
+				if err != nil {
+					return nil, err
+				}
+				c.entry = entry
+			}
 		}
+		sort.SliceStable(versions, func(i, j int) bool {
+			return versions[i].Timestamp > versions[j].Timestamp
+		})
+
+		purge := !mayHold(m.older, key)
+		m.pending = m.c.retainVersions(versions, m.cutoff, m.pinned, m.deleteCutoff, purge)
+	}
+
+	entry := m.pending[0]
+	m.pending = m.pending[1:]
+	return entry, nil
+}
 
-		entry := &Entry{
-			Key:       string(keyBytes),
-			Value:     valueBytes,
-			Timestamp: timestamp,
-			Deleted:   deleted == 1,
+// close releases the input files
+func (m *sstMerge) close() {
+	for _, it := range m.inputs {
+		it.close()
+	}
+}
+
+// retainVersions picks which versions of a key (newest first) survive compaction.
+// An older version is kept while its successor was written after cutoff, since
+// it is then still visible to time-travel reads inside the retention window,
+// and regardless of MaxVersions while its successor is newer than pinned, the
+// oldest live snapshot, which may still read it.
+// Tombstones written after deleteCutoff are kept so the key can be undeleted.
+// A key whose newest version expired before both cutoff and pinned is gone
+// to every read, so all of its versions are dropped.
+// Both only happen with purge set, when no file older than the merge may
+// hold the key: otherwise the tombstone or expired version must stay to hide
+// the older value, or dropping it would resurrect the key.
+func (c *Compactor) retainVersions(versions []*Entry, cutoff, pinned, deleteCutoff int64, purge bool) []*Entry {
+	if expiresAt := versions[0].ExpiresAt; purge && expiresAt != 0 && expiresAt < cutoff && expiresAt <= pinned {
+		return nil
+	}
+
+	kept := versions[:1]
+	for i := 1; i < len(versions); i++ {
+		if versions[i-1].Timestamp <= pinned && (i >= c.maxVersions || versions[i-1].Timestamp < cutoff) {
+			break
 		}
-		entries = append(entries, entry)
+		kept = versions[:i+1]
 	}
 
-	return entries, nil
+	// A lone tombstone has nothing left to shadow once it can't be undeleted
+	if purge && len(kept) == 1 && kept[0].Deleted {
+		if c.deleteRetention <= 0 || kept[0].Timestamp < deleteCutoff {
+			return nil
+		}
+	}
+	return kept
 }
@@ -0,0 +1,180 @@
+package engine_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"escabelo/internal/engine"
+	"escabelo/internal/engine/enginetest"
+)
+
+// flushBatch writes a batch of 100 ops and waits until it is flushed to an
+// SST file of its own, once the memtable holding it ages out. The engine
+// must run with a short MemTableMaxAge.
+func flushBatch(t *testing.T, eng *engine.Engine, op func(i int) engine.BatchOp) {
+	t.Helper()
+	files := len(eng.GetSSTableStats())
+	ops := make([]engine.BatchOp, 100)
+	for i := range ops {
+		ops[i] = op(i)
+	}
+	if err := eng.WriteBatch(ops); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for len(eng.GetSSTableStats()) <= files {
+		if time.Now().After(deadline) {
+			t.Fatal("memtable not flushed after 10s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestTombstoneRatioIgnoresLiveTTLs checks that a file of keys whose TTL is
+// still running isn't taken for a tombstone-heavy one, which compaction
+// would rewrite unchanged on every cycle
+func TestTombstoneRatioIgnoresLiveTTLs(t *testing.T) {
+	config := enginetest.Config(t)
+	config.TombstoneRatio = 0.5
+	eng := enginetest.NewEngine(t, config)
+
+	value := make([]byte, 100)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key:%04d", i)
+		if err := eng.Put(key, value); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+		if _, err := eng.Expire(key, time.Hour); err != nil {
+			t.Fatalf("expire %s: %v", key, err)
+		}
+	}
+	waitFlushed(t, eng)
+	if _, err := eng.CompactNow(true); err != nil {
+		t.Fatalf("full compaction: %v", err)
+	}
+
+	for cycle := 0; cycle < 3; cycle++ {
+		merged, err := eng.CompactNow(false)
+		if err != nil {
+			t.Fatalf("compaction cycle %d: %v", cycle, err)
+		}
+		if merged != 0 {
+			t.Fatalf("compaction cycle %d merged %d files holding only live TTL keys", cycle, merged)
+		}
+	}
+}
+
+// TestPartialCompactionKeepsTombstones deletes keys held by an older SST and
+// compacts only the newer files: the tombstones must survive the merge, as
+// dropping them would bring the older values back
+func TestPartialCompactionKeepsTombstones(t *testing.T) {
+	config := enginetest.Config(t)
+	config.MemTableMaxAge = 10 * time.Millisecond
+	eng := enginetest.NewEngine(t, config)
+	value := make([]byte, 100)
+
+	// Four files merged into an older one of the next tier
+	for file := 0; file < 4; file++ {
+		flushBatch(t, eng, func(i int) engine.BatchOp {
+			return engine.BatchOp{Key: fmt.Sprintf("key:%03d", i), Value: value}
+		})
+	}
+	if merged, err := eng.CompactNow(false); err != nil || merged != 4 {
+		t.Fatalf("first compaction merged %d files (err %v), want 4", merged, err)
+	}
+
+	// Then four newer files, the first deleting half of the older keys
+	flushBatch(t, eng, func(i int) engine.BatchOp {
+		if i%2 == 0 {
+			return engine.BatchOp{Key: fmt.Sprintf("key:%03d", i), Delete: true}
+		}
+		return engine.BatchOp{Key: fmt.Sprintf("other:0:%03d", i), Value: value}
+	})
+	for file := 1; file < 4; file++ {
+		flushBatch(t, eng, func(i int) engine.BatchOp {
+			return engine.BatchOp{Key: fmt.Sprintf("other:%d:%03d", file, i), Value: value}
+		})
+	}
+	if merged, err := eng.CompactNow(false); err != nil || merged != 4 {
+		t.Fatalf("second compaction merged %d files (err %v), want 4", merged, err)
+	}
+	if n := len(eng.GetSSTableStats()); n != 2 {
+		t.Fatalf("%d SST files after the second compaction, want the older one kept apart", n)
+	}
+
+	check := func() {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key:%03d", i)
+			_, found, err := eng.Get(key)
+			if err != nil {
+				t.Fatalf("get %s: %v", key, err)
+			}
+			if found != (i%2 != 0) {
+				t.Errorf("get %s found %v, want %v", key, found, i%2 != 0)
+			}
+		}
+	}
+	check()
+	eng = enginetest.Reopen(t, eng, config)
+	check()
+
+	// Merged with the older file, they have nothing left to hide
+	if _, err := eng.CompactNow(true); err != nil {
+		t.Fatalf("full compaction: %v", err)
+	}
+	check()
+}
+
+// TestCompactionMergesVersionsAcrossFiles writes a version of every key to
+// each of several files: merging them must keep the newest MaxVersions of
+// each key, newest first, while inside VersionRetention, along with the keys
+// only one file holds
+func TestCompactionMergesVersionsAcrossFiles(t *testing.T) {
+	config := enginetest.Config(t)
+	config.MemTableMaxAge = 10 * time.Millisecond
+	config.MaxVersions = 3
+	config.VersionRetention = time.Hour
+	eng := enginetest.NewEngine(t, config)
+
+	for file := 0; file < 5; file++ {
+		flushBatch(t, eng, func(i int) engine.BatchOp {
+			if i%10 == 9 {
+				return engine.BatchOp{Key: fmt.Sprintf("only:%d:%03d", file, i), Value: []byte("v1")}
+			}
+			return engine.BatchOp{Key: fmt.Sprintf("key:%03d", i), Value: []byte(fmt.Sprintf("v%d", file))}
+		})
+	}
+	if merged, err := eng.CompactNow(true); err != nil || merged != 5 {
+		t.Fatalf("full compaction merged %d files (err %v), want 5", merged, err)
+	}
+	if n := len(eng.GetSSTableStats()); n != 1 {
+		t.Fatalf("%d SST files after a full compaction, want 1", n)
+	}
+
+	for i := 0; i < 100; i++ {
+		if i%10 == 9 {
+			for file := 0; file < 5; file++ {
+				key := fmt.Sprintf("only:%d:%03d", file, i)
+				if value, found, err := eng.Get(key); err != nil || !found || string(value) != "v1" {
+					t.Errorf("get %s = %q (found %v, err %v), want v1", key, value, found, err)
+				}
+			}
+			continue
+		}
+
+		key := fmt.Sprintf("key:%03d", i)
+		versions, err := eng.History(key, 0)
+		if err != nil {
+			t.Fatalf("history %s: %v", key, err)
+		}
+		var got []string
+		for _, version := range versions {
+			got = append(got, string(version.Value))
+		}
+		if fmt.Sprint(got) != "[v4 v3 v2]" {
+			t.Errorf("history %s = %v, want [v4 v3 v2]", key, got)
+		}
+	}
+}
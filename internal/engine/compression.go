@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// SST value compression codecs
+const (
+	CompressionNone  = "none"
+	CompressionGzip  = "gzip"  // gzip framing, checked against its own CRC
+	CompressionFlate = "flate" // raw DEFLATE, a little smaller and faster
+)
+
+// Compressions lists the compression codecs
+var Compressions = []string{CompressionNone, CompressionGzip, CompressionFlate}
+
+// compressMinSize is the smallest value compressed when flushing. Shorter
+// values rarely shrink enough to pay for decompressing them on every read.
+const compressMinSize = 256
+
+// Codec IDs stored with compressed SST records
+const (
+	codecNone  byte = 0
+	codecGzip  byte = 1
+	codecFlate byte = 2
+)
+
+// codecID returns the ID records compressed with the named codec carry
+func codecID(name string) (byte, error) {
+	switch name {
+	case "", CompressionNone:
+		return codecNone, nil
+	case CompressionGzip:
+		return codecGzip, nil
+	case CompressionFlate:
+		return codecFlate, nil
+	}
+	return 0, fmt.Errorf("unknown compression %q", name)
+}
+
+// compressValue compresses value with codec, returning the codec the value
+// is stored with: codecNone when it is too short or doesn't shrink
+func compressValue(codec byte, value []byte) ([]byte, byte) {
+	if codec == codecNone || len(value) < compressMinSize {
+		return value, codecNone
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if codec == codecGzip {
+		w = gzip.NewWriter(&buf)
+	} else {
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	}
+	if _, err := w.Write(value); err != nil {
+		return value, codecNone
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(value) {
+		return value, codecNone
+	}
+	return buf.Bytes(), codec
+}
+
+// decompressValue restores a value of rawLen bytes stored with codec
+func decompressValue(codec byte, stored []byte, rawLen uint32) ([]byte, error) {
+	var r io.Reader
+	switch codec {
+	case codecGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(stored))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case codecFlate:
+		fr := flate.NewReader(bytes.NewReader(stored))
+		defer fr.Close()
+		r = fr
+	default:
+		return nil, fmt.Errorf("unknown codec %d", codec)
+	}
+
+	value := make([]byte, rawLen)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
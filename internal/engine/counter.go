@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+// ErrNotInteger is returned when a counter command targets a key whose value
+// isn't a base-10 64-bit integer
+var ErrNotInteger = errors.New("value is not an integer")
+
+// ErrOverflow is returned when an increment would overflow a counter
+var ErrOverflow = errors.New("increment would overflow")
+
+// Counters implements atomic integer increments on top of a Store. Counters
+// are stored as their base-10 text, so they read back with a plain get;
+// updates are read-modify-write under a per-key lock, and conditional on the
+// version read, so a concurrent plain write isn't lost but makes the
+// increment start over.
+type Counters struct {
+	store Store
+	locks keyLocks
+}
+
+// NewCounters creates the counter type for a store
+func NewCounters(store Store) *Counters {
+	return &Counters{store: store}
+}
+
+// Incr adds delta to the counter at key, which counts as 0 if missing, and
+// returns its new value along with the version assigned to it. It retries
+// when another write changed the key in between.
+func (c *Counters) Incr(key string, delta int64) (int64, int64, error) {
+	mu := c.locks.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	for {
+		// A missing key reads as version 0, which PutIfVersion takes as
+		// "doesn't exist"
+		value, version, found, err := c.store.GetVersion(key)
+		if err != nil {
+			return 0, 0, err
+		}
+		var current int64
+		if found {
+			if current, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+				return 0, 0, ErrNotInteger
+			}
+		}
+
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			return 0, 0, ErrOverflow
+		}
+		current += delta
+
+		version, err = c.store.PutIfVersion(key, []byte(strconv.FormatInt(current, 10)), version)
+		if errors.Is(err, ErrVersionMismatch) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		return current, version, nil
+	}
+}
@@ -0,0 +1,95 @@
+package engine_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"escabelo/internal/engine"
+	"escabelo/internal/engine/enginetest"
+)
+
+// TestCrashRecovery crashes the filesystem at a range of points during a
+// full compaction and the writes and flushes that follow it, then reopens
+// the engine on what survived: every acknowledged write must read back, and
+// no deleted key may reappear
+func TestCrashRecovery(t *testing.T) {
+	for crashAfter := 0; crashAfter < 600; crashAfter += 13 {
+		t.Run(fmt.Sprintf("crash_after=%d", crashAfter), func(t *testing.T) {
+			clock := enginetest.NewSimClock(time.Unix(1_700_000_000, 0))
+			fs := enginetest.NewSimFS(clock, int64(crashAfter))
+			config := enginetest.SimConfig(clock, fs)
+			config.Durability = engine.DurabilityAlways
+			eng := enginetest.NewEngine(t, config)
+			model := enginetest.NewModel()
+
+			// Flushed files for the compaction to merge
+			setup := enginetest.Workload{Keys: 1000, Prefix: "a:", Operations: 2000, ValueSize: 100, DeleteRatio: 0.2, Seed: 1}
+			enginetest.Run(t, eng, model, setup.Generate())
+			waitFlushed(t, eng)
+
+			fs.CrashAfter(crashAfter)
+			if _, err := eng.CompactNow(true); err != nil && !errors.Is(err, enginetest.ErrCrashed) {
+				t.Fatalf("compact: %v", err)
+			}
+			writes := enginetest.Workload{Keys: 1000, Prefix: "b:", Operations: 3000, ValueSize: 100, DeleteRatio: 0.2, Seed: 2}
+			inFlight := runUntilCrash(t, eng, model, writes.Generate())
+
+			config.FS = fs.Crash()
+			eng = enginetest.NewEngine(t, config)
+			if inFlight != nil {
+				resolveInFlight(t, eng, model, inFlight)
+			}
+			enginetest.CheckInvariants(t, eng, model)
+		})
+	}
+}
+
+// runUntilCrash applies ops, recording acknowledged ones in model, until
+// one fails on the crashed filesystem. It returns that op, which may or may
+// not have reached the disk, or nil if all of them were acknowledged.
+func runUntilCrash(tb testing.TB, store engine.Store, model *enginetest.Model, ops []enginetest.Op) *enginetest.Op {
+	tb.Helper()
+	for i, op := range ops {
+		if op.Delete {
+			deleted, err := store.Delete(op.Key)
+			if errors.Is(err, enginetest.ErrCrashed) {
+				return &ops[i]
+			}
+			if err != nil {
+				tb.Fatalf("delete %s: %v", op.Key, err)
+			}
+			if deleted {
+				model.Delete(op.Key)
+			}
+			continue
+		}
+		err := store.Put(op.Key, op.Value)
+		if errors.Is(err, enginetest.ErrCrashed) {
+			return &ops[i]
+		}
+		if err != nil {
+			tb.Fatalf("put %s: %v", op.Key, err)
+		}
+		model.Put(op.Key, op.Value)
+	}
+	return nil
+}
+
+// resolveInFlight records the op a crash interrupted in model if it
+// survived, so the invariants hold either way
+func resolveInFlight(tb testing.TB, store engine.Store, model *enginetest.Model, op *enginetest.Op) {
+	tb.Helper()
+	value, found, err := store.Get(op.Key)
+	if err != nil {
+		tb.Fatalf("get %s: %v", op.Key, err)
+	}
+	switch {
+	case op.Delete && !found:
+		model.Delete(op.Key)
+	case !op.Delete && found && bytes.Equal(value, op.Value):
+		model.Put(op.Key, op.Value)
+	}
+}
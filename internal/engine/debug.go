@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// DebugState is a dump of the engine's internals, for diagnosing stalls
+type DebugState struct {
+	MemTable       MemTableState   `json:"memtable"`
+	PendingFlushes []MemTableState `json:"pending_flushes"` // oldest first
+	FlushPaused    bool            `json:"flush_paused"`
+
+	CompactionPaused bool         `json:"compaction_paused"`
+	Levels           []LevelState `json:"levels"`
+
+	WALSegment    int64  `json:"wal_segment"`
+	WALSize       int64  `json:"wal_size"`
+	WALActiveSize int64  `json:"wal_active_size"`
+	WALLastSeq    uint64 `json:"wal_last_seq"`
+
+	// Snapshots is the number of live snapshots and OldestSnapshot the
+	// version the oldest one reads at (0 with none)
+	Snapshots      int   `json:"snapshots"`
+	OldestSnapshot int64 `json:"oldest_snapshot,omitempty"`
+
+	DiskFull bool `json:"disk_full"`
+}
+
+// MemTableState describes a memtable
+type MemTableState struct {
+	Size       int64     `json:"size"`
+	MaxSize    int64     `json:"max_size"`
+	Keys       int       `json:"keys"`
+	WALSegment int64     `json:"wal_segment"`
+	FirstWrite time.Time `json:"first_write,omitzero"`
+	LastWrite  time.Time `json:"last_write,omitzero"`
+}
+
+// LevelState lists the SST files of a level, newest first
+type LevelState struct {
+	Level int        `json:"level"`
+	Size  int64      `json:"size"`
+	Files []SSTState `json:"files"`
+}
+
+// SSTState describes an SST file
+type SSTState struct {
+	ID         int64  `json:"id"`
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	EntryCount int64  `json:"entries"`
+	MinKey     string `json:"min_key"`
+	MaxKey     string `json:"max_key"`
+}
+
+// DebugState returns a dump of the engine's memtables, SST files, WAL and
+// snapshots
+func (e *Engine) DebugState() DebugState {
+	e.mu.RLock()
+	state := DebugState{
+		MemTable:       memTableState(e.memtable),
+		PendingFlushes: make([]MemTableState, len(e.immutableMemtables)),
+		Levels:         []LevelState{},
+	}
+	for i, mt := range e.immutableMemtables {
+		state.PendingFlushes[i] = memTableState(mt)
+	}
+	e.mu.RUnlock()
+
+	state.FlushPaused = e.FlushPaused()
+	state.CompactionPaused = e.compactor.Paused()
+
+	levels := make(map[int]*LevelState)
+	for _, sst := range e.sstManager.GetAllSSTables() {
+		level, ok := levels[sst.Level]
+		if !ok {
+			level = &LevelState{Level: sst.Level}
+			levels[sst.Level] = level
+		}
+		level.Size += sst.Size
+		level.Files = append(level.Files, SSTState{
+			ID:         sst.ID,
+			Path:       sst.FilePath,
+			Size:       sst.Size,
+			EntryCount: sst.EntryCount,
+			MinKey:     sst.MinKey,
+			MaxKey:     sst.MaxKey,
+		})
+	}
+	for n := 0; len(state.Levels) < len(levels); n++ {
+		if level, ok := levels[n]; ok {
+			state.Levels = append(state.Levels, *level)
+		}
+	}
+
+	state.WALSegment = e.wal.Active()
+	state.WALSize, _ = e.wal.Size()
+	state.WALActiveSize = e.wal.ActiveSize()
+	state.WALLastSeq = e.LastSeq()
+
+	state.Snapshots = e.snapshots.count()
+	if oldest := e.snapshots.oldest(); oldest != math.MaxInt64 {
+		state.OldestSnapshot = oldest
+	}
+	state.DiskFull = atomic.LoadInt32(&e.diskFull) == 1
+	return state
+}
+
+// memTableState describes mt
+func memTableState(mt *MemTable) MemTableState {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return MemTableState{
+		Size:       mt.size,
+		MaxSize:    mt.maxSize,
+		Keys:       mt.count,
+		WALSegment: mt.walSegment,
+		FirstWrite: mt.firstWrite,
+		LastWrite:  mt.lastWrite,
+	}
+}
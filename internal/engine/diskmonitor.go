@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"errors"
+	"log/slog"
+	"sync/atomic"
+)
+
+// ErrDiskFull is returned for writes while free disk space is below the
+// configured minimum
+var ErrDiskFull = errors.New("disk full: engine is read-only")
+
+// budgetWarnLevels are the budget utilization percentages that log a warning
+var budgetWarnLevels = []int64{80, 90, 100}
+
+// diskMonitor periodically checks free space in the data directory, toggling
+// read-only mode when it crosses Config.MinFreeDiskBytes, and tracks usage
+// against Config.DiskBudgetBytes
+func (e *Engine) diskMonitor(ticker Ticker) {
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if e.config.MinFreeDiskBytes > 0 {
+				e.checkDiskSpace()
+			}
+			if e.config.DiskBudgetBytes > 0 {
+				e.checkDiskBudget()
+			}
+		case <-e.stopCh:
+			return
+		}
+	}
+}
+
+// diskUsage returns the bytes used by SST files and the WAL
+func (e *Engine) diskUsage() int64 {
+	var usage int64
+	for _, sst := range e.sstManager.GetAllSSTables() {
+		usage += sst.Size
+	}
+	walSize, _ := e.wal.Size()
+	return usage + walSize
+}
+
+// checkDiskBudget warns as usage approaches the budget and, if enabled,
+// compacts everything once the first warning level is reached
+func (e *Engine) checkDiskBudget() {
+	usage := e.diskUsage()
+	percent := usage * 100 / e.config.DiskBudgetBytes
+
+	level := int64(0)
+	for _, warn := range budgetWarnLevels {
+		if percent >= warn {
+			level = warn
+		}
+	}
+
+	previous := atomic.SwapInt64(&e.budgetLevel, level)
+	if level > previous {
+		slog.Warn("Disk usage nearing budget", "usage", usage, "percent", percent, "budget", e.config.DiskBudgetBytes)
+	}
+	if level > 0 && e.config.BudgetCompaction {
+		e.compactor.TriggerFull()
+	}
+}
+
+// checkDiskSpace refreshes the free space reading and the read-only flag
+func (e *Engine) checkDiskSpace() {
+	free, err := freeDiskSpace(e.config.DataDir)
+	if err != nil {
+		slog.Error("Disk space check failed", "err", err)
+		return
+	}
+	atomic.StoreInt64(&e.diskFree, free)
+
+	full := free < e.config.MinFreeDiskBytes
+	if atomic.SwapInt32(&e.diskFull, boolToInt32(full)) != boolToInt32(full) {
+		if full {
+			slog.Error("Free disk space below minimum: rejecting writes", "free", free, "min", e.config.MinFreeDiskBytes)
+		} else {
+			slog.Info("Free disk space recovered: accepting writes", "free", free)
+		}
+	}
+}
+
+// hasDiskSpace reports whether the data directory can take another n bytes
+// while staying above the configured minimum
+func (e *Engine) hasDiskSpace(n int64) bool {
+	if e.config.MinFreeDiskBytes <= 0 {
+		return true
+	}
+	free, err := freeDiskSpace(e.config.DataDir)
+	if err != nil {
+		return true // can't tell; don't block background work
+	}
+	return free-n >= e.config.MinFreeDiskBytes
+}
+
+// checkWritable returns ErrDiskFull while the engine is in read-only mode
+func (e *Engine) checkWritable() error {
+	if atomic.LoadInt32(&e.diskFull) == 1 {
+		return ErrDiskFull
+	}
+	return nil
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package engine
+
+import "errors"
+
+// freeDiskSpace is not supported on this platform
+func freeDiskSpace(dir string) (int64, error) {
+	return 0, errors.New("free disk space detection not supported on this platform")
+}
@@ -0,0 +1,245 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrNotJSON is returned when a JSON command targets a key whose value isn't
+// a JSON document
+var ErrNotJSON = errors.New("key holds a non-JSON value")
+
+// Documents implements JSON path operations on top of a Store. Documents are
+// parsed server-side so clients can read or update a sub-path without
+// transferring the whole value. Updates are conditional on the version of
+// the document they read, and start over if another write changed the key
+// in between.
+type Documents struct {
+	store Store
+	locks keyLocks
+}
+
+// NewDocuments creates the JSON document type for a store
+func NewDocuments(store Store) *Documents {
+	return &Documents{store: store}
+}
+
+// pathSegment is a step into a document: an object member or an array index
+type pathSegment struct {
+	member string
+	index  int
+	array  bool
+}
+
+// parseJSONPath parses a path such as "$", "$.user.tags[0]" or "user.name".
+// The leading "$" (the document root) is optional.
+func parseJSONPath(path string) ([]pathSegment, error) {
+	rest := strings.TrimPrefix(path, "$")
+	var segments []pathSegment
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid path: %s", path)
+			}
+			segments = append(segments, pathSegment{member: rest[:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path: %s", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid array index in path: %s", path)
+			}
+			segments = append(segments, pathSegment{index: index, array: true})
+			rest = rest[end+1:]
+		default:
+			// A path without "$" starts with a bare member name
+			if len(segments) > 0 || strings.HasPrefix(path, "$") {
+				return nil, fmt.Errorf("invalid path: %s", path)
+			}
+			rest = "." + rest
+		}
+	}
+	return segments, nil
+}
+
+// decodeJSON parses a JSON value, keeping numbers as written
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("trailing data after JSON value")
+	}
+	return value, nil
+}
+
+// encodeJSON encodes a value without escaping HTML characters
+func encodeJSON(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// load reads and parses the document stored at key, along with its
+// version, 0 if the key is missing
+func (d *Documents) load(key string) (interface{}, int64, bool, error) {
+	value, version, found, err := d.store.GetVersion(key)
+	if err != nil || !found {
+		return nil, 0, false, err
+	}
+	doc, err := decodeJSON(value)
+	if err != nil {
+		return nil, 0, false, ErrNotJSON
+	}
+	return doc, version, true, nil
+}
+
+// Get returns the JSON encoding of the value at path. It reports false when
+// the key or the path doesn't exist.
+func (d *Documents) Get(key, path string) ([]byte, bool, error) {
+	segments, err := parseJSONPath(path)
+	if err != nil {
+		return nil, false, err
+	}
+	doc, _, found, err := d.load(key)
+	if err != nil || !found {
+		return nil, false, err
+	}
+
+	node := doc
+	for _, seg := range segments {
+		var ok bool
+		if node, ok = child(node, seg); !ok {
+			return nil, false, nil
+		}
+	}
+	data, err := encodeJSON(node)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// Set replaces the value at path with a JSON value, creating the document
+// and missing object members along the way. An array index may address an
+// existing element or append one past the end. It returns the document's new
+// version.
+func (d *Documents) Set(key, path string, value []byte) (int64, error) {
+	segments, err := parseJSONPath(path)
+	if err != nil {
+		return 0, err
+	}
+	newValue, err := decodeJSON(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid JSON value: %w", err)
+	}
+
+	mu := d.locks.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	for {
+		// A missing key starts from an empty document
+		doc, current, _, err := d.load(key)
+		if err != nil {
+			return 0, err
+		}
+		if doc, err = setPath(doc, segments, newValue); err != nil {
+			return 0, err
+		}
+
+		data, err := encodeJSON(doc)
+		if err != nil {
+			return 0, err
+		}
+		version, err := d.store.PutIfVersion(key, data, current)
+		if errors.Is(err, ErrVersionMismatch) {
+			continue
+		}
+		return version, err
+	}
+}
+
+// child returns the member or element a segment addresses
+func child(node interface{}, seg pathSegment) (interface{}, bool) {
+	if seg.array {
+		arr, ok := node.([]interface{})
+		if !ok || seg.index >= len(arr) {
+			return nil, false
+		}
+		return arr[seg.index], true
+	}
+	obj, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	value, ok := obj[seg.member]
+	return value, ok
+}
+
+// setPath returns node with the value at segments replaced
+func setPath(node interface{}, segments []pathSegment, value interface{}) (interface{}, error) {
+	if len(segments) == 0 {
+		return value, nil
+	}
+	seg := segments[0]
+
+	if seg.array {
+		arr, ok := node.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot set element [%d] of a non-array", seg.index)
+		}
+		switch {
+		case seg.index < len(arr):
+			elem, err := setPath(arr[seg.index], segments[1:], value)
+			if err != nil {
+				return nil, err
+			}
+			arr[seg.index] = elem
+		case seg.index == len(arr):
+			elem, err := setPath(nil, segments[1:], value)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, elem)
+		default:
+			return nil, fmt.Errorf("array index %d out of range", seg.index)
+		}
+		return arr, nil
+	}
+
+	// Missing intermediate members become objects
+	if node == nil {
+		node = map[string]interface{}{}
+	}
+	obj, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot set member %s of a non-object", seg.member)
+	}
+	member, err := setPath(obj[seg.member], segments[1:], value)
+	if err != nil {
+		return nil, err
+	}
+	obj[seg.member] = member
+	return obj, nil
+}
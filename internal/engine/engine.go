@@ -1,8 +1,14 @@
 package engine
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,8 +18,150 @@ type Config struct {
 	MemTableMaxSize    int64
 	CompactionInterval time.Duration
 	WALSyncInterval    time.Duration
+
+	// Durability picks when the WAL is fsynced: on every write, every
+	// WALSyncInterval, or never (empty means DurabilityInterval)
+	Durability string
+
+	// Compression is the codec values of 256 bytes or more are compressed
+	// with in SST files (empty means CompressionNone). Files written with
+	// another codec stay readable.
+	Compression string
+
+	// BlockCacheSize is how many bytes of recently read SST data blocks are
+	// kept in memory for point lookups (0 disables the cache)
+	BlockCacheSize int64
+
+	// MaxOpenFiles is how many SST files are kept open between reads, the
+	// least recently used being closed past it (0 closes each after its read)
+	MaxOpenFiles int
+
+	// MaxVersions is how many versions of each key are retained for
+	// time-travel reads (1 keeps only the latest)
+	MaxVersions int
+
+	// VersionRetention bounds how long superseded versions survive compaction
+	VersionRetention time.Duration
+
+	// DeleteRetention is how long deleted values are kept so they can be
+	// undeleted (0 disables soft deletes)
+	DeleteRetention time.Duration
+
+	// MinFreeDiskBytes switches the engine to read-only when free space in
+	// DataDir drops below it (0 disables the check)
+	MinFreeDiskBytes  int64
+	DiskCheckInterval time.Duration
+
+	// DiskBudgetBytes is the target on-disk size of SSTs plus WAL. Usage is
+	// reported in stats and warnings are logged as it is approached; with
+	// BudgetCompaction all SSTs are compacted once usage reaches 80%.
+	DiskBudgetBytes  int64
+	BudgetCompaction bool
+
+	// WALMaxSize rotates the memtable once this many WAL bytes were written
+	// for it, bounding recovery time under overwrite-heavy workloads
+	// (0 disables)
+	WALMaxSize int64
+
+	// MemTableMaxAge flushes the memtable this long after its first write,
+	// and MemTableIdleFlush after this long without writes (0 disables each)
+	MemTableMaxAge    time.Duration
+	MemTableIdleFlush time.Duration
+
+	// CompactionStrategy picks how SSTs are grouped for compaction:
+	// CompactionSizeTiered (empty) or CompactionLeveled
+	CompactionStrategy string
+
+	// CompactionFileTrigger is how many files of a tier (size-tiered) or of
+	// level 0 (leveled) start their compaction (0 means 4)
+	CompactionFileTrigger int
+
+	// CompactionLevelBytes is level 1's byte budget under the leveled
+	// strategy, each deeper level's being 10 times the previous one's; a
+	// level past it is merged into the next (0 means 256MB)
+	CompactionLevelBytes int64
+
+	// CompactionWorkers is how many compactions of disjoint files a cycle
+	// may run at once, e.g. one per level (0 means 1)
+	CompactionWorkers int
+
+	// TombstoneRatio prioritizes compacting SSTs whose fraction of
+	// tombstones reaches it (0 disables)
+	TombstoneRatio float64
+
+	// StaleRatio rewrites SSTs whose fraction of versions beyond MaxVersions
+	// reaches it, once retention no longer keeps them (0 disables)
+	StaleRatio float64
+
+	// FlushBytesPerSec and CompactionBytesPerSec cap how fast flushes and
+	// compactions write SST files, leaving disk bandwidth to foreground
+	// reads and writes (0 disables)
+	FlushBytesPerSec      int64
+	CompactionBytesPerSec int64
+
+	// MaxBackgroundJobs bounds how many flushes and compactions run at once
+	// (0 disables). There's never more than one of each, so 1 keeps a flush
+	// and a compaction from competing for the disk.
+	MaxBackgroundJobs int
+
+	// Write throttling: writes are delayed progressively (up to
+	// WriteMaxDelay) once the SST count or the bytes awaiting compaction pass
+	// the slowdown threshold, and stall at the stop threshold (0 disables)
+	WriteSlowdownSSTs  int
+	WriteStopSSTs      int
+	WriteSlowdownBytes int64
+	WriteStopBytes     int64
+	WriteMaxDelay      time.Duration
+
+	// AdaptiveMemTable sizes the memtable to the memory left under
+	// MemoryLimit, from a quarter to four times MemTableMaxSize. Without a
+	// MemoryLimit the cgroup limit is used.
+	AdaptiveMemTable bool
+	MemoryLimit      int64
+
+	// Clock and FS replace the system clock and the operating system's
+	// filesystem, so tests can simulate time and crashes (nil uses the real ones)
+	Clock Clock
+	FS    FS
+
+	// WALTailRetention keeps flushed WAL segments, up to this many bytes, while
+	// tail consumers have unacknowledged entries (0 disables)
+	WALTailRetention int64
+
+	// HintMaxBytes keeps the entries a tail consumer hasn't acknowledged when
+	// WAL segments are released, up to this many bytes per consumer, so a replica
+	// that was briefly down can catch up (0 disables)
+	HintMaxBytes int64
+
+	// WALArchiveDir, when set, receives a copy of every WAL segment before
+	// it's released, so the WAL can be read and tailed past what the engine
+	// keeps, and replayed by restore. WALArchiveHook is then called with each
+	// archived segment, in order, from a background goroutine.
+	WALArchiveDir  string
+	WALArchiveHook func(ArchivedSegment)
+
+	// MaxKeySize and MaxValueSize bound the keys and values writes may carry
+	// (0 means DefaultMaxKeySize and DefaultMaxValueSize); values are held
+	// in memory whole, so the value limit bounds what a single write costs
+	MaxKeySize   int
+	MaxValueSize int64
+
+	// DeferWAL creates the WAL's active segment on the first write rather
+	// than on open, so a data directory that's only read, such as a restored
+	// backup served read-only, isn't written to
+	DeferWAL bool
 }
 
+// WAL durability modes
+const (
+	DurabilityAlways   = "always"   // fsync the WAL before acknowledging each write
+	DurabilityInterval = "interval" // fsync it every WALSyncInterval
+	DurabilityNever    = "never"    // hand writes to the OS and let it flush them
+)
+
+// Durabilities lists the durability modes, strictest first
+var Durabilities = []string{DurabilityAlways, DurabilityInterval, DurabilityNever}
+
 // Engine is the main LSM-tree storage engine
 type Engine struct {
 	mu sync.RWMutex
@@ -30,18 +178,55 @@ type Engine struct {
 	// WAL for durability
 	wal *WAL
 
+	// Acknowledged positions of WAL tail consumers
+	consumers *walConsumers
+
+	// Watchers of appended WAL entries
+	watches *watchHub
+
+	// Truncated entries consumers haven't acknowledged (nil when disabled)
+	hints *hintStore
+
 	// Background compactor
 	compactor *Compactor
 
+	// Slots of the background jobs, flushes and compactions
+	jobs *jobSlots
+
 	// Configuration
 	config Config
 
 	// Flush channel
 	flushCh chan struct{}
-	stopCh  chan struct{}
+
+	// flushing is held while a memtable is flushed, so PauseFlush can wait
+	// for it; flushPaused keeps memtables queued in memory
+	flushing    sync.Mutex
+	flushPaused int32
+	stopCh      chan struct{}
+	flusherDone chan struct{} // closed once the flusher stopped
 
 	// Stats
 	stats *Stats
+
+	// Disk space state (accessed atomically)
+	diskFull    int32
+	diskFree    int64
+	budgetLevel int64
+
+	// Adaptive memtable size (accessed atomically, 0 uses MemTableMaxSize)
+	memTableLimit int64
+
+	// lastVersion is the version of the latest mutation (guarded by mu);
+	// snapshots pins the versions live snapshots can still read
+	lastVersion int64
+	snapshots   *snapshotList
+
+	// Open buckets by name (nil once closed); parent is the engine a bucket
+	// belongs to
+	bucketsMu sync.Mutex
+	buckets   map[string]*Bucket
+	parent    *Engine
 }
 
 // Stats holds engine statistics
@@ -53,48 +238,205 @@ type Stats struct {
 	Flushes       int64
 	Compactions   int64
 	MemTableSize  int64
+	MemTableLimit int64
 	SSTCount      int64
 	WALSize       int64
 	TotalDataSize int64
+	DiskFree      int64
+	DiskFull      bool
+	DiskUsage     int64
+	DiskBudget    int64
+	WriteDelays   int64
+	WriteStalls   int64
+	HintBytes     int64
+	Durability    string
+
+	// Block cache lookups that found and missed their block, blocks evicted
+	// to make room and the bytes it holds
+	BlockCacheHits      int64
+	BlockCacheMisses    int64
+	BlockCacheEvictions int64
+	BlockCacheSize      int64
+
+	// SST files kept open for reads, and files opened since startup
+	OpenFiles int64
+	FileOpens int64
+
+	CompactionPaused bool
+	FlushPaused      bool
+
+	// Bytes of SST files written by flushes and compactions, whether either
+	// is waiting on its rate limit now, the total time they waited, and the
+	// flushes and compactions running
+	BytesFlushed   int64
+	BytesCompacted int64
+	IOThrottled    bool
+	IOThrottleWait time.Duration
+	BackgroundJobs int64
 }
 
 // NewEngine creates a new storage engine
 func NewEngine(config Config) (*Engine, error) {
+	if config.Clock == nil {
+		config.Clock = SystemClock
+	}
+	if config.FS == nil {
+		config.FS = OSFS
+	}
+	if config.Durability == "" {
+		config.Durability = DurabilityInterval
+	}
+	if err := config.applyLimits(); err != nil {
+		return nil, err
+	}
+	valid := false
+	for _, mode := range Durabilities {
+		valid = valid || mode == config.Durability
+	}
+	if !valid {
+		return nil, fmt.Errorf("unknown durability mode %q", config.Durability)
+	}
+	codec, err := codecID(config.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if config.CompactionStrategy == "" {
+		config.CompactionStrategy = CompactionSizeTiered
+	}
+	valid = false
+	for _, strategy := range CompactionStrategies {
+		valid = valid || strategy == config.CompactionStrategy
+	}
+	if !valid {
+		return nil, fmt.Errorf("unknown compaction strategy %q", config.CompactionStrategy)
+	}
+
+	// Records holding keys or values past the limits are corrupt
+	limits := SizeLimits{MaxKeySize: config.MaxKeySize, MaxValueSize: config.MaxValueSize}
+
 	// Create WAL
-	wal, err := NewWAL(config.DataDir)
+	wal, err := openWAL(config.FS, config.DataDir, config.DeferWAL, limits)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create WAL: %w", err)
 	}
+	wal.watches = newWatchHub()
+	if config.WALArchiveDir != "" {
+		if wal.archive, err = openWALArchive(config.FS, config.WALArchiveDir, config.WALArchiveHook, limits); err != nil {
+			return nil, fmt.Errorf("failed to open WAL archive: %w", err)
+		}
+	}
+
+	consumers, err := loadWALConsumers(config.FS, config.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load WAL consumers: %w", err)
+	}
+
+	var hints *hintStore
+	if config.HintMaxBytes > 0 {
+		hints, err = loadHintStore(config.FS, config.DataDir, config.HintMaxBytes, limits)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load hints: %w", err)
+		}
+	}
 
 	// Create SST manager
-	sstManager, err := NewSSTManager(config.DataDir)
+	sstManager, err := openSSTManager(config.FS, config.Clock, config.DataDir, limits)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SST manager: %w", err)
 	}
+	sstManager.codec = codec
+	sstManager.cache = newBlockCache(config.BlockCacheSize)
+	sstManager.files = newFileCache(config.FS, config.MaxOpenFiles)
+	sstManager.flushLimit = newRateLimiter(config.FlushBytesPerSec, config.Clock)
+	sstManager.compactionLimit = newRateLimiter(config.CompactionBytesPerSec, config.Clock)
+	if !config.DeferWAL {
+		// Files from before index blocks are indexed once, rather than
+		// scanned whole on every startup
+		upgraded, err := sstManager.PersistIndexes()
+		if err != nil {
+			return nil, err
+		}
+		if upgraded > 0 {
+			slog.Info("Persisted the index of SST files without one", "files", upgraded)
+		}
+	}
 
 	// Create engine
+	snapshots := newSnapshotList()
 	engine := &Engine{
-		memtable:           NewMemTable(config.MemTableMaxSize),
+		memtable:           newMemTable(config, config.MemTableMaxSize, snapshots),
 		immutableMemtables: make([]*MemTable, 0),
 		sstManager:         sstManager,
 		wal:                wal,
+		consumers:          consumers,
+		watches:            wal.watches,
+		hints:              hints,
 		config:             config,
 		flushCh:            make(chan struct{}, 1),
 		stopCh:             make(chan struct{}),
+		flusherDone:        make(chan struct{}),
 		stats:              &Stats{},
+		snapshots:          snapshots,
+		jobs:               newJobSlots(config.MaxBackgroundJobs),
+		buckets:            make(map[string]*Bucket),
 	}
 
 	// Recover from WAL
 	if err := engine.recover(); err != nil {
 		return nil, fmt.Errorf("recovery failed: %w", err)
 	}
+	engine.memtable.walSegment = wal.Active()
 
 	// Start background workers
-	engine.compactor = NewCompactor(sstManager, config.CompactionInterval)
+	engine.compactor = NewCompactor(sstManager, config)
+	engine.compactor.hasSpace = engine.hasDiskSpace
+	engine.compactor.pinned = snapshots.oldest
+	engine.compactor.jobs = engine.jobs
 	engine.compactor.Start()
 
+	// Tickers are created before their workers start, so a simulated clock
+	// sees them as soon as NewEngine returns
 	go engine.flusher()
-	go engine.walSyncer()
+	switch config.Durability {
+	case DurabilityInterval:
+		go engine.walSyncer(config.Clock.NewTicker(config.WALSyncInterval), wal.Sync)
+	case DurabilityNever:
+		// Buffered entries still reach the OS, which decides when to write
+		// them out
+		go engine.walSyncer(config.Clock.NewTicker(config.WALSyncInterval), wal.Flush)
+	}
+
+	if config.MemTableMaxAge > 0 || config.MemTableIdleFlush > 0 {
+		go engine.ageFlusher(config.Clock.NewTicker(engine.ageCheckInterval()))
+	}
+
+	if config.AdaptiveMemTable {
+		if engine.config.MemoryLimit <= 0 {
+			limit, err := cgroupMemoryLimit()
+			if err != nil {
+				slog.Warn("Adaptive memtable sizing disabled", "err", err)
+			}
+			engine.config.MemoryLimit = limit
+		}
+		if engine.config.MemoryLimit > 0 {
+			engine.adaptMemTableSize()
+			go engine.memoryMonitor(config.Clock.NewTicker(memoryCheckInterval))
+		}
+	}
+
+	if engine.throttlingEnabled() && engine.config.WriteMaxDelay <= 0 {
+		engine.config.WriteMaxDelay = 100 * time.Millisecond
+	}
+
+	if config.MinFreeDiskBytes > 0 || config.DiskBudgetBytes > 0 {
+		if engine.config.DiskCheckInterval <= 0 {
+			engine.config.DiskCheckInterval = 5 * time.Second
+		}
+		if config.MinFreeDiskBytes > 0 {
+			engine.checkDiskSpace()
+		}
+		go engine.diskMonitor(config.Clock.NewTicker(engine.config.DiskCheckInterval))
+	}
 
 	return engine, nil
 }
@@ -106,12 +448,15 @@ func (e *Engine) recover() error {
 		return err
 	}
 
+	// Replay with the original timestamps so retained versions keep their
+	// history, and number new mutations after them
 	for _, entry := range entries {
+		e.observeVersion(entry.Timestamp)
 		switch entry.OpType {
 		case OpTypePut:
-			e.memtable.Put(entry.Key, entry.Value)
+			e.memtable.Apply(&Entry{Key: entry.Key, Value: entry.Value, Timestamp: entry.Timestamp, ExpiresAt: entry.ExpiresAt})
 		case OpTypeDelete:
-			e.memtable.Delete(entry.Key)
+			e.memtable.Apply(&Entry{Key: entry.Key, Value: entry.Value, Timestamp: entry.Timestamp, Deleted: true})
 		}
 	}
 
@@ -120,74 +465,390 @@ func (e *Engine) recover() error {
 
 // Put writes a key-value pair
 func (e *Engine) Put(key string, value []byte) error {
-	// Validate key size (max 100KB)
-	if len(key) > 100*1024 {
-		return fmt.Errorf("key too large: %d bytes (max 100KB)", len(key))
+	_, err := e.PutVersion(key, value)
+	return err
+}
+
+// PutVersion stores a key-value pair and returns the version assigned to it:
+// its write timestamp, which GetVersion, meta and history report as well
+func (e *Engine) PutVersion(key string, value []byte) (int64, error) {
+	return e.put(key, value, 0, nil)
+}
+
+// Expire makes key expire ttl from now, rewriting its current value with the
+// expiry. It returns false if the key does not exist. The rewrite is
+// conditional on the version read, so a concurrent write isn't replaced by
+// the stale value but makes Expire start over.
+func (e *Engine) Expire(key string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, fmt.Errorf("ttl must be positive")
+	}
+	if err := e.checkWritable(); err != nil {
+		return false, err
+	}
+
+	for {
+		value, version, exists, err := e.GetVersion(key)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			return false, nil
+		}
+
+		expiresAt := e.config.Clock.Now().Add(ttl).UnixNano()
+		_, err = e.put(key, value, expiresAt, e.versionCheck(key, version))
+		if errors.Is(err, ErrVersionMismatch) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, nil
 	}
+}
+
+// put writes a new version of key that expires at expiresAt (0 for never).
+// check, when set, runs under e.mu before the write, and its error cancels
+// it.
+func (e *Engine) put(key string, value []byte, expiresAt int64, check func() error) (int64, error) {
+	if err := e.config.checkSize(key, value); err != nil {
+		return 0, err
+	}
+	if err := e.checkWritable(); err != nil {
+		return 0, err
+	}
+	e.throttleWrites()
 
 	// Write to WAL first (durability)
 	walEntry := &WALEntry{
 		OpType:    OpTypePut,
 		Key:       key,
 		Value:     value,
-		Timestamp: time.Now().UnixNano(),
+		ExpiresAt: expiresAt,
 	}
+	// Write to memtable with the WAL entry's timestamp, so replay restores
+	// the same version. Both happen under e.mu, so the entry lands in the WAL
+	// segment of the memtable it is applied to.
+	e.mu.Lock()
+	if check != nil {
+		if err := check(); err != nil {
+			e.mu.Unlock()
+			return 0, err
+		}
+	}
+	walEntry.Timestamp = e.nextVersion()
 	if err := e.wal.Append(walEntry); err != nil {
-		return fmt.Errorf("WAL append failed: %w", err)
+		e.mu.Unlock()
+		return 0, fmt.Errorf("WAL append failed: %w", err)
 	}
-
-	// Write to memtable
-	e.mu.Lock()
-	e.memtable.Put(key, value)
-	needRotate := e.memtable.IsFull()
+	e.memtable.Apply(&Entry{Key: key, Value: value, Timestamp: walEntry.Timestamp, ExpiresAt: expiresAt})
+	needRotate := e.needsRotation()
 	if needRotate {
 		e.rotateMemTable()
 	}
 	e.mu.Unlock()
 
+	if err := e.syncWrite(); err != nil {
+		return 0, err
+	}
+
 	// Update stats outside of engine lock to reduce contention
 	e.stats.mu.Lock()
 	e.stats.Writes++
 	e.stats.mu.Unlock()
 
-	return nil
+	return walEntry.Timestamp, nil
 }
 
 // Get retrieves a value by key
 func (e *Engine) Get(key string) ([]byte, bool, error) {
+	value, _, found, err := e.GetVersion(key)
+	return value, found, err
+}
+
+// GetVersion retrieves a value by key along with its version
+func (e *Engine) GetVersion(key string) ([]byte, int64, bool, error) {
 	e.stats.mu.Lock()
 	e.stats.Reads++
 	e.stats.mu.Unlock()
 
-	// Check active memtable
+	// Check active memtable, then immutable memtables newest first.
+	// A tombstone in a newer layer hides any older value.
 	e.mu.RLock()
-	if value, found := e.memtable.Get(key); found {
-		e.mu.RUnlock()
-		return value, true, nil
+	entry, found := e.memtable.Lookup(key)
+	for i := len(e.immutableMemtables) - 1; !found && i >= 0; i-- {
+		entry, found = e.immutableMemtables[i].Lookup(key)
 	}
+	e.mu.RUnlock()
 
-	// Check immutable memtables
-	for _, mt := range e.immutableMemtables {
-		if value, found := mt.Get(key); found {
-			e.mu.RUnlock()
-			return value, true, nil
+	if !found {
+		// Check SST files
+		var err error
+		if entry, err = e.sstManager.GetEntry(key); err != nil {
+			return nil, 0, false, fmt.Errorf("SST lookup failed: %w", err)
+		}
+	}
+	if entry == nil || entry.gone(e.config.Clock.Now().UnixNano()) {
+		return nil, 0, false, nil
+	}
+	return entry.Value, entry.Timestamp, true, nil
+}
+
+// MultiGet reads several keys at once, returning the values of those that
+// exist. SST files are searched concurrently rather than key by key.
+func (e *Engine) MultiGet(keys []string) (map[string][]byte, error) {
+	e.stats.mu.Lock()
+	e.stats.Reads += int64(len(keys))
+	e.stats.mu.Unlock()
+
+	values := make(map[string][]byte, len(keys))
+	var remaining []string
+	now := e.config.Clock.Now().UnixNano()
+
+	// Resolve what we can from the memtables
+	e.mu.RLock()
+	for _, key := range keys {
+		entry, found := e.memtable.Lookup(key)
+		for i := len(e.immutableMemtables) - 1; !found && i >= 0; i-- {
+			entry, found = e.immutableMemtables[i].Lookup(key)
+		}
+		if !found {
+			remaining = append(remaining, key)
+			continue
+		}
+		if !entry.gone(now) {
+			values[key] = entry.Value
 		}
 	}
 	e.mu.RUnlock()
 
-	// Check SST files
-	value, found, err := e.sstManager.Get(key)
+	if len(remaining) == 0 {
+		return values, nil
+	}
+
+	entries, err := e.sstManager.MultiGet(remaining)
+	if err != nil {
+		return nil, fmt.Errorf("SST lookup failed: %w", err)
+	}
+	for key, entry := range entries {
+		if !entry.gone(now) {
+			values[key] = entry.Value
+		}
+	}
+
+	return values, nil
+}
+
+// GetRange returns up to length bytes of the value stored for key, starting
+// at offset. Values in SST files are read from the requested offset, so large
+// values aren't loaded whole. A range past the end of the value is empty.
+func (e *Engine) GetRange(key string, offset, length int64) ([]byte, bool, error) {
+	e.stats.mu.Lock()
+	e.stats.Reads++
+	e.stats.mu.Unlock()
+
+	e.mu.RLock()
+	entry, found := e.memtable.Lookup(key)
+	for i := len(e.immutableMemtables) - 1; !found && i >= 0; i-- {
+		entry, found = e.immutableMemtables[i].Lookup(key)
+	}
+	e.mu.RUnlock()
+	if found {
+		value, ok, err := entryValue(entry, e.config.Clock.Now().UnixNano())
+		if !ok {
+			return nil, ok, err
+		}
+		start, end := rangeBounds(int64(len(value)), offset, length)
+		return value[start:end], true, nil
+	}
+
+	entry, value, err := e.sstManager.GetRange(key, offset, length)
 	if err != nil {
 		return nil, false, fmt.Errorf("SST lookup failed: %w", err)
 	}
+	if entry == nil || entry.gone(e.config.Clock.Now().UnixNano()) {
+		return nil, false, nil
+	}
+	return value, true, nil
+}
+
+// rangeBounds clamps [offset, offset+length) to a value of size bytes
+func rangeBounds(size, offset, length int64) (int64, int64) {
+	start := min(offset, size)
+	end := size
+	if length < size-start {
+		end = start + length
+	}
+	return start, end
+}
+
+// KeyMeta describes where and how a key is stored
+type KeyMeta struct {
+	Timestamp int64
+	Size      int64
+	Versions  int
+
+	// TTL is the remaining time to live, or -1 if the key never expires
+	TTL time.Duration
+
+	// Layer is "memtable", "immutable" or "sst:<id>"
+	Layer string
+}
+
+// ValueSize returns the size in bytes of the value stored for key
+func (e *Engine) ValueSize(key string) (int64, bool, error) {
+	e.stats.mu.Lock()
+	e.stats.Reads++
+	e.stats.mu.Unlock()
+
+	meta, found, err := e.locate(key)
+	if err != nil || !found {
+		return 0, false, err
+	}
+	return meta.Size, true, nil
+}
+
+// Meta returns metadata for a live key
+func (e *Engine) Meta(key string) (*KeyMeta, bool, error) {
+	meta, found, err := e.locate(key)
+	if err != nil || !found {
+		return nil, false, err
+	}
+
+	versions, err := e.versions(key)
+	if err != nil {
+		return nil, false, err
+	}
+	meta.Versions = len(versions)
+
+	return meta, true, nil
+}
+
+// locate finds the layer holding the newest live version of key without
+// reading values from disk
+func (e *Engine) locate(key string) (*KeyMeta, bool, error) {
+	e.mu.RLock()
+	layer := "memtable"
+	entry, found := e.memtable.Lookup(key)
+	for i := len(e.immutableMemtables) - 1; !found && i >= 0; i-- {
+		layer = "immutable"
+		entry, found = e.immutableMemtables[i].Lookup(key)
+	}
+	e.mu.RUnlock()
+
+	var size int64
+	if found {
+		size = int64(len(entry.Value))
+	} else {
+		sst, sstEntry, valueLen, err := e.sstManager.Locate(key)
+		if err != nil {
+			return nil, false, fmt.Errorf("SST lookup failed: %w", err)
+		}
+		if sstEntry == nil {
+			return nil, false, nil
+		}
+		entry, size = sstEntry, int64(valueLen)
+		layer = fmt.Sprintf("sst:%d", sst.ID)
+	}
+
+	now := e.config.Clock.Now()
+	if entry.gone(now.UnixNano()) {
+		return nil, false, nil
+	}
+
+	return &KeyMeta{
+		Timestamp: entry.Timestamp,
+		Size:      size,
+		TTL:       entryTTL(entry, now),
+		Layer:     layer,
+	}, true, nil
+}
+
+// entryTTL returns the time an entry has left to live at now, or -1 if it
+// never expires
+func entryTTL(entry *Entry, now time.Time) time.Duration {
+	if entry.ExpiresAt == 0 {
+		return -1
+	}
+	return time.Unix(0, entry.ExpiresAt).Sub(now)
+}
+
+// entryValue converts a located entry into a Get result at now
+func entryValue(entry *Entry, now int64) ([]byte, bool, error) {
+	if entry.gone(now) {
+		return nil, false, nil
+	}
+	return entry.Value, true, nil
+}
+
+// GetAsOf retrieves the value a key held at the given time (unix nanoseconds)
+func (e *Engine) GetAsOf(key string, asOf int64) ([]byte, bool, error) {
+	e.stats.mu.Lock()
+	e.stats.Reads++
+	e.stats.mu.Unlock()
+
+	versions, err := e.versions(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, version := range versions {
+		if version.Timestamp <= asOf {
+			if version.gone(asOf) {
+				return nil, false, nil
+			}
+			return version.Value, true, nil
+		}
+	}
+
+	return nil, false, nil
+}
 
-	return value, found, nil
+// History returns up to limit retained versions of a key, newest first,
+// including tombstones. A limit <= 0 returns every retained version.
+func (e *Engine) History(key string, limit int) ([]*Entry, error) {
+	versions, err := e.versions(key)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(versions) > limit {
+		versions = versions[:limit]
+	}
+	return versions, nil
 }
 
-// Delete removes a key
+// versions returns all retained versions of key across every layer, newest first
+func (e *Engine) versions(key string) ([]*Entry, error) {
+	e.mu.RLock()
+	versions := e.memtable.Versions(key)
+	for _, mt := range e.immutableMemtables {
+		versions = append(versions, mt.Versions(key)...)
+	}
+	e.mu.RUnlock()
+
+	sstVersions, err := e.sstManager.GetVersions(key)
+	if err != nil {
+		return nil, fmt.Errorf("SST lookup failed: %w", err)
+	}
+	versions = append(versions, sstVersions...)
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Timestamp > versions[j].Timestamp
+	})
+	return versions, nil
+}
+
+// Delete removes a key, reporting whether it existed. Finding out takes a
+// full lookup, which may touch every SST; DeleteBlind skips it.
 func (e *Engine) Delete(key string) (bool, error) {
+	if err := e.checkWritable(); err != nil {
+		return false, err
+	}
+	e.throttleWrites()
+
 	// Check if key exists
-	_, exists, err := e.Get(key)
+	value, exists, err := e.Get(key)
 	if err != nil {
 		return false, err
 	}
@@ -195,25 +856,61 @@ func (e *Engine) Delete(key string) (bool, error) {
 		return false, nil
 	}
 
+	// Soft deletes keep the old value on the tombstone
+	var retained []byte
+	if e.config.DeleteRetention > 0 {
+		retained = value
+	}
+	return e.writeTombstone(key, retained)
+}
+
+// DeleteBlind writes a tombstone for key whether or not it exists, without
+// looking it up first. With soft deletes enabled the value is still read, so
+// the tombstone can retain it.
+func (e *Engine) DeleteBlind(key string) error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+	e.throttleWrites()
+
+	var retained []byte
+	if e.config.DeleteRetention > 0 {
+		var err error
+		if retained, _, err = e.Get(key); err != nil {
+			return err
+		}
+	}
+	_, err := e.writeTombstone(key, retained)
+	return err
+}
+
+// writeTombstone logs and applies a delete of key keeping retained, returning
+// false if the memtable already held a tombstone for it
+func (e *Engine) writeTombstone(key string, retained []byte) (bool, error) {
 	// Write to WAL
 	walEntry := &WALEntry{
-		OpType:    OpTypeDelete,
-		Key:       key,
-		Timestamp: time.Now().UnixNano(),
+		OpType: OpTypeDelete,
+		Key:    key,
+		Value:  retained,
 	}
+	// Write tombstone to memtable
+	e.mu.Lock()
+	walEntry.Timestamp = e.nextVersion()
 	if err := e.wal.Append(walEntry); err != nil {
+		e.mu.Unlock()
 		return false, fmt.Errorf("WAL append failed: %w", err)
 	}
-
-	// Write tombstone to memtable
-	e.mu.Lock()
-	deleted := e.memtable.Delete(key)
-	needRotate := e.memtable.IsFull()
+	deleted := e.memtable.Delete(key, retained, walEntry.Timestamp)
+	needRotate := e.needsRotation()
 	if needRotate {
 		e.rotateMemTable()
 	}
 	e.mu.Unlock()
 
+	if err := e.syncWrite(); err != nil {
+		return false, err
+	}
+
 	// Update stats outside of engine lock
 	e.stats.mu.Lock()
 	e.stats.Deletes++
@@ -222,73 +919,507 @@ func (e *Engine) Delete(key string) (bool, error) {
 	return deleted, nil
 }
 
+// Undelete restores a key deleted within the delete retention window.
+// It returns false if the key is live or no retained value is available.
+func (e *Engine) Undelete(key string) (bool, error) {
+	if e.config.DeleteRetention <= 0 {
+		return false, fmt.Errorf("soft deletes are disabled")
+	}
+
+	versions, err := e.versions(key)
+	if err != nil {
+		return false, err
+	}
+
+	value, ok := undeleteValue(versions, e.config.Clock.Now().Add(-e.config.DeleteRetention))
+	if !ok {
+		return false, nil
+	}
+
+	if err := e.Put(key, value); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// undeleteValue returns the value to restore from a key's versions (newest
+// first), if its newest version is a tombstone written after cutoff
+func undeleteValue(versions []*Entry, cutoff time.Time) ([]byte, bool) {
+	if len(versions) == 0 || !versions[0].Deleted {
+		return nil, false
+	}
+
+	tombstone := versions[0]
+	if tombstone.Timestamp < cutoff.UnixNano() {
+		return nil, false
+	}
+
+	value := tombstone.Value
+	if value == nil && len(versions) > 1 && !versions[1].Deleted {
+		// Tombstones written before soft deletes were enabled carry no value;
+		// fall back to a retained older version if there is one
+		value = versions[1].Value
+	}
+	return value, value != nil
+}
+
 // Keys returns all keys
 func (e *Engine) Keys() ([]string, error) {
-	keySet := make(map[string]bool)
+	return e.KeysMatching(context.Background(), "", ScanOptions{})
+}
 
-	// Get from memtable
-	e.mu.RLock()
-	for _, key := range e.memtable.Keys() {
-		keySet[key] = true
+// KeysMatching returns the live keys matching a glob pattern (see
+// matchGlob), in key order, merged across the memtables and SSTs. An empty
+// pattern matches every key. Only the range the pattern's literal prefix
+// covers is read, so "user:*" doesn't walk the whole keyspace.
+func (e *Engine) KeysMatching(ctx context.Context, pattern string, opts ScanOptions) ([]string, error) {
+	if err := checkGlob(pattern); err != nil {
+		return nil, err
 	}
 
-	// Get from immutable memtables
-	for _, mt := range e.immutableMemtables {
-		for _, key := range mt.Keys() {
-			keySet[key] = true
-		}
+	prefix := globPrefix(pattern)
+	iterOpts := IteratorOptions{Start: prefix, End: prefixUpperBound(prefix)}
+	if opts.After != "" && opts.After >= iterOpts.Start {
+		iterOpts.Start = opts.After + "\x00" // the smallest key after it
 	}
-	e.mu.RUnlock()
-
-	// Get from SST files using sparse index (much faster)
-	sstKeys, err := e.sstManager.GetAllKeys()
+	it, err := e.NewIterator(iterOpts)
 	if err != nil {
 		return nil, err
 	}
-	for _, key := range sstKeys {
-		keySet[key] = true
+	defer it.Close()
+
+	var keys []string
+	i := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if i%cancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		i++
+		if pattern != "" {
+			if !matchGlob(pattern, it.Key()) {
+				continue
+			}
+		}
+		keys = append(keys, it.Key())
+		if opts.Limit > 0 && len(keys) == opts.Limit {
+			break
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
 	}
+	return keys, nil
+}
 
-	keys := make([]string, 0, len(keySet))
-	for key := range keySet {
-		keys = append(keys, key)
+// globPrefix returns the literal leading part of a glob pattern, which
+// every key it matches starts with
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		return pattern[:i]
 	}
+	return pattern
+}
 
-	return keys, nil
+// checkGlob returns an error if pattern isn't a well-formed glob pattern
+// (see matchGlob): a class left open or a "\" escaping nothing
+func checkGlob(pattern string) error {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if i++; i == len(pattern) {
+				return fmt.Errorf("invalid pattern: %s", pattern)
+			}
+		case '[':
+			end := classEnd(pattern, i)
+			if end < 0 {
+				return fmt.Errorf("invalid pattern: %s", pattern)
+			}
+			i = end
+		}
+	}
+	return nil
+}
+
+// matchGlob reports whether key matches a well-formed glob pattern: "*"
+// matches any run of bytes, "?" any single byte, "[...]" a byte in a set of
+// bytes and ranges ("[^...]" one outside it), and "\" matches the byte after
+// it literally. Unlike path.Match, "*" and "?" match "/" too, as keys may
+// hold any byte.
+func matchGlob(pattern, key string) bool {
+	p, k := 0, 0
+	// Where the last "*" is in the pattern and the key, to backtrack to
+	// when the rest doesn't match
+	star, starKey := -1, 0
+	for p < len(pattern) || k < len(key) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				star, starKey = p, k
+				p++
+				continue
+			}
+			if k < len(key) {
+				if width, ok := matchByte(pattern, p, key[k]); ok {
+					p += width
+					k++
+					continue
+				}
+			}
+		}
+		if star < 0 || starKey == len(key) {
+			return false
+		}
+		// Let the "*" take one more byte and match the rest again
+		starKey++
+		p, k = star+1, starKey
+	}
+	return true
+}
+
+// matchByte matches b against the single-byte element of pattern at p (a
+// literal, "?", an escape or a class), returning the element's width
+func matchByte(pattern string, p int, b byte) (int, bool) {
+	switch pattern[p] {
+	case '?':
+		return 1, true
+	case '\\':
+		return 2, pattern[p+1] == b
+	case '[':
+		end := classEnd(pattern, p)
+		i, negated := p+1, false
+		if pattern[i] == '^' {
+			i, negated = i+1, true
+		}
+		matched := false
+		for i < end {
+			lo := pattern[i]
+			if lo == '\\' {
+				i++
+				lo = pattern[i]
+			}
+			i++
+			hi := lo
+			if i+1 < end && pattern[i] == '-' {
+				hi = pattern[i+1]
+				if hi == '\\' {
+					i++
+					hi = pattern[i+1]
+				}
+				i += 2
+			}
+			if lo <= b && b <= hi {
+				matched = true
+			}
+		}
+		return end - p + 1, matched != negated
+	}
+	return 1, pattern[p] == b
+}
+
+// classEnd returns the index of the "]" closing the class opened at
+// pattern[start], or -1 if it isn't closed. A "]" right after "[" or "[^"
+// is part of the class.
+func classEnd(pattern string, start int) int {
+	i := start + 1
+	if i < len(pattern) && pattern[i] == '^' {
+		i++
+	}
+	for first := true; i < len(pattern); i, first = i+1, false {
+		switch {
+		case pattern[i] == '\\':
+			i++
+		case pattern[i] == ']' && !first:
+			return i
+		}
+	}
+	return -1
+}
+
+// PrefixScan returns the live key/value pairs with keys starting with
+// prefix, in key order, merged across all layers
+func (e *Engine) PrefixScan(prefix string) ([]KeyValue, error) {
+	return e.PrefixScanWithOptions(context.Background(), prefix, ScanOptions{})
 }
 
-// PrefixScan returns all values with keys starting with prefix
-func (e *Engine) PrefixScan(prefix string) ([][]byte, error) {
-	valueMap := make(map[string][]byte)
+// KeyValue is a key with its value
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// ScanOptions controls paging of prefix scans
+type ScanOptions struct {
+	// Limit caps the number of results (0 means unlimited)
+	Limit int
+
+	// After skips keys up to and including this key, as a continuation token
+	After string
+}
+
+// PrefixScanWithOptions returns live key/value pairs with keys starting with
+// prefix, in key order, merged across all layers with newest-wins semantics.
+// It streams layers from the key past opts.After (see RangeScan), so a page
+// reads about as much as it returns rather than the whole prefix.
+func (e *Engine) PrefixScanWithOptions(ctx context.Context, prefix string, opts ScanOptions) ([]KeyValue, error) {
+	start, end := prefix, prefixUpperBound(prefix)
+	if opts.After != "" && opts.After >= start {
+		// The smallest key past After
+		start = opts.After + "\x00"
+	}
+	if end != "" && start >= end {
+		return nil, ctx.Err()
+	}
+	return e.RangeScan(ctx, start, end, opts.Limit)
+}
+
+// CountPrefix returns the number of live keys starting with prefix
+func (e *Engine) CountPrefix(ctx context.Context, prefix string) (int64, error) {
+	return e.CountRange(ctx, prefix, prefixUpperBound(prefix))
+}
 
-	// Get from memtable
+// CountRange returns the number of live keys in [start, end). An empty end
+// means no upper bound.
+func (e *Engine) CountRange(ctx context.Context, start, end string) (int64, error) {
+	// Fast path: when the range lies in a single tombstone-free SST that it
+	// fully covers and no memtable holds keys in it, the file's key count is exact
+	if count, ok := e.countFromStats(start, end); ok {
+		return count, nil
+	}
+
+	newest, err := e.mergedRange(ctx, start, end)
+	if err != nil {
+		return 0, err
+	}
+
+	now := e.config.Clock.Now().UnixNano()
+	var count int64
+	for _, entry := range newest {
+		if !entry.gone(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// countFromStats answers a count from SST metadata alone when that is exact
+func (e *Engine) countFromStats(start, end string) (int64, bool) {
 	e.mu.RLock()
-	for _, value := range e.memtable.PrefixScan(prefix) {
-		// Store with a unique identifier
-		valueMap[string(value)] = value
+	inMemory := e.memtable.HasRange(start, end)
+	for _, mt := range e.immutableMemtables {
+		inMemory = inMemory || mt.HasRange(start, end)
+	}
+	e.mu.RUnlock()
+	if inMemory {
+		return 0, false
 	}
 
-	// Get from immutable memtables
+	var overlapping []*SSTable
+	for _, sst := range e.sstManager.GetAllSSTables() {
+		if sst.Overlaps(start, end) {
+			overlapping = append(overlapping, sst)
+		}
+	}
+
+	switch len(overlapping) {
+	case 0:
+		return 0, true
+	case 1:
+		sst := overlapping[0]
+		covered := sst.MinKey >= start && (end == "" || sst.MaxKey < end)
+		if covered && sst.TombstoneCount == 0 && sst.ExpiringCount == 0 {
+			return sst.KeyCount, true
+		}
+	}
+	return 0, false
+}
+
+// mergedRange returns the newest entry (tombstones included) for every key in
+// [start, end) across all layers. The SST scan stops early if ctx is done.
+func (e *Engine) mergedRange(ctx context.Context, start, end string) (map[string]*Entry, error) {
+	newest := make(map[string]*Entry)
+	merge := func(entry *Entry) {
+		if existing, ok := newest[entry.Key]; !ok || entry.Timestamp > existing.Timestamp {
+			newest[entry.Key] = entry
+		}
+	}
+
+	// Memtables are read before SSTs so that one flushed in between is seen
+	// twice rather than not at all
+	e.mu.RLock()
 	for _, mt := range e.immutableMemtables {
-		for _, value := range mt.PrefixScan(prefix) {
-			valueMap[string(value)] = value
+		for _, entry := range mt.RangeEntries(start, end) {
+			merge(entry)
 		}
 	}
+	for _, entry := range e.memtable.RangeEntries(start, end) {
+		merge(entry)
+	}
+	e.mu.RUnlock()
+
+	sstEntries, err := e.sstManager.RangeEntries(ctx, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("SST scan failed: %w", err)
+	}
+	for _, entry := range sstEntries {
+		merge(entry)
+	}
+
+	return newest, nil
+}
+
+// rangeCursor is one layer's position in a merged range scan: the entry it
+// holds next, and how to read the one after it (nil past the range)
+type rangeCursor struct {
+	entry *Entry
+	next  func() (*Entry, error)
+}
+
+// RangeScan returns up to limit live key/value pairs with keys in
+// [start, end), in key order, merged across all layers with newest-wins
+// semantics. An empty end means no upper bound and a limit of 0 means
+// unlimited. Layers are streamed, so a small limit reads only as far as it
+// needs to.
+func (e *Engine) RangeScan(ctx context.Context, start, end string, limit int) ([]KeyValue, error) {
+	// Memtables are taken before SSTs so that one flushed in between is seen
+	// twice rather than not at all
+	e.mu.RLock()
+	memtables := make([]*MemTable, 0, len(e.immutableMemtables)+1)
+	memtables = append(memtables, e.memtable)
+	for i := len(e.immutableMemtables) - 1; i >= 0; i-- {
+		memtables = append(memtables, e.immutableMemtables[i])
+	}
 	e.mu.RUnlock()
 
-	// Convert to slice
-	values := make([][]byte, 0, len(valueMap))
-	for _, value := range valueMap {
-		values = append(values, value)
+	// Cursors are ordered newest layer first, which breaks timestamp ties
+	var cursors []*rangeCursor
+	for _, mt := range memtables {
+		it := mt.Iterator()
+		it.Seek(start)
+		cursors = append(cursors, &rangeCursor{next: func() (*Entry, error) {
+			if !it.Valid() || (end != "" && it.Key() >= end) {
+				return nil, nil
+			}
+			entry := it.Entry()
+			it.Next()
+			return entry, nil
+		}})
+	}
+	sstables := e.sstManager.acquire()
+	defer e.sstManager.release(sstables)
+	for _, sst := range sstables {
+		if !sst.Overlaps(start, end) {
+			continue
+		}
+		it, err := e.sstManager.newSSTIterator(sst, start, end)
+		if err != nil {
+			return nil, fmt.Errorf("SST scan failed: %w", err)
+		}
+		defer it.close()
+		cursors = append(cursors, &rangeCursor{next: it.next})
+	}
+
+	for _, c := range cursors {
+		entry, err := c.next()
+		if err != nil {
+			return nil, fmt.Errorf("SST scan failed: %w", err)
+		}
+		c.entry = entry
 	}
 
-	return values, nil
+	now := e.config.Clock.Now().UnixNano()
+	var result []KeyValue
+	for n := 0; limit <= 0 || len(result) < limit; n++ {
+		if n%cancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		// The smallest key across layers, and its newest entry
+		var newest *Entry
+		for _, c := range cursors {
+			if c.entry == nil {
+				continue
+			}
+			if newest == nil || c.entry.Key < newest.Key ||
+				(c.entry.Key == newest.Key && c.entry.Timestamp > newest.Timestamp) {
+				newest = c.entry
+			}
+		}
+		if newest == nil {
+			break
+		}
+
+		key := newest.Key
+		for _, c := range cursors {
+			if c.entry == nil || c.entry.Key != key {
+				continue
+			}
+			entry, err := c.next()
+			if err != nil {
+				return nil, fmt.Errorf("SST scan failed: %w", err)
+			}
+			c.entry = entry
+		}
+
+		if !newest.gone(now) {
+			result = append(result, KeyValue{Key: key, Value: newest.Value})
+		}
+	}
+
+	return result, nil
+}
+
+// needsRotation reports whether the active memtable should be rotated,
+// either because it is full or its share of the WAL grew too large
+func (e *Engine) needsRotation() bool {
+	if e.memtable.IsFull() {
+		return true
+	}
+	return e.config.WALMaxSize > 0 && e.wal.ActiveSize() >= e.config.WALMaxSize
+}
+
+// newMemTable creates an empty memtable following config, keeping the
+// versions snapshots pins (which may be nil)
+func newMemTable(config Config, maxSize int64, snapshots *snapshotList) *MemTable {
+	mt := NewMemTable(maxSize, config.MaxVersions)
+	mt.clock = config.Clock
+	mt.snapshots = snapshots
+	return mt
 }
 
-// rotateMemTable moves the current memtable to immutable list
+// nextVersion returns the version of a new mutation: its write time, moved
+// past the previous mutation's so versions strictly increase and number
+// mutations like sequence numbers. Must hold e.mu.
+func (e *Engine) nextVersion() int64 {
+	version := e.config.Clock.Now().UnixNano()
+	if version <= e.lastVersion {
+		version = e.lastVersion + 1
+	}
+	e.lastVersion = version
+	return version
+}
+
+// observeVersion records a mutation applied with an existing version, so
+// later ones are numbered after it. Must hold e.mu or have sole access.
+func (e *Engine) observeVersion(version int64) {
+	if version > e.lastVersion {
+		e.lastVersion = version
+	}
+}
+
+// rotateMemTable moves the current memtable to immutable list, starting a
+// new WAL segment for its successor. Must hold e.mu.
 func (e *Engine) rotateMemTable() {
+	if _, err := e.wal.Rotate(); err != nil {
+		// The new memtable shares the current segment, which is released
+		// once a later rotation succeeds and that memtable is flushed
+		slog.Error("WAL rotation failed", "err", err)
+	}
 	e.immutableMemtables = append(e.immutableMemtables, e.memtable)
-	e.memtable = NewMemTable(e.config.MemTableMaxSize)
+	e.memtable = newMemTable(e.config, e.memTableSize(), e.snapshots)
+	e.memtable.walSegment = e.wal.Active()
 
 	// Trigger flush
 	select {
@@ -299,42 +1430,62 @@ func (e *Engine) rotateMemTable() {
 
 // flusher handles background flushing of immutable memtables
 func (e *Engine) flusher() {
+	defer close(e.flusherDone)
 	for {
 		select {
 		case <-e.flushCh:
-			e.flush()
+			// Drain every queued memtable, not just the one signalled
+			for e.flush() {
+			}
 		case <-e.stopCh:
 			return
 		}
 	}
 }
 
-// flush writes immutable memtables to SST files
-func (e *Engine) flush() {
+// flush writes the oldest immutable memtable to an SST file. It reports
+// whether more memtables are waiting to be flushed.
+func (e *Engine) flush() bool {
+	e.flushing.Lock()
+	defer e.flushing.Unlock()
+	if e.FlushPaused() {
+		return false
+	}
+
 	e.mu.Lock()
 	if len(e.immutableMemtables) == 0 {
 		e.mu.Unlock()
-		return
+		return false
 	}
 
-	// Take the oldest immutable memtable
+	// Take the oldest immutable memtable. It stays visible to readers until
+	// its SST is in place, and is retried on the next flush if writing fails.
 	mt := e.immutableMemtables[0]
-	e.immutableMemtables = e.immutableMemtables[1:]
-	shouldTruncateWAL := len(e.immutableMemtables) == 0
 	e.mu.Unlock()
 
 	// Flush to SST
 	entries := mt.Entries()
-	if err := e.sstManager.Flush(entries); err != nil {
-		fmt.Printf("Flush failed: %v\n", err)
-		return
+	e.jobs.acquire()
+	err := e.sstManager.Flush(entries)
+	e.jobs.release()
+	if err != nil {
+		slog.Error("Flush failed", "err", err)
+		if e.config.MinFreeDiskBytes > 0 {
+			e.checkDiskSpace()
+		}
+		return false
 	}
 
-	// Only truncate WAL when all immutable memtables have been flushed
-	// This prevents data loss if server crashes while flushing
-	if shouldTruncateWAL {
-		if err := e.wal.Truncate(); err != nil {
-			fmt.Printf("WAL truncate failed: %v\n", err)
+	e.mu.Lock()
+	e.immutableMemtables = e.immutableMemtables[1:]
+	more := len(e.immutableMemtables) > 0
+	e.mu.Unlock()
+
+	// The memtable's writes are in an SST now, so its WAL segments (and any
+	// older ones held back for consumers) can go
+	if !e.holdWAL() {
+		if err := e.releaseWAL(mt.walSegment); err != nil {
+			slog.Error("WAL release failed", "err", err)
 		}
 	}
 
@@ -342,18 +1493,81 @@ func (e *Engine) flush() {
 	e.stats.Flushes++
 	e.stats.SSTCount = int64(len(e.sstManager.GetAllSSTables()))
 	e.stats.mu.Unlock()
+
+	return more
 }
 
-// walSyncer periodically syncs WAL to disk
-func (e *Engine) walSyncer() {
-	ticker := time.NewTicker(e.config.WALSyncInterval)
+// ageFlusher rotates the memtable once it gets too old or sits idle, so
+// quiet periods still reach SSTs and let their WAL segments be released
+func (e *Engine) ageFlusher(ticker Ticker) {
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
-			if err := e.wal.Sync(); err != nil {
-				fmt.Printf("WAL sync failed: %v\n", err)
+		case <-ticker.C():
+			e.mu.Lock()
+			if e.memtableExpired() {
+				e.rotateMemTable()
+			}
+			e.mu.Unlock()
+		case <-e.stopCh:
+			return
+		}
+	}
+}
+
+// ageCheckInterval is how often the age flusher checks the memtable: a
+// quarter of the shorter of its maximum age and idle time
+func (e *Engine) ageCheckInterval() time.Duration {
+	interval := e.config.MemTableMaxAge
+	if e.config.MemTableIdleFlush > 0 && (interval == 0 || e.config.MemTableIdleFlush < interval) {
+		interval = e.config.MemTableIdleFlush
+	}
+	return interval / 4
+}
+
+// memtableExpired reports whether the active memtable reached its maximum
+// age or idle time. Must hold e.mu.
+func (e *Engine) memtableExpired() bool {
+	first, last := e.memtable.WriteTimes()
+	if first.IsZero() {
+		return false
+	}
+	if e.config.MemTableMaxAge > 0 && e.config.Clock.Now().Sub(first) >= e.config.MemTableMaxAge {
+		return true
+	}
+	return e.config.MemTableIdleFlush > 0 && e.config.Clock.Now().Sub(last) >= e.config.MemTableIdleFlush
+}
+
+// syncWrite fsyncs the WAL after a write when the durability mode is
+// DurabilityAlways. It runs after e.mu is released, so concurrent writers
+// share the fsync; a rotation in between already synced the older segment.
+func (e *Engine) syncWrite() error {
+	if e.config.Durability != DurabilityAlways {
+		return nil
+	}
+	if err := e.wal.Sync(); err != nil {
+		return fmt.Errorf("WAL sync failed: %w", err)
+	}
+	return nil
+}
+
+// Sync fsyncs the WAL, making every write acknowledged so far durable
+// whatever the durability mode
+func (e *Engine) Sync() error {
+	return e.wal.Sync()
+}
+
+// walSyncer periodically syncs WAL to disk, or with DurabilityNever only
+// flushes it to the OS
+func (e *Engine) walSyncer(ticker Ticker, sync func() error) {
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if err := sync(); err != nil {
+				slog.Error("WAL sync failed", "err", err)
 			}
 		case <-e.stopCh:
 			return
@@ -369,6 +1583,8 @@ func (e *Engine) GetStats() Stats {
 	deletes := e.stats.Deletes
 	flushes := e.stats.Flushes
 	compactions := e.stats.Compactions
+	writeDelays := e.stats.WriteDelays
+	writeStalls := e.stats.WriteStalls
 	e.stats.mu.RUnlock()
 
 	// Update dynamic stats
@@ -378,43 +1594,129 @@ func (e *Engine) GetStats() Stats {
 	e.mu.RUnlock()
 
 	walSize, _ := e.wal.Size()
+	cacheHits, cacheMisses, cacheEvictions, cacheSize := e.sstManager.cache.stats()
+	openFiles, fileOpens := e.sstManager.files.stats()
+	flushThrottled, flushWait := e.sstManager.flushLimit.stats()
+	compactionThrottled, compactionWait := e.sstManager.compactionLimit.stats()
+
+	var sstBytes int64
+	for _, sst := range e.sstManager.GetAllSSTables() {
+		sstBytes += sst.Size
+	}
 
 	return Stats{
+		DiskFree:      atomic.LoadInt64(&e.diskFree),
+		DiskFull:      atomic.LoadInt32(&e.diskFull) == 1,
+		DiskUsage:     sstBytes + walSize,
+		DiskBudget:    e.config.DiskBudgetBytes,
 		Writes:        writes,
 		Reads:         reads,
 		Deletes:       deletes,
 		Flushes:       flushes,
 		Compactions:   compactions,
+		WriteDelays:   writeDelays,
+		WriteStalls:   writeStalls,
 		MemTableSize:  memTableSize,
+		MemTableLimit: e.memTableSize(),
 		SSTCount:      sstCount,
 		WALSize:       walSize,
 		TotalDataSize: 0,
+		HintBytes:     e.hintBytes(),
+
+		CompactionPaused: e.compactor.Paused(),
+		FlushPaused:      e.FlushPaused(),
+		Durability:       e.config.Durability,
+
+		BlockCacheHits:      cacheHits,
+		BlockCacheMisses:    cacheMisses,
+		BlockCacheEvictions: cacheEvictions,
+		BlockCacheSize:      cacheSize,
+
+		OpenFiles: int64(openFiles),
+		FileOpens: fileOpens,
+
+		BytesFlushed:   atomic.LoadInt64(&e.sstManager.flushed),
+		BytesCompacted: atomic.LoadInt64(&e.sstManager.compacted),
+		IOThrottled:    flushThrottled || compactionThrottled,
+		IOThrottleWait: flushWait + compactionWait,
+		BackgroundJobs: e.jobs.count(),
 	}
 }
 
+// SSTableStats describes a single SST file
+type SSTableStats struct {
+	ID         int64
+	Size       int64
+	EntryCount int64
+	MinKey     string
+	MaxKey     string
+	Age        time.Duration
+	Reads      int64
+	Hits       int64
+}
+
+// GetSSTableStats returns statistics for each SST file, newest first
+func (e *Engine) GetSSTableStats() []SSTableStats {
+	sstables := e.sstManager.GetAllSSTables()
+	stats := make([]SSTableStats, len(sstables))
+	for i, sst := range sstables {
+		stats[i] = SSTableStats{
+			ID:         sst.ID,
+			Size:       sst.Size,
+			EntryCount: sst.EntryCount,
+			MinKey:     sst.MinKey,
+			MaxKey:     sst.MaxKey,
+			Age:        e.config.Clock.Now().Sub(sst.CreatedAt),
+			Reads:      sst.Reads(),
+			Hits:       sst.Hits(),
+		}
+	}
+	return stats
+}
+
 // Close shuts down the engine gracefully
 func (e *Engine) Close() error {
+	e.closeBuckets()
 	close(e.stopCh)
 
-	// Stop compactor
+	// Wait for the flusher and compactor, so the final flush doesn't write
+	// a memtable the flusher is writing too, and no file is left half
+	// written for the next open to clean up under a flush still going
+	<-e.flusherDone
 	e.compactor.Stop()
 
-	// Flush remaining memtables
+	// Flush remaining memtables, unless a deferred WAL was never written to:
+	// they then hold nothing the WAL doesn't, and the data directory is left
+	// as it was
 	e.mu.Lock()
-	for _, mt := range e.immutableMemtables {
-		entries := mt.Entries()
+	if !e.config.DeferWAL || e.wal.Opened() {
+		for _, mt := range e.immutableMemtables {
+			entries := mt.Entries()
+			if err := e.sstManager.Flush(entries); err != nil {
+				slog.Error("Final flush failed", "err", err)
+			}
+		}
+
+		// Flush active memtable
+		entries := e.memtable.Entries()
 		if err := e.sstManager.Flush(entries); err != nil {
-			fmt.Printf("Final flush failed: %v\n", err)
+			slog.Error("Final flush failed", "err", err)
 		}
 	}
+	e.mu.Unlock()
 
-	// Flush active memtable
-	entries := e.memtable.Entries()
-	if err := e.sstManager.Flush(entries); err != nil {
-		fmt.Printf("Final flush failed: %v\n", err)
+	if e.hints != nil {
+		if err := e.hints.close(); err != nil {
+			slog.Error("Hint spill failed", "err", err)
+		}
 	}
-	e.mu.Unlock()
+
+	e.sstManager.Close()
 
 	// Close WAL
-	return e.wal.Close()
+	err := e.wal.Close()
+	if e.wal.archive != nil {
+		e.wal.archive.close()
+	}
+	return err
 }
@@ -0,0 +1,133 @@
+package engine_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"escabelo/internal/engine"
+	"escabelo/internal/engine/enginetest"
+)
+
+// waitFlushed waits until the engine flushed every full memtable
+func waitFlushed(tb testing.TB, eng *engine.Engine) {
+	tb.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for len(eng.DebugState().PendingFlushes) > 0 {
+		if time.Now().After(deadline) {
+			tb.Fatal("memtables not flushed after 10s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestInvariants runs random writes and deletes, then checks that every
+// acknowledged write reads back and no deleted key shows up, as written,
+// once flushed, after a full compaction and after a restart
+func TestInvariants(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			config := enginetest.Config(t)
+			eng := enginetest.NewEngine(t, config)
+			model := enginetest.NewModel()
+
+			workload := enginetest.Workload{
+				Keys:        3000,
+				Prefix:      "key:",
+				Operations:  6000,
+				ValueSize:   100,
+				DeleteRatio: 0.2,
+				Seed:        seed,
+			}
+			enginetest.Run(t, eng, model, workload.Generate())
+			enginetest.CheckInvariants(t, eng, model)
+
+			waitFlushed(t, eng)
+			if eng.GetStats().SSTCount == 0 {
+				t.Fatal("workload didn't flush any memtable")
+			}
+			enginetest.CheckInvariants(t, eng, model)
+
+			if _, err := eng.CompactNow(true); err != nil {
+				t.Fatalf("compact: %v", err)
+			}
+			enginetest.CheckInvariants(t, eng, model)
+
+			eng = enginetest.Reopen(t, eng, config)
+			enginetest.CheckInvariants(t, eng, model)
+		})
+	}
+}
+
+// TestReopenWhileFlushing closes the engine while memtables are still
+// being flushed, so the final flush and the flusher would overlap unless
+// Close waits for it, and checks that every write survives the restarts
+func TestReopenWhileFlushing(t *testing.T) {
+	config := enginetest.Config(t)
+	eng := enginetest.NewEngine(t, config)
+	model := enginetest.NewModel()
+
+	for round := int64(1); round <= 10; round++ {
+		workload := enginetest.Workload{
+			Keys:        2000,
+			Prefix:      fmt.Sprintf("round%02d:", round),
+			Operations:  2000,
+			ValueSize:   100,
+			DeleteRatio: 0.1,
+			Seed:        round,
+		}
+		enginetest.Run(t, eng, model, workload.Generate())
+		eng = enginetest.Reopen(t, eng, config)
+		enginetest.CheckInvariants(t, eng, model)
+	}
+}
+
+// TestKeysMatching checks glob patterns against keys holding "/", glob
+// characters and other bytes, on the engine and the MemStore alike
+func TestKeysMatching(t *testing.T) {
+	keys := []string{"a", "a*b", "a/b", "a/b/c", "a?", "a[1]", "a\\b", "ab", "b-2", "b]", "b^"}
+	cases := []struct {
+		pattern string
+		want    []string
+	}{
+		{"a*", []string{"a", "a*b", "a/b", "a/b/c", "a?", "a[1]", "a\\b", "ab"}},
+		{"a?b", []string{"a*b", "a/b", "a\\b"}},
+		{"a\\*b", []string{"a*b"}},
+		{"a\\?", []string{"a?"}},
+		{"a\\\\b", []string{"a\\b"}},
+		{"a\\[1\\]", []string{"a[1]"}},
+		{"*/c", []string{"a/b/c"}},
+		{"[^a]*", []string{"b-2", "b]", "b^"}},
+		{"b[]^]", []string{"b]", "b^"}},
+		{"b[0-9\\-]*", []string{"b-2"}},
+		{"[a-b][^/]", []string{"a?", "ab", "b]", "b^"}},
+	}
+
+	stores := map[string]engine.Store{
+		"engine":   enginetest.NewEngine(t, enginetest.Config(t)),
+		"memstore": enginetest.NewMemStore(t),
+	}
+	for name, store := range stores {
+		for _, key := range keys {
+			if err := store.Put(key, []byte("v")); err != nil {
+				t.Fatalf("%s: put %q: %v", name, key, err)
+			}
+		}
+		for _, c := range cases {
+			got, err := store.KeysMatching(context.Background(), c.pattern, engine.ScanOptions{})
+			if err != nil {
+				t.Fatalf("%s: keys %q: %v", name, c.pattern, err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%s: keys %q = %q, want %q", name, c.pattern, got, c.want)
+			}
+		}
+		for _, pattern := range []string{"a[", "a[]", "a[^]", "a\\"} {
+			if _, err := store.KeysMatching(context.Background(), pattern, engine.ScanOptions{}); err == nil {
+				t.Errorf("%s: keys %q: no error for a malformed pattern", name, pattern)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package enginetest
+
+import (
+	"escabelo/internal/engine"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// fixtureEpoch is the timestamp of the first fixture entry, so fixtures are
+// byte-for-byte reproducible
+const fixtureEpoch = int64(1_700_000_000_000_000_000)
+
+// FixtureEntries returns n deterministic entries for seed: keys
+// "fixture-<n>", some overwritten by later versions and some deleted, with
+// strictly increasing timestamps
+func FixtureEntries(n int, seed int64) []*engine.Entry {
+	rng := rand.New(rand.NewSource(seed))
+	keys := max(n/2, 1)
+
+	entries := make([]*engine.Entry, n)
+	for i := range entries {
+		entry := &engine.Entry{
+			Key:       fmt.Sprintf("fixture-%06d", rng.Intn(keys)),
+			Timestamp: fixtureEpoch + int64(i),
+		}
+		if rng.Intn(5) == 0 {
+			entry.Deleted = true
+		} else {
+			entry.Value = []byte(fmt.Sprintf("value-%d-%d", seed, i))
+		}
+		entries[i] = entry
+	}
+	return entries
+}
+
+// WriteSST writes entries as a new SST file in dir
+func WriteSST(tb testing.TB, dir string, entries []*engine.Entry) {
+	tb.Helper()
+	sm, err := engine.NewSSTManager(dir)
+	if err != nil {
+		tb.Fatalf("open SSTs in %s: %v", dir, err)
+	}
+	if err := sm.Flush(entries); err != nil {
+		tb.Fatalf("write SST fixture: %v", err)
+	}
+}
+
+// WriteWAL appends entries to the WAL in dir, as if written and never flushed
+func WriteWAL(tb testing.TB, dir string, entries []*engine.Entry) {
+	tb.Helper()
+	wal, err := engine.NewWAL(dir)
+	if err != nil {
+		tb.Fatalf("open WAL in %s: %v", dir, err)
+	}
+	defer wal.Close()
+
+	for _, entry := range entries {
+		walEntry := &engine.WALEntry{
+			OpType:    engine.OpTypePut,
+			Key:       entry.Key,
+			Value:     entry.Value,
+			Timestamp: entry.Timestamp,
+		}
+		if entry.Deleted {
+			walEntry.OpType = engine.OpTypeDelete
+		}
+		if err := wal.Append(walEntry); err != nil {
+			tb.Fatalf("write WAL fixture: %v", err)
+		}
+	}
+}
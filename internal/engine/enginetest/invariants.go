@@ -0,0 +1,154 @@
+package enginetest
+
+import (
+	"bytes"
+	"context"
+	"escabelo/internal/engine"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// Model is the expected state of a store: the last acknowledged value of
+// every key, or a tombstone. Concurrent writers should use disjoint keys,
+// since the model can't order acknowledgements for the same key.
+type Model struct {
+	mu      sync.Mutex
+	live    map[string][]byte
+	deleted map[string]bool
+}
+
+// NewModel returns an empty model
+func NewModel() *Model {
+	return &Model{
+		live:    make(map[string][]byte),
+		deleted: make(map[string]bool),
+	}
+}
+
+// ModelFromEntries builds the model of a store holding entries, keeping the
+// newest version of each key
+func ModelFromEntries(entries []*engine.Entry) *Model {
+	sorted := append([]*engine.Entry(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp < sorted[j].Timestamp
+	})
+
+	m := NewModel()
+	for _, entry := range sorted {
+		if entry.Deleted {
+			m.Delete(entry.Key)
+		} else {
+			m.Put(entry.Key, entry.Value)
+		}
+	}
+	return m
+}
+
+// Put records an acknowledged write
+func (m *Model) Put(key string, value []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.live[key] = value
+	delete(m.deleted, key)
+}
+
+// Delete records an acknowledged delete
+func (m *Model) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.live, key)
+	m.deleted[key] = true
+}
+
+// snapshot copies the model's state
+func (m *Model) snapshot() (map[string][]byte, []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	live := make(map[string][]byte, len(m.live))
+	for key, value := range m.live {
+		live[key] = value
+	}
+	deleted := make([]string, 0, len(m.deleted))
+	for key := range m.deleted {
+		deleted = append(deleted, key)
+	}
+	return live, deleted
+}
+
+// CheckNoLostWrites fails the test if any acknowledged write doesn't read
+// back with its last acknowledged value
+func CheckNoLostWrites(tb testing.TB, store engine.Store, model *Model) {
+	tb.Helper()
+	live, _ := model.snapshot()
+
+	for key, want := range live {
+		got, found, err := store.Get(key)
+		if err != nil {
+			tb.Fatalf("get %s: %v", key, err)
+		}
+		if !found {
+			tb.Errorf("acknowledged write lost: %s", key)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			tb.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+// CheckTombstones fails the test if a deleted key is visible through point
+// reads, key listings, scans or counts. The store must hold only keys
+// written through the model.
+func CheckTombstones(tb testing.TB, store engine.Store, model *Model) {
+	tb.Helper()
+	live, deleted := model.snapshot()
+	ctx := context.Background()
+
+	for _, key := range deleted {
+		if value, found, err := store.Get(key); err != nil {
+			tb.Fatalf("get %s: %v", key, err)
+		} else if found {
+			tb.Errorf("deleted key %s is readable: %q", key, value)
+		}
+	}
+
+	keys, err := store.KeysMatching(ctx, "", engine.ScanOptions{})
+	if err != nil {
+		tb.Fatalf("keys: %v", err)
+	}
+	for _, key := range keys {
+		if _, ok := live[key]; !ok {
+			tb.Errorf("keys lists deleted or unknown key %s", key)
+		}
+	}
+
+	pairs, err := store.PrefixScanWithOptions(ctx, "", engine.ScanOptions{})
+	if err != nil {
+		tb.Fatalf("scan: %v", err)
+	}
+	for _, kv := range pairs {
+		if _, ok := live[kv.Key]; !ok {
+			tb.Errorf("scan returns deleted or unknown key %s", kv.Key)
+		}
+	}
+	if len(pairs) != len(live) {
+		tb.Errorf("scan returned %d keys, want %d", len(pairs), len(live))
+	}
+
+	count, err := store.CountPrefix(ctx, "")
+	if err != nil {
+		tb.Fatalf("count: %v", err)
+	}
+	if count != int64(len(live)) {
+		tb.Errorf("count = %d, want %d", count, len(live))
+	}
+}
+
+// CheckInvariants runs every invariant check
+func CheckInvariants(tb testing.TB, store engine.Store, model *Model) {
+	tb.Helper()
+	CheckNoLostWrites(tb, store, model)
+	CheckTombstones(tb, store, model)
+}
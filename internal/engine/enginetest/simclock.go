@@ -0,0 +1,151 @@
+package enginetest
+
+import (
+	"escabelo/internal/engine"
+	"sync"
+	"time"
+)
+
+// SimClock is a virtual clock for deterministic tests. Time only moves when
+// Advance is called, which fires due tickers and wakes sleepers in order.
+type SimClock struct {
+	mu       sync.Mutex
+	now      time.Time
+	tickers  []*simTicker
+	sleepers []*simSleeper
+}
+
+type simTicker struct {
+	period  time.Duration
+	next    time.Time
+	ch      chan time.Time
+	stopped bool
+	clock   *SimClock
+}
+
+type simSleeper struct {
+	until time.Time
+	done  chan struct{}
+}
+
+// NewSimClock returns a clock stopped at start
+func NewSimClock(start time.Time) *SimClock {
+	return &SimClock{now: start}
+}
+
+// Now returns the virtual time
+func (c *SimClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker returns a ticker firing every d of virtual time
+func (c *SimClock) NewTicker(d time.Duration) engine.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &simTicker{
+		period: d,
+		next:   c.now.Add(d),
+		ch:     make(chan time.Time, 1),
+		clock:  c,
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Sleep blocks until the virtual time has advanced by d
+func (c *SimClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	if d <= 0 {
+		c.mu.Unlock()
+		return
+	}
+	s := &simSleeper{until: c.now.Add(d), done: make(chan struct{})}
+	c.sleepers = append(c.sleepers, s)
+	c.mu.Unlock()
+
+	<-s.done
+}
+
+// Advance moves the clock forward by d. Tickers fire once for every period
+// that elapses (dropping ticks a slow receiver hasn't taken, like
+// time.Ticker) and sleepers whose time has come are woken, in time order.
+func (c *SimClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	target := c.now.Add(d)
+	for {
+		next, ok := c.nextEvent()
+		if !ok || next.After(target) {
+			break
+		}
+		c.now = next
+
+		for _, t := range c.tickers {
+			if !t.stopped && !t.next.After(next) {
+				select {
+				case t.ch <- next:
+				default:
+				}
+				t.next = t.next.Add(t.period)
+			}
+		}
+
+		remaining := c.sleepers[:0]
+		for _, s := range c.sleepers {
+			if s.until.After(next) {
+				remaining = append(remaining, s)
+			} else {
+				close(s.done)
+			}
+		}
+		c.sleepers = remaining
+	}
+	c.now = target
+}
+
+// nextEvent returns the earliest pending tick or wake-up. Caller holds c.mu.
+func (c *SimClock) nextEvent() (time.Time, bool) {
+	var next time.Time
+	found := false
+	consider := func(t time.Time) {
+		if !found || t.Before(next) {
+			next, found = t, true
+		}
+	}
+	for _, t := range c.tickers {
+		if !t.stopped {
+			consider(t.next)
+		}
+	}
+	for _, s := range c.sleepers {
+		consider(s.until)
+	}
+	return next, found
+}
+
+// C returns the tick channel
+func (t *simTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+// Stop stops further ticks
+func (t *simTicker) Stop() {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t.stopped = true
+	for i, other := range c.tickers {
+		if other == t {
+			c.tickers = append(c.tickers[:i], c.tickers[i+1:]...)
+			break
+		}
+	}
+}
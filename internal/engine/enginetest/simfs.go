@@ -0,0 +1,503 @@
+package enginetest
+
+import (
+	"bytes"
+	"errors"
+	"escabelo/internal/engine"
+	"io"
+	iofs "io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrCrashed is returned by every operation on a SimFS after its crash point
+var ErrCrashed = errors.New("simulated crash")
+
+// SimFS is an in-memory filesystem that remembers which data has been
+// synced, so tests can crash it at a chosen point and reopen the engine on
+// what would have survived.
+//
+// Directory operations (create, rename, remove) are durable immediately.
+// File contents written since the last Sync may be lost: on Crash each file
+// independently keeps a random amount of its unsynced data, so writes to
+// different files can land out of order, as with OS writeback.
+type SimFS struct {
+	mu    sync.Mutex
+	files map[string]*simNode
+	dirs  map[string]bool
+	clock engine.Clock
+	rng   *rand.Rand
+
+	// Mutating operations left before the crash point (-1 for none)
+	opsLeft int
+	crashed bool
+}
+
+// simNode is a file's contents as seen by readers, and as of its last sync
+type simNode struct {
+	data    []byte
+	synced  []byte
+	modTime time.Time
+}
+
+// NewSimFS returns an empty filesystem. clock dates file modifications and
+// seed drives what survives a crash.
+func NewSimFS(clock engine.Clock, seed int64) *SimFS {
+	return &SimFS{
+		files:   make(map[string]*simNode),
+		dirs:    map[string]bool{"/": true, ".": true},
+		clock:   clock,
+		rng:     rand.New(rand.NewSource(seed)),
+		opsLeft: -1,
+	}
+}
+
+// CrashAfter makes the filesystem fail every operation, as if the process
+// had died, once n more mutating operations (writes, syncs, truncates,
+// renames, removes, creates) have completed
+func (f *SimFS) CrashAfter(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.opsLeft = n
+}
+
+// Crash stops this filesystem and returns a new one holding what a real disk
+// would have after power loss: synced data plus a random part of the rest.
+// The engine using f must be abandoned; reopen one on the returned SimFS.
+func (f *SimFS) Crash() *SimFS {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.crashed = true
+
+	after := &SimFS{
+		files:   make(map[string]*simNode, len(f.files)),
+		dirs:    make(map[string]bool, len(f.dirs)),
+		clock:   f.clock,
+		rng:     rand.New(rand.NewSource(f.rng.Int63())),
+		opsLeft: -1,
+	}
+	for dir := range f.dirs {
+		after.dirs[dir] = true
+	}
+
+	// Visit files in a fixed order so a seed always yields the same state
+	names := make([]string, 0, len(f.files))
+	for name := range f.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		node := f.files[name]
+		survived := f.survivor(node)
+		after.files[name] = &simNode{
+			data:    survived,
+			synced:  append([]byte(nil), survived...),
+			modTime: node.modTime,
+		}
+	}
+	return after
+}
+
+// survivor picks the contents of a file after a crash. Caller holds f.mu.
+func (f *SimFS) survivor(node *simNode) []byte {
+	if bytes.Equal(node.data, node.synced) {
+		return append([]byte(nil), node.synced...)
+	}
+
+	// Appends since the last sync: some prefix of them made it to disk
+	if bytes.HasPrefix(node.data, node.synced) {
+		n := len(node.synced) + f.rng.Intn(len(node.data)-len(node.synced)+1)
+		return append([]byte(nil), node.data[:n]...)
+	}
+
+	// Rewritten since the last sync: either none of it reached the disk, or
+	// the rewrite did along with part of the new data
+	if f.rng.Intn(2) == 0 {
+		return append([]byte(nil), node.synced...)
+	}
+	return append([]byte(nil), node.data[:f.rng.Intn(len(node.data)+1)]...)
+}
+
+// check fails operations after a crash. Caller holds f.mu.
+func (f *SimFS) check() error {
+	if f.crashed {
+		return ErrCrashed
+	}
+	return nil
+}
+
+// mutate accounts for a mutating operation. Caller holds f.mu.
+func (f *SimFS) mutate() error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	if f.opsLeft == 0 {
+		f.crashed = true
+		return ErrCrashed
+	}
+	if f.opsLeft > 0 {
+		f.opsLeft--
+	}
+	return nil
+}
+
+// Open opens a file for reading
+func (f *SimFS) Open(name string) (engine.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates a file for writing
+func (f *SimFS) Create(name string) (engine.File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// OpenFile opens a file with os.OpenFile flags
+func (f *SimFS) OpenFile(name string, flag int, perm os.FileMode) (engine.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+
+	node, exists := f.files[name]
+	if !exists {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if err := f.mutate(); err != nil {
+			return nil, err
+		}
+		node = &simNode{modTime: f.clock.Now()}
+		f.files[name] = node
+	} else if flag&os.O_TRUNC != 0 {
+		if err := f.mutate(); err != nil {
+			return nil, err
+		}
+		node.data = nil
+		node.modTime = f.clock.Now()
+	}
+
+	return &simFile{fs: f, name: name, node: node, flag: flag}, nil
+}
+
+// ReadFile returns a file's contents
+func (f *SimFS) ReadFile(name string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	node, exists := f.files[filepath.Clean(name)]
+	if !exists {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), node.data...), nil
+}
+
+// WriteFile replaces a file's contents without syncing them, like os.WriteFile
+func (f *SimFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	file, err := f.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ReadDir lists the files and directories directly inside name
+func (f *SimFS) ReadDir(name string) ([]os.DirEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	if !f.dirs[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	var entries []os.DirEntry
+	for path, node := range f.files {
+		if filepath.Dir(path) == name {
+			entries = append(entries, iofs.FileInfoToDirEntry(simFileInfo{
+				name: filepath.Base(path), size: int64(len(node.data)), modTime: node.modTime,
+			}))
+		}
+	}
+	for dir := range f.dirs {
+		if dir != name && filepath.Dir(dir) == name {
+			entries = append(entries, iofs.FileInfoToDirEntry(simFileInfo{name: filepath.Base(dir), dir: true}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// MkdirAll creates a directory and its parents
+func (f *SimFS) MkdirAll(path string, perm os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return err
+	}
+	for dir := filepath.Clean(path); !f.dirs[dir]; dir = filepath.Dir(dir) {
+		f.dirs[dir] = true
+	}
+	return nil
+}
+
+// Remove deletes a file
+func (f *SimFS) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, exists := f.files[name]; !exists {
+		if err := f.check(); err != nil {
+			return err
+		}
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if err := f.mutate(); err != nil {
+		return err
+	}
+	delete(f.files, name)
+	return nil
+}
+
+// Rename moves a file, replacing any file at newpath
+func (f *SimFS) Rename(oldpath, newpath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	node, exists := f.files[oldpath]
+	if !exists {
+		if err := f.check(); err != nil {
+			return err
+		}
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if err := f.mutate(); err != nil {
+		return err
+	}
+	delete(f.files, oldpath)
+	f.files[newpath] = node
+	return nil
+}
+
+// SyncDir is a no-op beyond failing after a crash, since directory
+// operations are durable immediately
+func (f *SimFS) SyncDir(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.check()
+}
+
+// Files returns the names of all files, sorted
+func (f *SimFS) Files() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	names := make([]string, 0, len(f.files))
+	for name := range f.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// simFile is an open handle on a SimFS file
+type simFile struct {
+	fs     *SimFS
+	name   string
+	node   *simNode
+	flag   int
+	pos    int64
+	closed bool
+}
+
+func (h *simFile) Read(p []byte) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if err := h.usable(); err != nil {
+		return 0, err
+	}
+	if h.pos >= int64(len(h.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.node.data[h.pos:])
+	h.pos += int64(n)
+	return n, nil
+}
+
+func (h *simFile) ReadAt(p []byte, off int64) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if err := h.usable(); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: h.name, Err: os.ErrInvalid}
+	}
+	if off >= int64(len(h.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *simFile) Write(p []byte) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if err := h.usable(); err != nil {
+		return 0, err
+	}
+	if h.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: h.name, Err: os.ErrPermission}
+	}
+	if err := h.fs.mutate(); err != nil {
+		return 0, err
+	}
+
+	if h.flag&os.O_APPEND != 0 {
+		h.pos = int64(len(h.node.data))
+	}
+	if end := h.pos + int64(len(p)); end > int64(len(h.node.data)) {
+		grown := make([]byte, end)
+		copy(grown, h.node.data)
+		h.node.data = grown
+	}
+	copy(h.node.data[h.pos:], p)
+	h.pos += int64(len(p))
+	h.node.modTime = h.fs.clock.Now()
+	return len(p), nil
+}
+
+func (h *simFile) Seek(offset int64, whence int) (int64, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if err := h.usable(); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += h.pos
+	case io.SeekEnd:
+		offset += int64(len(h.node.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: h.name, Err: os.ErrInvalid}
+	}
+	h.pos = offset
+	return offset, nil
+}
+
+func (h *simFile) Stat() (os.FileInfo, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if err := h.usable(); err != nil {
+		return nil, err
+	}
+	return simFileInfo{name: filepath.Base(h.name), size: int64(len(h.node.data)), modTime: h.node.modTime}, nil
+}
+
+func (h *simFile) Sync() error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if err := h.usable(); err != nil {
+		return err
+	}
+	if err := h.fs.mutate(); err != nil {
+		return err
+	}
+	h.node.synced = append([]byte(nil), h.node.data...)
+	return nil
+}
+
+func (h *simFile) Truncate(size int64) error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if err := h.usable(); err != nil {
+		return err
+	}
+	if err := h.fs.mutate(); err != nil {
+		return err
+	}
+	if size < int64(len(h.node.data)) {
+		h.node.data = h.node.data[:size:size]
+	} else {
+		h.node.data = append(h.node.data, make([]byte, size-int64(len(h.node.data)))...)
+	}
+	h.node.modTime = h.fs.clock.Now()
+	return nil
+}
+
+func (h *simFile) Close() error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if h.closed {
+		return &os.PathError{Op: "close", Path: h.name, Err: os.ErrClosed}
+	}
+	h.closed = true
+	return nil
+}
+
+// usable fails operations on closed handles or a crashed filesystem.
+// Caller holds h.fs.mu.
+func (h *simFile) usable() error {
+	if h.closed {
+		return &os.PathError{Op: "use", Path: h.name, Err: os.ErrClosed}
+	}
+	return h.fs.check()
+}
+
+// simFileInfo describes a SimFS file or directory
+type simFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i simFileInfo) Name() string       { return i.name }
+func (i simFileInfo) Size() int64        { return i.size }
+func (i simFileInfo) ModTime() time.Time { return i.modTime }
+func (i simFileInfo) IsDir() bool        { return i.dir }
+func (i simFileInfo) Sys() any           { return nil }
+
+func (i simFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+var _ engine.FS = (*SimFS)(nil)
@@ -0,0 +1,76 @@
+package enginetest
+
+import (
+	"escabelo/internal/engine"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// Op is a single write or delete issued by a workload
+type Op struct {
+	Key    string
+	Value  []byte
+	Delete bool
+}
+
+// Workload describes a reproducible mix of writes and deletes
+type Workload struct {
+	// Keys is the size of the keyspace; keys are "<Prefix><n>"
+	Keys   int
+	Prefix string
+
+	// Operations is the number of operations generated
+	Operations int
+
+	// ValueSize is the length of written values
+	ValueSize int
+
+	// DeleteRatio is the fraction of operations that delete
+	DeleteRatio float64
+
+	// Seed makes the generated operations reproducible
+	Seed int64
+}
+
+// Generate returns the workload's operations
+func (w Workload) Generate() []Op {
+	rng := rand.New(rand.NewSource(w.Seed))
+	keys := max(w.Keys, 1)
+
+	ops := make([]Op, w.Operations)
+	for i := range ops {
+		ops[i].Key = fmt.Sprintf("%s%06d", w.Prefix, rng.Intn(keys))
+		if rng.Float64() < w.DeleteRatio {
+			ops[i].Delete = true
+			continue
+		}
+		value := make([]byte, w.ValueSize)
+		for j := range value {
+			value[j] = byte('a' + rng.Intn(26))
+		}
+		ops[i].Value = value
+	}
+	return ops
+}
+
+// Run applies ops to store, recording every acknowledged operation in model
+func Run(tb testing.TB, store engine.Store, model *Model, ops []Op) {
+	tb.Helper()
+	for _, op := range ops {
+		if op.Delete {
+			deleted, err := store.Delete(op.Key)
+			if err != nil {
+				tb.Fatalf("delete %s: %v", op.Key, err)
+			}
+			if deleted {
+				model.Delete(op.Key)
+			}
+			continue
+		}
+		if err := store.Put(op.Key, op.Value); err != nil {
+			tb.Fatalf("put %s: %v", op.Key, err)
+		}
+		model.Put(op.Key, op.Value)
+	}
+}
@@ -0,0 +1,94 @@
+package engine
+
+import "sort"
+
+// KeyEstimate is an approximate number of keys and the bytes they take
+type KeyEstimate struct {
+	Keys  int64
+	Bytes int64
+}
+
+// EstimateKeys approximates the live keys starting with prefix ("" for
+// every key), and their size, from metadata alone: memtable counts, plus each
+// overlapping SST file's key count scaled by the share of its data blocks
+// the prefix spans, the block index serving as a histogram of its key range.
+// Nothing is read from disk. A key with versions in several layers counts
+// once per layer, and deleted keys count until compaction drops them, so the
+// estimate runs high while overwrites and deletes await compaction.
+func (e *Engine) EstimateKeys(prefix string) KeyEstimate {
+	end := prefixUpperBound(prefix)
+	now := e.config.Clock.Now().UnixNano()
+
+	var estimate KeyEstimate
+	e.mu.RLock()
+	for _, mt := range append([]*MemTable{e.memtable}, e.immutableMemtables...) {
+		estimate.add(estimateMemTable(mt, prefix, end, now))
+	}
+	e.mu.RUnlock()
+
+	for _, sst := range e.sstManager.GetAllSSTables() {
+		if !sst.Overlaps(prefix, end) {
+			continue
+		}
+		share := sst.blockShare(prefix, end)
+		keys := max(sst.KeyCount-sst.TombstoneCount, 0)
+		estimate.Keys += int64(float64(keys)*share + 0.5)
+		estimate.Bytes += int64(float64(sst.DataSize)*share + 0.5)
+	}
+	return estimate
+}
+
+func (k *KeyEstimate) add(other KeyEstimate) {
+	k.Keys += other.Keys
+	k.Bytes += other.Bytes
+}
+
+// estimateMemTable counts the keys of a memtable in [start, end). The whole
+// table is taken from its counters, tombstones included; a range is counted
+// exactly, which only walks memory.
+func estimateMemTable(mt *MemTable, start, end string, now int64) KeyEstimate {
+	if start == "" && end == "" {
+		return KeyEstimate{Keys: int64(mt.Len()), Bytes: mt.Size()}
+	}
+	var estimate KeyEstimate
+	for _, entry := range mt.RangeEntries(start, end) {
+		if !entry.gone(now) {
+			estimate.Keys++
+			estimate.Bytes += int64(len(entry.Key) + len(entry.Value))
+		}
+	}
+	return estimate
+}
+
+// blockShare returns the share of the file's data blocks that hold keys in
+// [start, end), or 1 for files without a block index
+func (sst *SSTable) blockShare(start, end string) float64 {
+	n := len(sst.Index)
+	if n == 0 || start <= sst.MinKey && (end == "" || end > sst.MaxKey) {
+		return 1
+	}
+	// The block holding start, through the last block starting before end
+	first := max(sort.Search(n, func(i int) bool { return sst.Index[i].Key > start })-1, 0)
+	last := n
+	if end != "" {
+		last = sort.Search(n, func(i int) bool { return sst.Index[i].Key >= end })
+	}
+	if last <= first {
+		return 0
+	}
+	return float64(last-first) / float64(n)
+}
+
+// EstimateKeys counts the live keys starting with prefix, and their size.
+// The store is in memory, so the count is exact.
+func (m *MemStore) EstimateKeys(prefix string) KeyEstimate {
+	var estimate KeyEstimate
+	now := m.now()
+	for _, entry := range m.data.RangeEntries(prefix, prefixUpperBound(prefix)) {
+		if !entry.gone(now) {
+			estimate.Keys++
+			estimate.Bytes += int64(len(entry.Key) + len(entry.Value))
+		}
+	}
+	return estimate
+}
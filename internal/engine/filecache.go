@@ -0,0 +1,172 @@
+package engine
+
+import (
+	"container/list"
+	"sync"
+)
+
+// fileCache keeps SST files open between reads, so lookups don't pay an
+// open and a close each. Once more than maxOpen files are open, the least
+// recently used is closed as soon as no read is using it. Files are keyed by
+// their *SSTable, like blocks in the block cache. Reads acquire files of
+// SSTs they hold a reference on (see SSTManager.acquire), so a file is
+// never deleted between a read picking it and opening it.
+type fileCache struct {
+	fs      FS
+	maxOpen int
+
+	mu    sync.Mutex
+	lru   *list.List // of *sharedFile, most recently used first
+	files map[*SSTable]*list.Element
+
+	opens int64 // files opened, cache misses included
+}
+
+// sharedFile is an open SST file shared by concurrent reads. Reads only use
+// ReadAt, which doesn't move a file offset, so they don't interfere.
+type sharedFile struct {
+	sst  *SSTable
+	file File
+
+	// refs counts the reads using the file, plus one while it is cached
+	// (guarded by fileCache.mu). The file is closed when it drops to 0.
+	refs int
+}
+
+// fileHandle is one read's use of a shared file. Closing it releases the
+// file rather than closing it.
+type fileHandle struct {
+	cache  *fileCache
+	shared *sharedFile
+}
+
+// newFileCache creates a cache keeping up to maxOpen files of fs open. With
+// maxOpen 0 every file is closed once its read is done.
+func newFileCache(fs FS, maxOpen int) *fileCache {
+	return &fileCache{
+		fs:      fs,
+		maxOpen: maxOpen,
+		lru:     list.New(),
+		files:   make(map[*SSTable]*list.Element),
+	}
+}
+
+// acquire returns a handle on sst's file, opening it unless it is cached
+func (c *fileCache) acquire(sst *SSTable) (*fileHandle, error) {
+	c.mu.Lock()
+	if elem, ok := c.files[sst]; ok {
+		c.lru.MoveToFront(elem)
+		shared := elem.Value.(*sharedFile)
+		shared.refs++
+		c.mu.Unlock()
+		return &fileHandle{cache: c, shared: shared}, nil
+	}
+	c.mu.Unlock()
+
+	// Open without holding the lock, so a slow open doesn't hold up reads of
+	// cached files
+	file, err := c.fs.Open(sst.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	shared := &sharedFile{sst: sst, file: file, refs: 1}
+
+	c.mu.Lock()
+	c.opens++
+	if c.maxOpen <= 0 {
+		c.mu.Unlock()
+		return &fileHandle{cache: c, shared: shared}, nil
+	}
+	if elem, ok := c.files[sst]; ok {
+		// A concurrent read opened it first
+		c.lru.MoveToFront(elem)
+		cached := elem.Value.(*sharedFile)
+		cached.refs++
+		c.mu.Unlock()
+		file.Close()
+		return &fileHandle{cache: c, shared: cached}, nil
+	}
+	shared.refs++
+	c.files[sst] = c.lru.PushFront(shared)
+	var closing []File
+	for c.lru.Len() > c.maxOpen {
+		if file := c.removeLocked(c.lru.Back()); file != nil {
+			closing = append(closing, file)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, file := range closing {
+		file.Close()
+	}
+	return &fileHandle{cache: c, shared: shared}, nil
+}
+
+// evict stops caching sst's file once it is gone, closing it when no read
+// is using it
+func (c *fileCache) evict(sst *SSTable) {
+	c.mu.Lock()
+	var file File
+	if elem, ok := c.files[sst]; ok {
+		file = c.removeLocked(elem)
+	}
+	c.mu.Unlock()
+
+	if file != nil {
+		file.Close()
+	}
+}
+
+// close stops caching every file
+func (c *fileCache) close() {
+	c.mu.Lock()
+	var closing []File
+	for c.lru.Len() > 0 {
+		if file := c.removeLocked(c.lru.Back()); file != nil {
+			closing = append(closing, file)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, file := range closing {
+		file.Close()
+	}
+}
+
+// removeLocked drops a cached file and its reference, returning the file if
+// that was the last one and it should be closed. Must hold c.mu.
+func (c *fileCache) removeLocked(elem *list.Element) File {
+	shared := c.lru.Remove(elem).(*sharedFile)
+	delete(c.files, shared.sst)
+	if shared.refs--; shared.refs == 0 {
+		return shared.file
+	}
+	return nil
+}
+
+// stats returns how many files are open in the cache and how many were
+// opened in all
+func (c *fileCache) stats() (open int, opens int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len(), c.opens
+}
+
+// ReadAt reads from the file at off
+func (h *fileHandle) ReadAt(p []byte, off int64) (int, error) {
+	return h.shared.file.ReadAt(p, off)
+}
+
+// Close releases the handle, closing the file if it is no longer cached and
+// no other read is using it
+func (h *fileHandle) Close() error {
+	h.cache.mu.Lock()
+	h.shared.refs--
+	last := h.shared.refs == 0
+	h.cache.mu.Unlock()
+
+	if last {
+		return h.shared.file.Close()
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// hashMagic prefixes values holding a hash. It starts with a NUL byte, which
+// text protocol writes practically never begin with.
+var hashMagic = []byte("\x00HASH1")
+
+// ErrNotHash is returned when a hash command targets a key holding a plain value
+var ErrNotHash = errors.New("key holds a non-hash value")
+
+// HashField is a field of a hash value
+type HashField struct {
+	Field string
+	Value []byte
+}
+
+// Hashes implements the hash data type on top of a Store. All fields of a
+// key are encoded together in its value, so updates are read-modify-write.
+// Each is conditional on the version it read and starts over if another
+// write changed the key in between, so no concurrent write to the key is
+// lost, whichever command made it.
+type Hashes struct {
+	store Store
+	locks keyLocks
+}
+
+// NewHashes creates the hash data type for a store
+func NewHashes(store Store) *Hashes {
+	return &Hashes{store: store}
+}
+
+// load reads and decodes the hash stored at key, along with its version,
+// 0 if the key is missing
+func (h *Hashes) load(key string) ([]HashField, int64, bool, error) {
+	value, version, found, err := h.store.GetVersion(key)
+	if err != nil || !found {
+		return nil, 0, false, err
+	}
+	fields, err := DecodeHash(value)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return fields, version, true, nil
+}
+
+// Set sets a field, creating the hash if needed. It returns the hash's new
+// version.
+func (h *Hashes) Set(key, field string, value []byte) (int64, error) {
+	mu := h.locks.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	for {
+		fields, current, _, err := h.load(key)
+		if err != nil {
+			return 0, err
+		}
+
+		i := sort.Search(len(fields), func(i int) bool { return fields[i].Field >= field })
+		if i < len(fields) && fields[i].Field == field {
+			fields[i].Value = value
+		} else {
+			fields = append(fields, HashField{})
+			copy(fields[i+1:], fields[i:])
+			fields[i] = HashField{Field: field, Value: value}
+		}
+
+		version, err := h.store.PutIfVersion(key, EncodeHash(fields), current)
+		if errors.Is(err, ErrVersionMismatch) {
+			continue
+		}
+		return version, err
+	}
+}
+
+// Get returns the value of a field
+func (h *Hashes) Get(key, field string) ([]byte, bool, error) {
+	fields, _, _, err := h.load(key)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, f := range fields {
+		if f.Field == field {
+			return f.Value, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// Delete removes a field, deleting the key along with its last field. It
+// returns whether the field existed.
+func (h *Hashes) Delete(key, field string) (bool, error) {
+	mu := h.locks.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	for {
+		fields, current, _, err := h.load(key)
+		if err != nil {
+			return false, err
+		}
+		i := slices.IndexFunc(fields, func(f HashField) bool { return f.Field == field })
+		if i < 0 {
+			return false, nil
+		}
+
+		fields = slices.Delete(fields, i, i+1)
+		if len(fields) == 0 {
+			err = h.store.DeleteIfVersion(key, current)
+		} else {
+			_, err = h.store.PutIfVersion(key, EncodeHash(fields), current)
+		}
+		if errors.Is(err, ErrVersionMismatch) {
+			continue
+		}
+		return true, err
+	}
+}
+
+// GetAll returns every field in field order
+func (h *Hashes) GetAll(key string) ([]HashField, bool, error) {
+	fields, _, found, err := h.load(key)
+	return fields, found, err
+}
+
+// IsHash reports whether a stored value holds a hash
+func IsHash(value []byte) bool {
+	return bytes.HasPrefix(value, hashMagic)
+}
+
+// EncodeHash encodes fields, sorted by name, as a hash value:
+// magic | (fieldLen(4) | field | valueLen(4) | value)*
+func EncodeHash(fields []HashField) []byte {
+	size := len(hashMagic)
+	for _, f := range fields {
+		size += 8 + len(f.Field) + len(f.Value)
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, hashMagic...)
+	for _, f := range fields {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(f.Field)))
+		buf = append(buf, f.Field...)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(f.Value)))
+		buf = append(buf, f.Value...)
+	}
+	return buf
+}
+
+// DecodeHash decodes a value written by EncodeHash
+func DecodeHash(value []byte) ([]HashField, error) {
+	if !IsHash(value) {
+		return nil, ErrNotHash
+	}
+
+	var fields []HashField
+	buf := value[len(hashMagic):]
+	for len(buf) > 0 {
+		field, rest, err := readHashChunk(buf)
+		if err != nil {
+			return nil, err
+		}
+		val, rest, err := readHashChunk(rest)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, HashField{Field: string(field), Value: val})
+		buf = rest
+	}
+	return fields, nil
+}
+
+// readHashChunk reads one length-prefixed chunk of a hash value
+func readHashChunk(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 4 {
+		return nil, nil, fmt.Errorf("corrupt hash value")
+	}
+	n := binary.LittleEndian.Uint32(buf)
+	buf = buf[4:]
+	if uint64(n) > uint64(len(buf)) {
+		return nil, nil, fmt.Errorf("corrupt hash value")
+	}
+	return buf[:n], buf[n:], nil
+}
@@ -0,0 +1,309 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// hintMemoryBytes bounds the hints of a consumer buffered in memory before
+// they spill to its hint file
+const hintMemoryBytes = 1 << 20
+
+// hintLog holds the WAL entries a consumer hadn't acknowledged when they
+// were truncated: the oldest in its file, the newest in memory
+type hintLog struct {
+	path     string
+	first    uint64 // oldest sequence number held (0 when empty)
+	last     uint64 // newest sequence number held
+	spilled  uint64 // entries up to this sequence number are in the file
+	fileSize int64
+	mem      []*WALEntry
+	memSize  int64
+}
+
+// hintStore keeps a hint log per WAL consumer so consumers that fall behind
+// a truncation, like a replica that is briefly down, can still catch up
+// entry by entry
+type hintStore struct {
+	mu       sync.Mutex
+	fs       FS
+	dir      string
+	maxBytes int64
+	logs     map[string]*hintLog
+
+	// limits bound the key and value lengths records may hold
+	limits SizeLimits
+}
+
+// loadHintStore opens the hint logs stored in dataDir. Each consumer's hints
+// are bounded by maxBytes, and records of keys or values past limits read
+// as corrupt.
+func loadHintStore(fs FS, dataDir string, maxBytes int64, limits SizeLimits) (*hintStore, error) {
+	h := &hintStore{
+		fs:       fs,
+		dir:      filepath.Join(dataDir, "hints"),
+		maxBytes: maxBytes,
+		logs:     make(map[string]*hintLog),
+		limits:   limits,
+	}
+	if err := fs.MkdirAll(h.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := fs.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".hint") {
+			continue
+		}
+		hl := &hintLog{path: filepath.Join(h.dir, name)}
+		entries, err := h.readFile(hl, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read hints %s: %w", name, err)
+		}
+		if len(entries) == 0 {
+			h.fs.Remove(hl.path)
+			continue
+		}
+		hl.first = entries[0].Seq
+		hl.last = entries[len(entries)-1].Seq
+		hl.spilled = hl.last
+		for _, entry := range entries {
+			hl.fileSize += hintRecordSize(entry)
+		}
+		h.logs[strings.TrimSuffix(name, ".hint")] = hl
+	}
+	return h, nil
+}
+
+// hintRecordSize returns the encoded size of a hint record:
+// seq(8) followed by the entry's WAL record
+func hintRecordSize(entry *WALEntry) int64 {
+	return 8 + walRecordSize(entry)
+}
+
+// add hands off truncated entries to the consumers that hadn't acknowledged
+// them
+func (h *hintStore) add(acked map[string]uint64, entries []*WALEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for consumer, seq := range acked {
+		hl := h.logs[consumer]
+		if hl == nil {
+			hl = &hintLog{path: filepath.Join(h.dir, consumer+".hint")}
+		}
+
+		from := max(seq, hl.last) + 1
+		if from < entries[0].Seq {
+			// Entries between the hints and this batch were lost (e.g. the
+			// memory buffer on a crash): the consumer can't catch up from hints
+			h.dropLocked(consumer, hl)
+			hl = &hintLog{path: hl.path}
+			if seq+1 < entries[0].Seq {
+				continue
+			}
+			from = seq + 1
+		}
+
+		for _, entry := range entries {
+			if entry.Seq < from {
+				continue
+			}
+			if hl.first == 0 {
+				hl.first = entry.Seq
+			}
+			hl.last = entry.Seq
+			hl.mem = append(hl.mem, entry)
+			hl.memSize += hintRecordSize(entry)
+		}
+		if hl.first == 0 {
+			continue
+		}
+		h.logs[consumer] = hl
+
+		if hl.fileSize+hl.memSize > h.maxBytes {
+			slog.Warn("Hints for WAL consumer dropped; it must resync", "consumer", consumer, "max_bytes", h.maxBytes)
+			h.dropLocked(consumer, hl)
+			continue
+		}
+		if hl.memSize > hintMemoryBytes {
+			if err := h.spillLocked(hl); err != nil {
+				slog.Error("Hint spill failed", "consumer", consumer, "err", err)
+				h.dropLocked(consumer, hl)
+			}
+		}
+	}
+}
+
+// spillLocked appends the in-memory hints to the hint file. Caller holds h.mu.
+func (h *hintStore) spillLocked(hl *hintLog) error {
+	if len(hl.mem) == 0 {
+		return nil
+	}
+	file, err := h.fs.OpenFile(hl.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, entry := range hl.mem {
+		var buf []byte
+		buf = binary.LittleEndian.AppendUint64(buf, entry.Seq)
+		buf = appendWALRecord(buf, entry)
+		if _, err := writer.Write(buf); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	hl.spilled = hl.last
+	hl.fileSize += hl.memSize
+	hl.mem = nil
+	hl.memSize = 0
+	return nil
+}
+
+// dropLocked discards a consumer's hints. Caller holds h.mu.
+func (h *hintStore) dropLocked(consumer string, hl *hintLog) {
+	if hl.fileSize > 0 {
+		h.fs.Remove(hl.path)
+	}
+	delete(h.logs, consumer)
+}
+
+// readFile returns the entries of a hint file from sequence number from
+func (h *hintStore) readFile(hl *hintLog, from uint64) ([]*WALEntry, error) {
+	file, err := h.fs.Open(hl.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := newRecordReader(bufio.NewReader(file), info.Size(), h.limits)
+	var entries []*WALEntry
+	for {
+		var seq uint64
+		if err := binary.Read(reader, binary.LittleEndian, &seq); err != nil {
+			if err == io.EOF {
+				return entries, nil
+			}
+			return nil, err
+		}
+		entry, err := readWALEntry(reader)
+		if err != nil {
+			return nil, err
+		}
+		if seq >= from {
+			entry.Seq = seq
+			entries = append(entries, entry)
+		}
+	}
+}
+
+// read returns up to limit hinted entries for consumer from sequence number
+// from. It reports false when the hints don't cover from.
+func (h *hintStore) read(consumer string, from uint64, limit int) ([]*WALEntry, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hl := h.logs[consumer]
+	if hl == nil || from < hl.first || from > hl.last {
+		return nil, false, nil
+	}
+
+	var entries []*WALEntry
+	if from <= hl.spilled {
+		spilled, err := h.readFile(hl, from)
+		if err != nil {
+			return nil, false, err
+		}
+		entries = spilled
+	}
+	for _, entry := range hl.mem {
+		if entry.Seq >= from {
+			entries = append(entries, entry)
+		}
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, true, nil
+}
+
+// ack releases the hints a consumer has acknowledged. The hint file is
+// removed once every entry in it is acknowledged.
+func (h *hintStore) ack(consumer string, seq uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hl := h.logs[consumer]
+	if hl == nil || seq < hl.first {
+		return
+	}
+	if seq >= hl.last {
+		h.dropLocked(consumer, hl)
+		return
+	}
+
+	hl.first = seq + 1
+	for len(hl.mem) > 0 && hl.mem[0].Seq <= seq {
+		hl.memSize -= hintRecordSize(hl.mem[0])
+		hl.mem = hl.mem[1:]
+	}
+	if seq >= hl.spilled && hl.fileSize > 0 {
+		h.fs.Remove(hl.path)
+		hl.fileSize = 0
+	}
+}
+
+// size returns the bytes held in hints across consumers
+func (h *hintStore) size() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var total int64
+	for _, hl := range h.logs {
+		total += hl.fileSize + hl.memSize
+	}
+	return total
+}
+
+// close spills every in-memory hint so they survive a restart
+func (h *hintStore) close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for consumer, hl := range h.logs {
+		if err := h.spillLocked(hl); err != nil {
+			return fmt.Errorf("failed to spill hints for %s: %w", consumer, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,521 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Index types
+const (
+	IndexNumeric = "numeric"
+	IndexLex     = "lex"
+)
+
+// PathFirstToken is the index path selecting the first whitespace-separated
+// token of the value
+const PathFirstToken = "$first"
+
+// indexDefsFile names the file in the data directory holding the index
+// definitions declared at runtime
+const indexDefsFile = "indexes"
+
+// IndexDef declares a secondary index over the values of the keys sharing a
+// prefix
+type IndexDef struct {
+	Name   string
+	Prefix string
+
+	// Path selects the indexed part of the value: a JSON path into document
+	// values, a field name of hash values, "$" for the whole value or
+	// PathFirstToken for its first token
+	Path string
+
+	// Type is IndexNumeric or IndexLex
+	Type string
+}
+
+// IndexEntry is a key and the indexed part of its value
+type IndexEntry struct {
+	Key   string
+	Score float64 // numeric indexes
+	Term  string  // lexicographic indexes
+}
+
+// IndexStats describes an index
+type IndexStats struct {
+	IndexDef
+	Entries int
+}
+
+// String returns the declaration of the index, as ParseIndexDef reads it
+func (d IndexDef) String() string {
+	return strings.Join([]string{d.Name, d.Prefix, d.Path, d.Type}, ",")
+}
+
+// index keeps the entries of one IndexDef sorted by score or term, then key
+type index struct {
+	def        IndexDef
+	path       []pathSegment
+	firstToken bool
+	entries    []IndexEntry
+	byKey      map[string]IndexEntry
+}
+
+// Indexes maintains sorted secondary indexes over a Store. Indexes live in
+// memory: they are built by scanning their prefix and kept current by
+// calling Update after every write.
+type Indexes struct {
+	store   Store
+	mu      sync.RWMutex
+	indexes map[string]*index
+	locks   keyLocks
+}
+
+// NewIndexes creates an empty set of indexes for a store
+func NewIndexes(store Store) *Indexes {
+	return &Indexes{
+		store:   store,
+		indexes: make(map[string]*index),
+	}
+}
+
+// ParseIndexDef parses an index declaration "name,prefix,path,type"
+func ParseIndexDef(spec string) (IndexDef, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) != 4 {
+		return IndexDef{}, fmt.Errorf("index format: name,prefix,path,numeric|lex")
+	}
+	def := IndexDef{Name: parts[0], Prefix: parts[1], Path: parts[2], Type: strings.ToLower(parts[3])}
+	if def.Name == "" {
+		return IndexDef{}, fmt.Errorf("index name is empty")
+	}
+	if def.Type != IndexNumeric && def.Type != IndexLex {
+		return IndexDef{}, fmt.Errorf("unknown index type: %s", parts[3])
+	}
+	if _, err := parseIndexPath(def.Path); err != nil {
+		return IndexDef{}, err
+	}
+	return def, nil
+}
+
+// parseIndexPath parses the path of an index, returning nil segments for
+// PathFirstToken
+func parseIndexPath(path string) ([]pathSegment, error) {
+	if path == PathFirstToken {
+		return nil, nil
+	}
+	return parseJSONPath(path)
+}
+
+// Define adds an index and builds it from the keys already stored
+func (x *Indexes) Define(def IndexDef) error {
+	path, err := parseIndexPath(def.Path)
+	if err != nil {
+		return err
+	}
+
+	x.mu.Lock()
+	if _, exists := x.indexes[def.Name]; exists {
+		x.mu.Unlock()
+		return fmt.Errorf("index %s already defined", def.Name)
+	}
+	x.indexes[def.Name] = &index{def: def, path: path, firstToken: def.Path == PathFirstToken, byKey: make(map[string]IndexEntry)}
+	x.mu.Unlock()
+
+	if err := x.rebuild(def.Name); err != nil {
+		x.Drop(def.Name)
+		return err
+	}
+	return nil
+}
+
+// Drop removes an index, reporting whether it existed
+func (x *Indexes) Drop(name string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	_, ok := x.indexes[name]
+	delete(x.indexes, name)
+	return ok
+}
+
+// Rebuild rebuilds every index from the store, e.g. after entries were
+// applied without going through Update
+func (x *Indexes) Rebuild() error {
+	x.mu.RLock()
+	names := make([]string, 0, len(x.indexes))
+	for name := range x.indexes {
+		names = append(names, name)
+	}
+	x.mu.RUnlock()
+
+	for _, name := range names {
+		if err := x.rebuild(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuild scans the prefix of an index and replaces its entries
+func (x *Indexes) rebuild(name string) error {
+	x.mu.RLock()
+	idx := x.indexes[name]
+	x.mu.RUnlock()
+
+	pairs, err := x.store.PrefixScanWithOptions(context.Background(), idx.def.Prefix, ScanOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to build index %s: %w", name, err)
+	}
+
+	byKey := make(map[string]IndexEntry, len(pairs))
+	entries := make([]IndexEntry, 0, len(pairs))
+	for _, kv := range pairs {
+		if entry, ok := idx.extract(kv.Key, kv.Value); ok {
+			byKey[kv.Key] = entry
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return idx.less(entries[i], entries[j])
+	})
+
+	x.mu.Lock()
+	idx.entries = entries
+	idx.byKey = byKey
+	x.mu.Unlock()
+	return nil
+}
+
+// Find returns the entries whose term (lex) or score (numeric) equals
+// value, in key order. A limit <= 0 returns every match.
+func (x *Indexes) Find(name, value string, limit int) ([]IndexEntry, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	idx, ok := x.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown index: %s", name)
+	}
+
+	probe := IndexEntry{Term: value}
+	if idx.def.Type == IndexNumeric {
+		score, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number: %s", value)
+		}
+		probe = IndexEntry{Score: score}
+	}
+	// The probe has the smallest key, so it sorts before its equals
+	start := sort.Search(len(idx.entries), func(i int) bool { return !idx.less(idx.entries[i], probe) })
+	end := start
+	for end < len(idx.entries) && idx.entries[end].Score == probe.Score && idx.entries[end].Term == probe.Term {
+		if limit > 0 && end-start == limit {
+			break
+		}
+		end++
+	}
+	result := make([]IndexEntry, end-start)
+	copy(result, idx.entries[start:end])
+	return result, nil
+}
+
+// Update re-reads a key after a write and updates the indexes covering it.
+// Updates of a key are serialized, so the last one reflects its latest value.
+func (x *Indexes) Update(key string) error {
+	x.mu.RLock()
+	var covering []*index
+	for _, idx := range x.indexes {
+		if strings.HasPrefix(key, idx.def.Prefix) {
+			covering = append(covering, idx)
+		}
+	}
+	x.mu.RUnlock()
+	if len(covering) == 0 {
+		return nil
+	}
+
+	mu := x.locks.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	value, found, err := x.store.Get(key)
+	if err != nil {
+		return err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, idx := range covering {
+		idx.remove(key)
+		if !found {
+			continue
+		}
+		if entry, ok := idx.extract(key, value); ok {
+			idx.insert(entry)
+		}
+	}
+	return nil
+}
+
+// Range returns the entries with a score (numeric) or term (lex) in
+// [min, max], in index order. "-inf" and "+inf" leave a bound open. A limit
+// <= 0 returns every match.
+func (x *Indexes) Range(name, min, max string, limit int) ([]IndexEntry, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	idx, ok := x.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown index: %s", name)
+	}
+
+	start, end := 0, len(idx.entries)
+	if idx.def.Type == IndexNumeric {
+		lo, err := parseBound(min, math.Inf(-1))
+		if err != nil {
+			return nil, err
+		}
+		hi, err := parseBound(max, math.Inf(1))
+		if err != nil {
+			return nil, err
+		}
+		start = sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].Score >= lo })
+		end = sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].Score > hi })
+	} else {
+		if min != "-inf" {
+			start = sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].Term >= min })
+		}
+		if max != "+inf" {
+			end = sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].Term > max })
+		}
+	}
+
+	if end <= start {
+		return nil, nil
+	}
+	if limit > 0 && end-start > limit {
+		end = start + limit
+	}
+	result := make([]IndexEntry, end-start)
+	copy(result, idx.entries[start:end])
+	return result, nil
+}
+
+// Type returns the type of an index
+func (x *Indexes) Type(name string) (string, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	idx, ok := x.indexes[name]
+	if !ok {
+		return "", false
+	}
+	return idx.def.Type, true
+}
+
+// Defs returns the definitions of every index, sorted by name
+func (x *Indexes) Defs() []IndexDef {
+	stats := x.Stats()
+	defs := make([]IndexDef, len(stats))
+	for i, stat := range stats {
+		defs[i] = stat.IndexDef
+	}
+	return defs
+}
+
+// Stats describes every index, sorted by name
+func (x *Indexes) Stats() []IndexStats {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	stats := make([]IndexStats, 0, len(x.indexes))
+	for _, idx := range x.indexes {
+		stats = append(stats, IndexStats{IndexDef: idx.def, Entries: len(idx.entries)})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+// parseBound parses a numeric range bound, where "-inf"/"+inf" are open
+func parseBound(s string, open float64) (float64, error) {
+	if s == "-inf" || s == "+inf" {
+		return open, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid range bound: %s", s)
+	}
+	return v, nil
+}
+
+// extract returns the index entry of a value, or false when the value has
+// nothing to index (missing path, or not a number for numeric indexes)
+func (idx *index) extract(key string, value []byte) (IndexEntry, bool) {
+	var term string
+	switch {
+	case idx.firstToken:
+		// Hashes have no first token
+		fields := strings.Fields(string(value))
+		if IsHash(value) || len(fields) == 0 {
+			return IndexEntry{}, false
+		}
+		term = fields[0]
+
+	case IsHash(value):
+		// Hash values are indexed by field: path "field" or "$.field"
+		if len(idx.path) != 1 || idx.path[0].array {
+			return IndexEntry{}, false
+		}
+		fields, err := DecodeHash(value)
+		if err != nil {
+			return IndexEntry{}, false
+		}
+		found := false
+		for _, f := range fields {
+			if f.Field == idx.path[0].member {
+				term, found = string(f.Value), true
+				break
+			}
+		}
+		if !found {
+			return IndexEntry{}, false
+		}
+
+	case len(idx.path) == 0:
+		// The whole value, unquoting JSON strings
+		term = string(value)
+		if doc, err := decodeJSON(value); err == nil {
+			if s, ok := doc.(string); ok {
+				term = s
+			}
+		}
+
+	default:
+		doc, err := decodeJSON(value)
+		if err != nil {
+			return IndexEntry{}, false
+		}
+		for _, seg := range idx.path {
+			var ok bool
+			if doc, ok = child(doc, seg); !ok {
+				return IndexEntry{}, false
+			}
+		}
+		switch v := doc.(type) {
+		case string:
+			term = v
+		case json.Number:
+			term = v.String()
+		case bool:
+			term = strconv.FormatBool(v)
+		default:
+			// Objects, arrays and null aren't indexed
+			return IndexEntry{}, false
+		}
+	}
+
+	entry := IndexEntry{Key: key, Term: term}
+	if idx.def.Type == IndexNumeric {
+		score, err := strconv.ParseFloat(strings.TrimSpace(term), 64)
+		if err != nil || math.IsNaN(score) {
+			return IndexEntry{}, false
+		}
+		entry.Score = score
+		entry.Term = ""
+	}
+	return entry, true
+}
+
+// less orders entries by score or term, then by key
+func (idx *index) less(a, b IndexEntry) bool {
+	if idx.def.Type == IndexNumeric {
+		if a.Score != b.Score {
+			return a.Score < b.Score
+		}
+	} else if a.Term != b.Term {
+		return a.Term < b.Term
+	}
+	return a.Key < b.Key
+}
+
+// insert adds an entry in order. Requires the Indexes lock held.
+func (idx *index) insert(entry IndexEntry) {
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return !idx.less(idx.entries[i], entry)
+	})
+	idx.entries = append(idx.entries, IndexEntry{})
+	copy(idx.entries[i+1:], idx.entries[i:])
+	idx.entries[i] = entry
+	idx.byKey[entry.Key] = entry
+}
+
+// remove drops the entry of a key, if any. Requires the Indexes lock held.
+func (idx *index) remove(key string) {
+	entry, ok := idx.byKey[key]
+	if !ok {
+		return
+	}
+	delete(idx.byKey, key)
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return !idx.less(idx.entries[i], entry)
+	})
+	if i < len(idx.entries) && idx.entries[i].Key == key {
+		idx.entries = append(idx.entries[:i], idx.entries[i+1:]...)
+	}
+}
+
+// IndexDefs returns the index definitions saved with SaveIndexDefs
+func (e *Engine) IndexDefs() ([]IndexDef, error) {
+	file, err := e.config.FS.Open(filepath.Join(e.config.DataDir, indexDefsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Format: one "name,prefix,path,type" line per index
+	var defs []IndexDef
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		def, err := ParseIndexDef(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("invalid index definition %q: %w", scanner.Text(), err)
+		}
+		defs = append(defs, def)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// SaveIndexDefs replaces the saved index definitions atomically, so indexes
+// declared at runtime are declared again after a restart
+func (e *Engine) SaveIndexDefs(defs []IndexDef) error {
+	var sb strings.Builder
+	for _, def := range defs {
+		sb.WriteString(def.String() + "\n")
+	}
+
+	path := filepath.Join(e.config.DataDir, indexDefsFile)
+	tmpPath := path + ".tmp"
+	if err := e.config.FS.WriteFile(tmpPath, []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	if err := e.config.FS.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return e.config.FS.SyncDir(e.config.DataDir)
+}
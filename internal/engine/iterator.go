@@ -0,0 +1,339 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// IteratorOptions bound the keys an Iterator visits to [Start, End). Empty
+// bounds leave that side open.
+type IteratorOptions struct {
+	Start string
+	End   string
+}
+
+// Iterator walks the live keys of the engine in order, forward or in
+// reverse, merging the memtables and every SST with newest-wins semantics.
+// It reads a snapshot taken when it was created, so writes made while it
+// runs aren't seen, and it holds the SST files it reads, so compactions
+// don't delete them. Only one block per file is held in
+// memory at a time. Close it once done.
+//
+// An Iterator isn't safe for concurrent use.
+type Iterator struct {
+	snapshot *Snapshot
+	opts     IteratorOptions
+	layers   []iteratorLayer // newest first, which breaks version ties
+	files    []*fileHandle
+
+	sstManager *SSTManager
+	sstables   []*SSTable // held until Close
+
+	entry *Entry // the current entry, nil when not positioned at one
+	err   error
+}
+
+// iteratorLayer is one memtable or SST file as an Iterator sees it: the
+// newest version of each key written at or before the snapshot
+type iteratorLayer interface {
+	// seekGE returns the first key >= key
+	seekGE(key string) (*Entry, error)
+
+	// seekLT returns the last key < key, or the last key of all when key is
+	// empty
+	seekLT(key string) (*Entry, error)
+}
+
+// NewIterator returns an iterator over the keys in opts' bounds, positioned
+// before the first one: call Seek, SeekToFirst or SeekToLast
+func (e *Engine) NewIterator(opts IteratorOptions) (*Iterator, error) {
+	snapshot := e.GetSnapshot()
+	it := &Iterator{snapshot: snapshot, opts: opts, sstManager: e.sstManager}
+
+	// Memtables are taken before SSTs so that one flushed in between is seen
+	// twice rather than not at all
+	e.mu.RLock()
+	memtables := make([]*MemTable, 0, len(e.immutableMemtables)+1)
+	memtables = append(memtables, e.memtable)
+	for i := len(e.immutableMemtables) - 1; i >= 0; i-- {
+		memtables = append(memtables, e.immutableMemtables[i])
+	}
+	e.mu.RUnlock()
+
+	for _, mt := range memtables {
+		it.layers = append(it.layers, &memTableLayer{it: mt.Iterator(), seq: snapshot.seq})
+	}
+	it.sstables = e.sstManager.acquire()
+	for _, sst := range it.sstables {
+		if !sst.Overlaps(opts.Start, opts.End) {
+			continue
+		}
+		file, err := e.sstManager.files.acquire(sst)
+		if err != nil {
+			it.Close()
+			return nil, fmt.Errorf("SST open failed: %w", err)
+		}
+		it.files = append(it.files, file)
+		it.layers = append(it.layers, &sstLayer{sst: sst, file: file, seq: snapshot.seq, block: -1})
+	}
+	return it, nil
+}
+
+// Seek positions the iterator at the first live key >= key
+func (it *Iterator) Seek(key string) {
+	if key < it.opts.Start {
+		key = it.opts.Start
+	}
+
+	for {
+		var newest *Entry
+		for _, layer := range it.layers {
+			entry, err := layer.seekGE(key)
+			if err != nil {
+				it.fail(err)
+				return
+			}
+			if entry != nil && (newest == nil || entry.Key < newest.Key ||
+				(entry.Key == newest.Key && entry.Timestamp > newest.Timestamp)) {
+				newest = entry
+			}
+		}
+		if newest == nil || (it.opts.End != "" && newest.Key >= it.opts.End) {
+			it.entry = nil
+			return
+		}
+		if !newest.gone(it.snapshot.seq) {
+			it.entry = newest
+			return
+		}
+		key = newest.Key + "\x00" // the smallest key after it
+	}
+}
+
+// seekBefore positions the iterator at the last live key < key, or the
+// last of all when key is empty
+func (it *Iterator) seekBefore(key string) {
+	for {
+		var newest *Entry
+		for _, layer := range it.layers {
+			entry, err := layer.seekLT(key)
+			if err != nil {
+				it.fail(err)
+				return
+			}
+			if entry != nil && (newest == nil || entry.Key > newest.Key ||
+				(entry.Key == newest.Key && entry.Timestamp > newest.Timestamp)) {
+				newest = entry
+			}
+		}
+		if newest == nil || newest.Key < it.opts.Start {
+			it.entry = nil
+			return
+		}
+		if !newest.gone(it.snapshot.seq) {
+			it.entry = newest
+			return
+		}
+		key = newest.Key
+	}
+}
+
+// SeekToFirst positions the iterator at the first live key
+func (it *Iterator) SeekToFirst() {
+	it.Seek(it.opts.Start)
+}
+
+// SeekToLast positions the iterator at the last live key
+func (it *Iterator) SeekToLast() {
+	it.seekBefore(it.opts.End)
+}
+
+// Next moves to the following live key
+func (it *Iterator) Next() {
+	if it.entry != nil {
+		it.Seek(it.entry.Key + "\x00")
+	}
+}
+
+// Prev moves to the preceding live key
+func (it *Iterator) Prev() {
+	if it.entry != nil {
+		it.seekBefore(it.entry.Key)
+	}
+}
+
+// Valid reports whether the iterator is positioned at a key. It turns false
+// past either end and on errors; check Err to tell them apart.
+func (it *Iterator) Valid() bool {
+	return it.entry != nil
+}
+
+// Key returns the key at the current position
+func (it *Iterator) Key() string {
+	return it.entry.Key
+}
+
+// Value returns the value at the current position. It must not be modified.
+func (it *Iterator) Value() []byte {
+	return it.entry.Value
+}
+
+// Err returns the error that stopped the iterator, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator's snapshot and files
+func (it *Iterator) Close() {
+	it.entry = nil
+	it.snapshot.Release()
+	for _, file := range it.files {
+		file.Close()
+	}
+	it.files = nil
+	it.sstManager.release(it.sstables)
+	it.sstables = nil
+}
+
+// fail stops the iterator on err
+func (it *Iterator) fail(err error) {
+	it.entry = nil
+	if it.err == nil {
+		it.err = fmt.Errorf("SST scan failed: %w", err)
+	}
+}
+
+// memTableLayer reads a memtable for an Iterator
+type memTableLayer struct {
+	it  *MemTableIterator
+	seq int64
+}
+
+func (l *memTableLayer) seekGE(key string) (*Entry, error) {
+	for l.it.Seek(key); l.it.Valid(); l.it.Next() {
+		if entry := l.it.EntryAsOf(l.seq); entry != nil {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+func (l *memTableLayer) seekLT(key string) (*Entry, error) {
+	if key == "" {
+		l.it.SeekToLast()
+	} else if l.it.Seek(key); l.it.Valid() {
+		l.it.Prev()
+	} else {
+		l.it.SeekToLast()
+	}
+
+	for ; l.it.Valid(); l.it.Prev() {
+		if entry := l.it.EntryAsOf(l.seq); entry != nil {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// sstLayer reads an SST file for an Iterator, one data block at a time
+type sstLayer struct {
+	sst  *SSTable
+	file *fileHandle
+	seq  int64
+
+	// The loaded block (-1 for none), and the newest version of each of its
+	// keys written at or before seq
+	block   int
+	entries []*Entry
+}
+
+func (l *sstLayer) seekGE(key string) (*Entry, error) {
+	// The block holding key is the last one starting at or before it
+	i := sort.Search(len(l.sst.Index), func(i int) bool {
+		return l.sst.Index[i].Key > key
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	for ; i < len(l.sst.Index); i++ {
+		if err := l.load(i); err != nil {
+			return nil, err
+		}
+		j := sort.Search(len(l.entries), func(j int) bool {
+			return l.entries[j].Key >= key
+		})
+		if j < len(l.entries) {
+			return l.entries[j], nil
+		}
+	}
+	return nil, nil
+}
+
+func (l *sstLayer) seekLT(key string) (*Entry, error) {
+	// The last block starting before key holds any key before it
+	i := len(l.sst.Index) - 1
+	if key != "" {
+		i = sort.Search(len(l.sst.Index), func(i int) bool {
+			return l.sst.Index[i].Key >= key
+		}) - 1
+	}
+
+	for ; i >= 0; i-- {
+		if err := l.load(i); err != nil {
+			return nil, err
+		}
+		j := len(l.entries)
+		if key != "" {
+			j = sort.Search(len(l.entries), func(j int) bool {
+				return l.entries[j].Key >= key
+			})
+		}
+		if j > 0 {
+			return l.entries[j-1], nil
+		}
+	}
+	return nil, nil
+}
+
+// load decodes the i'th data block, unless it is already loaded. Blocks are
+// read straight from the file rather than through the block cache, so a
+// long iteration doesn't push hot blocks out.
+func (l *sstLayer) load(i int) error {
+	if l.block == i {
+		return nil
+	}
+
+	start, end := l.sst.blockBounds(i)
+	data := make([]byte, end-start)
+	if _, err := io.ReadFull(io.NewSectionReader(l.file, start, end-start), data); err != nil {
+		return noEOF(err)
+	}
+
+	// Versions of a key are stored newest first, and never span blocks
+	var entries []*Entry
+	reader := l.sst.records(bufio.NewReader(bytes.NewReader(data)), int64(len(data)))
+	for {
+		entry, err := l.sst.readEntry(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if entry.Timestamp > l.seq {
+			continue
+		}
+		if n := len(entries); n > 0 && entries[n-1].Key == entry.Key {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	l.block = i
+	l.entries = entries
+	return nil
+}
@@ -0,0 +1,20 @@
+package engine
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// keyLockStripes is the number of locks in a keyLocks
+const keyLockStripes = 64
+
+// keyLocks serializes read-modify-write updates of values, striping keys
+// over a fixed set of mutexes
+type keyLocks [keyLockStripes]sync.Mutex
+
+// lock returns the lock guarding updates of a key
+func (l *keyLocks) lock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &l[h.Sum32()%keyLockStripes]
+}
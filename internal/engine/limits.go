@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Default key and value size limits
+const (
+	DefaultMaxKeySize   = 100 * 1024
+	DefaultMaxValueSize = 64 << 20
+)
+
+// maxEncodedSize is the largest key or value the WAL and SST formats can
+// hold, their lengths being encoded in 32 bits
+const maxEncodedSize = math.MaxUint32
+
+// ErrKeyTooLarge and ErrValueTooLarge are returned for writes past the
+// configured MaxKeySize and MaxValueSize
+var (
+	ErrKeyTooLarge   = errors.New("key too large")
+	ErrValueTooLarge = errors.New("value too large")
+)
+
+// SizeLimits are the largest key and value a store accepts
+type SizeLimits struct {
+	MaxKeySize   int
+	MaxValueSize int64
+}
+
+// applyLimits fills in the default size limits and rejects those the
+// on-disk formats can't hold
+func (c *Config) applyLimits() error {
+	if c.MaxKeySize <= 0 {
+		c.MaxKeySize = DefaultMaxKeySize
+	}
+	if c.MaxValueSize <= 0 {
+		c.MaxValueSize = DefaultMaxValueSize
+	}
+	if int64(c.MaxKeySize) > maxEncodedSize {
+		return fmt.Errorf("max key size %d exceeds %d bytes", c.MaxKeySize, int64(maxEncodedSize))
+	}
+	if c.MaxValueSize > maxEncodedSize {
+		return fmt.Errorf("max value size %d exceeds %d bytes", c.MaxValueSize, int64(maxEncodedSize))
+	}
+	return nil
+}
+
+// checkSize returns ErrKeyTooLarge or ErrValueTooLarge if key or value is
+// past the configured limits
+func (c *Config) checkSize(key string, value []byte) error {
+	if len(key) > c.MaxKeySize {
+		return fmt.Errorf("%w: %d bytes (max %d)", ErrKeyTooLarge, len(key), c.MaxKeySize)
+	}
+	if int64(len(value)) > c.MaxValueSize {
+		return fmt.Errorf("%w: %d bytes (max %d)", ErrValueTooLarge, len(value), c.MaxValueSize)
+	}
+	return nil
+}
+
+// Limits returns the largest key and value the engine accepts
+func (e *Engine) Limits() SizeLimits {
+	return SizeLimits{MaxKeySize: e.config.MaxKeySize, MaxValueSize: e.config.MaxValueSize}
+}
+
+// Limits returns the largest key and value the store accepts
+func (m *MemStore) Limits() SizeLimits {
+	return SizeLimits{MaxKeySize: m.config.MaxKeySize, MaxValueSize: m.config.MaxValueSize}
+}
@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// manifestName is the file in the data directory listing the live SSTs.
+// Files it doesn't list are leftovers of a crashed flush or compaction and
+// are deleted on startup.
+const manifestName = "MANIFEST"
+
+// manifestHeader is the first line of a manifest. Each following line
+// describes a live SST as
+//
+//	<id> <level> <min key> <max key>
+//
+// with keys quoted as Go strings, since they may hold any bytes.
+const manifestHeader = "escabelo-manifest 1"
+
+// manifestEntry is one live SST as recorded in the manifest
+type manifestEntry struct {
+	id     int64
+	level  int
+	minKey string
+	maxKey string
+}
+
+// readManifest returns the SSTs listed in the manifest at path. It reports
+// false if there is no manifest.
+func readManifest(fs FS, path string) ([]manifestEntry, bool, error) {
+	data, err := fs.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if lines[0] != manifestHeader {
+		return nil, false, fmt.Errorf("invalid manifest: unknown header %q", lines[0])
+	}
+
+	var entries []manifestEntry
+	for i, line := range lines[1:] {
+		entry, err := parseManifestLine(line)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid manifest line %d: %w", i+2, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, true, nil
+}
+
+// parseManifestLine decodes "<id> <level> <min key> <max key>"
+func parseManifestLine(line string) (manifestEntry, error) {
+	var entry manifestEntry
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return entry, fmt.Errorf("expected id, level and key range")
+	}
+
+	var err error
+	if entry.id, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return entry, fmt.Errorf("bad id: %w", err)
+	}
+	if entry.level, err = strconv.Atoi(fields[1]); err != nil {
+		return entry, fmt.Errorf("bad level: %w", err)
+	}
+
+	rest := fields[2]
+	for _, key := range []*string{&entry.minKey, &entry.maxKey} {
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return entry, fmt.Errorf("bad key: %w", err)
+		}
+		if *key, err = strconv.Unquote(quoted); err != nil {
+			return entry, fmt.Errorf("bad key: %w", err)
+		}
+		rest = strings.TrimPrefix(rest[len(quoted):], " ")
+	}
+	if rest != "" {
+		return entry, fmt.Errorf("trailing data %q", rest)
+	}
+	return entry, nil
+}
+
+// writeManifest atomically replaces the manifest at path with one listing
+// sstables. The contents are synced before the rename, so a crash leaves
+// either the old manifest or the complete new one, and the directory after
+// it, so the new one survives.
+func writeManifest(fs FS, path string, sstables []*SSTable) error {
+	tmpPath := path + ".tmp"
+	file, err := fs.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(encodeManifest(sstables)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := fs.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return fs.SyncDir(filepath.Dir(path))
+}
+
+// encodeManifest returns the contents of a manifest listing sstables
+func encodeManifest(sstables []*SSTable) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, manifestHeader)
+	for _, sst := range sstables {
+		fmt.Fprintf(&buf, "%d %d %s %s\n", sst.ID, sst.Level, strconv.Quote(sst.MinKey), strconv.Quote(sst.MaxKey))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,84 @@
+package engine_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"escabelo/internal/engine"
+	"escabelo/internal/engine/enginetest"
+)
+
+// TestManifestDropsUnlistedSSTs leaves a whole SST the manifest doesn't
+// list and a partial one in the data directory, as a flush or compaction
+// crashing before its manifest update does: startup must delete both
+// rather than load their data
+func TestManifestDropsUnlistedSSTs(t *testing.T) {
+	config := enginetest.Config(t)
+	eng := enginetest.NewEngine(t, config)
+	if err := eng.Put("kept", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := enginetest.Close(eng); err != nil {
+		t.Fatal(err)
+	}
+
+	fixtureDir := t.TempDir()
+	enginetest.WriteSST(t, fixtureDir, []*engine.Entry{
+		{Key: "stray", Value: []byte("v1"), Timestamp: time.Now().UnixNano()},
+	})
+	fixtures, err := filepath.Glob(filepath.Join(fixtureDir, "*.sst"))
+	if err != nil || len(fixtures) != 1 {
+		t.Fatalf("SST fixture files = %v (err %v), want one", fixtures, err)
+	}
+	stray := filepath.Join(config.DataDir, "000099.sst")
+	if err := os.Rename(fixtures[0], stray); err != nil {
+		t.Fatal(err)
+	}
+	partial := filepath.Join(config.DataDir, "000100.sst.tmp")
+	if err := os.WriteFile(partial, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	eng = enginetest.NewEngine(t, config)
+	if value, found, err := eng.Get("kept"); err != nil || !found || string(value) != "v1" {
+		t.Errorf("get kept = %q (found %v, err %v), want v1", value, found, err)
+	}
+	if value, found, err := eng.Get("stray"); err != nil || found {
+		t.Errorf("get stray = %q (found %v, err %v), want not found", value, found, err)
+	}
+	for _, path := range []string{stray, partial} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still present after startup: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+// TestManifestCreatedForExistingSSTs starts the engine on a data directory
+// from before the manifest: every SST file in it is live, and is listed in
+// a new manifest
+func TestManifestCreatedForExistingSSTs(t *testing.T) {
+	config := enginetest.Config(t)
+	eng := enginetest.NewEngine(t, config)
+	model := enginetest.NewModel()
+	workload := enginetest.Workload{Keys: 500, Prefix: "key:", Operations: 2000, ValueSize: 100, DeleteRatio: 0.2, Seed: 1}
+	enginetest.Run(t, eng, model, workload.Generate())
+	if err := enginetest.Close(eng); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := filepath.Join(config.DataDir, "MANIFEST")
+	if err := os.Remove(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	eng = enginetest.NewEngine(t, config)
+	enginetest.CheckInvariants(t, eng, model)
+	if _, err := os.Stat(manifest); err != nil {
+		t.Errorf("no manifest written on startup: %v", err)
+	}
+
+	eng = enginetest.Reopen(t, eng, config)
+	enginetest.CheckInvariants(t, eng, model)
+}
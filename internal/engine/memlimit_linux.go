@@ -0,0 +1,40 @@
+//go:build linux
+
+package engine
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cgroupMemoryLimits are the cgroup v2 and v1 files holding the memory limit
+var cgroupMemoryLimits = []string{
+	"/sys/fs/cgroup/memory.max",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+// cgroupMemoryLimit returns the memory limit of the process's cgroup
+func cgroupMemoryLimit() (int64, error) {
+	for _, path := range cgroupMemoryLimits {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		value := strings.TrimSpace(string(data))
+		if value == "max" {
+			return 0, errors.New("cgroup memory is unlimited")
+		}
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		// cgroup v1 reports a huge page-aligned number when unlimited
+		if limit >= 1<<62 {
+			return 0, errors.New("cgroup memory is unlimited")
+		}
+		return limit, nil
+	}
+	return 0, errors.New("no cgroup memory limit found")
+}
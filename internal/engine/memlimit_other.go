@@ -0,0 +1,10 @@
+//go:build !linux
+
+package engine
+
+import "errors"
+
+// cgroupMemoryLimit is not supported on this platform
+func cgroupMemoryLimit() (int64, error) {
+	return 0, errors.New("cgroup memory limit detection not supported on this platform")
+}
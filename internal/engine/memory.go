@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// memoryCheckInterval is how often adaptive memtable sizing samples memory use
+const memoryCheckInterval = time.Second
+
+// Adaptive memtable sizes stay within these factors of Config.MemTableMaxSize
+const (
+	memTableShrinkFactor = 4
+	memTableGrowFactor   = 4
+)
+
+// memTableSize returns the current memtable rotation threshold
+func (e *Engine) memTableSize() int64 {
+	if size := atomic.LoadInt64(&e.memTableLimit); size > 0 {
+		return size
+	}
+	return e.config.MemTableMaxSize
+}
+
+// memoryMonitor periodically resizes the memtable to the memory headroom
+func (e *Engine) memoryMonitor(ticker Ticker) {
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			e.adaptMemTableSize()
+		case <-e.stopCh:
+			return
+		}
+	}
+}
+
+// adaptMemTableSize sets the rotation threshold to a share of the memory left
+// under the limit. The active memtable, immutable memtables waiting to be
+// flushed and flush buffers all hold copies of the data, so only a quarter of
+// the headroom is handed to a single memtable.
+func (e *Engine) adaptMemTableSize() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	used := int64(ms.Sys - ms.HeapReleased)
+
+	size := (e.config.MemoryLimit - used) / 4
+	size = max(size, e.config.MemTableMaxSize/memTableShrinkFactor)
+	size = min(size, e.config.MemTableMaxSize*memTableGrowFactor)
+
+	atomic.StoreInt64(&e.memTableLimit, size)
+
+	// Rotate right away if the memtable already exceeds a shrunken limit
+	e.mu.Lock()
+	e.memtable.SetMaxSize(size)
+	if e.memtable.IsFull() {
+		e.rotateMemTable()
+	}
+	e.mu.Unlock()
+}
@@ -0,0 +1,750 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemStore is a Store that keeps all data in memory and never touches disk,
+// for fast hermetic tests of the server, the client and applications.
+// It honors MaxVersions and DeleteRetention from its Config; settings that
+// only apply to files (flushing, compaction, WAL, disk limits) are ignored.
+type MemStore struct {
+	config Config
+	data   *MemTable
+
+	// Change log served to tail consumers, in place of the WAL
+	mu      sync.Mutex
+	changes []*WALEntry
+	acked   map[string]uint64
+	watches *watchHub
+	version int64 // the newest version applied
+
+	// snapshots pins the versions open transactions read
+	snapshots *snapshotList
+
+	// indexDefs holds the index definitions saved with SaveIndexDefs
+	indexDefs []IndexDef
+
+	// Buckets by name, each a MemStore of its own; parent is the store a
+	// bucket belongs to
+	bucketsMu sync.Mutex
+	buckets   map[string]*MemStore
+	parent    *MemStore
+
+	stats *Stats
+}
+
+// NewMemStore creates an empty in-memory store
+func NewMemStore(config Config) *MemStore {
+	if config.MaxVersions < 1 {
+		config.MaxVersions = 1
+	}
+	if config.Clock == nil {
+		config.Clock = SystemClock
+	}
+	// Limits past what the on-disk formats hold don't matter in memory
+	config.applyLimits()
+	snapshots := newSnapshotList()
+	return &MemStore{
+		config:    config,
+		data:      newMemTable(config, 0, snapshots),
+		acked:     make(map[string]uint64),
+		watches:   newWatchHub(),
+		snapshots: snapshots,
+		buckets:   make(map[string]*MemStore),
+		stats:     &Stats{},
+	}
+}
+
+// Begin starts a transaction reading the store as of now
+func (m *MemStore) Begin() *Txn {
+	m.mu.Lock()
+	seq := m.now()
+	m.snapshots.acquire(seq)
+	m.mu.Unlock()
+
+	commit := func(ops []BatchOp, seq int64) error {
+		_, err := m.writeBatch(ops, func() error {
+			for _, op := range ops {
+				if entry, found := m.data.Lookup(op.Key); found && entry.Timestamp > seq {
+					return fmt.Errorf("%w: %s", ErrConflict, op.Key)
+				}
+			}
+			return nil
+		})
+		return err
+	}
+	return &Txn{seq: seq, read: m.GetAsOf, check: m.config.checkSize, commit: commit, release: func() { m.snapshots.release(seq) }}
+}
+
+// PutIfVersion writes key only if its current version is expected, 0
+// meaning the key doesn't exist
+func (m *MemStore) PutIfVersion(key string, value []byte, expected int64) (int64, error) {
+	return m.writeBatch([]BatchOp{{Key: key, Value: value}}, m.versionCheck(key, expected))
+}
+
+// DeleteIfVersion deletes key only if its current version is expected
+func (m *MemStore) DeleteIfVersion(key string, expected int64) error {
+	_, err := m.writeBatch([]BatchOp{{Key: key, Delete: true}}, m.versionCheck(key, expected))
+	return err
+}
+
+// versionCheck returns a writeBatch check that key is at version expected
+func (m *MemStore) versionCheck(key string, expected int64) func() error {
+	return func() error {
+		var current int64
+		if entry, found := m.data.Lookup(key); found && !entry.gone(m.now()) {
+			current = entry.Timestamp
+		}
+		if current != expected {
+			return fmt.Errorf("%w: %s is at version %d", ErrVersionMismatch, key, current)
+		}
+		return nil
+	}
+}
+
+// IndexDefs returns the index definitions saved with SaveIndexDefs
+func (m *MemStore) IndexDefs() ([]IndexDef, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]IndexDef(nil), m.indexDefs...), nil
+}
+
+// SaveIndexDefs replaces the saved index definitions
+func (m *MemStore) SaveIndexDefs(defs []IndexDef) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.indexDefs = append([]IndexDef(nil), defs...)
+	return nil
+}
+
+// Put writes a key-value pair
+func (m *MemStore) Put(key string, value []byte) error {
+	_, err := m.PutVersion(key, value)
+	return err
+}
+
+// PutVersion stores a key-value pair and returns its version
+func (m *MemStore) PutVersion(key string, value []byte) (int64, error) {
+	if err := m.config.checkSize(key, value); err != nil {
+		return 0, err
+	}
+
+	entry := &Entry{Key: key, Value: value, Timestamp: m.config.Clock.Now().UnixNano()}
+	m.mu.Lock()
+	m.apply(entry)
+	m.mu.Unlock()
+
+	m.stats.mu.Lock()
+	m.stats.Writes++
+	m.stats.mu.Unlock()
+	return entry.Timestamp, nil
+}
+
+// apply stores an entry and records it in the change log. Must hold m.mu.
+func (m *MemStore) apply(entry *Entry) {
+	opType := OpTypePut
+	if entry.Deleted {
+		opType = OpTypeDelete
+	}
+
+	m.data.Apply(entry)
+	m.version = max(m.version, entry.Timestamp)
+	change := &WALEntry{
+		OpType:    opType,
+		Key:       entry.Key,
+		Value:     entry.Value,
+		Timestamp: entry.Timestamp,
+		ExpiresAt: entry.ExpiresAt,
+		Seq:       uint64(len(m.changes) + 1),
+	}
+	m.changes = append(m.changes, change)
+	m.watches.publish(change)
+}
+
+// countRead adds n to the read counter
+func (m *MemStore) countRead(n int) {
+	m.stats.mu.Lock()
+	m.stats.Reads += int64(n)
+	m.stats.mu.Unlock()
+}
+
+// now returns the current time in unix nanoseconds, which expiry is
+// checked against
+func (m *MemStore) now() int64 {
+	return m.config.Clock.Now().UnixNano()
+}
+
+// Get retrieves a value by key
+func (m *MemStore) Get(key string) ([]byte, bool, error) {
+	m.countRead(1)
+	entry, found := m.data.Lookup(key)
+	if !found {
+		return nil, false, nil
+	}
+	return entryValue(entry, m.now())
+}
+
+// GetVersion retrieves a value by key along with its version
+func (m *MemStore) GetVersion(key string) ([]byte, int64, bool, error) {
+	m.countRead(1)
+	entry, found := m.data.Lookup(key)
+	if !found || entry.gone(m.now()) {
+		return nil, 0, false, nil
+	}
+	return entry.Value, entry.Timestamp, true, nil
+}
+
+// GetAsOf retrieves the value a key held at the given time (unix nanoseconds)
+func (m *MemStore) GetAsOf(key string, asOf int64) ([]byte, bool, error) {
+	m.countRead(1)
+	for _, version := range m.data.Versions(key) {
+		if version.Timestamp <= asOf {
+			return entryValue(version, asOf)
+		}
+	}
+	return nil, false, nil
+}
+
+// MultiGet reads several keys at once, returning the values of those that exist
+func (m *MemStore) MultiGet(keys []string) (map[string][]byte, error) {
+	m.countRead(len(keys))
+	values := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if value, found := m.data.Get(key); found {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// ValueSize returns the size in bytes of the value stored for key
+func (m *MemStore) ValueSize(key string) (int64, bool, error) {
+	m.countRead(1)
+	value, found := m.data.Get(key)
+	return int64(len(value)), found, nil
+}
+
+// GetRange returns up to length bytes of the value stored for key, starting
+// at offset
+func (m *MemStore) GetRange(key string, offset, length int64) ([]byte, bool, error) {
+	m.countRead(1)
+	value, found := m.data.Get(key)
+	if !found {
+		return nil, false, nil
+	}
+	start, end := rangeBounds(int64(len(value)), offset, length)
+	return value[start:end], true, nil
+}
+
+// Meta returns metadata for a live key
+func (m *MemStore) Meta(key string) (*KeyMeta, bool, error) {
+	now := m.config.Clock.Now()
+	entry, found := m.data.Lookup(key)
+	if !found || entry.gone(now.UnixNano()) {
+		return nil, false, nil
+	}
+	return &KeyMeta{
+		Timestamp: entry.Timestamp,
+		Size:      int64(len(entry.Value)),
+		Versions:  len(m.data.Versions(key)),
+		TTL:       entryTTL(entry, now),
+		Layer:     "memory",
+	}, true, nil
+}
+
+// History returns up to limit retained versions of a key, newest first,
+// including tombstones. A limit <= 0 returns every retained version.
+func (m *MemStore) History(key string, limit int) ([]*Entry, error) {
+	versions := m.data.Versions(key)
+	if limit > 0 && len(versions) > limit {
+		versions = versions[:limit]
+	}
+	return versions, nil
+}
+
+// Delete removes a key
+func (m *MemStore) Delete(key string) (bool, error) {
+	m.mu.Lock()
+	entry, found := m.data.Lookup(key)
+	if !found || entry.gone(m.now()) {
+		m.mu.Unlock()
+		return false, nil
+	}
+
+	// Soft deletes keep the old value on the tombstone
+	var retained []byte
+	if m.config.DeleteRetention > 0 {
+		retained = entry.Value
+	}
+	m.apply(&Entry{Key: key, Value: retained, Timestamp: m.config.Clock.Now().UnixNano(), Deleted: true})
+	m.mu.Unlock()
+
+	m.stats.mu.Lock()
+	m.stats.Deletes++
+	m.stats.mu.Unlock()
+	return true, nil
+}
+
+// DeleteBlind writes a tombstone for key whether or not it exists
+func (m *MemStore) DeleteBlind(key string) error {
+	m.mu.Lock()
+	var retained []byte
+	if entry, found := m.data.Lookup(key); found && !entry.gone(m.now()) && m.config.DeleteRetention > 0 {
+		retained = entry.Value
+	}
+	m.apply(&Entry{Key: key, Value: retained, Timestamp: m.config.Clock.Now().UnixNano(), Deleted: true})
+	m.mu.Unlock()
+
+	m.stats.mu.Lock()
+	m.stats.Deletes++
+	m.stats.mu.Unlock()
+	return nil
+}
+
+// WriteBatch applies ops in order under a single lock, so readers see all of
+// them or none. Deletes write a tombstone whether or not the key exists.
+func (m *MemStore) WriteBatch(ops []BatchOp) error {
+	_, err := m.writeBatch(ops, nil)
+	return err
+}
+
+// writeBatch implements WriteBatch, returning the version of the last op.
+// check, when set, runs under m.mu before the batch is applied, and its
+// error cancels the batch.
+func (m *MemStore) writeBatch(ops []BatchOp, check func() error) (int64, error) {
+	for _, op := range ops {
+		if err := m.config.checkSize(op.Key, op.Value); err != nil {
+			return 0, err
+		}
+	}
+
+	now := m.config.Clock.Now().UnixNano()
+	var writes, deletes, version int64
+	m.mu.Lock()
+	if check != nil {
+		if err := check(); err != nil {
+			m.mu.Unlock()
+			return 0, err
+		}
+	}
+	for i, op := range ops {
+		entry := &Entry{Key: op.Key, Value: op.Value, Timestamp: now + int64(i)}
+		if op.Delete {
+			// Soft deletes keep the old value on the tombstone
+			entry.Value = nil
+			if current, found := m.data.Lookup(op.Key); found && !current.Deleted && m.config.DeleteRetention > 0 {
+				entry.Value = current.Value
+			}
+			entry.Deleted = true
+			deletes++
+		} else {
+			writes++
+		}
+		m.apply(entry)
+		version = entry.Timestamp
+	}
+	m.mu.Unlock()
+
+	m.stats.mu.Lock()
+	m.stats.Writes += writes
+	m.stats.Deletes += deletes
+	m.stats.mu.Unlock()
+	return version, nil
+}
+
+// Undelete restores a key deleted within the delete retention window
+func (m *MemStore) Undelete(key string) (bool, error) {
+	if m.config.DeleteRetention <= 0 {
+		return false, fmt.Errorf("soft deletes are disabled")
+	}
+
+	value, ok := undeleteValue(m.data.Versions(key), m.config.Clock.Now().Add(-m.config.DeleteRetention))
+	if !ok {
+		return false, nil
+	}
+	return true, m.Put(key, value)
+}
+
+// Expire makes key expire ttl from now. It returns false if the key does not
+// exist.
+func (m *MemStore) Expire(key string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, fmt.Errorf("ttl must be positive")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.config.Clock.Now()
+	entry, found := m.data.Lookup(key)
+	if !found || entry.gone(now.UnixNano()) {
+		return false, nil
+	}
+	m.apply(&Entry{Key: key, Value: entry.Value, Timestamp: now.UnixNano(), ExpiresAt: now.Add(ttl).UnixNano()})
+
+	m.stats.mu.Lock()
+	m.stats.Writes++
+	m.stats.mu.Unlock()
+	return true, nil
+}
+
+// KeysMatching returns the live keys matching a glob pattern (see
+// matchGlob), in key order. An empty pattern matches every key.
+func (m *MemStore) KeysMatching(ctx context.Context, pattern string, opts ScanOptions) ([]string, error) {
+	if err := checkGlob(pattern); err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for i, key := range m.data.Keys() {
+		if i%cancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if opts.After != "" && key <= opts.After {
+			continue
+		}
+		if pattern != "" {
+			if !matchGlob(pattern, key) {
+				continue
+			}
+		}
+		keys = append(keys, key)
+		if opts.Limit > 0 && len(keys) == opts.Limit {
+			break
+		}
+	}
+	return keys, nil
+}
+
+// PrefixScanWithOptions returns live key/value pairs with keys starting with
+// prefix, in key order
+func (m *MemStore) PrefixScanWithOptions(ctx context.Context, prefix string, opts ScanOptions) ([]KeyValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	entries := m.data.RangeEntries(prefix, prefixUpperBound(prefix))
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	now := m.now()
+	var result []KeyValue
+	for _, entry := range entries {
+		if entry.gone(now) || (opts.After != "" && entry.Key <= opts.After) {
+			continue
+		}
+		result = append(result, KeyValue{Key: entry.Key, Value: entry.Value})
+		if opts.Limit > 0 && len(result) == opts.Limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+// RangeScan returns up to limit live key/value pairs with keys in
+// [start, end), in key order. An empty end means no upper bound and a limit
+// of 0 means unlimited.
+func (m *MemStore) RangeScan(ctx context.Context, start, end string, limit int) ([]KeyValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	now := m.now()
+	var result []KeyValue
+	for _, entry := range m.data.RangeEntries(start, end) {
+		if entry.gone(now) {
+			continue
+		}
+		result = append(result, KeyValue{Key: entry.Key, Value: entry.Value})
+		if limit > 0 && len(result) == limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+// CountPrefix returns the number of live keys starting with prefix
+func (m *MemStore) CountPrefix(ctx context.Context, prefix string) (int64, error) {
+	return m.CountRange(ctx, prefix, prefixUpperBound(prefix))
+}
+
+// CountRange returns the number of live keys in [start, end). An empty end
+// means no upper bound.
+func (m *MemStore) CountRange(ctx context.Context, start, end string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	now := m.now()
+	var count int64
+	for _, entry := range m.data.RangeEntries(start, end) {
+		if !entry.gone(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// TailWAL returns up to limit changes for consumer, starting at sequence
+// number from. With from 0 it resumes after the consumer's last
+// acknowledged change. Nothing is ever truncated, so every change is kept.
+func (m *MemStore) TailWAL(consumer string, from uint64, limit int) ([]*WALEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	acked := m.acked[consumer]
+	m.acked[consumer] = acked
+	if from == 0 {
+		from = acked + 1
+	}
+	if from > uint64(len(m.changes)) {
+		return nil, nil
+	}
+
+	changes := m.changes[from-1:]
+	if limit > 0 && len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return append([]*WALEntry(nil), changes...), nil
+}
+
+// ReadWAL returns up to limit changes from sequence number from on, without
+// registering a consumer
+func (m *MemStore) ReadWAL(from uint64, limit int) ([]*WALEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if from == 0 {
+		from = 1
+	}
+	if from > uint64(len(m.changes)) {
+		return nil, nil
+	}
+	changes := m.changes[from-1:]
+	if limit > 0 && len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return append([]*WALEntry(nil), changes...), nil
+}
+
+// LastSeq returns the sequence number of the last change
+func (m *MemStore) LastSeq() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return uint64(len(m.changes))
+}
+
+// Watch returns a watcher for the changes to keys with prefix made from now
+// on
+func (m *MemStore) Watch(prefix string) *Watcher {
+	return m.watches.watch(prefix)
+}
+
+// AckWAL records that consumer has processed every change up to seq
+func (m *MemStore) AckWAL(consumer string, seq uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if last := uint64(len(m.changes)); seq > last {
+		return fmt.Errorf("sequence %d not yet written (last is %d)", seq, last)
+	}
+	acked, known := m.acked[consumer]
+	if !known {
+		return fmt.Errorf("unknown consumer: %s", consumer)
+	}
+	if seq > acked {
+		m.acked[consumer] = seq
+	}
+	return nil
+}
+
+// Consumers returns the acknowledged position of every WAL tail consumer
+func (m *MemStore) Consumers() map[string]uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	acked := make(map[string]uint64, len(m.acked))
+	for consumer, seq := range m.acked {
+		acked[consumer] = seq
+	}
+	return acked
+}
+
+// MerkleTree builds a merkle tree over the store's contents
+func (m *MemStore) MerkleTree(depth int) (*MerkleTree, error) {
+	if err := checkMerkleDepth(depth); err != nil {
+		return nil, err
+	}
+	return buildMerkleTree(m.collectEntries(func(string) bool { return true }), depth), nil
+}
+
+// BucketEntries returns all entries (including tombstones) in a leaf bucket
+func (m *MemStore) BucketEntries(depth, bucket int) ([]*Entry, error) {
+	if err := checkMerkleBucket(depth, bucket); err != nil {
+		return nil, err
+	}
+	entries := m.collectEntries(func(key string) bool {
+		return BucketOf(key, depth) == bucket
+	})
+	return sortedEntries(entries), nil
+}
+
+// ApplyEntry applies an entry received from a peer if it is newer than the
+// local version. It returns whether the entry was applied.
+func (m *MemStore) ApplyEntry(entry *Entry) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, ok := m.data.Lookup(entry.Key); ok && existing.Timestamp >= entry.Timestamp {
+		return false, nil
+	}
+	m.apply(&Entry{
+		Key:       entry.Key,
+		Value:     entry.Value,
+		Timestamp: entry.Timestamp,
+		Deleted:   entry.Deleted,
+		ExpiresAt: entry.ExpiresAt,
+	})
+	return true, nil
+}
+
+// ApplyBatch applies entries made elsewhere, such as by a Stage, keeping
+// their versions, under a single lock. An entry that isn't newer than its
+// key's current version is skipped, so applying entries again is harmless.
+func (m *MemStore) ApplyBatch(entries []*Entry) error {
+	var writes, deletes int64
+	m.mu.Lock()
+	for _, entry := range entries {
+		if existing, ok := m.data.Lookup(entry.Key); ok && existing.Timestamp >= entry.Timestamp {
+			continue
+		}
+		m.apply(&Entry{
+			Key:       entry.Key,
+			Value:     entry.Value,
+			Timestamp: entry.Timestamp,
+			Deleted:   entry.Deleted,
+			ExpiresAt: entry.ExpiresAt,
+		})
+		if entry.Deleted {
+			deletes++
+		} else {
+			writes++
+		}
+	}
+	m.mu.Unlock()
+
+	m.stats.mu.Lock()
+	m.stats.Writes += writes
+	m.stats.Deletes += deletes
+	m.stats.mu.Unlock()
+	return nil
+}
+
+// collectEntries returns the current entry of every matching key,
+// tombstones included
+func (m *MemStore) collectEntries(match func(key string) bool) map[string]*Entry {
+	result := make(map[string]*Entry)
+	for _, entry := range m.data.RangeEntries("", "") {
+		if match(entry.Key) {
+			result[entry.Key] = entry
+		}
+	}
+	return result
+}
+
+// GetStats returns current store statistics
+func (m *MemStore) GetStats() Stats {
+	m.stats.mu.RLock()
+	defer m.stats.mu.RUnlock()
+
+	return Stats{
+		Writes:        m.stats.Writes,
+		Reads:         m.stats.Reads,
+		Deletes:       m.stats.Deletes,
+		MemTableSize:  m.data.Size(),
+		MemTableLimit: m.config.MemTableMaxSize,
+		Durability:    DurabilityNever,
+	}
+}
+
+// Sync does nothing: a MemStore never writes to disk
+func (m *MemStore) Sync() error {
+	return nil
+}
+
+// Backup fails with ErrBackupUnsupported: a MemStore has no files to copy
+func (m *MemStore) Backup(path string) (*BackupInfo, error) {
+	return nil, ErrBackupUnsupported
+}
+
+// PauseCompaction does nothing: a MemStore never compacts
+func (m *MemStore) PauseCompaction() {}
+
+// CompactNow does nothing: a MemStore never compacts
+func (m *MemStore) CompactNow(full bool) (int, error) {
+	return 0, nil
+}
+
+// ResumeCompaction does nothing: a MemStore never compacts
+func (m *MemStore) ResumeCompaction() {}
+
+// PauseFlush does nothing: a MemStore never flushes
+func (m *MemStore) PauseFlush() {}
+
+// ResumeFlush does nothing: a MemStore never flushes
+func (m *MemStore) ResumeFlush() {}
+
+// GetSSTableStats returns nothing: a MemStore has no SST files
+func (m *MemStore) GetSSTableStats() []SSTableStats {
+	return nil
+}
+
+// OpenBucket returns the bucket called name, creating it empty on first use
+func (m *MemStore) OpenBucket(name string) (Store, error) {
+	if m.parent != nil {
+		return m.parent.OpenBucket(name)
+	}
+	if name == DefaultBucket {
+		return m, nil
+	}
+	if !ValidBucketName(name) {
+		return nil, fmt.Errorf("invalid bucket name: %q", name)
+	}
+
+	m.bucketsMu.Lock()
+	defer m.bucketsMu.Unlock()
+	b, ok := m.buckets[name]
+	if !ok {
+		b = NewMemStore(m.config)
+		b.parent = m
+		m.buckets[name] = b
+	}
+	return b, nil
+}
+
+// Buckets returns the names of the buckets opened so far, DefaultBucket
+// first and the others sorted
+func (m *MemStore) Buckets() ([]string, error) {
+	if m.parent != nil {
+		return m.parent.Buckets()
+	}
+	m.bucketsMu.Lock()
+	defer m.bucketsMu.Unlock()
+	names := make([]string, 0, len(m.buckets))
+	for name := range m.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{DefaultBucket}, names...), nil
+}
+
+// Close is a no-op; the data is simply dropped with the store
+func (m *MemStore) Close() error {
+	return nil
+}
@@ -0,0 +1,206 @@
+package engine_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"escabelo/internal/engine"
+	"escabelo/internal/engine/enginetest"
+)
+
+// parityKeys is the keyspace of the parity test
+const parityKeys = 2000
+
+// parityKey returns the n-th key of the parity test's keyspace
+func parityKey(n int) string {
+	return fmt.Sprintf("key:%06d", n)
+}
+
+// TestMemStoreParity runs the same random operations against an engine and
+// a MemStore, checking that they answer alike as they go, and that they
+// hold the same data once the engine flushed, compacted and restarted, so
+// the MemStore is a valid model of the engine
+func TestMemStoreParity(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			config := enginetest.Config(t)
+			eng := enginetest.NewEngine(t, config)
+			mem := enginetest.NewMemStore(t)
+			model := enginetest.NewModel()
+
+			runParityOps(t, eng, mem, model, rand.New(rand.NewSource(seed)), 8000)
+			compareStores(t, eng, mem)
+			enginetest.CheckInvariants(t, mem, model)
+
+			waitFlushed(t, eng)
+			compareStores(t, eng, mem)
+
+			if _, err := eng.CompactNow(true); err != nil {
+				t.Fatalf("compact: %v", err)
+			}
+			compareStores(t, eng, mem)
+
+			eng = enginetest.Reopen(t, eng, config)
+			compareStores(t, eng, mem)
+			enginetest.CheckInvariants(t, eng, model)
+		})
+	}
+}
+
+// runParityOps applies n random puts, deletes and batches to both stores,
+// comparing their answers and reads of the keys touched
+func runParityOps(tb testing.TB, eng, mem engine.Store, model *enginetest.Model, rng *rand.Rand, n int) {
+	tb.Helper()
+	value := func() []byte {
+		v := make([]byte, 50+rng.Intn(100))
+		for i := range v {
+			v[i] = byte('a' + rng.Intn(26))
+		}
+		return v
+	}
+
+	for i := 0; i < n; i++ {
+		key := parityKey(rng.Intn(parityKeys))
+		switch p := rng.Intn(100); {
+		case p < 40:
+			v := value()
+			if err := eng.Put(key, v); err != nil {
+				tb.Fatalf("engine put %s: %v", key, err)
+			}
+			if err := mem.Put(key, v); err != nil {
+				tb.Fatalf("memstore put %s: %v", key, err)
+			}
+			model.Put(key, v)
+
+		case p < 60:
+			engDeleted, err := eng.Delete(key)
+			if err != nil {
+				tb.Fatalf("engine delete %s: %v", key, err)
+			}
+			memDeleted, err := mem.Delete(key)
+			if err != nil {
+				tb.Fatalf("memstore delete %s: %v", key, err)
+			}
+			if engDeleted != memDeleted {
+				tb.Fatalf("delete %s: engine %v, memstore %v", key, engDeleted, memDeleted)
+			}
+			if engDeleted {
+				model.Delete(key)
+			}
+
+		case p < 65:
+			if err := eng.DeleteBlind(key); err != nil {
+				tb.Fatalf("engine blind delete %s: %v", key, err)
+			}
+			if err := mem.DeleteBlind(key); err != nil {
+				tb.Fatalf("memstore blind delete %s: %v", key, err)
+			}
+			model.Delete(key)
+
+		case p < 80:
+			ops := make([]engine.BatchOp, 1+rng.Intn(5))
+			for j := range ops {
+				ops[j].Key = parityKey(rng.Intn(parityKeys))
+				if rng.Intn(4) == 0 {
+					ops[j].Delete = true
+				} else {
+					ops[j].Value = value()
+				}
+			}
+			if err := eng.WriteBatch(ops); err != nil {
+				tb.Fatalf("engine batch: %v", err)
+			}
+			if err := mem.WriteBatch(ops); err != nil {
+				tb.Fatalf("memstore batch: %v", err)
+			}
+			for _, op := range ops {
+				if op.Delete {
+					model.Delete(op.Key)
+				} else {
+					model.Put(op.Key, op.Value)
+				}
+				compareKey(tb, eng, mem, op.Key)
+			}
+
+		default:
+			compareKey(tb, eng, mem, key)
+		}
+	}
+}
+
+// compareKey fails the test if the stores read key differently
+func compareKey(tb testing.TB, eng, mem engine.Store, key string) {
+	tb.Helper()
+	engValue, engFound, err := eng.Get(key)
+	if err != nil {
+		tb.Fatalf("engine get %s: %v", key, err)
+	}
+	memValue, memFound, err := mem.Get(key)
+	if err != nil {
+		tb.Fatalf("memstore get %s: %v", key, err)
+	}
+	if engFound != memFound || !bytes.Equal(engValue, memValue) {
+		tb.Fatalf("get %s: engine %q (found %v), memstore %q (found %v)", key, engValue, engFound, memValue, memFound)
+	}
+}
+
+// compareStores fails the test if the stores hold different data, read
+// through point reads, scans, key listings and counts
+func compareStores(tb testing.TB, eng, mem engine.Store) {
+	tb.Helper()
+	ctx := context.Background()
+
+	for n := 0; n < parityKeys; n++ {
+		compareKey(tb, eng, mem, parityKey(n))
+	}
+
+	compare := func(what string, read func(store engine.Store) (any, error)) {
+		tb.Helper()
+		engResult, err := read(eng)
+		if err != nil {
+			tb.Fatalf("engine %s: %v", what, err)
+		}
+		memResult, err := read(mem)
+		if err != nil {
+			tb.Fatalf("memstore %s: %v", what, err)
+		}
+		if !reflect.DeepEqual(engResult, memResult) {
+			tb.Errorf("%s differs: engine %v, memstore %v", what, engResult, memResult)
+		}
+	}
+
+	compare("prefix scan", func(store engine.Store) (any, error) {
+		return store.PrefixScanWithOptions(ctx, "key:", engine.ScanOptions{})
+	})
+	compare("paged prefix scan", func(store engine.Store) (any, error) {
+		return store.PrefixScanWithOptions(ctx, "key:001", engine.ScanOptions{After: parityKey(1050), Limit: 10})
+	})
+	compare("prefix scan in pages", func(store engine.Store) (any, error) {
+		var pairs []engine.KeyValue
+		opts := engine.ScanOptions{Limit: 7}
+		for {
+			page, err := store.PrefixScanWithOptions(ctx, "key:0001", opts)
+			if err != nil || len(page) == 0 {
+				return pairs, err
+			}
+			pairs = append(pairs, page...)
+			opts.After = page[len(page)-1].Key
+		}
+	})
+	compare("range scan", func(store engine.Store) (any, error) {
+		return store.RangeScan(ctx, parityKey(100), parityKey(300), 50)
+	})
+	compare("keys", func(store engine.Store) (any, error) {
+		return store.KeysMatching(ctx, "key:00*7", engine.ScanOptions{})
+	})
+	compare("prefix count", func(store engine.Store) (any, error) {
+		return store.CountPrefix(ctx, "key:000")
+	})
+	compare("range count", func(store engine.Store) (any, error) {
+		return store.CountRange(ctx, parityKey(500), parityKey(1500))
+	})
+}
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"sort"
 	"sync"
 	"time"
 )
@@ -11,21 +12,56 @@ type Entry struct {
 	Value     []byte
 	Timestamp int64
 	Deleted   bool
+
+	// ExpiresAt is when the entry expires (unix nanoseconds, 0 never). An
+	// expired entry reads like a tombstone.
+	ExpiresAt int64
+}
+
+// Expired reports whether the entry has expired at now (unix nanoseconds)
+func (e *Entry) Expired(now int64) bool {
+	return e.ExpiresAt != 0 && e.ExpiresAt <= now
+}
+
+// gone reports whether the entry hides its key at now: it is a tombstone or
+// has expired
+func (e *Entry) gone(now int64) bool {
+	return e.Deleted || e.Expired(now)
 }
 
-// MemTable is an in-memory sorted structure (skip list or tree-based)
+// MemTable is an in-memory sorted structure backed by a skip list. Writes
+// are serialized by mu; lookups and iterators read the list concurrently.
 type MemTable struct {
 	mu      sync.RWMutex
-	data    map[string]*Entry
+	list    *skipList
+	count   int   // keys held, tombstones included
 	size    int64 // approximate size in bytes
 	maxSize int64
+
+	// Older versions are kept on each key's node, newest first: up to
+	// maxVersions-1 of them, plus those live snapshots can still read
+	maxVersions int
+	snapshots   *snapshotList
+
+	// Time of the first and most recent writes (zero while empty)
+	firstWrite time.Time
+	lastWrite  time.Time
+
+	clock Clock
+
+	// walSegment is the WAL segment the engine appended this memtable's
+	// writes to, released once it is flushed
+	walSegment int64
 }
 
-// NewMemTable creates a new memtable with a size limit
-func NewMemTable(maxSize int64) *MemTable {
+// NewMemTable creates a new memtable with a size limit, keeping up to
+// maxVersions versions of each key
+func NewMemTable(maxSize int64, maxVersions int) *MemTable {
 	return &MemTable{
-		data:    make(map[string]*Entry),
-		maxSize: maxSize,
+		list:        newSkipList(),
+		maxSize:     maxSize,
+		maxVersions: maxVersions,
+		clock:       SystemClock,
 	}
 }
 
@@ -34,75 +70,150 @@ func (m *MemTable) Put(key string, value []byte) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	entry := &Entry{
+	m.set(&Entry{
 		Key:       key,
 		Value:     value,
-		Timestamp: time.Now().UnixNano(),
+		Timestamp: m.clock.Now().UnixNano(),
 		Deleted:   false,
-	}
+	})
+}
+
+// Apply stores an entry as-is, preserving its timestamp and tombstone flag
+func (m *MemTable) Apply(entry *Entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(entry)
+}
 
-	// Update size tracking
-	if old, exists := m.data[key]; exists {
-		m.size -= int64(len(old.Key) + len(old.Value))
+// set installs entry as the current version of its key. Must hold m.mu.
+func (m *MemTable) set(entry *Entry) {
+	node, created := m.list.insert(entry)
+	if created {
+		m.count++
+	} else {
+		older := append([]*Entry{node.entry.Load()}, node.older...)
+		pinned := m.snapshots.oldest()
+		for len(older) > 0 && len(older) > m.maxVersions-1 {
+			// A version superseded after a snapshot was taken is what that
+			// snapshot reads, and so are the newer ones before it
+			successor := entry
+			if len(older) > 1 {
+				successor = older[len(older)-2]
+			}
+			if successor.Timestamp > pinned {
+				break
+			}
+			dropped := older[len(older)-1]
+			m.size -= int64(len(dropped.Key) + len(dropped.Value))
+			older = older[:len(older)-1]
+		}
+		if len(older) == 0 {
+			older = nil
+		}
+		node.older = older
+		node.entry.Store(entry)
 	}
-	m.size += int64(len(key) + len(value))
+	m.size += int64(len(entry.Key) + len(entry.Value))
 
-	m.data[key] = entry
+	now := m.clock.Now()
+	if m.firstWrite.IsZero() {
+		m.firstWrite = now
+	}
+	m.lastWrite = now
 }
 
 // Get retrieves a value by key
 func (m *MemTable) Get(key string) ([]byte, bool) {
+	entry, exists := m.Lookup(key)
+	if !exists || entry.gone(m.clock.Now().UnixNano()) {
+		return nil, false
+	}
+	return entry.Value, true
+}
+
+// Lookup returns the current entry for key, including tombstones
+func (m *MemTable) Lookup(key string) (*Entry, bool) {
 	m.mu.RLock()
-	defer m.mu.RUnlock()
+	list := m.list
+	m.mu.RUnlock()
 
-	entry, exists := m.data[key]
-	if !exists || entry.Deleted {
+	node := list.get(key)
+	if node == nil {
 		return nil, false
 	}
-	return entry.Value, true
+	return node.entry.Load(), true
 }
 
-// Delete marks a key as deleted (tombstone)
-func (m *MemTable) Delete(key string) bool {
+// Versions returns all versions of a key held by the memtable, newest first
+func (m *MemTable) Versions(key string) []*Entry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	node := m.list.get(key)
+	if node == nil {
+		return nil
+	}
+	return append([]*Entry{node.entry.Load()}, node.older...)
+}
+
+// Delete writes a tombstone for key at timestamp. The retained value, if any,
+// is kept on the tombstone so the key can be undeleted. It returns false if
+// the memtable already holds a tombstone for it.
+func (m *MemTable) Delete(key string, retained []byte, timestamp int64) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	entry, exists := m.data[key]
-	if !exists || entry.Deleted {
+	if node := m.list.get(key); node != nil && node.entry.Load().Deleted {
 		return false
 	}
 
-	entry.Deleted = true
-	entry.Timestamp = time.Now().UnixNano()
+	m.set(&Entry{
+		Key:       key,
+		Value:     retained,
+		Timestamp: timestamp,
+		Deleted:   true,
+	})
 	return true
 }
 
-// Keys returns all non-deleted keys
-func (m *MemTable) Keys() []string {
+// Iterator returns an iterator over the memtable's current entries in key
+// order, positioned before the first one: call Seek or SeekToFirst
+func (m *MemTable) Iterator() *MemTableIterator {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	return &MemTableIterator{mt: m, list: m.list}
+}
 
-	keys := make([]string, 0, len(m.data))
-	for k, entry := range m.data {
-		if !entry.Deleted {
-			keys = append(keys, k)
+// Keys returns all live keys, in order
+func (m *MemTable) Keys() []string {
+	now := m.clock.Now().UnixNano()
+	var keys []string
+	it := m.Iterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if !it.Entry().gone(now) {
+			keys = append(keys, it.Key())
 		}
 	}
 	return keys
 }
 
-// PrefixScan returns all values with keys starting with prefix
-func (m *MemTable) PrefixScan(prefix string) [][]byte {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	var values [][]byte
-	for k, entry := range m.data {
-		if !entry.Deleted && len(k) >= len(prefix) && k[:len(prefix)] == prefix {
-			values = append(values, entry.Value)
-		}
+// RangeEntries returns the current entries (tombstones included) with keys
+// in [start, end), in key order. An empty end means no upper bound.
+func (m *MemTable) RangeEntries(start, end string) []*Entry {
+	var entries []*Entry
+	it := m.Iterator()
+	for it.Seek(start); it.Valid() && (end == "" || it.Key() < end); it.Next() {
+		entries = append(entries, it.Entry())
 	}
-	return values
+	return entries
+}
+
+// HasRange reports whether the memtable holds any entry with a key in
+// [start, end). An empty end means no upper bound.
+func (m *MemTable) HasRange(start, end string) bool {
+	it := m.Iterator()
+	it.Seek(start)
+	return it.Valid() && (end == "" || it.Key() < end)
 }
 
 // Size returns the approximate size in bytes
@@ -112,6 +223,21 @@ func (m *MemTable) Size() int64 {
 	return m.size
 }
 
+// Len returns the number of keys held (tombstones included)
+func (m *MemTable) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.count
+}
+
+// WriteTimes returns when the memtable was first and last written to.
+// Both are zero for an empty memtable.
+func (m *MemTable) WriteTimes() (first, last time.Time) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.firstWrite, m.lastWrite
+}
+
 // IsFull checks if memtable has reached its size limit
 func (m *MemTable) IsFull() bool {
 	m.mu.RLock()
@@ -119,14 +245,23 @@ func (m *MemTable) IsFull() bool {
 	return m.size >= m.maxSize
 }
 
-// Entries returns all entries for flushing to SST
+// SetMaxSize changes the size limit
+func (m *MemTable) SetMaxSize(maxSize int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxSize = maxSize
+}
+
+// Entries returns all entries for flushing to SST, including retained
+// older versions, ordered by key with the newest version first
 func (m *MemTable) Entries() []*Entry {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	entries := make([]*Entry, 0, len(m.data))
-	for _, entry := range m.data {
-		entries = append(entries, entry)
+	entries := make([]*Entry, 0, m.count)
+	for node := m.list.first(); node != nil; node = node.next[0].Load() {
+		entries = append(entries, node.entry.Load())
+		entries = append(entries, node.older...)
 	}
 	return entries
 }
@@ -135,6 +270,24 @@ func (m *MemTable) Entries() []*Entry {
 func (m *MemTable) Clear() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.data = make(map[string]*Entry)
+	m.list = newSkipList()
+	m.count = 0
 	m.size = 0
+	m.firstWrite = time.Time{}
+	m.lastWrite = time.Time{}
+}
+
+// sortEntries orders entries by key, newest version first. Entries already
+// in that order, as memtables return them, are left as they are.
+func sortEntries(entries []*Entry) {
+	less := func(i, j int) bool {
+		if entries[i].Key != entries[j].Key {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Timestamp > entries[j].Timestamp
+	}
+	if sort.SliceIsSorted(entries, less) {
+		return
+	}
+	sort.Slice(entries, less)
 }
@@ -0,0 +1,237 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// MaxMerkleDepth bounds the number of leaves (2^depth) in a merkle tree
+const MaxMerkleDepth = 16
+
+// MerkleTree is a binary hash tree over key-hash ranges.
+// Nodes are stored heap-style: node i has children 2i+1 and 2i+2,
+// and the 2^Depth leaves occupy the last positions.
+type MerkleTree struct {
+	Depth int
+	Nodes [][]byte
+}
+
+// Leaves returns the number of leaf buckets
+func (t *MerkleTree) Leaves() int {
+	return 1 << t.Depth
+}
+
+// Leaf returns the hash of a leaf bucket
+func (t *MerkleTree) Leaf(bucket int) []byte {
+	return t.Nodes[t.Leaves()-1+bucket]
+}
+
+// BucketOf returns the leaf bucket a key falls into for a given depth
+func BucketOf(key string, depth int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() >> (32 - uint(depth)))
+}
+
+// MerkleTree builds a merkle tree over the merged contents of all layers
+func (e *Engine) MerkleTree(depth int) (*MerkleTree, error) {
+	if err := checkMerkleDepth(depth); err != nil {
+		return nil, err
+	}
+
+	entries, err := e.collectEntries(func(string) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	return buildMerkleTree(entries, depth), nil
+}
+
+// BucketEntries returns all entries (including tombstones) in a leaf bucket
+func (e *Engine) BucketEntries(depth, bucket int) ([]*Entry, error) {
+	if err := checkMerkleBucket(depth, bucket); err != nil {
+		return nil, err
+	}
+
+	entries, err := e.collectEntries(func(key string) bool {
+		return BucketOf(key, depth) == bucket
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortedEntries(entries), nil
+}
+
+// checkMerkleDepth validates a requested tree depth
+func checkMerkleDepth(depth int) error {
+	if depth < 1 || depth > MaxMerkleDepth {
+		return fmt.Errorf("merkle depth must be between 1 and %d", MaxMerkleDepth)
+	}
+	return nil
+}
+
+// checkMerkleBucket validates a requested depth and leaf bucket
+func checkMerkleBucket(depth, bucket int) error {
+	if err := checkMerkleDepth(depth); err != nil {
+		return err
+	}
+	if bucket < 0 || bucket >= 1<<depth {
+		return fmt.Errorf("bucket %d out of range", bucket)
+	}
+	return nil
+}
+
+// buildMerkleTree hashes the newest entry of every key into a tree
+func buildMerkleTree(entries map[string]*Entry, depth int) *MerkleTree {
+	// Group entries by leaf bucket
+	leaves := 1 << depth
+	buckets := make([][]*Entry, leaves)
+	for _, entry := range entries {
+		b := BucketOf(entry.Key, depth)
+		buckets[b] = append(buckets[b], entry)
+	}
+
+	tree := &MerkleTree{
+		Depth: depth,
+		Nodes: make([][]byte, 2*leaves-1),
+	}
+	for b, bucket := range buckets {
+		tree.Nodes[leaves-1+b] = hashBucket(bucket)
+	}
+	for i := leaves - 2; i >= 0; i-- {
+		h := sha256.New()
+		h.Write(tree.Nodes[2*i+1])
+		h.Write(tree.Nodes[2*i+2])
+		tree.Nodes[i] = h.Sum(nil)
+	}
+
+	return tree
+}
+
+// sortedEntries returns the entries of a key-to-entry map in key order
+func sortedEntries(entries map[string]*Entry) []*Entry {
+	result := make([]*Entry, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// ApplyEntry applies an entry received from a peer if it is newer than the
+// local version. It returns whether the entry was applied.
+func (e *Engine) ApplyEntry(entry *Entry) (bool, error) {
+	if err := e.checkWritable(); err != nil {
+		return false, err
+	}
+
+	local, err := e.collectEntries(func(key string) bool { return key == entry.Key })
+	if err != nil {
+		return false, err
+	}
+	if existing, ok := local[entry.Key]; ok && existing.Timestamp >= entry.Timestamp {
+		return false, nil
+	}
+
+	opType := OpTypePut
+	if entry.Deleted {
+		opType = OpTypeDelete
+	}
+	walEntry := &WALEntry{
+		OpType:    opType,
+		Key:       entry.Key,
+		Value:     entry.Value,
+		Timestamp: entry.Timestamp,
+		ExpiresAt: entry.ExpiresAt,
+	}
+	e.mu.Lock()
+	if err := e.wal.Append(walEntry); err != nil {
+		e.mu.Unlock()
+		return false, fmt.Errorf("WAL append failed: %w", err)
+	}
+	e.observeVersion(entry.Timestamp)
+	e.memtable.Apply(&Entry{
+		Key:       entry.Key,
+		Value:     entry.Value,
+		Timestamp: entry.Timestamp,
+		Deleted:   entry.Deleted,
+		ExpiresAt: entry.ExpiresAt,
+	})
+	if e.needsRotation() {
+		e.rotateMemTable()
+	}
+	e.mu.Unlock()
+
+	if err := e.syncWrite(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// collectEntries merges all layers (SSTs, immutable memtables, active memtable)
+// keeping only the newest entry per key, tombstones included
+func (e *Engine) collectEntries(match func(key string) bool) (map[string]*Entry, error) {
+	result := make(map[string]*Entry)
+	merge := func(entry *Entry) {
+		if !match(entry.Key) {
+			return
+		}
+		if existing, ok := result[entry.Key]; !ok || entry.Timestamp > existing.Timestamp {
+			result[entry.Key] = entry
+		}
+	}
+
+	sstables := e.sstManager.acquire()
+	defer e.sstManager.release(sstables)
+	for _, sst := range sstables {
+		entries, err := e.sstManager.ReadAllEntries(sst)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			merge(entry)
+		}
+	}
+
+	e.mu.RLock()
+	for _, mt := range e.immutableMemtables {
+		for _, entry := range mt.Entries() {
+			merge(entry)
+		}
+	}
+	for _, entry := range e.memtable.Entries() {
+		merge(entry)
+	}
+	e.mu.RUnlock()
+
+	return result, nil
+}
+
+// hashBucket hashes the sorted contents of a bucket
+func hashBucket(entries []*Entry) []byte {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	h := sha256.New()
+	var buf [8]byte
+	for _, entry := range entries {
+		binary.LittleEndian.PutUint32(buf[:4], uint32(len(entry.Key)))
+		h.Write(buf[:4])
+		h.Write([]byte(entry.Key))
+		if entry.Deleted {
+			h.Write([]byte{1})
+			continue
+		}
+		h.Write([]byte{0})
+		binary.LittleEndian.PutUint32(buf[:4], uint32(len(entry.Value)))
+		h.Write(buf[:4])
+		h.Write(entry.Value)
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,46 @@
+package engine
+
+import "sync/atomic"
+
+// PauseCompaction stops background compactions from starting, e.g. during
+// latency-critical peaks, and waits for a running one to finish
+func (e *Engine) PauseCompaction() {
+	e.compactor.Pause()
+}
+
+// CompactNow runs a compaction cycle immediately instead of waiting for the
+// next tick, e.g. after a bulk load, and returns the number of SST files it
+// merged. full merges every file into one. It fails with
+// ErrCompactionPaused while compaction is paused.
+func (e *Engine) CompactNow(full bool) (int, error) {
+	return e.compactor.TriggerNow(full)
+}
+
+// ResumeCompaction lets background compactions run again
+func (e *Engine) ResumeCompaction() {
+	e.compactor.Resume()
+}
+
+// PauseFlush stops memtables from being flushed, so no SST file is written
+// while it is paused, and waits for a running flush to finish. Writes keep
+// going to the WAL and rotated memtables queue up in memory.
+func (e *Engine) PauseFlush() {
+	atomic.StoreInt32(&e.flushPaused, 1)
+	e.flushing.Lock()
+	e.flushing.Unlock()
+}
+
+// ResumeFlush flushes the memtables queued while paused and lets flushing
+// continue
+func (e *Engine) ResumeFlush() {
+	atomic.StoreInt32(&e.flushPaused, 0)
+	select {
+	case e.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// FlushPaused reports whether flushing is paused
+func (e *Engine) FlushPaused() bool {
+	return atomic.LoadInt32(&e.flushPaused) == 1
+}
@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"bufio"
+	"io"
+)
+
+const (
+	// prefetchChunkSize is the size of each read issued by a sequential scan
+	prefetchChunkSize = 256 * 1024
+
+	// prefetchDepth is how many chunks are read ahead of the consumer
+	prefetchDepth = 2
+)
+
+// prefetchChunk is a block of file data read ahead, or the error that ended reading
+type prefetchChunk struct {
+	data []byte
+	err  error
+}
+
+// prefetchReader reads large chunks from an underlying reader in a background
+// goroutine, so decoding one chunk overlaps with reading the next
+type prefetchReader struct {
+	chunks chan prefetchChunk
+	free   chan []byte
+	done   chan struct{}
+
+	cur []byte // unread part of the current chunk
+	buf []byte // buffer backing cur, returned to free once consumed
+	err error
+}
+
+// newPrefetchReader starts reading r ahead of the consumer. Close must be
+// called to stop the background reader.
+func newPrefetchReader(r io.Reader) *prefetchReader {
+	p := &prefetchReader{
+		chunks: make(chan prefetchChunk, prefetchDepth),
+		free:   make(chan []byte, prefetchDepth+1),
+		done:   make(chan struct{}),
+	}
+	for i := 0; i < prefetchDepth+1; i++ {
+		p.free <- make([]byte, prefetchChunkSize)
+	}
+
+	go p.fill(r)
+	return p
+}
+
+// newScanReader returns a buffered reader over r with read-ahead, and a
+// function that stops the read-ahead
+func newScanReader(r io.Reader) (*bufio.Reader, func()) {
+	p := newPrefetchReader(r)
+	return bufio.NewReader(p), p.Close
+}
+
+// fill reads chunks until EOF, an error or Close
+func (p *prefetchReader) fill(r io.Reader) {
+	for {
+		var buf []byte
+		select {
+		case buf = <-p.free:
+		case <-p.done:
+			return
+		}
+
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			select {
+			case p.chunks <- prefetchChunk{data: buf[:n]}:
+			case <-p.done:
+				return
+			}
+		}
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			select {
+			case p.chunks <- prefetchChunk{err: err}:
+			case <-p.done:
+			}
+			return
+		}
+	}
+}
+
+// Read implements io.Reader
+func (p *prefetchReader) Read(b []byte) (int, error) {
+	if len(p.cur) == 0 {
+		if p.buf != nil {
+			p.free <- p.buf[:cap(p.buf)]
+			p.buf = nil
+		}
+		if p.err != nil {
+			return 0, p.err
+		}
+
+		chunk := <-p.chunks
+		if chunk.err != nil {
+			p.err = chunk.err
+			return 0, p.err
+		}
+		p.cur = chunk.data
+		p.buf = chunk.data
+	}
+
+	n := copy(b, p.cur)
+	p.cur = p.cur[n:]
+	return n, nil
+}
+
+// Close stops the background reader
+func (p *prefetchReader) Close() {
+	close(p.done)
+}
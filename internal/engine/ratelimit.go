@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateBurst is how much unused bandwidth a rate limiter lets a writer catch
+// up on after being idle
+const rateBurst = 100 * time.Millisecond
+
+// rateLimiter paces background writes to a number of bytes per second. A
+// nil limiter doesn't limit.
+type rateLimiter struct {
+	rate  int64
+	clock Clock
+
+	// next is when the bytes granted so far are paid for
+	mu   sync.Mutex
+	next time.Time
+
+	// Writers waiting now, and total time waited in nanoseconds (accessed
+	// atomically)
+	waiting int32
+	waited  int64
+}
+
+// newRateLimiter returns a limiter to rate bytes per second, or nil when
+// rate is 0
+func newRateLimiter(rate int64, clock Clock) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate, clock: clock}
+}
+
+// wait blocks until n more bytes fit within the rate
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	now := l.clock.Now()
+	if earliest := now.Add(-rateBurst); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return
+	}
+	atomic.AddInt32(&l.waiting, 1)
+	l.clock.Sleep(delay)
+	atomic.AddInt32(&l.waiting, -1)
+	atomic.AddInt64(&l.waited, int64(delay))
+}
+
+// stats reports whether a writer is waiting now and the total time waited
+func (l *rateLimiter) stats() (bool, time.Duration) {
+	if l == nil {
+		return false, 0
+	}
+	return atomic.LoadInt32(&l.waiting) > 0, time.Duration(atomic.LoadInt64(&l.waited))
+}
+
+// limitedWriter writes through a rate limiter
+type limitedWriter struct {
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func (w limitedWriter) Write(p []byte) (int, error) {
+	w.limiter.wait(len(p))
+	return w.w.Write(p)
+}
+
+// jobSlots counts running background jobs, flushes and compactions, and
+// bounds how many run at once
+type jobSlots struct {
+	slots   chan struct{} // nil doesn't limit
+	running int64         // accessed atomically
+}
+
+// newJobSlots returns slots for n concurrent jobs, unlimited when n is 0
+func newJobSlots(n int) *jobSlots {
+	j := &jobSlots{}
+	if n > 0 {
+		j.slots = make(chan struct{}, n)
+	}
+	return j
+}
+
+// acquire waits for a free slot
+func (j *jobSlots) acquire() {
+	if j == nil {
+		return
+	}
+	if j.slots != nil {
+		j.slots <- struct{}{}
+	}
+	atomic.AddInt64(&j.running, 1)
+}
+
+// release frees a slot taken by acquire
+func (j *jobSlots) release() {
+	if j == nil {
+		return
+	}
+	atomic.AddInt64(&j.running, -1)
+	if j.slots != nil {
+		<-j.slots
+	}
+}
+
+// count returns the number of jobs running now
+func (j *jobSlots) count() int64 {
+	if j == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&j.running)
+}
@@ -0,0 +1,301 @@
+package engine
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// RestoreOptions configures Restore
+type RestoreOptions struct {
+	// WALDir holds WAL segments written after the backup, e.g. the data
+	// directory it was taken from or an archive of its segments. Those
+	// continuing the backup's segments without a gap are replayed too.
+	WALDir string
+
+	// Until drops WAL entries with versions (write timestamps, in unix
+	// nanoseconds) past it, restoring the data as of that point in time. It
+	// can't precede the backup. 0 keeps every entry.
+	Until int64
+}
+
+// RestoreInfo describes a finished restore
+type RestoreInfo struct {
+	// Seq is the version the backup was taken at
+	Seq int64
+
+	SSTs        int
+	WALSegments int
+
+	// Dropped counts WAL entries past RestoreOptions.Until
+	Dropped int
+}
+
+// Restore rebuilds dataDir, which must be empty or not exist yet, from the
+// backup at from: a directory or tar archive written by Backup. The engine
+// replays the restored WAL segments when opened on dataDir.
+func Restore(fs FS, from, dataDir string, opts RestoreOptions) (*RestoreInfo, error) {
+	files, err := fs.ReadDir(dataDir)
+	if err == nil && len(files) > 0 {
+		return nil, fmt.Errorf("data directory %s is not empty", dataDir)
+	}
+	if err := fs.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(from, ".tar") {
+		err = extractBackup(fs, from, dataDir)
+	} else {
+		err = copyBackup(fs, from, dataDir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("restore failed: %w", err)
+	}
+
+	// The BACKUP file describes the backup, not the data directory
+	backupPath := filepath.Join(dataDir, backupName)
+	seq, err := readBackupSeq(fs, backupPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.Remove(backupPath); err != nil {
+		return nil, err
+	}
+	if opts.Until > 0 && opts.Until < seq {
+		return nil, fmt.Errorf("backup at version %d is newer than %d; restore an older one", seq, opts.Until)
+	}
+
+	segments, err := listWALSegments(fs, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if opts.WALDir != "" {
+		if segments, err = appendWALSegments(fs, opts.WALDir, dataDir, segments); err != nil {
+			return nil, fmt.Errorf("restore failed: %w", err)
+		}
+	}
+
+	info := &RestoreInfo{Seq: seq, WALSegments: len(segments)}
+	if opts.Until > 0 {
+		for _, seg := range segments {
+			dropped, err := filterWALSegment(fs, seg.path, opts.Until)
+			if err != nil {
+				return nil, fmt.Errorf("restore failed: %w", err)
+			}
+			info.Dropped += dropped
+		}
+	}
+
+	manifest, _, err := readManifest(fs, filepath.Join(dataDir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	info.SSTs = len(manifest)
+
+	if err := fs.SyncDir(dataDir); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// readBackupSeq returns the version recorded in a backup's BACKUP file
+func readBackupSeq(fs FS, path string) (int64, error) {
+	data, err := fs.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, errors.New("not a complete backup: no BACKUP file")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if lines[0] != backupHeader {
+		return 0, fmt.Errorf("invalid BACKUP file: unknown header %q", lines[0])
+	}
+	for _, line := range lines[1:] {
+		if value, ok := strings.CutPrefix(line, "seq "); ok {
+			seq, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid BACKUP file: %w", err)
+			}
+			return seq, nil
+		}
+	}
+	return 0, errors.New("invalid BACKUP file: no seq")
+}
+
+// copyBackup copies the files of a backup directory to dataDir
+func copyBackup(fs FS, from, dataDir string) error {
+	files, err := fs.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if err := copyFile(fs, filepath.Join(from, file.Name()), filepath.Join(dataDir, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the file at src to dst
+func copyFile(fs FS, src, dst string) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeFileFrom(fs, dst, in)
+}
+
+// writeFileFrom writes everything r holds to a file at path, synced
+func writeFileFrom(fs FS, path string, r io.Reader) error {
+	out, err := fs.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// extractBackup extracts a backup archive to dataDir
+func extractBackup(fs FS, from, dataDir string) error {
+	file, err := fs.Open(from)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	archive := tar.NewReader(bufio.NewReader(file))
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		// Backups are flat; anything else could write outside dataDir
+		if name := header.Name; name != filepath.Base(name) || name == ".." {
+			return fmt.Errorf("unexpected file %q in backup archive", name)
+		}
+		if err := writeFileFrom(fs, filepath.Join(dataDir, header.Name), archive); err != nil {
+			return err
+		}
+	}
+}
+
+// appendWALSegments copies the segments of walDir that continue segments
+// (the backup's, oldest first) to dataDir, stopping at the first gap, and
+// returns all of them
+func appendWALSegments(fs FS, walDir, dataDir string, segments []*walSegment) ([]*walSegment, error) {
+	if len(segments) == 0 {
+		return nil, errors.New("backup holds no WAL segment to continue")
+	}
+	later, err := listWALSegments(fs, walDir)
+	if err != nil {
+		return nil, err
+	}
+
+	last := segments[len(segments)-1].id
+	for _, seg := range later {
+		if seg.id <= last {
+			continue
+		}
+		if seg.id != last+1 {
+			// Entries in between are lost, and replaying past them would
+			// restore a state that never existed
+			return nil, fmt.Errorf("WAL segment %d missing from %s", last+1, walDir)
+		}
+		path := walSegmentPath(dataDir, seg.id)
+		if err := copyFile(fs, seg.path, path); err != nil {
+			return nil, err
+		}
+		segments = append(segments, &walSegment{id: seg.id, path: path, size: seg.size})
+		last = seg.id
+	}
+	return segments, nil
+}
+
+// filterWALSegment rewrites the segment at path without the entries whose
+// versions are past until, returning how many it dropped. A batch goes as a
+// whole if any of its entries does. A torn or corrupted tail is left out,
+// as replay would cut it off anyway. Records are only bounded by what the
+// format holds, as restore doesn't know the server's size limits.
+func filterWALSegment(fs FS, path string, until int64) (int, error) {
+	in, err := fs.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	reader := newRecordReader(bufio.NewReader(in), info.Size(), SizeLimits{})
+	if err := readWALHeader(reader); err != nil {
+		if err == io.EOF || errors.Is(err, ErrCorrupt) || err == io.ErrUnexpectedEOF {
+			return 0, nil // replay discards a segment without a valid header
+		}
+		return 0, err
+	}
+	kept := []byte(walMagic)
+	dropped := 0
+	for {
+		group, _, err := readWALGroup(reader)
+		if err == io.EOF || errors.Is(err, ErrCorrupt) || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		past := false
+		for _, entry := range group {
+			past = past || entry.Timestamp > until
+		}
+		if past {
+			dropped += len(group)
+			continue
+		}
+		if len(group) > 1 {
+			header := &WALEntry{OpType: OpTypeBatch, Value: binary.LittleEndian.AppendUint32(nil, uint32(len(group)))}
+			kept = appendWALRecord(kept, header)
+		}
+		for _, entry := range group {
+			kept = appendWALRecord(kept, entry)
+		}
+	}
+	if dropped == 0 {
+		return 0, nil
+	}
+
+	tmpPath := path + ".tmp"
+	if err := writeFileFrom(fs, tmpPath, bytes.NewReader(kept)); err != nil {
+		fs.Remove(tmpPath)
+		return 0, err
+	}
+	return dropped, fs.Rename(tmpPath, path)
+}
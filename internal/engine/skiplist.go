@@ -0,0 +1,200 @@
+package engine
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+const (
+	// skipListMaxHeight bounds the levels of a skip list, enough for
+	// millions of keys with a branching factor of 4
+	skipListMaxHeight = 12
+
+	// skipListBranching is the inverse probability of a node growing a level
+	skipListBranching = 4
+)
+
+// skipNode holds the current entry of a key and the older versions kept for
+// it, newest first. Readers load the entry and links atomically; older is
+// guarded by the owning MemTable's lock.
+type skipNode struct {
+	key   string
+	entry atomic.Pointer[Entry]
+	older []*Entry
+	next  []atomic.Pointer[skipNode]
+}
+
+// skipList is an ordered map from keys to entries. Writers must be
+// serialized by the caller; readers and iterators need no lock and see
+// every insert that happened before they reached its position.
+type skipList struct {
+	head   *skipNode
+	height atomic.Int32
+	rnd    *rand.Rand // writers only
+}
+
+// newSkipList creates an empty skip list
+func newSkipList() *skipList {
+	s := &skipList{
+		head: &skipNode{next: make([]atomic.Pointer[skipNode], skipListMaxHeight)},
+		rnd:  rand.New(rand.NewSource(rand.Int63())),
+	}
+	s.height.Store(1)
+	return s
+}
+
+// randomHeight picks the level count of a new node
+func (s *skipList) randomHeight() int {
+	height := 1
+	for height < skipListMaxHeight && s.rnd.Intn(skipListBranching) == 0 {
+		height++
+	}
+	return height
+}
+
+// seek returns the first node with a key >= key, or nil. When prev is
+// non-nil it receives the last node before that position on every level.
+func (s *skipList) seek(key string, prev []*skipNode) *skipNode {
+	node := s.head
+	for level := int(s.height.Load()) - 1; level >= 0; level-- {
+		next := node.next[level].Load()
+		for next != nil && next.key < key {
+			node = next
+			next = node.next[level].Load()
+		}
+		if prev != nil {
+			prev[level] = node
+		}
+		if level == 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+// get returns the node of key, or nil
+func (s *skipList) get(key string) *skipNode {
+	node := s.seek(key, nil)
+	if node == nil || node.key != key {
+		return nil
+	}
+	return node
+}
+
+// insert links in a node holding entry if its key is missing, reporting
+// true. Otherwise it returns the key's node unchanged and false.
+func (s *skipList) insert(entry *Entry) (*skipNode, bool) {
+	key := entry.Key
+	var prev [skipListMaxHeight]*skipNode
+	if node := s.seek(key, prev[:]); node != nil && node.key == key {
+		return node, false
+	}
+
+	height := s.randomHeight()
+	if current := int(s.height.Load()); height > current {
+		for level := current; level < height; level++ {
+			prev[level] = s.head
+		}
+		s.height.Store(int32(height))
+	}
+
+	// Link bottom-up, so a reader that finds the node on a level can follow
+	// it on every level below
+	node := &skipNode{key: key, next: make([]atomic.Pointer[skipNode], height)}
+	node.entry.Store(entry)
+	for level := 0; level < height; level++ {
+		node.next[level].Store(prev[level].next[level].Load())
+		prev[level].next[level].Store(node)
+	}
+	return node, true
+}
+
+// first returns the node with the smallest key, or nil
+func (s *skipList) first() *skipNode {
+	return s.head.next[0].Load()
+}
+
+// before returns the last node with a key < key, or nil. An empty key
+// returns the node with the largest key.
+func (s *skipList) before(key string) *skipNode {
+	node := s.head
+	for level := int(s.height.Load()) - 1; level >= 0; level-- {
+		next := node.next[level].Load()
+		for next != nil && (key == "" || next.key < key) {
+			node = next
+			next = node.next[level].Load()
+		}
+	}
+	if node == s.head {
+		return nil
+	}
+	return node
+}
+
+// MemTableIterator walks a memtable's current entries (tombstones included)
+// in key order. It needs no lock and may run alongside writes, seeing each
+// key's entry as of when it reaches it.
+type MemTableIterator struct {
+	mt   *MemTable
+	list *skipList
+	node *skipNode
+}
+
+// Seek positions the iterator at the first key >= key
+func (it *MemTableIterator) Seek(key string) {
+	it.node = it.list.seek(key, nil)
+}
+
+// SeekToFirst positions the iterator at the smallest key
+func (it *MemTableIterator) SeekToFirst() {
+	it.node = it.list.first()
+}
+
+// SeekToLast positions the iterator at the largest key
+func (it *MemTableIterator) SeekToLast() {
+	it.node = it.list.before("")
+}
+
+// Valid reports whether the iterator is positioned at an entry
+func (it *MemTableIterator) Valid() bool {
+	return it.node != nil
+}
+
+// Next moves to the following key
+func (it *MemTableIterator) Next() {
+	it.node = it.node.next[0].Load()
+}
+
+// Prev moves to the preceding key. Nodes only link forward, so this
+// searches the list again.
+func (it *MemTableIterator) Prev() {
+	it.node = it.list.before(it.node.key)
+}
+
+// Key returns the key at the current position
+func (it *MemTableIterator) Key() string {
+	return it.node.key
+}
+
+// Entry returns the current entry of the key at the current position
+func (it *MemTableIterator) Entry() *Entry {
+	return it.node.entry.Load()
+}
+
+// EntryAsOf returns the newest version of the key at the current position
+// written at or before asOf, or nil if the memtable holds none. Older
+// versions are only there while MaxVersions or a snapshot keeps them.
+func (it *MemTableIterator) EntryAsOf(asOf int64) *Entry {
+	if entry := it.node.entry.Load(); entry.Timestamp <= asOf {
+		return entry
+	}
+
+	it.mt.mu.RLock()
+	defer it.mt.mu.RUnlock()
+	for _, version := range it.node.older {
+		if version.Timestamp <= asOf {
+			return version
+		}
+	}
+	return nil
+}
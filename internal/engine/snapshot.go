@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// Snapshot is a consistent, read-only view of the engine as of one sequence
+// number: it sees every mutation up to it and none after, across memtables
+// and SSTs. Mutations are numbered by their versions, which strictly
+// increase. A snapshot keeps the versions it can read from being dropped, so
+// release it once done.
+type Snapshot struct {
+	engine   *Engine
+	seq      int64
+	released int32
+}
+
+// GetSnapshot returns a snapshot of the engine's current state
+func (e *Engine) GetSnapshot() *Snapshot {
+	// Versions are assigned under e.mu, so no write is half-way between
+	// taking its version and being pinned against
+	e.mu.Lock()
+	seq := e.lastVersion
+	e.snapshots.acquire(seq)
+	e.mu.Unlock()
+
+	return &Snapshot{engine: e, seq: seq}
+}
+
+// Seq returns the sequence number the snapshot reads at
+func (s *Snapshot) Seq() int64 {
+	return s.seq
+}
+
+// Get retrieves the value key held in the snapshot
+func (s *Snapshot) Get(key string) ([]byte, bool, error) {
+	return s.engine.GetAsOf(key, s.seq)
+}
+
+// MultiGet reads several keys from the snapshot, returning the values of
+// those that exist
+func (s *Snapshot) MultiGet(keys []string) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		value, found, err := s.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// Release unpins the snapshot's versions. Releasing twice is a no-op.
+func (s *Snapshot) Release() {
+	if atomic.CompareAndSwapInt32(&s.released, 0, 1) {
+		s.engine.snapshots.release(s.seq)
+	}
+}
+
+// snapshotList tracks the sequence numbers of live snapshots
+type snapshotList struct {
+	mu   sync.Mutex
+	live map[int64]int // snapshots per sequence number
+
+	// Oldest live sequence number, or math.MaxInt64 with none (accessed
+	// atomically, as memtable writes consult it)
+	min int64
+}
+
+func newSnapshotList() *snapshotList {
+	return &snapshotList{live: make(map[int64]int), min: math.MaxInt64}
+}
+
+// acquire pins seq
+func (l *snapshotList) acquire(seq int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.live[seq]++
+	if seq < atomic.LoadInt64(&l.min) {
+		atomic.StoreInt64(&l.min, seq)
+	}
+}
+
+// release unpins seq
+func (l *snapshotList) release(seq int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.live[seq]--; l.live[seq] > 0 {
+		return
+	}
+	delete(l.live, seq)
+
+	min := int64(math.MaxInt64)
+	for live := range l.live {
+		if live < min {
+			min = live
+		}
+	}
+	atomic.StoreInt64(&l.min, min)
+}
+
+// oldest returns the oldest pinned sequence number, or math.MaxInt64 when
+// no snapshot is live. A version is still visible to some snapshot if its
+// successor is newer than this.
+func (l *snapshotList) oldest() int64 {
+	if l == nil {
+		return math.MaxInt64
+	}
+	return atomic.LoadInt64(&l.min)
+}
+
+// count returns the number of live snapshots
+func (l *snapshotList) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, refs := range l.live {
+		n += refs
+	}
+	return n
+}
@@ -2,37 +2,160 @@ package engine
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // SSTable represents a sorted string table (immutable on-disk segment)
 type SSTable struct {
 	ID       int64
 	FilePath string
-	Index    map[string]int64 // sparse index: key -> file offset
+	Index    []BlockHandle // data blocks, in key order
 	MinKey   string
 	MaxKey   string
 	Size     int64
+
+	// Level is the file's compaction level or size tier, recorded in the
+	// manifest. Flushed files start at level 0; a file's level is never
+	// below that of a newer file, so each level is a contiguous run of the
+	// newest-first file list.
+	Level int
+
+	// DataSize is where the data blocks end and the index block begins
+	DataSize int64
+
+	// checksums is set when records carry a checksum, which files written
+	// before the block format lack
+	checksums bool
+
+	// indexed is set when the file ends with an index block, so loading it
+	// reads only that; other files have their index rebuilt from every record
+	indexed bool
+
+	// limits bound the key and value lengths its records may hold
+	limits SizeLimits
+
+	// Record counts: all entries (versions included), tombstones and distinct
+	// keys. Records that had expired when the file was written count as
+	// tombstones; those expiring later are counted in ExpiringCount instead,
+	// as rewriting the file wouldn't drop them yet.
+	EntryCount     int64
+	TombstoneCount int64
+	KeyCount       int64
+	ExpiringCount  int64
+
+	CreatedAt time.Time
+
+	// Point lookups that searched this file, and those it answered
+	reads int64
+	hits  int64
+
+	// refs counts the reads holding the file, plus one while it is live
+	// (accessed atomically). A file dropped from the live set is only
+	// deleted once it drops to 0, so reads that started before keep going.
+	refs int32
+}
+
+// cancelCheckInterval is how many entries a scan reads between checks of its context
+const cancelCheckInterval = 1024
+
+// BlockHandle locates a data block: the first key it holds and its offset
+type BlockHandle struct {
+	Key    string
+	Offset int64
 }
 
+// An SST file is a run of data blocks holding records in key order, an index
+// block and a fixed-size footer. Each record is
+//
+//	crc(4) + timestamp(8) + flags(1) + keyLen(4) + [expiresAt(8)] +
+//	[codec(1) + rawLen(4)] + key + valueLen(4) + value
+//
+// where crc is the CRC-32C of the rest of the record. Flags mark tombstones
+// and which optional fields are present. A compressed value is stored as
+// valueLen bytes of codec output that decompress to rawLen bytes. The file is laid out as
+//
+//	data blocks | index block | footer: indexOffset(8) + magic(8)
+//
+// Files written before records carried checksums are given an index block
+// and footer on startup, with their own magic, so they're read the same way.
+//
+// The index block stores the file's metadata and a handle for every block:
+//
+//	entries(8) + tombstones(8) + keys(8) + minKey + maxKey + blocks(4) +
+//	(key + offset(8)) per block + expiring(8)
+//
+// Strings are a keyLen(4) prefix followed by the bytes. Loading a file reads
+// only its footer and index block. Files written before expiring was added
+// end their index block after the block handles; their tombstones count
+// records expiring later too.
+const (
+	// sstBlockSize is the size at which a data block is closed. Blocks only
+	// start at a key's newest version, so all versions of a key share a block.
+	sstBlockSize = 4096
+
+	sstFooterSize  = 16
+	sstMagic       = uint64(0x3130626c65637365) // "escelb01"
+	sstMagicLegacy = uint64(0x3030626c65637365) // "escelb00", records without checksums
+)
+
 // SSTManager manages multiple SST files
 type SSTManager struct {
 	mu       sync.RWMutex
 	sstables []*SSTable
 	dataDir  string
 	nextID   int64
+	fs       FS
+	clock    Clock
+
+	// codec compresses the values of new files
+	codec byte
+
+	// limits are the configured key and value size limits; records past
+	// them are reported as corrupt
+	limits SizeLimits
+
+	// cache holds recently read data blocks (nil disables it), and files
+	// keeps files open between reads
+	cache *blockCache
+	files *fileCache
+
+	// flushLimit and compactionLimit pace the writes of flushes and
+	// compactions (nil doesn't limit); flushed and compacted count the bytes
+	// they wrote (accessed atomically)
+	flushLimit      *rateLimiter
+	compactionLimit *rateLimiter
+	flushed         int64
+	compacted       int64
 }
 
 // NewSSTManager creates a new SST manager
 func NewSSTManager(dataDir string) (*SSTManager, error) {
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+	return OpenSSTManager(OSFS, SystemClock, dataDir)
+}
+
+// OpenSSTManager creates an SST manager for files on fs, dating new files
+// with clock
+func OpenSSTManager(fs FS, clock Clock, dataDir string) (*SSTManager, error) {
+	return openSSTManager(fs, clock, dataDir, SizeLimits{MaxKeySize: DefaultMaxKeySize, MaxValueSize: DefaultMaxValueSize})
+}
+
+// openSSTManager implements OpenSSTManager, reporting records of keys or
+// values past limits as corrupt
+func openSSTManager(fs FS, clock Clock, dataDir string, limits SizeLimits) (*SSTManager, error) {
+	if err := fs.MkdirAll(dataDir, 0755); err != nil {
 		return nil, err
 	}
 
@@ -40,6 +163,10 @@ func NewSSTManager(dataDir string) (*SSTManager, error) {
 		sstables: make([]*SSTable, 0),
 		dataDir:  dataDir,
 		nextID:   1,
+		fs:       fs,
+		clock:    clock,
+		files:    newFileCache(fs, 0),
+		limits:   limits,
 	}
 
 	// Load existing SST files
@@ -50,38 +177,84 @@ func NewSSTManager(dataDir string) (*SSTManager, error) {
 	return manager, nil
 }
 
-// loadExistingSSTables scans the data directory for existing SST files
+// loadExistingSSTables loads the SST files listed in the manifest and
+// deletes any others. A data directory without a manifest has every SST
+// file loaded, and gets a manifest listing them.
 func (sm *SSTManager) loadExistingSSTables() error {
-	files, err := os.ReadDir(sm.dataDir)
+	entries, found, err := readManifest(sm.fs, sm.manifestPath())
+	if err != nil {
+		return err
+	}
+
+	files, err := sm.fs.ReadDir(sm.dataDir)
 	if err != nil {
 		return err
 	}
 
+	live := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		live[filepath.Base(sm.sstPath(entry.id))] = true
+	}
+
 	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".sst") {
-			path := filepath.Join(sm.dataDir, file.Name())
-			sst, err := sm.loadSSTable(path)
-			if err != nil {
-				return fmt.Errorf("failed to load SST %s: %w", path, err)
-			}
-			sm.sstables = append(sm.sstables, sst)
-			if sst.ID >= sm.nextID {
-				sm.nextID = sst.ID + 1
+		name := file.Name()
+		if file.IsDir() {
+			continue
+		}
+
+		// Leftovers of a flush or compaction that crashed before the
+		// manifest listed their output
+		if strings.HasSuffix(name, ".sst.tmp") || (found && strings.HasSuffix(name, ".sst") && !live[name]) {
+			slog.Warn("Removing SST not listed in the manifest", "file", name)
+			if err := sm.fs.Remove(filepath.Join(sm.dataDir, name)); err != nil {
+				return err
 			}
+			continue
+		}
+		if !found && strings.HasSuffix(name, ".sst") {
+			entries = append(entries, manifestEntry{id: sstID(name)})
 		}
 	}
 
-	// Sort by ID (newest first for reads)
-	sort.Slice(sm.sstables, func(i, j int) bool {
-		return sm.sstables[i].ID > sm.sstables[j].ID
-	})
+	for _, entry := range entries {
+		path := sm.sstPath(entry.id)
+		sst, err := sm.loadSSTable(path)
+		if err != nil {
+			return fmt.Errorf("failed to load SST %s: %w", path, err)
+		}
+		sst.Level = entry.level
+		sm.sstables = append(sm.sstables, sst)
+		if sst.ID >= sm.nextID {
+			sm.nextID = sst.ID + 1
+		}
+	}
 
+	// The manifest lists files newest first, which is the read order.
+	// Without one, files are only ever flushed in ID order.
+	if !found {
+		sort.Slice(sm.sstables, func(i, j int) bool {
+			return sm.sstables[i].ID > sm.sstables[j].ID
+		})
+		return writeManifest(sm.fs, sm.manifestPath(), sm.sstables)
+	}
 	return nil
 }
 
-// loadSSTable loads an SST file and builds its index
+// sstID parses the ID from an SST file name (e.g., "000001.sst")
+func sstID(name string) int64 {
+	var id int64
+	fmt.Sscanf(name, "%d.sst", &id)
+	return id
+}
+
+// manifestPath returns the path of the manifest
+func (sm *SSTManager) manifestPath() string {
+	return filepath.Join(sm.dataDir, manifestName)
+}
+
+// loadSSTable loads an SST file's metadata and block index
 func (sm *SSTManager) loadSSTable(path string) (*SSTable, error) {
-	file, err := os.Open(path)
+	file, err := sm.fs.Open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -92,86 +265,159 @@ func (sm *SSTManager) loadSSTable(path string) (*SSTable, error) {
 		return nil, err
 	}
 
-	// Parse ID from filename (e.g., "000001.sst")
-	name := filepath.Base(path)
-	var id int64
-	fmt.Sscanf(name, "%d.sst", &id)
-
 	sst := &SSTable{
-		ID:       id,
-		FilePath: path,
-		Index:    make(map[string]int64),
-		Size:     stat.Size(),
+		ID:        sstID(filepath.Base(path)),
+		FilePath:  path,
+		Size:      stat.Size(),
+		CreatedAt: stat.ModTime(),
+		limits:    sm.limits,
+		refs:      1,
 	}
 
-	// Build sparse index by reading the file
-	reader := bufio.NewReader(file)
-	var offset int64
-	var firstKey, lastKey string
-	entryCount := 0
-
-	for {
-		startOffset := offset
-
-		// Read entry: timestamp(8) + deleted(1) + keyLen(4) + key + valueLen(4) + value
-		var timestamp int64
-		if err := binary.Read(reader, binary.LittleEndian, &timestamp); err != nil {
-			if err == io.EOF {
-				break
-			}
+	found, err := sst.readIndexBlock(file)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		// Files written before the block format end without a footer:
+		// rebuild the index by reading every record
+		if err := sst.rebuildIndex(file, sm.clock.Now().UnixNano()); err != nil {
 			return nil, err
 		}
-		offset += 8
+	}
 
-		// Read deleted flag (not used in index building)
-		_, err = reader.ReadByte()
-		if err != nil {
-			return nil, err
-		}
-		offset += 1
+	return sst, nil
+}
 
-		var keyLen uint32
-		if err := binary.Read(reader, binary.LittleEndian, &keyLen); err != nil {
-			return nil, err
-		}
-		offset += 4
+// readIndexBlock loads the metadata and block index from the file's footer
+// and index block. It reports false if the file has no footer.
+func (sst *SSTable) readIndexBlock(file File) (bool, error) {
+	if sst.Size < sstFooterSize {
+		return false, nil
+	}
+	if _, err := file.Seek(sst.Size-sstFooterSize, 0); err != nil {
+		return false, err
+	}
+	var footer [sstFooterSize]byte
+	if _, err := io.ReadFull(file, footer[:]); err != nil {
+		return false, err
+	}
+	magic := binary.LittleEndian.Uint64(footer[8:])
+	if magic != sstMagic && magic != sstMagicLegacy {
+		return false, nil
+	}
 
-		keyBytes := make([]byte, keyLen)
-		if _, err := io.ReadFull(reader, keyBytes); err != nil {
-			return nil, err
-		}
-		offset += int64(keyLen)
-		key := string(keyBytes)
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[:8]))
+	if indexOffset < 0 || indexOffset > sst.Size-sstFooterSize {
+		return false, fmt.Errorf("corrupt SST footer: index offset %d", indexOffset)
+	}
+	if _, err := file.Seek(indexOffset, 0); err != nil {
+		return false, err
+	}
+	reader := bufio.NewReader(io.LimitReader(file, sst.Size-sstFooterSize-indexOffset))
 
-		var valueLen uint32
-		if err := binary.Read(reader, binary.LittleEndian, &valueLen); err != nil {
-			return nil, err
-		}
-		offset += 4
+	var counts [3]int64
+	if err := binary.Read(reader, binary.LittleEndian, &counts); err != nil {
+		return false, err
+	}
+	sst.EntryCount, sst.TombstoneCount, sst.KeyCount = counts[0], counts[1], counts[2]
 
-		if _, err := reader.Discard(int(valueLen)); err != nil {
-			return nil, err
-		}
-		offset += int64(valueLen)
+	var err error
+	if sst.MinKey, err = readString(reader); err != nil {
+		return false, err
+	}
+	if sst.MaxKey, err = readString(reader); err != nil {
+		return false, err
+	}
 
-		// Track first and last keys
-		if entryCount == 0 {
-			firstKey = key
+	var blocks uint32
+	if err := binary.Read(reader, binary.LittleEndian, &blocks); err != nil {
+		return false, err
+	}
+	sst.Index = make([]BlockHandle, blocks)
+	for i := range sst.Index {
+		if sst.Index[i].Key, err = readString(reader); err != nil {
+			return false, err
 		}
-		lastKey = key
-
-		// Add to sparse index (every 10th entry or so)
-		if entryCount%10 == 0 {
-			sst.Index[key] = startOffset
+		if err := binary.Read(reader, binary.LittleEndian, &sst.Index[i].Offset); err != nil {
+			return false, err
 		}
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &sst.ExpiringCount); err != nil && err != io.EOF {
+		return false, err
+	}
+
+	sst.DataSize = indexOffset
+	sst.checksums = magic == sstMagic
+	sst.indexed = true
+	return true, nil
+}
+
+// rebuildIndex reads every record of a file without an index block, which
+// holds nothing but records, and derives its metadata and block index as of
+// now (unix nanoseconds)
+func (sst *SSTable) rebuildIndex(file File, now int64) error {
+	if _, err := file.Seek(0, 0); err != nil {
+		return err
+	}
+	scan, stop := newScanReader(file)
+	defer stop()
+	reader := sst.records(scan, sst.Size)
 
-		entryCount++
+	var offset int64
+	for {
+		header, err := sst.skipEntry(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sst.track(header.entry, offset, now)
+		offset += sst.recordSize(header)
 	}
 
-	sst.MinKey = firstKey
-	sst.MaxKey = lastKey
+	sst.DataSize = offset
+	return nil
+}
+
+// track adds a record written at offset to the file's counts and key range,
+// starting a new data block at it once the current block is full. Records
+// are counted as expired or expiring as of now (unix nanoseconds).
+func (sst *SSTable) track(entry *Entry, offset, now int64) {
+	newKey := sst.EntryCount == 0 || entry.Key != sst.MaxKey
+	if newKey {
+		if len(sst.Index) == 0 || offset-sst.Index[len(sst.Index)-1].Offset >= sstBlockSize {
+			sst.Index = append(sst.Index, BlockHandle{Key: entry.Key, Offset: offset})
+		}
+		sst.KeyCount++
+	}
+	if sst.EntryCount == 0 {
+		sst.MinKey = entry.Key
+	}
+	sst.MaxKey = entry.Key
+	switch {
+	case entry.gone(now):
+		sst.TombstoneCount++
+	case entry.ExpiresAt != 0:
+		sst.ExpiringCount++
+	}
+	sst.EntryCount++
+}
 
-	return sst, nil
+// recordSize returns the encoded size of the record header was read from
+func (sst *SSTable) recordSize(header *recordHeader) int64 {
+	size := 8 + 1 + 4 + int64(len(header.entry.Key)) + 4 + int64(header.valueLen)
+	if sst.checksums {
+		size += 4
+	}
+	if header.entry.ExpiresAt != 0 {
+		size += 8
+	}
+	if header.codec != codecNone {
+		size += 5
+	}
+	return size
 }
 
 // Flush writes a memtable to a new SST file
@@ -185,233 +431,1259 @@ func (sm *SSTManager) Flush(entries []*Entry) error {
 	sm.nextID++
 	sm.mu.Unlock()
 
-	// Sort entries by key
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].Key < entries[j].Key
-	})
-
-	filename := fmt.Sprintf("%06d.sst", id)
-	path := filepath.Join(sm.dataDir, filename)
+	// Sort entries by key (newest version first)
+	sortEntries(entries)
 
-	file, err := os.Create(path)
+	// Write next to the final path and rename once complete, so the final
+	// path only ever holds a whole, synced file
+	path := sm.sstPath(id)
+	sst, err := sm.writeSST(path+".tmp", id, sliceEntries(entries), sm.flushLimit)
 	if err != nil {
+		sm.fs.Remove(path + ".tmp")
 		return err
 	}
-	defer file.Close()
+	if err := sm.fs.Rename(path+".tmp", path); err != nil {
+		sm.fs.Remove(path + ".tmp")
+		return err
+	}
+	if err := sm.fs.SyncDir(sm.dataDir); err != nil {
+		sm.fs.Remove(path)
+		return err
+	}
+	sst.FilePath = path
 
-	writer := bufio.NewWriter(file)
-	defer writer.Flush()
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 
-	sst := &SSTable{
-		ID:       id,
-		FilePath: path,
-		Index:    make(map[string]int64),
-		MinKey:   entries[0].Key,
-		MaxKey:   entries[len(entries)-1].Key,
+	// The file only becomes live once the manifest lists it
+	sstables := append([]*SSTable{sst}, sm.sstables...)
+	if err := writeManifest(sm.fs, sm.manifestPath(), sstables); err != nil {
+		sm.fs.Remove(sst.FilePath)
+		return err
 	}
+	sm.sstables = sstables
+	atomic.AddInt64(&sm.flushed, sst.Size)
 
-	var offset int64
-	for i, entry := range entries {
-		startOffset := offset
+	return nil
+}
 
-		// Write: timestamp(8) + deleted(1) + keyLen(4) + key + valueLen(4) + value
-		if err := binary.Write(writer, binary.LittleEndian, entry.Timestamp); err != nil {
-			return err
-		}
-		offset += 8
+// Replace swaps a set of SST files, a contiguous run of the newest-first
+// file list, for a single new file at level holding the entries next yields
+// (sorted by key, nil once done). They are written as they come, so a merge
+// never holds more than a key's versions in memory. The new file takes the
+// place of the inputs in the list, so it keeps their position in the read
+// order relative to untouched files. The inputs are deleted once no read
+// holds them anymore.
+func (sm *SSTManager) Replace(old []*SSTable, next func() (*Entry, error), level int) error {
+	if len(old) == 0 {
+		return nil
+	}
 
-		deleted := byte(0)
-		if entry.Deleted {
-			deleted = 1
-		}
-		if err := writer.WriteByte(deleted); err != nil {
-			return err
-		}
-		offset += 1
+	sm.mu.Lock()
+	id := sm.nextID
+	sm.nextID++
+	sm.mu.Unlock()
 
-		keyLen := uint32(len(entry.Key))
-		if err := binary.Write(writer, binary.LittleEndian, keyLen); err != nil {
+	// Write next to the final path and rename once complete, like a flush
+	path := sm.sstPath(id)
+	sst, err := sm.writeSST(path+".tmp", id, next, sm.compactionLimit)
+	if err != nil {
+		sm.fs.Remove(path + ".tmp")
+		return err
+	}
+	var replacement *SSTable
+	if sst.EntryCount == 0 {
+		// The merge dropped every entry, so nothing takes the inputs' place
+		sm.fs.Remove(path + ".tmp")
+	} else {
+		if err := sm.fs.Rename(path+".tmp", path); err != nil {
+			sm.fs.Remove(path + ".tmp")
 			return err
 		}
-		offset += 4
+		sst.FilePath = path
+		sst.Level = level
+		replacement = sst
+	}
 
-		if _, err := writer.Write([]byte(entry.Key)); err != nil {
-			return err
-		}
-		offset += int64(keyLen)
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 
-		valueLen := uint32(len(entry.Value))
-		if err := binary.Write(writer, binary.LittleEndian, valueLen); err != nil {
-			return err
-		}
-		offset += 4
+	replaced := make(map[int64]bool, len(old))
+	for _, sst := range old {
+		replaced[sst.ID] = true
+	}
 
-		if _, err := writer.Write(entry.Value); err != nil {
-			return err
+	sstables := make([]*SSTable, 0, len(sm.sstables))
+	pending := replacement
+	for _, sst := range sm.sstables {
+		if !replaced[sst.ID] {
+			sstables = append(sstables, sst)
+			continue
 		}
-		offset += int64(valueLen)
-
-		// Sparse index
-		if i%10 == 0 {
-			sst.Index[entry.Key] = startOffset
+		if pending != nil {
+			sstables = append(sstables, pending)
+			pending = nil
 		}
 	}
 
-	sst.Size = offset
+	// Drop the inputs from the manifest before deleting them. If that fails
+	// they stay live and the merged file is discarded. Writing the manifest
+	// syncs the directory, which makes the rename durable as well.
+	if err := writeManifest(sm.fs, sm.manifestPath(), sstables); err != nil {
+		if replacement != nil {
+			sm.fs.Remove(replacement.FilePath)
+		}
+		return err
+	}
+	sm.sstables = sstables
+	if replacement != nil {
+		atomic.AddInt64(&sm.compacted, replacement.Size)
+	}
 
-	sm.mu.Lock()
-	sm.sstables = append([]*SSTable{sst}, sm.sstables...)
-	sm.mu.Unlock()
+	for _, sst := range old {
+		sm.unref(sst)
+	}
 
 	return nil
 }
 
-// Get searches for a key across all SST files (newest first)
-func (sm *SSTManager) Get(key string) ([]byte, bool, error) {
-	sm.mu.RLock()
-	sstables := make([]*SSTable, len(sm.sstables))
-	copy(sstables, sm.sstables)
-	sm.mu.RUnlock()
-
-	for _, sst := range sstables {
-		// Check if key is in range
-		if key < sst.MinKey || key > sst.MaxKey {
-			continue
-		}
+// SetLevel moves SST files to level without rewriting them, by updating the
+// manifest
+func (sm *SSTManager) SetLevel(sstables []*SSTable, level int) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 
-		value, found, err := sm.getFromSST(sst, key)
-		if err != nil {
-			return nil, false, err
-		}
-		if found {
-			return value, true, nil
+	previous := make([]int, len(sstables))
+	for i, sst := range sstables {
+		previous[i] = sst.Level
+		sst.Level = level
+	}
+	if err := writeManifest(sm.fs, sm.manifestPath(), sm.sstables); err != nil {
+		for i, sst := range sstables {
+			sst.Level = previous[i]
 		}
+		return err
 	}
+	return nil
+}
 
-	return nil, false, nil
+// sstPath returns the file path for an SST ID
+func (sm *SSTManager) sstPath(id int64) string {
+	return filepath.Join(sm.dataDir, fmt.Sprintf("%06d.sst", id))
 }
 
-// getFromSST searches for a key in a specific SST file
-func (sm *SSTManager) getFromSST(sst *SSTable, key string) ([]byte, bool, error) {
-	file, err := os.Open(sst.FilePath)
+// writeSST writes the entries next yields (already sorted, nil once done)
+// to a file at path, paced by limiter, and returns its metadata. The file is
+// fsynced before returning, so it is complete by the time the manifest
+// lists it.
+func (sm *SSTManager) writeSST(path string, id int64, next func() (*Entry, error), limiter *rateLimiter) (*SSTable, error) {
+	file, err := sm.fs.Create(path)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 	defer file.Close()
 
-	// Find starting offset from sparse index
-	var startOffset int64
-	for indexKey, offset := range sst.Index {
-		if indexKey <= key {
-			if offset > startOffset {
-				startOffset = offset
-			}
-		}
+	var writer *bufio.Writer
+	if limiter != nil {
+		writer = bufio.NewWriter(limitedWriter{w: file, limiter: limiter})
+	} else {
+		writer = bufio.NewWriter(file)
 	}
 
-	if _, err := file.Seek(startOffset, 0); err != nil {
-		return nil, false, err
+	sst := &SSTable{
+		ID:        id,
+		FilePath:  path,
+		CreatedAt: sm.clock.Now(),
+		checksums: true,
+		indexed:   true,
+		limits:    sm.limits,
+		refs:      1,
 	}
 
-	reader := bufio.NewReader(file)
-
-	// Scan from startOffset
+	var offset int64
+	var record []byte
+	now := sst.CreatedAt.UnixNano()
 	for {
-		var timestamp int64
-		if err := binary.Read(reader, binary.LittleEndian, &timestamp); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, false, err
-		}
-
-		var deleted byte
-		deleted, err = reader.ReadByte()
+		entry, err := next()
 		if err != nil {
-			return nil, false, err
+			return nil, err
 		}
-
-		var keyLen uint32
-		if err := binary.Read(reader, binary.LittleEndian, &keyLen); err != nil {
-			return nil, false, err
+		if entry == nil {
+			break
 		}
+		sst.track(entry, offset, now)
 
-		keyBytes := make([]byte, keyLen)
-		if _, err := io.ReadFull(reader, keyBytes); err != nil {
-			return nil, false, err
+		value, codec := compressValue(sm.codec, entry.Value)
+		record = appendRecord(record[:0], entry, value, codec)
+		if _, err := writer.Write(record); err != nil {
+			return nil, err
 		}
-		entryKey := string(keyBytes)
+		offset += int64(len(record))
+	}
+	sst.DataSize = offset
 
-		var valueLen uint32
-		if err := binary.Read(reader, binary.LittleEndian, &valueLen); err != nil {
-			return nil, false, err
-		}
+	indexSize, err := sst.writeIndexBlock(writer)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+
+	sst.Size = sst.DataSize + indexSize + sstFooterSize
 
-		valueBytes := make([]byte, valueLen)
-		if _, err := io.ReadFull(reader, valueBytes); err != nil {
-			return nil, false, err
+	return sst, nil
+}
+
+// sliceEntries returns a function yielding entries in turn, then nil
+func sliceEntries(entries []*Entry) func() (*Entry, error) {
+	return func() (*Entry, error) {
+		if len(entries) == 0 {
+			return nil, nil
 		}
+		entry := entries[0]
+		entries = entries[1:]
+		return entry, nil
+	}
+}
 
-		if entryKey == key {
-			if deleted == 1 {
-				return nil, false, nil // tombstone
-			}
-			return valueBytes, true, nil
+// writeIndexBlock writes the metadata, block index and footer following the
+// data blocks, returning the size of the index block
+func (sst *SSTable) writeIndexBlock(writer *bufio.Writer) (int64, error) {
+	counts := [3]int64{sst.EntryCount, sst.TombstoneCount, sst.KeyCount}
+	if err := binary.Write(writer, binary.LittleEndian, counts); err != nil {
+		return 0, err
+	}
+	size := int64(len(counts) * 8)
+
+	for _, key := range []string{sst.MinKey, sst.MaxKey} {
+		if err := writeString(writer, key); err != nil {
+			return 0, err
 		}
+		size += 4 + int64(len(key))
+	}
 
-		if entryKey > key {
-			break // passed the key
+	if err := binary.Write(writer, binary.LittleEndian, uint32(len(sst.Index))); err != nil {
+		return 0, err
+	}
+	size += 4
+	for _, block := range sst.Index {
+		if err := writeString(writer, block.Key); err != nil {
+			return 0, err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, block.Offset); err != nil {
+			return 0, err
 		}
+		size += 4 + int64(len(block.Key)) + 8
+	}
+	if err := binary.Write(writer, binary.LittleEndian, sst.ExpiringCount); err != nil {
+		return 0, err
+	}
+	size += 8
+
+	magic := sstMagic
+	if !sst.checksums {
+		magic = sstMagicLegacy
+	}
+	footer := [2]uint64{uint64(sst.DataSize), magic}
+	if err := binary.Write(writer, binary.LittleEndian, footer); err != nil {
+		return 0, err
 	}
 
-	return nil, false, nil
+	return size, nil
 }
 
-// GetAllSSTables returns a copy of all SST files
-func (sm *SSTManager) GetAllSSTables() []*SSTable {
+// PersistIndexes gives the files loaded without an index block one, so the
+// next startup reads only their footers instead of every record. Each file's
+// records are copied to a temporary file, followed by the index block
+// rebuilt on load, which replaces the file once complete. It returns the
+// number of files rewritten.
+func (sm *SSTManager) PersistIndexes() (int, error) {
 	sm.mu.RLock()
-	defer sm.mu.RUnlock()
+	var pending []*SSTable
+	for _, sst := range sm.sstables {
+		if !sst.indexed {
+			pending = append(pending, sst)
+		}
+	}
+	sm.mu.RUnlock()
 
-	sstables := make([]*SSTable, len(sm.sstables))
-	copy(sstables, sm.sstables)
-	return sstables
+	for _, sst := range pending {
+		if err := sm.persistIndex(sst); err != nil {
+			return 0, fmt.Errorf("failed to persist the index of %s: %w", sst.FilePath, err)
+		}
+	}
+	if len(pending) > 0 {
+		if err := sm.fs.SyncDir(sm.dataDir); err != nil {
+			return 0, err
+		}
+	}
+	return len(pending), nil
 }
 
-// RemoveSSTable removes an SST file from the manager and deletes it
-func (sm *SSTManager) RemoveSSTable(sst *SSTable) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+// persistIndex rewrites a file with its index block and footer appended
+func (sm *SSTManager) persistIndex(sst *SSTable) error {
+	src, err := sm.fs.Open(sst.FilePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
 
-	for i, s := range sm.sstables {
-		if s.ID == sst.ID {
-			sm.sstables = append(sm.sstables[:i], sm.sstables[i+1:]...)
-			return os.Remove(sst.FilePath)
-		}
+	tmp := sst.FilePath + ".tmp"
+	dst, err := sm.fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	writer := bufio.NewWriter(dst)
+	if _, err := io.Copy(writer, io.LimitReader(src, sst.DataSize)); err != nil {
+		return err
+	}
+	indexSize, err := sst.writeIndexBlock(writer)
+	if err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	if err := sm.fs.Rename(tmp, sst.FilePath); err != nil {
+		return err
 	}
+
+	sst.Size = sst.DataSize + indexSize + sstFooterSize
+	sst.indexed = true
 	return nil
 }
 
-// GetAllKeys returns all keys from SST files using sparse index
-// This is much faster than scanning entire files
-func (sm *SSTManager) GetAllKeys() ([]string, error) {
-	sm.mu.RLock()
-	sstables := make([]*SSTable, len(sm.sstables))
-	copy(sstables, sm.sstables)
-	sm.mu.RUnlock()
-
-	keySet := make(map[string]bool)
+// writeString writes a keyLen(4)-prefixed string
+func writeString(writer *bufio.Writer, s string) error {
+	if err := binary.Write(writer, binary.LittleEndian, uint32(len(s))); err != nil {
+		return err
+	}
+	_, err := writer.WriteString(s)
+	return err
+}
 
-	// Use sparse index for quick key extraction
-	for _, sst := range sstables {
-		for key := range sst.Index {
-			keySet[key] = true
-		}
+// readString reads a keyLen(4)-prefixed string
+func readString(reader *bufio.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(reader, binary.LittleEndian, &n); err != nil {
+		return "", err
 	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(reader, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
 
-	keys := make([]string, 0, len(keySet))
-	for key := range keySet {
-		keys = append(keys, key)
+// TombstoneRatio returns the fraction of records in the file that are
+// tombstones or had expired when it was written
+func (sst *SSTable) TombstoneRatio() float64 {
+	if sst.EntryCount == 0 {
+		return 0
 	}
+	return float64(sst.TombstoneCount) / float64(sst.EntryCount)
+}
+
+// StaleRatio returns the fraction of records in the file that are versions
+// beyond the newest maxVersions of their key, which compaction drops once
+// no retention policy or snapshot needs them
+func (sst *SSTable) StaleRatio(maxVersions int) float64 {
+	stale := sst.EntryCount - sst.KeyCount*int64(max(maxVersions, 1))
+	if sst.EntryCount == 0 || stale <= 0 {
+		return 0
+	}
+	return float64(stale) / float64(sst.EntryCount)
+}
+
+// Reads returns how many point lookups have searched this file
+func (sst *SSTable) Reads() int64 {
+	return atomic.LoadInt64(&sst.reads)
+}
+
+// Hits returns how many point lookups this file answered
+func (sst *SSTable) Hits() int64 {
+	return atomic.LoadInt64(&sst.hits)
+}
+
+// Get searches for a key across all SST files (newest first)
+func (sm *SSTManager) Get(key string) ([]byte, bool, error) {
+	entry, err := sm.GetEntry(key)
+	if err != nil || entry == nil || entry.gone(sm.clock.Now().UnixNano()) {
+		return nil, false, err
+	}
+	return entry.Value, true, nil
+}
+
+// GetEntry returns the newest entry for key across all SST files, or nil if
+// none holds it. The entry may be a tombstone, which hides older files.
+func (sm *SSTManager) GetEntry(key string) (*Entry, error) {
+	sstables := sm.acquire()
+	defer sm.release(sstables)
+
+	for _, sst := range sstables {
+		// Check if key is in range
+		if key < sst.MinKey || key > sst.MaxKey {
+			continue
+		}
+
+		atomic.AddInt64(&sst.reads, 1)
+		entry, err := sm.getFromSST(sst, key)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			atomic.AddInt64(&sst.hits, 1)
+			return entry, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// MultiGet looks up several keys at once. Every file whose key range covers
+// one of the keys is searched concurrently, opening each file only once, and
+// the newest entry found for each key is returned (tombstones included).
+func (sm *SSTManager) MultiGet(keys []string) (map[string]*Entry, error) {
+	sstables := sm.acquire()
+	defer sm.release(sstables)
+
+	sorted := make([]string, len(keys))
+	copy(sorted, keys)
+	sort.Strings(sorted)
+
+	results := make([]map[string]*Entry, len(sstables))
+	errs := make([]error, len(sstables))
+	var wg sync.WaitGroup
+
+	for i, sst := range sstables {
+		var inRange []string
+		for _, key := range sorted {
+			if key >= sst.MinKey && key <= sst.MaxKey {
+				inRange = append(inRange, key)
+			}
+		}
+		if len(inRange) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, sst *SSTable, keys []string) {
+			defer wg.Done()
+			results[i], errs[i] = sm.getManyFromSST(sst, keys)
+		}(i, sst, inRange)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Resolve each key from the newest file that holds it
+	found := make(map[string]*Entry, len(keys))
+	for i, sst := range sstables {
+		for key, entry := range results[i] {
+			if _, ok := found[key]; !ok {
+				found[key] = entry
+				atomic.AddInt64(&sst.hits, 1)
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// getManyFromSST returns the newest entry in a specific SST file for each of
+// keys (sorted) that it contains
+func (sm *SSTManager) getManyFromSST(sst *SSTable, keys []string) (map[string]*Entry, error) {
+	// The file is opened on the first block the cache misses
+	var file *fileHandle
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	entries := make(map[string]*Entry)
+	reader := bufio.NewReader(nil)
+
+	for _, key := range keys {
+		atomic.AddInt64(&sst.reads, 1)
+
+		start, end := sst.blockRange(key)
+		block, ok := sm.cache.get(sst, start)
+		if !ok && start < end {
+			if file == nil {
+				var err error
+				if file, err = sm.files.acquire(sst); err != nil {
+					return nil, err
+				}
+			}
+			var err error
+			if block, err = sm.loadBlock(file, sst, start, end); err != nil {
+				return nil, err
+			}
+		}
+		reader.Reset(bytes.NewReader(block))
+		records := sst.records(reader, int64(len(block)))
+
+		for {
+			entry, err := sst.readEntry(records)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			if entry.Key == key {
+				entries[key] = entry
+				break
+			}
+			if entry.Key > key {
+				break
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// Locate finds the SST file holding the newest entry for key, returning the
+// entry (without its value) and the value length. The entry may be a tombstone.
+func (sm *SSTManager) Locate(key string) (*SSTable, *Entry, uint32, error) {
+	sstables := sm.acquire()
+	defer sm.release(sstables)
+
+	for _, sst := range sstables {
+		if key < sst.MinKey || key > sst.MaxKey {
+			continue
+		}
+
+		entry, valueLen, err := sm.getHeaderFromSST(sst, key)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if entry != nil {
+			return sst, entry, valueLen, nil
+		}
+	}
+
+	return nil, nil, 0, nil
+}
+
+// GetRange returns length bytes of the newest value of key from offset,
+// reading only that part of the record. It returns the entry (without its
+// value, possibly a tombstone) or nil if no SST holds the key.
+func (sm *SSTManager) GetRange(key string, offset, length int64) (*Entry, []byte, error) {
+	sstables := sm.acquire()
+	defer sm.release(sstables)
+
+	for _, sst := range sstables {
+		if key < sst.MinKey || key > sst.MaxKey {
+			continue
+		}
+
+		entry, value, err := sm.getRangeFromSST(sst, key, offset, length)
+		if err != nil {
+			return nil, nil, err
+		}
+		if entry != nil {
+			return entry, value, nil
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// getRangeFromSST is like getFromSST but only reads a range of the value
+func (sm *SSTManager) getRangeFromSST(sst *SSTable, key string, offset, length int64) (*Entry, []byte, error) {
+	file, reader, err := sm.openBlock(sst, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	for {
+		header, err := sst.readRecordHeader(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		entry, valueLen := header.entry, header.valueLen
+
+		if entry.Key == key && header.codec != codecNone {
+			// A compressed value has to be read whole to get at any of it
+			full, err := sst.readValue(reader, header)
+			if err != nil {
+				return nil, nil, err
+			}
+			start, end := rangeBounds(int64(len(full)), offset, length)
+			return entry, full[start:end], nil
+		}
+		if entry.Key == key {
+			start, end := rangeBounds(int64(valueLen), offset, length)
+			if _, err := reader.Discard(int(start)); err != nil {
+				return nil, nil, err
+			}
+			value := make([]byte, end-start)
+			if _, err := io.ReadFull(reader, value); err != nil {
+				return nil, nil, err
+			}
+			return entry, value, nil
+		}
+		if entry.Key > key {
+			break
+		}
+		if _, err := reader.Discard(int(valueLen)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// getHeaderFromSST is like getFromSST but skips over value bytes
+func (sm *SSTManager) getHeaderFromSST(sst *SSTable, key string) (*Entry, uint32, error) {
+	file, reader, err := sm.openBlock(sst, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	for {
+		header, err := sst.skipEntry(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		entry := header.entry
+		if entry.Key == key {
+			return entry, header.rawLen, nil
+		}
+		if entry.Key > key {
+			break
+		}
+	}
+
+	return nil, 0, nil
+}
+
+// getFromSST returns the newest entry for key in a specific SST file,
+// or nil if the file doesn't contain it
+func (sm *SSTManager) getFromSST(sst *SSTable, key string) (*Entry, error) {
+	block, err := sm.readBlock(sst, key)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := sst.records(bufio.NewReader(bytes.NewReader(block)), int64(len(block)))
+
+	// Scan the block
+	for {
+		entry, err := sst.readEntry(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if entry.Key == key {
+			return entry, nil
+		}
+
+		if entry.Key > key {
+			break // passed the key
+		}
+	}
+
+	return nil, nil
+}
+
+// Close closes the files kept open for reads
+func (sm *SSTManager) Close() {
+	sm.files.close()
+}
+
+// GetAllSSTables returns a copy of all SST files. Their files may be deleted
+// once they're replaced; reading them takes acquire.
+func (sm *SSTManager) GetAllSSTables() []*SSTable {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	sstables := make([]*SSTable, len(sm.sstables))
+	copy(sstables, sm.sstables)
+	return sstables
+}
+
+// acquire returns the live SST files, newest first, holding a reference on
+// each so they aren't deleted while read. The caller must release them.
+func (sm *SSTManager) acquire() []*SSTable {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	sstables := make([]*SSTable, len(sm.sstables))
+	copy(sstables, sm.sstables)
+	for _, sst := range sstables {
+		atomic.AddInt32(&sst.refs, 1)
+	}
+	return sstables
+}
+
+// release drops the references taken by acquire
+func (sm *SSTManager) release(sstables []*SSTable) {
+	for _, sst := range sstables {
+		sm.unref(sst)
+	}
+}
+
+// unref drops a reference on sst, deleting the file if it was dropped from
+// the live set and this was the last reference
+func (sm *SSTManager) unref(sst *SSTable) {
+	if atomic.AddInt32(&sst.refs, -1) > 0 {
+		return
+	}
+	sm.cache.evict(sst)
+	sm.files.evict(sst)
+	if err := sm.fs.Remove(sst.FilePath); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to delete SST", "file", sst.FilePath, "error", err)
+	}
+}
+
+// RemoveSSTable removes an SST file from the manager, deleting it once no
+// read holds it
+func (sm *SSTManager) RemoveSSTable(sst *SSTable) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for i, s := range sm.sstables {
+		if s.ID == sst.ID {
+			sstables := make([]*SSTable, 0, len(sm.sstables)-1)
+			sstables = append(sstables, sm.sstables[:i]...)
+			sstables = append(sstables, sm.sstables[i+1:]...)
+			if err := writeManifest(sm.fs, sm.manifestPath(), sstables); err != nil {
+				return err
+			}
+			sm.sstables = sstables
+			sm.unref(s)
+			return nil
+		}
+	}
+	return nil
+}
+
+// ReadAllEntries reads all entries from an SST file
+func (sm *SSTManager) ReadAllEntries(sst *SSTable) ([]*Entry, error) {
+	file, data, err := sm.openData(sst, 0, sst.DataSize)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Whole-file read: prefetch ahead of decoding
+	scan, stop := newScanReader(data)
+	defer stop()
+	reader := sst.records(scan, sst.DataSize)
+	var entries []*Entry
+
+	for {
+		entry, err := sst.readEntry(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// GetVersions returns every version of key stored across SST files, newest first
+func (sm *SSTManager) GetVersions(key string) ([]*Entry, error) {
+	sstables := sm.acquire()
+	defer sm.release(sstables)
+
+	var versions []*Entry
+	for _, sst := range sstables {
+		if key < sst.MinKey || key > sst.MaxKey {
+			continue
+		}
+
+		found, err := sm.getVersionsFromSST(sst, key)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, found...)
+	}
+
+	return versions, nil
+}
+
+// getVersionsFromSST collects all versions of key in a specific SST file
+func (sm *SSTManager) getVersionsFromSST(sst *SSTable, key string) ([]*Entry, error) {
+	block, err := sm.readBlock(sst, key)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := sst.records(bufio.NewReader(bytes.NewReader(block)), int64(len(block)))
+	var versions []*Entry
+
+	for {
+		entry, err := sst.readEntry(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if entry.Key == key {
+			versions = append(versions, entry)
+			continue
+		}
+		if entry.Key > key {
+			break
+		}
+	}
+
+	return versions, nil
+}
+
+// RangeEntries returns the newest entry (tombstones included) of every key
+// in [start, end) from each SST file. An empty end means no upper bound.
+// Files are scanned newest first.
+func (sm *SSTManager) RangeEntries(ctx context.Context, start, end string) ([]*Entry, error) {
+	sstables := sm.acquire()
+	defer sm.release(sstables)
+
+	var result []*Entry
+	for _, sst := range sstables {
+		if !sst.Overlaps(start, end) {
+			continue
+		}
+
+		entries, err := sm.rangeEntriesFromSST(ctx, sst, start, end)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entries...)
+	}
+
+	return result, nil
+}
+
+// Overlaps reports whether the file's key range intersects [start, end)
+func (sst *SSTable) Overlaps(start, end string) bool {
+	return sst.MaxKey >= start && (end == "" || sst.MinKey < end)
+}
+
+// MayContain reports whether key falls within the file's key range, so the
+// file may hold a version of it
+func (sst *SSTable) MayContain(key string) bool {
+	return key >= sst.MinKey && key <= sst.MaxKey
+}
+
+// rangeEntriesFromSST scans the key range [start, end) in a specific SST file
+func (sm *SSTManager) rangeEntriesFromSST(ctx context.Context, sst *SSTable, start, end string) ([]*Entry, error) {
+	offset := sst.seekOffset(start)
+	file, data, err := sm.openData(sst, offset, sst.DataSize)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scan, stop := newScanReader(data)
+	defer stop()
+	reader := sst.records(scan, sst.DataSize-offset)
+	var entries []*Entry
+	var lastKey string
+
+	for n := 0; ; n++ {
+		// Check for cancellation every so often rather than per entry
+		if n%cancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		entry, err := sst.readEntry(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if entry.Key < start {
+			continue
+		}
+		if end != "" && entry.Key >= end {
+			break // past the range
+		}
+
+		// Only the first (newest) version of each key matters
+		if len(entries) > 0 && entry.Key == lastKey {
+			continue
+		}
+		lastKey = entry.Key
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// sstIterator streams the newest entry of each key in [start, end) from one
+// SST file, in key order, or every version of each key with versions set
+type sstIterator struct {
+	sst      *SSTable
+	file     io.Closer
+	reader   *recordReader
+	stop     func()
+	start    string
+	end      string
+	versions bool
+	lastKey  string
+	started  bool
+}
+
+// newSSTIterator opens an iterator over the key range [start, end) of sst
+func (sm *SSTManager) newSSTIterator(sst *SSTable, start, end string) (*sstIterator, error) {
+	offset := sst.seekOffset(start)
+	file, data, err := sm.openData(sst, offset, sst.DataSize)
+	if err != nil {
+		return nil, err
+	}
+	scan, stop := newScanReader(data)
+	reader := sst.records(scan, sst.DataSize-offset)
+	return &sstIterator{sst: sst, file: file, reader: reader, stop: stop, start: start, end: end}, nil
+}
+
+// next returns the following entry (tombstones included), or nil past the
+// end of the range
+func (it *sstIterator) next() (*Entry, error) {
+	for {
+		entry, err := it.sst.readEntry(it.reader)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.Key < it.start {
+			continue
+		}
+		if it.end != "" && entry.Key >= it.end {
+			return nil, nil
+		}
+
+		// Only the first (newest) version of each key matters, unless
+		// every version was asked for
+		if !it.versions && it.started && entry.Key == it.lastKey {
+			continue
+		}
+		it.started = true
+		it.lastKey = entry.Key
+		return entry, nil
+	}
+}
+
+// close releases the file
+func (it *sstIterator) close() {
+	it.stop()
+	it.file.Close()
+}
+
+// PrefixEnd returns the exclusive end of the range holding the keys with
+// prefix, for RangeScan: "" when the range is open
+func PrefixEnd(prefix string) string {
+	return prefixUpperBound(prefix)
+}
+
+// prefixUpperBound returns the smallest key greater than every key with the
+// given prefix, or "" if there is none
+func prefixUpperBound(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// seekOffset returns the offset of the data block to start scanning for key
+func (sst *SSTable) seekOffset(key string) int64 {
+	start, _ := sst.blockRange(key)
+	return start
+}
+
+// blockRange binary-searches the index for the data block that would hold
+// key and returns its bounds
+func (sst *SSTable) blockRange(key string) (int64, int64) {
+	i := sort.Search(len(sst.Index), func(i int) bool {
+		return sst.Index[i].Key > key
+	})
+	if i == 0 {
+		return 0, 0 // before the first block
+	}
+	return sst.blockBounds(i - 1)
+}
+
+// blockBounds returns the bounds of the i'th data block
+func (sst *SSTable) blockBounds(i int) (int64, int64) {
+	end := sst.DataSize
+	if i+1 < len(sst.Index) {
+		end = sst.Index[i+1].Offset
+	}
+	return sst.Index[i].Offset, end
+}
+
+// openData opens an SST file for reading its data blocks between offsets
+// start and end. Closing the returned handle releases the file to the file
+// cache.
+func (sm *SSTManager) openData(sst *SSTable, start, end int64) (io.Closer, io.Reader, error) {
+	file, err := sm.files.acquire(sst)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, io.NewSectionReader(file, start, end-start), nil
+}
+
+// openBlock opens an SST file for reading the records of the data block
+// that would hold key
+func (sm *SSTManager) openBlock(sst *SSTable, key string) (io.Closer, *recordReader, error) {
+	start, end := sst.blockRange(key)
+	file, block, err := sm.openData(sst, start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, sst.records(bufio.NewReader(block), end-start), nil
+}
+
+// readBlock returns the data block that would hold key, from the block cache
+// if it holds it. Blocks read from the file are added to the cache.
+func (sm *SSTManager) readBlock(sst *SSTable, key string) ([]byte, error) {
+	start, end := sst.blockRange(key)
+	if start == end {
+		return nil, nil // before the first block
+	}
+	if block, ok := sm.cache.get(sst, start); ok {
+		return block, nil
+	}
+
+	file, err := sm.files.acquire(sst)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return sm.loadBlock(file, sst, start, end)
+}
+
+// loadBlock reads the data block of sst between start and end from file and
+// caches it
+func (sm *SSTManager) loadBlock(file io.ReaderAt, sst *SSTable, start, end int64) ([]byte, error) {
+	block := make([]byte, end-start)
+	if _, err := io.ReadFull(io.NewSectionReader(file, start, end-start), block); err != nil {
+		return nil, noEOF(err)
+	}
+	sm.cache.put(sst, start, block)
+	return block, nil
+}
+
+// SST record flags
+const (
+	sstDeleted byte = 1 << 0 // the record is a tombstone
+	sstExpires byte = 1 << 1 // expiresAt(8) follows keyLen
+	sstCodec   byte = 1 << 2 // the value is compressed: codec(1) + rawLen(4) precede the key
+)
+
+// appendRecord appends the SST record of entry to buf, storing value, which
+// is entry's value compressed with codec
+func appendRecord(buf []byte, entry *Entry, value []byte, codec byte) []byte {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0) // checksum, filled in below
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(entry.Timestamp))
+	var flags byte
+	if entry.Deleted {
+		flags |= sstDeleted
+	}
+	if entry.ExpiresAt != 0 {
+		flags |= sstExpires
+	}
+	if codec != codecNone {
+		flags |= sstCodec
+	}
+	buf = append(buf, flags)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(entry.Key)))
+	if entry.ExpiresAt != 0 {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(entry.ExpiresAt))
+	}
+	if codec != codecNone {
+		buf = append(buf, codec)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(entry.Value)))
+	}
+	buf = append(buf, entry.Key...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(value)))
+	buf = append(buf, value...)
+	binary.LittleEndian.PutUint32(buf[start:], checksum(buf[start+4:]))
+	return buf
+}
+
+// readEntry decodes a single SST record, returning an error wrapping
+// ErrCorrupt if it doesn't match its checksum
+func (sst *SSTable) readEntry(reader *recordReader) (*Entry, error) {
+	header, err := sst.readRecordHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := header.entry
+	if entry.Value, err = sst.readValue(reader, header); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// readValue reads the value following header, verifying the record's
+// checksum and decompressing it
+func (sst *SSTable) readValue(reader *recordReader, header *recordHeader) ([]byte, error) {
+	value := make([]byte, header.valueLen)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return nil, noEOF(err)
+	}
+	if sst.checksums && crc32.Update(header.crc, crcTable, value) != header.checksum {
+		return nil, fmt.Errorf("%w: key %q in %s", ErrCorrupt, header.entry.Key, sst.FilePath)
+	}
+	if header.codec == codecNone {
+		return value, nil
+	}
+
+	value, err := decompressValue(header.codec, value, header.rawLen)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %q in %s: %v", ErrCorrupt, header.entry.Key, sst.FilePath, err)
+	}
+	return value, nil
+}
+
+// skipEntry decodes a record's header and skips its value. The checksum is
+// not verified, as that would take reading the value.
+func (sst *SSTable) skipEntry(reader *recordReader) (*recordHeader, error) {
+	header, err := sst.readRecordHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := reader.Discard(int(header.valueLen)); err != nil {
+		return nil, noEOF(err)
+	}
+	return header, nil
+}
+
+// recordHeader is a decoded record header: the entry without its value, the
+// stored value length, the codec it is compressed with and its length once
+// decompressed, the checksum stored with the record and the CRC of the
+// header bytes, to be continued over the value
+type recordHeader struct {
+	entry    *Entry
+	valueLen uint32
+	codec    byte
+	rawLen   uint32
+	checksum uint32
+	crc      uint32
+}
+
+// readRecordHeader decodes a record header. Only its first byte may hit the
+// end of the data. Key and value lengths past the file's limits or the data
+// left are reported as ErrCorrupt before anything is allocated for them.
+func (sst *SSTable) readRecordHeader(reader *recordReader) (*recordHeader, error) {
+	header := &recordHeader{}
+	if sst.checksums {
+		if err := binary.Read(reader, binary.LittleEndian, &header.checksum); err != nil {
+			return nil, err
+		}
+	}
+
+	// timestamp(8) + flags(1) + keyLen(4)
+	var fixed [13]byte
+	if _, err := io.ReadFull(reader, fixed[:]); err != nil {
+		if sst.checksums {
+			err = noEOF(err)
+		}
+		return nil, err
+	}
+	flags := fixed[8]
+	keyLen := binary.LittleEndian.Uint32(fixed[9:])
+	header.entry = &Entry{
+		Timestamp: int64(binary.LittleEndian.Uint64(fixed[:8])),
+		Deleted:   flags&sstDeleted != 0,
+	}
+	header.crc = checksum(fixed[:])
+
+	if flags&sstExpires != 0 {
+		var expires [8]byte
+		if _, err := io.ReadFull(reader, expires[:]); err != nil {
+			return nil, noEOF(err)
+		}
+		header.entry.ExpiresAt = int64(binary.LittleEndian.Uint64(expires[:]))
+		header.crc = crc32.Update(header.crc, crcTable, expires[:])
+	}
+	if flags&sstCodec != 0 {
+		var codec [5]byte
+		if _, err := io.ReadFull(reader, codec[:]); err != nil {
+			return nil, noEOF(err)
+		}
+		header.codec = codec[0]
+		header.rawLen = binary.LittleEndian.Uint32(codec[1:])
+		header.crc = crc32.Update(header.crc, crcTable, codec[:])
+	}
+
+	// key + valueLen(4)
+	if err := reader.checkKey(keyLen); err != nil {
+		return nil, sst.corrupt(err, "key length %d", keyLen)
+	}
+	keyBytes := make([]byte, keyLen+4)
+	if _, err := io.ReadFull(reader, keyBytes); err != nil {
+		return nil, noEOF(err)
+	}
+	header.entry.Key = string(keyBytes[:keyLen])
+	header.valueLen = binary.LittleEndian.Uint32(keyBytes[keyLen:])
+	header.crc = crc32.Update(header.crc, crcTable, keyBytes)
+	if header.codec == codecNone {
+		header.rawLen = header.valueLen
+	}
+	if err := reader.checkValue(header.valueLen, header.rawLen); err != nil {
+		return nil, sst.corrupt(err, "value length %d of key %q", header.valueLen, header.entry.Key)
+	}
+	return header, nil
+}
+
+// records returns a reader of size bytes of the file's records from r
+func (sst *SSTable) records(r *bufio.Reader, size int64) *recordReader {
+	return newRecordReader(r, size, sst.limits)
+}
 
-	return keys, nil
+// corrupt wraps err, an ErrCorrupt, with what was found corrupt in the file
+func (sst *SSTable) corrupt(err error, format string, args ...any) error {
+	return fmt.Errorf("%w: %s in %s", err, fmt.Sprintf(format, args...), sst.FilePath)
 }
@@ -0,0 +1,71 @@
+package engine_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"escabelo/internal/engine"
+	"escabelo/internal/engine/enginetest"
+)
+
+// Layout of the first walRecords record of an SST, at the start of its
+// first block: crc(4) + timestamp(8) + flags(1) + keyLen(4) + key(7) +
+// valueLen(4) + value(9)
+const (
+	sstKeyLenAt   = 4 + 8 + 1
+	sstValueLenAt = sstKeyLenAt + 4 + 7
+	sstValueAt    = sstValueLenAt + 4
+)
+
+// TestSSTCorruption damages the first record of an SST file: reading it
+// must fail with ErrCorrupt rather than return garbage or panic, while
+// records of other blocks stay readable
+func TestSSTCorruption(t *testing.T) {
+	cases := []struct {
+		name   string
+		damage func(sst []byte)
+	}{
+		{"flipped checksum byte", func(sst []byte) { sst[0] ^= 0xff }},
+		{"flipped value byte", func(sst []byte) { sst[sstValueAt] ^= 0x01 }},
+		{"key length past the block", func(sst []byte) {
+			binary.LittleEndian.PutUint32(sst[sstKeyLenAt:], 0xfffffffe)
+		}},
+		{"value length past the limit", func(sst []byte) {
+			binary.LittleEndian.PutUint32(sst[sstValueLenAt:], 0xfffffff0)
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := enginetest.Config(t)
+			entries := walRecords(1000)
+			enginetest.WriteSST(t, config.DataDir, entries)
+
+			paths, err := filepath.Glob(filepath.Join(config.DataDir, "*.sst"))
+			if err != nil || len(paths) != 1 {
+				t.Fatalf("SST fixture files = %v (err %v), want one", paths, err)
+			}
+			sst, err := os.ReadFile(paths[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.damage(sst)
+			if err := os.WriteFile(paths[0], sst, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			eng := enginetest.NewEngine(t, config)
+			first := entries[0]
+			if value, _, err := eng.Get(first.Key); !errors.Is(err, engine.ErrCorrupt) {
+				t.Errorf("get %s = %q (err %v), want ErrCorrupt", first.Key, value, err)
+			}
+			last := entries[len(entries)-1]
+			if value, found, err := eng.Get(last.Key); err != nil || !found || string(value) != string(last.Value) {
+				t.Errorf("get %s = %q (found %v, err %v), want %q", last.Key, value, found, err, last.Value)
+			}
+		})
+	}
+}
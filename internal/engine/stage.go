@@ -0,0 +1,320 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+)
+
+// Stage is a view of a store that records the writes made through it
+// instead of applying them, giving each the version it will have once
+// applied. A Raft leader runs a write against a Stage and proposes the
+// entries it staged, which every member then applies with ApplyBatch once
+// committed, the leader included, so no node sees a write before it commits.
+//
+// Get and GetVersion see the staged writes; other reads see the store. A
+// Stage isn't safe for concurrent use, and its entries are only numbered
+// after the store's versions if nothing else writes to the store before
+// they are applied.
+type Stage struct {
+	Store
+	base    stageBase
+	entries []*Entry
+	latest  map[string]*Entry // the newest staged entry of each key
+	version int64             // the version of the last staged entry
+}
+
+// stageBase is what a Stage needs of the store it is built on
+type stageBase interface {
+	Store
+	storeConfig() *Config
+	checkWritable() error
+	latestVersion() int64
+	versions(key string) ([]*Entry, error)
+}
+
+// newStage returns an empty stage of base
+func newStage(base stageBase) *Stage {
+	return &Stage{Store: base, base: base, latest: make(map[string]*Entry)}
+}
+
+// Entries returns the writes staged so far, in order
+func (s *Stage) Entries() []*Entry {
+	return s.entries
+}
+
+// stage records entry with the next version and returns it
+func (s *Stage) stage(entry *Entry) int64 {
+	version := s.base.storeConfig().Clock.Now().UnixNano()
+	if floor := max(s.version, s.base.latestVersion()); version <= floor {
+		version = floor + 1
+	}
+	s.version = version
+	entry.Timestamp = version
+	s.entries = append(s.entries, entry)
+	s.latest[entry.Key] = entry
+	return version
+}
+
+// check rejects a write the store would reject
+func (s *Stage) check(key string, value []byte) error {
+	if err := s.base.storeConfig().checkSize(key, value); err != nil {
+		return err
+	}
+	return s.base.checkWritable()
+}
+
+// now returns the current time in unix nanoseconds, which expiry is
+// checked against
+func (s *Stage) now() int64 {
+	return s.base.storeConfig().Clock.Now().UnixNano()
+}
+
+// Get retrieves a value by key, staged or stored
+func (s *Stage) Get(key string) ([]byte, bool, error) {
+	if entry, ok := s.latest[key]; ok {
+		if entry.gone(s.now()) {
+			return nil, false, nil
+		}
+		return entry.Value, true, nil
+	}
+	return s.Store.Get(key)
+}
+
+// GetVersion retrieves a value by key along with its version, staged or
+// stored
+func (s *Stage) GetVersion(key string) ([]byte, int64, bool, error) {
+	if entry, ok := s.latest[key]; ok {
+		if entry.gone(s.now()) {
+			return nil, 0, false, nil
+		}
+		return entry.Value, entry.Timestamp, true, nil
+	}
+	return s.Store.GetVersion(key)
+}
+
+// Put stages a write of key
+func (s *Stage) Put(key string, value []byte) error {
+	_, err := s.PutVersion(key, value)
+	return err
+}
+
+// PutVersion stages a write of key and returns the version it will have
+func (s *Stage) PutVersion(key string, value []byte) (int64, error) {
+	if err := s.check(key, value); err != nil {
+		return 0, err
+	}
+	return s.stage(&Entry{Key: key, Value: value}), nil
+}
+
+// PutIfVersion stages a write of key only if its current version is
+// expected, 0 meaning the key doesn't exist
+func (s *Stage) PutIfVersion(key string, value []byte, expected int64) (int64, error) {
+	if err := s.check(key, value); err != nil {
+		return 0, err
+	}
+	if err := s.checkVersion(key, expected); err != nil {
+		return 0, err
+	}
+	return s.stage(&Entry{Key: key, Value: value}), nil
+}
+
+// checkVersion returns ErrVersionMismatch unless key is at version expected
+func (s *Stage) checkVersion(key string, expected int64) error {
+	_, current, _, err := s.GetVersion(key)
+	if err != nil {
+		return err
+	}
+	if current != expected {
+		return fmt.Errorf("%w: %s is at version %d", ErrVersionMismatch, key, current)
+	}
+	return nil
+}
+
+// Delete stages a delete of key, returning false if it doesn't exist
+func (s *Stage) Delete(key string) (bool, error) {
+	if err := s.base.checkWritable(); err != nil {
+		return false, err
+	}
+	value, exists, err := s.Get(key)
+	if err != nil || !exists {
+		return false, err
+	}
+	s.tombstone(key, value)
+	return true, nil
+}
+
+// DeleteBlind stages a tombstone for key whether or not it exists
+func (s *Stage) DeleteBlind(key string) error {
+	if err := s.base.checkWritable(); err != nil {
+		return err
+	}
+	value, _, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	s.tombstone(key, value)
+	return nil
+}
+
+// DeleteIfVersion stages a delete of key only if its current version is
+// expected
+func (s *Stage) DeleteIfVersion(key string, expected int64) error {
+	if err := s.base.checkWritable(); err != nil {
+		return err
+	}
+	if err := s.checkVersion(key, expected); err != nil {
+		return err
+	}
+	return s.DeleteBlind(key)
+}
+
+// tombstone stages a delete of key, which soft deletes make keep value
+func (s *Stage) tombstone(key string, value []byte) {
+	if s.base.storeConfig().DeleteRetention <= 0 {
+		value = nil
+	}
+	s.stage(&Entry{Key: key, Value: value, Deleted: true})
+}
+
+// Undelete stages the restore of a key deleted within the delete
+// retention window
+func (s *Stage) Undelete(key string) (bool, error) {
+	config := s.base.storeConfig()
+	if config.DeleteRetention <= 0 {
+		return false, fmt.Errorf("soft deletes are disabled")
+	}
+
+	versions, err := s.base.versions(key)
+	if err != nil {
+		return false, err
+	}
+	if entry, ok := s.latest[key]; ok {
+		versions = append([]*Entry{entry}, versions...)
+	}
+
+	value, ok := undeleteValue(versions, config.Clock.Now().Add(-config.DeleteRetention))
+	if !ok {
+		return false, nil
+	}
+	return true, s.Put(key, value)
+}
+
+// Expire stages a rewrite of key's current value expiring ttl from now. It
+// returns false if the key does not exist.
+func (s *Stage) Expire(key string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, fmt.Errorf("ttl must be positive")
+	}
+	value, exists, err := s.Get(key)
+	if err != nil || !exists {
+		return false, err
+	}
+	if err := s.check(key, value); err != nil {
+		return false, err
+	}
+	expiresAt := s.base.storeConfig().Clock.Now().Add(ttl).UnixNano()
+	s.stage(&Entry{Key: key, Value: value, ExpiresAt: expiresAt})
+	return true, nil
+}
+
+// WriteBatch stages ops in order. Deletes stage a tombstone whether or not
+// the key exists.
+func (s *Stage) WriteBatch(ops []BatchOp) error {
+	for _, op := range ops {
+		if err := s.check(op.Key, op.Value); err != nil {
+			return err
+		}
+	}
+	for _, op := range ops {
+		if !op.Delete {
+			s.stage(&Entry{Key: op.Key, Value: op.Value})
+			continue
+		}
+		if err := s.DeleteBlind(op.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Begin starts a transaction reading the store as of now, whose Commit
+// stages its writes
+func (s *Stage) Begin() *Txn {
+	txn := s.Store.Begin()
+	txn.commit = s.commitTxn
+	return txn
+}
+
+// CommitTxn commits a transaction begun on the store by staging its
+// writes, unless they conflict
+func (s *Stage) CommitTxn(txn *Txn) error {
+	if !txn.done {
+		txn.commit = s.commitTxn
+	}
+	return txn.Commit()
+}
+
+// commitTxn stages a transaction's ops if none of their keys has a version
+// newer than seq, tombstones included
+func (s *Stage) commitTxn(ops []BatchOp, seq int64) error {
+	for _, op := range ops {
+		latest, ok := s.latest[op.Key]
+		if !ok {
+			versions, err := s.Store.History(op.Key, 1)
+			if err != nil {
+				return err
+			}
+			if len(versions) > 0 {
+				latest = versions[0]
+			}
+		}
+		if latest != nil && latest.Timestamp > seq {
+			return fmt.Errorf("%w: %s", ErrConflict, op.Key)
+		}
+	}
+	return s.WriteBatch(ops)
+}
+
+// Stage returns an empty stage of the engine
+func (e *Engine) Stage() *Stage {
+	return newStage(e)
+}
+
+// storeConfig returns the engine's configuration
+func (e *Engine) storeConfig() *Config {
+	return &e.config
+}
+
+// latestVersion returns the version of the latest mutation
+func (e *Engine) latestVersion() int64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.lastVersion
+}
+
+// Stage returns an empty stage of the store
+func (m *MemStore) Stage() *Stage {
+	return newStage(m)
+}
+
+// storeConfig returns the store's configuration
+func (m *MemStore) storeConfig() *Config {
+	return &m.config
+}
+
+// checkWritable never fails: a MemStore is always writable
+func (m *MemStore) checkWritable() error {
+	return nil
+}
+
+// latestVersion returns the newest version in the store
+func (m *MemStore) latestVersion() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.version
+}
+
+// versions returns all retained versions of key, newest first
+func (m *MemStore) versions(key string) ([]*Entry, error) {
+	return m.data.Versions(key), nil
+}
@@ -0,0 +1,74 @@
+package engine
+
+import (
+	"context"
+	"time"
+)
+
+// Store is the storage interface the server runs on. Engine is the on-disk
+// LSM implementation; MemStore keeps everything in memory for tests.
+type Store interface {
+	Put(key string, value []byte) error
+	PutVersion(key string, value []byte) (int64, error)
+	PutIfVersion(key string, value []byte, expected int64) (int64, error)
+	Get(key string) ([]byte, bool, error)
+	GetVersion(key string) ([]byte, int64, bool, error)
+	GetAsOf(key string, asOf int64) ([]byte, bool, error)
+	MultiGet(keys []string) (map[string][]byte, error)
+	ValueSize(key string) (int64, bool, error)
+	GetRange(key string, offset, length int64) ([]byte, bool, error)
+	Meta(key string) (*KeyMeta, bool, error)
+	History(key string, limit int) ([]*Entry, error)
+	Delete(key string) (bool, error)
+	DeleteBlind(key string) error
+	DeleteIfVersion(key string, expected int64) error
+	Undelete(key string) (bool, error)
+	Expire(key string, ttl time.Duration) (bool, error)
+	WriteBatch(ops []BatchOp) error
+	Begin() *Txn
+	Limits() SizeLimits
+
+	KeysMatching(ctx context.Context, pattern string, opts ScanOptions) ([]string, error)
+	PrefixScanWithOptions(ctx context.Context, prefix string, opts ScanOptions) ([]KeyValue, error)
+	RangeScan(ctx context.Context, start, end string, limit int) ([]KeyValue, error)
+	CountPrefix(ctx context.Context, prefix string) (int64, error)
+	CountRange(ctx context.Context, start, end string) (int64, error)
+	EstimateKeys(prefix string) KeyEstimate
+
+	TailWAL(consumer string, from uint64, limit int) ([]*WALEntry, error)
+	AckWAL(consumer string, seq uint64) error
+	Consumers() map[string]uint64
+	LastSeq() uint64
+	ReadWAL(from uint64, limit int) ([]*WALEntry, error)
+	Watch(prefix string) *Watcher
+
+	MerkleTree(depth int) (*MerkleTree, error)
+	BucketEntries(depth, bucket int) ([]*Entry, error)
+	ApplyEntry(entry *Entry) (bool, error)
+	ApplyBatch(entries []*Entry) error
+	Stage() *Stage
+
+	PauseCompaction()
+	ResumeCompaction()
+	CompactNow(full bool) (int, error)
+	PauseFlush()
+	ResumeFlush()
+
+	Sync() error
+	Backup(path string) (*BackupInfo, error)
+
+	OpenBucket(name string) (Store, error)
+	Buckets() ([]string, error)
+
+	IndexDefs() ([]IndexDef, error)
+	SaveIndexDefs(defs []IndexDef) error
+
+	GetStats() Stats
+	GetSSTableStats() []SSTableStats
+	Close() error
+}
+
+var (
+	_ Store = (*Engine)(nil)
+	_ Store = (*MemStore)(nil)
+)
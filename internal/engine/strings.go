@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrHashValue is returned when a byte-level update targets a hash
+var ErrHashValue = errors.New("key holds a hash")
+
+// Strings implements in-place updates of plain values on top of a Store,
+// so appending to a log-style value or patching a buffer doesn't take a
+// client round trip of the whole value. Updates are read-modify-write under
+// a per-key lock, and conditional on the version read, so a concurrent plain
+// write isn't lost but makes the update start over.
+type Strings struct {
+	store Store
+	locks keyLocks
+}
+
+// NewStrings creates the string type for a store
+func NewStrings(store Store) *Strings {
+	return &Strings{store: store}
+}
+
+// Append adds data to the end of the value at key, which counts as empty if
+// missing, and returns the new length along with the version assigned
+func (s *Strings) Append(key string, data []byte) (int64, int64, error) {
+	return s.update(key, func(value []byte) ([]byte, error) {
+		if err := s.checkLength(int64(len(value) + len(data))); err != nil {
+			return nil, err
+		}
+		return append(value[:len(value):len(value)], data...), nil
+	})
+}
+
+// SetRange overwrites the value at key with data starting at offset, padding
+// with zero bytes when offset is past the end, and returns the new length
+// along with the version assigned
+func (s *Strings) SetRange(key string, offset int64, data []byte) (int64, int64, error) {
+	if offset < 0 {
+		return 0, 0, fmt.Errorf("offset must not be negative")
+	}
+	if err := s.checkLength(offset + int64(len(data))); err != nil {
+		return 0, 0, err
+	}
+	return s.update(key, func(value []byte) ([]byte, error) {
+		if len(data) == 0 {
+			// Nothing to write, so nothing to pad either
+			return value, nil
+		}
+		updated := make([]byte, max(int64(len(value)), offset+int64(len(data))))
+		copy(updated, value)
+		copy(updated[offset:], data)
+		return updated, nil
+	})
+}
+
+// checkLength returns ErrValueTooLarge if an update would grow the value
+// past the store's limit, before the value is built
+func (s *Strings) checkLength(length int64) error {
+	if limit := s.store.Limits().MaxValueSize; length > limit {
+		return fmt.Errorf("%w: %d bytes (max %d)", ErrValueTooLarge, length, limit)
+	}
+	return nil
+}
+
+// update replaces the value at key with fn of its current value, retrying
+// when another write changed the key in between
+func (s *Strings) update(key string, fn func(value []byte) ([]byte, error)) (int64, int64, error) {
+	mu := s.locks.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	for {
+		// A missing key reads as version 0, which PutIfVersion takes as
+		// "doesn't exist"
+		value, current, _, err := s.store.GetVersion(key)
+		if err != nil {
+			return 0, 0, err
+		}
+		if IsHash(value) {
+			return 0, 0, ErrHashValue
+		}
+		updated, err := fn(value)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		version, err := s.store.PutIfVersion(key, updated, current)
+		if errors.Is(err, ErrVersionMismatch) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		return int64(len(updated)), version, nil
+	}
+}
@@ -0,0 +1,216 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// walConsumers tracks the acknowledged position of each WAL tail consumer,
+// persisted so consumers can resume after a restart
+type walConsumers struct {
+	mu    sync.Mutex
+	fs    FS
+	path  string
+	acked map[string]uint64
+}
+
+// loadWALConsumers reads the consumer positions stored in dataDir
+func loadWALConsumers(fs FS, dataDir string) (*walConsumers, error) {
+	c := &walConsumers{
+		fs:    fs,
+		path:  filepath.Join(dataDir, "wal.consumers"),
+		acked: make(map[string]uint64),
+	}
+
+	file, err := c.fs.Open(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Format: one "<consumer> <acked-seq>" line per consumer
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		seq, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid consumer position %q: %w", scanner.Text(), err)
+		}
+		c.acked[fields[0]] = seq
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// save writes the consumer positions atomically. Caller holds c.mu.
+func (c *walConsumers) save() error {
+	names := make([]string, 0, len(c.acked))
+	for name := range c.acked {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s %d\n", name, c.acked[name])
+	}
+
+	tmpPath := c.path + ".tmp"
+	if err := c.fs.WriteFile(tmpPath, []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	return c.fs.Rename(tmpPath, c.path)
+}
+
+// minAcked returns the lowest acknowledged position, and false if there
+// are no consumers
+func (c *walConsumers) minAcked() (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var lowest uint64
+	first := true
+	for _, seq := range c.acked {
+		if first || seq < lowest {
+			lowest = seq
+			first = false
+		}
+	}
+	return lowest, !first
+}
+
+// TailWAL returns up to limit committed WAL entries for consumer, starting
+// at sequence number from, reaching into the archive for released ones. With from 0 it resumes after the consumer's last
+// acknowledged entry. A consumer is registered the first time it tails.
+func (e *Engine) TailWAL(consumer string, from uint64, limit int) ([]*WALEntry, error) {
+	e.consumers.mu.Lock()
+	acked, known := e.consumers.acked[consumer]
+	if !known {
+		// Start new consumers at the oldest retained entry
+		acked = e.wal.FirstSeq() - 1
+		e.consumers.acked[consumer] = acked
+		if err := e.consumers.save(); err != nil {
+			e.consumers.mu.Unlock()
+			return nil, fmt.Errorf("failed to register consumer: %w", err)
+		}
+	}
+	e.consumers.mu.Unlock()
+
+	if from == 0 {
+		from = acked + 1
+	}
+
+	// Entries truncated before the consumer acknowledged them come from its
+	// hints
+	if e.hints != nil && from < e.wal.FirstSeq() {
+		entries, ok, err := e.hints.read(consumer, from, limit)
+		if err != nil || ok {
+			return entries, err
+		}
+	}
+	return e.ReadWAL(from, limit)
+}
+
+// AckWAL records that consumer has processed every entry up to seq, letting
+// the WAL segments holding it be released
+func (e *Engine) AckWAL(consumer string, seq uint64) error {
+	if last := e.wal.LastSeq(); seq > last {
+		return fmt.Errorf("sequence %d not yet written (last is %d)", seq, last)
+	}
+
+	e.consumers.mu.Lock()
+	defer e.consumers.mu.Unlock()
+
+	acked, known := e.consumers.acked[consumer]
+	if !known {
+		return fmt.Errorf("unknown consumer: %s", consumer)
+	}
+	if seq <= acked {
+		return nil
+	}
+	e.consumers.acked[consumer] = seq
+	if e.hints != nil {
+		e.hints.ack(consumer, seq)
+	}
+	return e.consumers.save()
+}
+
+// Consumers returns the acknowledged position of every WAL tail consumer
+func (e *Engine) Consumers() map[string]uint64 {
+	e.consumers.mu.Lock()
+	defer e.consumers.mu.Unlock()
+	acked := make(map[string]uint64, len(e.consumers.acked))
+	for consumer, seq := range e.consumers.acked {
+		acked[consumer] = seq
+	}
+	return acked
+}
+
+// LastSeq returns the sequence number of the last committed WAL entry
+func (e *Engine) LastSeq() uint64 {
+	return e.wal.LastSeq()
+}
+
+// releaseWAL releases the WAL segments up to and including through. With
+// hints enabled, the entries consumers haven't acknowledged are handed off to
+// their hints first.
+func (e *Engine) releaseWAL(through int64) error {
+	if e.hints == nil {
+		return e.wal.Release(through)
+	}
+
+	e.consumers.mu.Lock()
+	acked := make(map[string]uint64, len(e.consumers.acked))
+	for consumer, seq := range e.consumers.acked {
+		acked[consumer] = seq
+	}
+	e.consumers.mu.Unlock()
+
+	lowest, ok := e.consumers.minAcked()
+	if !ok {
+		return e.wal.Release(through)
+	}
+	entries, err := e.wal.Drain(through, lowest+1)
+	if err != nil {
+		return err
+	}
+	e.hints.add(acked, entries)
+	return nil
+}
+
+// hintBytes returns the bytes held in hints
+func (e *Engine) hintBytes() int64 {
+	if e.hints == nil {
+		return 0
+	}
+	return e.hints.size()
+}
+
+// holdWAL reports whether the WAL must be kept for consumers that haven't
+// acknowledged all of it, up to the WALTailRetention size
+func (e *Engine) holdWAL() bool {
+	if e.config.WALTailRetention <= 0 {
+		return false
+	}
+	lowest, ok := e.consumers.minAcked()
+	if !ok || lowest >= e.wal.LastSeq() {
+		return false
+	}
+	size, _ := e.wal.Size()
+	return size < e.config.WALTailRetention
+}
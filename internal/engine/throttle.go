@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"time"
+)
+
+// throttlingEnabled reports whether any write throttling threshold is set
+func (e *Engine) throttlingEnabled() bool {
+	return e.config.WriteSlowdownSSTs > 0 || e.config.WriteStopSSTs > 0 ||
+		e.config.WriteSlowdownBytes > 0 || e.config.WriteStopBytes > 0
+}
+
+// compactionDebt returns the SST file count and the bytes the compactor
+// still has to merge (files beyond the newest CompactionFileTrigger)
+func (e *Engine) compactionDebt() (int, int64) {
+	sstables := e.sstManager.GetAllSSTables()
+
+	var debt int64
+	if newest := e.compactor.fileTrigger; len(sstables) > newest {
+		for _, sst := range sstables[newest:] {
+			debt += sst.Size
+		}
+	}
+	return len(sstables), debt
+}
+
+// writePressure returns how far compaction debt is between the slowdown and
+// stop thresholds: 0 below slowdown, up to 1 at stop
+func (e *Engine) writePressure() float64 {
+	files, debt := e.compactionDebt()
+	return max(
+		thresholdPressure(float64(files), float64(e.config.WriteSlowdownSSTs), float64(e.config.WriteStopSSTs)),
+		thresholdPressure(float64(debt), float64(e.config.WriteSlowdownBytes), float64(e.config.WriteStopBytes)),
+	)
+}
+
+// thresholdPressure scales value between soft and hard limits (0 disables
+// either). Without a hard limit, pressure keeps growing past soft but never
+// reaches a stall.
+func thresholdPressure(value, soft, hard float64) float64 {
+	if hard > 0 && value >= hard {
+		return 1
+	}
+	if soft <= 0 || value <= soft {
+		return 0
+	}
+	if hard > soft {
+		return (value - soft) / (hard - soft)
+	}
+	return min((value-soft)/soft, 0.99)
+}
+
+// throttleWrites delays a write in proportion to compaction debt, and stalls
+// it while debt is at the stop threshold, so ingest can't outrun compaction
+func (e *Engine) throttleWrites() {
+	if !e.throttlingEnabled() {
+		return
+	}
+
+	pressure := e.writePressure()
+	if pressure <= 0 {
+		return
+	}
+
+	if pressure < 1 {
+		e.stats.mu.Lock()
+		e.stats.WriteDelays++
+		e.stats.mu.Unlock()
+
+		e.config.Clock.Sleep(time.Duration(float64(e.config.WriteMaxDelay) * pressure))
+		return
+	}
+
+	e.stats.mu.Lock()
+	e.stats.WriteStalls++
+	e.stats.mu.Unlock()
+
+	// Catch up as fast as possible, then wait until debt drops below the stop threshold
+	e.compactor.TriggerFull()
+
+	ticker := e.config.Clock.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for e.writePressure() >= 1 {
+		select {
+		case <-ticker.C():
+		case <-e.stopCh:
+			return
+		}
+	}
+}
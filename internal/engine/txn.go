@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrConflict is returned by Commit when another write changed a key the
+// transaction writes after the transaction began
+var ErrConflict = errors.New("conflict: key changed since the transaction began")
+
+// ErrVersionMismatch is returned by PutIfVersion and DeleteIfVersion when
+// the key's current version isn't the expected one
+var ErrVersionMismatch = errors.New("conflict: version mismatch")
+
+// ErrTxnDone is returned when using a transaction after Commit or Rollback
+var ErrTxnDone = errors.New("transaction already committed or rolled back")
+
+// Txn is a transaction with snapshot isolation: its reads see the store as
+// of Begin plus its own writes, which are buffered until Commit applies them
+// atomically. Commit fails with ErrConflict if a key the transaction writes
+// was changed by anyone else since Begin, so the first of two overlapping
+// transactions to commit wins. A Txn isn't safe for concurrent use.
+type Txn struct {
+	seq     int64
+	read    func(key string, asOf int64) ([]byte, bool, error)
+	check   func(key string, value []byte) error
+	commit  func(ops []BatchOp, seq int64) error
+	release func()
+	ops     []BatchOp
+	done    bool
+}
+
+// Get returns the value of key as the transaction sees it
+func (t *Txn) Get(key string) ([]byte, bool, error) {
+	if t.done {
+		return nil, false, ErrTxnDone
+	}
+	for i := len(t.ops) - 1; i >= 0; i-- {
+		if t.ops[i].Key == key {
+			return t.ops[i].Value, !t.ops[i].Delete, nil
+		}
+	}
+	return t.read(key, t.seq)
+}
+
+// Put buffers a write of key
+func (t *Txn) Put(key string, value []byte) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if err := t.check(key, value); err != nil {
+		return err
+	}
+	t.ops = append(t.ops, BatchOp{Key: key, Value: value})
+	return nil
+}
+
+// Delete buffers a delete of key
+func (t *Txn) Delete(key string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.ops = append(t.ops, BatchOp{Key: key, Delete: true})
+	return nil
+}
+
+// Commit applies the buffered writes atomically, as a single WAL batch that
+// recovery restores whole or not at all, unless they conflict
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	defer t.release()
+	if len(t.ops) == 0 {
+		return nil
+	}
+	return t.commit(t.ops, t.seq)
+}
+
+// Rollback discards the buffered writes. Rolling back a finished
+// transaction is a no-op.
+func (t *Txn) Rollback() {
+	if t.done {
+		return
+	}
+	t.done = true
+	t.release()
+}
+
+// Begin starts a transaction reading from a snapshot of the engine's
+// current state
+func (e *Engine) Begin() *Txn {
+	snap := e.GetSnapshot()
+	return &Txn{seq: snap.seq, read: e.GetAsOf, check: e.config.checkSize, commit: e.commitTxn, release: snap.Release}
+}
+
+// commitTxn writes a transaction's ops as one batch if none of their keys
+// has a version newer than seq
+func (e *Engine) commitTxn(ops []BatchOp, seq int64) error {
+	_, err := e.writeBatch(ops, func() error {
+		for _, op := range ops {
+			entry, err := e.latestLocked(op.Key)
+			if err != nil {
+				return err
+			}
+			if entry != nil && entry.Timestamp > seq {
+				return fmt.Errorf("%w: %s", ErrConflict, op.Key)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// PutIfVersion writes key, like PutVersion, only if its current version is
+// expected, 0 meaning the key doesn't exist. It returns ErrVersionMismatch
+// otherwise, so a read-modify-write doesn't overwrite a concurrent update.
+func (e *Engine) PutIfVersion(key string, value []byte, expected int64) (int64, error) {
+	return e.writeBatch([]BatchOp{{Key: key, Value: value}}, e.versionCheck(key, expected))
+}
+
+// DeleteIfVersion deletes key only if its current version is expected,
+// returning ErrVersionMismatch otherwise
+func (e *Engine) DeleteIfVersion(key string, expected int64) error {
+	_, err := e.writeBatch([]BatchOp{{Key: key, Delete: true}}, e.versionCheck(key, expected))
+	return err
+}
+
+// versionCheck returns a writeBatch check that key is at version expected
+func (e *Engine) versionCheck(key string, expected int64) func() error {
+	return func() error {
+		entry, err := e.latestLocked(key)
+		if err != nil {
+			return err
+		}
+		var current int64
+		if entry != nil && !entry.gone(e.config.Clock.Now().UnixNano()) {
+			current = entry.Timestamp
+		}
+		if current != expected {
+			return fmt.Errorf("%w: %s is at version %d", ErrVersionMismatch, key, current)
+		}
+		return nil
+	}
+}
+
+// latestLocked returns the latest version of key, tombstones included, or
+// nil if there is none. Caller holds e.mu, so no write lands in between.
+func (e *Engine) latestLocked(key string) (*Entry, error) {
+	entry, found := e.memtable.Lookup(key)
+	for i := len(e.immutableMemtables) - 1; !found && i >= 0; i-- {
+		entry, found = e.immutableMemtables[i].Lookup(key)
+	}
+	if found {
+		return entry, nil
+	}
+	entry, err := e.sstManager.GetEntry(key)
+	if err != nil {
+		return nil, fmt.Errorf("SST lookup failed: %w", err)
+	}
+	return entry, nil
+}
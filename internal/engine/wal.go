@@ -2,22 +2,73 @@ package engine
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
-// WAL (Write-Ahead Log) provides durability
+// ErrWALTruncated is returned when tailing from a sequence number whose
+// entry has already been truncated from the WAL
+var ErrWALTruncated = errors.New("sequence no longer retained in WAL")
+
+// WAL (Write-Ahead Log) provides durability. It is split into numbered
+// segment files: the engine starts a new segment each time it rotates the
+// memtable, and releases segments once the memtables they hold are flushed.
+// Entries are only ever appended to the last, active segment.
 type WAL struct {
-	mu         sync.Mutex
-	file       *os.File
-	writer     *bufio.Writer
-	filePath   string
-	bufSize    int
-	pendingOps int32 // atomic counter for pending operations
+	mu       sync.Mutex
+	fs       FS
+	dataDir  string
+	file     File // the active segment, nil until first written when deferred
+	writer   *bufio.Writer
+	bufSize  int
+	segments []*walSegment // oldest first
+
+	// Logical size of all segments and of the active one (including buffered
+	// bytes), accessed atomically
+	size       int64
+	activeSize int64
+
+	// Entries are numbered in append order. baseSeq is the sequence number of
+	// the last entry released (persisted in seqPath), lastSeq that of the
+	// last entry appended.
+	seqPath string
+	baseSeq uint64
+	lastSeq uint64
+
+	// watches receives every entry once it's appended
+	watches *watchHub
+
+	// archive, when set, receives a copy of segments before they're released
+	archive *walArchive
+
+	// limits bound the key and value lengths records may hold
+	limits SizeLimits
+}
+
+// walSegment is one WAL file
+type walSegment struct {
+	id   int64
+	path string
+	size int64
+
+	// lastSeq is the sequence number of the segment's last entry, or of the
+	// previous segment's if it is empty
+	lastSeq uint64
+
+	// pending marks an active segment whose file isn't created yet
+	pending bool
 }
 
 // WALEntry represents a log entry
@@ -26,65 +77,273 @@ type WALEntry struct {
 	Key       string
 	Value     []byte
 	Timestamp int64
+
+	// ExpiresAt is when a put expires (unix nanoseconds, 0 never)
+	ExpiresAt int64
+
+	// Seq is the entry's sequence number (not stored in the record itself)
+	Seq uint64
 }
 
 const (
 	OpTypePut    byte = 1
 	OpTypeDelete byte = 2
+
+	// OpTypeBatch starts a batch: its value holds the number of entries that
+	// follow as a uint32. It has no sequence number and is never returned to
+	// readers, and replay drops a batch whose entries aren't all intact.
+	OpTypeBatch byte = 3
 )
 
-// NewWAL creates or opens a WAL file
+// NewWAL creates or opens a WAL
 func NewWAL(dataDir string) (*WAL, error) {
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+	return OpenWAL(OSFS, dataDir)
+}
+
+// OpenWAL creates or opens the WAL segments in dataDir on fs
+func OpenWAL(fs FS, dataDir string) (*WAL, error) {
+	return openWAL(fs, dataDir, false, SizeLimits{MaxKeySize: DefaultMaxKeySize, MaxValueSize: DefaultMaxValueSize})
+}
+
+// openWAL implements OpenWAL, reporting records of keys or values past
+// limits as corrupt. With deferred, the active segment is neither created
+// nor opened until the first append, leaving dataDir as it was while
+// nothing is written.
+func openWAL(fs FS, dataDir string, deferred bool, limits SizeLimits) (*WAL, error) {
+	if err := fs.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+
+	segments, err := listWALSegments(fs, dataDir)
+	if err != nil {
 		return nil, err
 	}
 
-	filePath := filepath.Join(dataDir, "wal.log")
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	// A WAL from before segmentation is a single wal.log, of records without
+	// checksums: its entries are rewritten as the first segment. Alongside
+	// segments, it's one whose removal a crash interrupted once rewritten.
+	legacyPath := filepath.Join(dataDir, "wal.log")
+	if file, err := fs.Open(legacyPath); err == nil {
+		file.Close()
+		if len(segments) > 0 {
+			if err := fs.Remove(legacyPath); err != nil {
+				return nil, err
+			}
+		} else {
+			if err := upgradeLegacyWAL(fs, dataDir, limits); err != nil {
+				return nil, fmt.Errorf("failed to upgrade %s: %w", legacyPath, err)
+			}
+			if segments, err = listWALSegments(fs, dataDir); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	seqPath := filepath.Join(dataDir, "wal.seq")
+	baseSeq, err := readBaseSeq(fs, seqPath)
 	if err != nil {
 		return nil, err
 	}
 
-	bufSize := 256 * 1024 // 256KB buffer for better throughput
-	return &WAL{
-		file:     file,
-		writer:   bufio.NewWriterSize(file, bufSize),
-		filePath: filePath,
-		bufSize:  bufSize,
-	}, nil
+	w := &WAL{
+		fs:       fs,
+		dataDir:  dataDir,
+		bufSize:  256 * 1024, // 256KB buffer for better throughput
+		segments: segments,
+		seqPath:  seqPath,
+		baseSeq:  baseSeq,
+		lastSeq:  baseSeq,
+		limits:   limits,
+	}
+	for _, seg := range segments {
+		seg.lastSeq = baseSeq
+		w.size += seg.size
+	}
+
+	if len(segments) == 0 {
+		if deferred {
+			w.segments = []*walSegment{{id: 1, path: walSegmentPath(dataDir, 1), lastSeq: baseSeq, pending: true}}
+			return w, nil
+		}
+		if err := w.openSegment(1); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+
+	w.activeSize = segments[len(segments)-1].size
+	if !deferred {
+		if err := w.openActive(); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
 }
 
-// Append writes an entry to the WAL
-func (w *WAL) Append(entry *WALEntry) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// openActive opens the active segment for appending, creating its file if
+// it's pending, unless it's open already. Caller holds w.mu or has sole
+// access.
+func (w *WAL) openActive() error {
+	if w.file != nil {
+		return nil
+	}
+	active := w.segments[len(w.segments)-1]
+	file, err := w.fs.OpenFile(active.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if active.pending {
+		if err := w.fs.SyncDir(w.dataDir); err != nil {
+			file.Close()
+			return err
+		}
+		active.pending = false
+	}
+	w.file = file
+	w.writer = bufio.NewWriterSize(file, w.bufSize)
+	if active.size == 0 {
+		return w.startSegment(active)
+	}
+	return nil
+}
 
-	// Format: opType(1) + timestamp(8) + keyLen(4) + key + valueLen(4) + value
-	if err := w.writer.WriteByte(entry.OpType); err != nil {
+// startSegment writes the header of seg, the active segment, which is
+// still empty. Caller holds w.mu or has sole access.
+func (w *WAL) startSegment(seg *walSegment) error {
+	if _, err := w.writer.WriteString(walMagic); err != nil {
 		return err
 	}
+	seg.size += walHeaderSize
+	atomic.AddInt64(&w.size, walHeaderSize)
+	atomic.AddInt64(&w.activeSize, walHeaderSize)
+	return nil
+}
 
-	if err := binary.Write(w.writer, binary.LittleEndian, entry.Timestamp); err != nil {
+// walSegmentPath returns the path of WAL segment id
+func walSegmentPath(dataDir string, id int64) string {
+	return filepath.Join(dataDir, fmt.Sprintf("wal-%06d.log", id))
+}
+
+// listWALSegments returns the WAL segments in dataDir, oldest first
+func listWALSegments(fs FS, dataDir string) ([]*walSegment, error) {
+	files, err := fs.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []*walSegment
+	for _, file := range files {
+		var id int64
+		if file.IsDir() || !strings.HasPrefix(file.Name(), "wal-") || !strings.HasSuffix(file.Name(), ".log") {
+			continue
+		}
+		if _, err := fmt.Sscanf(file.Name(), "wal-%d.log", &id); err != nil {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, &walSegment{
+			id:   id,
+			path: filepath.Join(dataDir, file.Name()),
+			size: info.Size(),
+		})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].id < segments[j].id
+	})
+	return segments, nil
+}
+
+// openSegment creates segment id and makes it the active one. Caller holds
+// w.mu or has sole access.
+func (w *WAL) openSegment(id int64) error {
+	path := walSegmentPath(w.dataDir, id)
+	file, err := w.fs.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if err := w.fs.SyncDir(w.dataDir); err != nil {
+		file.Close()
 		return err
 	}
 
-	keyLen := uint32(len(entry.Key))
-	if err := binary.Write(w.writer, binary.LittleEndian, keyLen); err != nil {
+	w.file = file
+	w.writer = bufio.NewWriterSize(file, w.bufSize)
+	seg := &walSegment{id: id, path: path, lastSeq: w.lastSeq}
+	w.segments = append(w.segments, seg)
+	atomic.StoreInt64(&w.activeSize, 0)
+	return w.startSegment(seg)
+}
+
+// readBaseSeq reads the persisted base sequence number, or 0 if there is none
+func readBaseSeq(fs FS, path string) (uint64, error) {
+	data, err := fs.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WAL sequence file: %w", err)
+	}
+	return seq, nil
+}
+
+// writeBaseSeq atomically persists the base sequence number. Like the
+// manifest, it's synced before the rename, so a crash can't leave the
+// renamed file without its contents.
+func writeBaseSeq(fs FS, path string, seq uint64) error {
+	tmpPath := path + ".tmp"
+	file, err := fs.Create(tmpPath)
+	if err != nil {
 		return err
 	}
 
-	if _, err := w.writer.Write([]byte(entry.Key)); err != nil {
+	if _, err := file.Write([]byte(strconv.FormatUint(seq, 10))); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
 		return err
 	}
 
-	valueLen := uint32(len(entry.Value))
-	if err := binary.Write(w.writer, binary.LittleEndian, valueLen); err != nil {
+	if err := fs.Rename(tmpPath, path); err != nil {
 		return err
 	}
+	return fs.SyncDir(filepath.Dir(path))
+}
+
+// Append writes an entry to the active segment
+func (w *WAL) Append(entry *WALEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	if _, err := w.writer.Write(entry.Value); err != nil {
+	if err := w.openActive(); err != nil {
 		return err
 	}
+	if _, err := w.writer.Write(appendWALRecord(nil, entry)); err != nil {
+		return err
+	}
+
+	w.lastSeq++
+	entry.Seq = w.lastSeq
+	w.watches.publish(entry)
+
+	active := w.segments[len(w.segments)-1]
+	n := walRecordSize(entry)
+	active.lastSeq = w.lastSeq
+	active.size += n
+	atomic.AddInt64(&w.size, n)
+	atomic.AddInt64(&w.activeSize, n)
 
 	// Group commit: only flush if buffer is nearly full
 	// This allows batching many writes together for better throughput
@@ -96,146 +355,662 @@ func (w *WAL) Append(entry *WALEntry) error {
 	return nil
 }
 
-// Replay reads all entries from the WAL and applies them to a memtable
+// AppendBatch writes entries to the active segment as one batch, in a single
+// write behind a batch header, so replay restores either all of them or none
+func (w *WAL) AppendBatch(entries []*WALEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.openActive(); err != nil {
+		return err
+	}
+	header := &WALEntry{OpType: OpTypeBatch, Value: binary.LittleEndian.AppendUint32(nil, uint32(len(entries)))}
+	buf := appendWALRecord(nil, header)
+	for _, entry := range entries {
+		buf = appendWALRecord(buf, entry)
+	}
+	if _, err := w.writer.Write(buf); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		w.lastSeq++
+		entry.Seq = w.lastSeq
+	}
+	w.watches.publish(entries...)
+
+	active := w.segments[len(w.segments)-1]
+	n := int64(len(buf))
+	active.lastSeq = w.lastSeq
+	active.size += n
+	atomic.AddInt64(&w.size, n)
+	atomic.AddInt64(&w.activeSize, n)
+
+	if w.writer.Buffered() >= w.bufSize-4096 {
+		return w.writer.Flush()
+	}
+	return nil
+}
+
+// Rotate syncs the active segment and starts a new one, returning the ID of
+// the segment it closed. Entries appended before Rotate returns are all in
+// that segment or older ones.
+func (w *WAL) Rotate() (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	closed := w.segments[len(w.segments)-1]
+	if err := w.openActive(); err != nil {
+		return 0, err
+	}
+	if err := w.writer.Flush(); err != nil {
+		return 0, err
+	}
+	if err := w.file.Sync(); err != nil {
+		return 0, err
+	}
+
+	file := w.file
+	if err := w.openSegment(closed.id + 1); err != nil {
+		return 0, err
+	}
+	file.Close()
+
+	return closed.id, nil
+}
+
+// Checkpoint rotates the WAL and returns the closed segments, which hold
+// every entry appended so far and never change again, along with the base
+// sequence number their entries are numbered after. They stay on disk until
+// released.
+func (w *WAL) Checkpoint() ([]walSegment, uint64, error) {
+	if _, err := w.Rotate(); err != nil {
+		return nil, 0, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	closed := make([]walSegment, 0, len(w.segments)-1)
+	for _, seg := range w.segments[:len(w.segments)-1] {
+		closed = append(closed, *seg)
+	}
+	return closed, w.baseSeq, nil
+}
+
+// Active returns the ID of the segment entries are appended to
+func (w *WAL) Active() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.segments[len(w.segments)-1].id
+}
+
+// Replay reads all entries from the WAL segments and numbers them. It must
+// run before the first Append so that new entries continue the sequence.
+// A torn or corrupted record ends its segment: the segment is cut off there
+// and replay continues with the next one.
 func (w *WAL) Replay() ([]*WALEntry, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// Seek to beginning
-	if _, err := w.file.Seek(0, 0); err != nil {
+	// The header of a new active segment may still be buffered
+	if err := w.flushLocked(); err != nil {
 		return nil, err
 	}
 
-	reader := bufio.NewReader(w.file)
 	var entries []*WALEntry
+	seq := w.baseSeq
+	for _, seg := range w.segments {
+		if seg.pending {
+			continue
+		}
+		segEntries, size, err := w.replaySegment(seg, seq)
+		if err != nil {
+			return nil, err
+		}
+		seq += uint64(len(segEntries))
+		seg.lastSeq = seq
+		entries = append(entries, segEntries...)
+
+		if size != seg.size {
+			atomic.AddInt64(&w.size, size-seg.size)
+			if seg == w.segments[len(w.segments)-1] {
+				atomic.StoreInt64(&w.activeSize, size)
+			}
+			seg.size = size
+		}
+	}
+	w.lastSeq = seq
 
-	for {
-		entry := &WALEntry{}
+	// An active segment cut off before the end of its header is started
+	// again, if open; otherwise that's done once it's opened
+	if active := w.segments[len(w.segments)-1]; active.size == 0 && w.file != nil {
+		if err := w.startSegment(active); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// replaySegment reads the entries of a segment, numbering them after base,
+// and returns them with the size of the valid part of the segment. Caller
+// holds w.mu.
+func (w *WAL) replaySegment(seg *walSegment, base uint64) ([]*WALEntry, int64, error) {
+	file, err := w.fs.Open(seg.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
 
-		// Read opType
-		opType, err := reader.ReadByte()
+	reader := newRecordReader(bufio.NewReader(file), info.Size(), w.limits)
+	if err := readWALHeader(reader); err != nil {
+		if err == io.EOF {
+			return nil, 0, nil
+		}
+		if !errors.Is(err, ErrCorrupt) && err != io.ErrUnexpectedEOF {
+			return nil, 0, err
+		}
+		slog.Warn("Discarding a WAL segment without a valid header", "file", seg.path, "err", err)
+		return nil, 0, w.truncateSegment(seg, 0)
+	}
+
+	var entries []*WALEntry
+	offset := walHeaderSize
+	for {
+		group, size, err := readWALGroup(reader)
 		if err == io.EOF {
 			break
 		}
+		if errors.Is(err, ErrCorrupt) || err == io.ErrUnexpectedEOF {
+			// Keep what precedes the damaged record (or the batch holding it)
+			// and cut it off, so new entries aren't appended after garbage
+			slog.Warn("Discarding the rest of a WAL segment", "file", seg.path, "offset", offset, "err", err)
+			if err := w.truncateSegment(seg, offset); err != nil {
+				return nil, 0, err
+			}
+			break
+		}
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		entry.OpType = opType
-
-		// Read timestamp
-		if err := binary.Read(reader, binary.LittleEndian, &entry.Timestamp); err != nil {
-			return nil, err
+		for _, entry := range group {
+			entry.Seq = base + uint64(len(entries)) + 1
+			entries = append(entries, entry)
 		}
+		offset += size
+	}
 
-		// Read key
-		var keyLen uint32
-		if err := binary.Read(reader, binary.LittleEndian, &keyLen); err != nil {
-			return nil, err
+	return entries, offset, nil
+}
+
+// readWALGroup reads the next entry, or every entry of the next batch, and
+// returns them with the size of their records. An incomplete batch is
+// reported as io.ErrUnexpectedEOF.
+func readWALGroup(reader *recordReader) ([]*WALEntry, int64, error) {
+	entry, err := readWALEntry(reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := walRecordSize(entry)
+	if entry.OpType != OpTypeBatch {
+		return []*WALEntry{entry}, size, nil
+	}
+	if len(entry.Value) != 4 {
+		return nil, 0, ErrCorrupt
+	}
+	count := binary.LittleEndian.Uint32(entry.Value)
+	if int64(count)*walMinRecordSize > reader.left {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	group := make([]*WALEntry, count)
+	for i := range group {
+		if group[i], err = readWALEntry(reader); err != nil {
+			return nil, 0, noEOF(err)
 		}
+		size += walRecordSize(group[i])
+	}
+	return group, size, nil
+}
 
-		keyBytes := make([]byte, keyLen)
-		if _, err := io.ReadFull(reader, keyBytes); err != nil {
-			return nil, err
+// truncateSegment cuts a segment off at size
+func (w *WAL) truncateSegment(seg *walSegment, size int64) error {
+	file, err := w.fs.OpenFile(seg.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ReadFrom returns up to limit entries with sequence numbers from from
+// onwards. Buffered entries are written out first so every appended entry is
+// visible.
+func (w *WAL) ReadFrom(from uint64, limit int) ([]*WALEntry, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if from <= w.baseSeq {
+		return nil, fmt.Errorf("%w: %d (oldest is %d)", ErrWALTruncated, from, w.baseSeq+1)
+	}
+	if from > w.lastSeq {
+		return nil, nil
+	}
+	if err := w.flushLocked(); err != nil {
+		return nil, err
+	}
+	return w.readSegments(w.segments, from, limit)
+}
+
+// readSegments returns up to limit entries with sequence numbers from from
+// onwards held in segments, which must start with the oldest retained one;
+// a limit <= 0 reads every entry. Caller holds w.mu.
+func (w *WAL) readSegments(segments []*walSegment, from uint64, limit int) ([]*WALEntry, error) {
+	var entries []*WALEntry
+	seq := w.baseSeq
+	for _, seg := range segments {
+		if seg.lastSeq < from {
+			seq = seg.lastSeq
+			continue
 		}
-		entry.Key = string(keyBytes)
 
-		// Read value
-		var valueLen uint32
-		if err := binary.Read(reader, binary.LittleEndian, &valueLen); err != nil {
+		file, err := w.fs.Open(seg.path)
+		if err != nil {
 			return nil, err
 		}
+		reader := newRecordReader(bufio.NewReader(file), seg.size, w.limits)
+		if err := readWALHeader(reader); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("WAL segment %d: %w", seg.id, noEOF(err))
+		}
 
-		entry.Value = make([]byte, valueLen)
-		if _, err := io.ReadFull(reader, entry.Value); err != nil {
-			return nil, err
+		for seq < seg.lastSeq && (limit <= 0 || len(entries) < limit) {
+			entry, err := readWALEntry(reader)
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			if entry.OpType == OpTypeBatch {
+				continue
+			}
+			seq++
+			if seq >= from {
+				entry.Seq = seq
+				entries = append(entries, entry)
+			}
 		}
+		file.Close()
 
-		entries = append(entries, entry)
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
 	}
 
 	return entries, nil
 }
 
-// Truncate clears the WAL (after successful flush to SST)
-func (w *WAL) Truncate() error {
+// LastSeq returns the sequence number of the last appended entry
+func (w *WAL) LastSeq() uint64 {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	return w.lastSeq
+}
 
-	if err := w.file.Truncate(0); err != nil {
+// FirstSeq returns the sequence number of the oldest retained entry
+func (w *WAL) FirstSeq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.baseSeq + 1
+}
+
+// A WAL segment starts with the 8-byte walMagic, followed by records:
+// crc(4) + opType(1) + timestamp(8) + keyLen(4) + [expiresAt(8)] + key +
+// valueLen(4) + value, where crc is the CRC-32C of the rest of the record.
+// expiresAt is present when opType has walExpires set. The wal.log of
+// versions before segments has no magic, and records without crc or
+// expiresAt.
+const (
+	walMagic      = "escwal01"
+	walHeaderSize = int64(len(walMagic))
+
+	// walMinRecordSize is the size of a record with an empty key and value
+	walMinRecordSize = 4 + 1 + 8 + 4 + 4
+)
+
+// walExpires is set on the opType of records carrying an expiry
+const walExpires byte = 0x80
+
+// readWALHeader reads the magic starting a WAL segment, returning io.EOF
+// for an empty segment and ErrCorrupt if it doesn't match
+func readWALHeader(reader io.Reader) error {
+	var magic [walHeaderSize]byte
+	if _, err := io.ReadFull(reader, magic[:]); err != nil {
 		return err
 	}
+	if string(magic[:]) != walMagic {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// walRecordSize returns the encoded size of an entry's WAL record
+func walRecordSize(entry *WALEntry) int64 {
+	size := int64(4 + 1 + 8 + 4 + len(entry.Key) + 4 + len(entry.Value))
+	if entry.ExpiresAt != 0 {
+		size += 8
+	}
+	return size
+}
+
+// appendWALRecord appends the WAL record of entry to buf
+func appendWALRecord(buf []byte, entry *WALEntry) []byte {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0) // checksum, filled in below
+	if entry.ExpiresAt != 0 {
+		buf = append(buf, entry.OpType|walExpires)
+	} else {
+		buf = append(buf, entry.OpType)
+	}
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(entry.Timestamp))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(entry.Key)))
+	if entry.ExpiresAt != 0 {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(entry.ExpiresAt))
+	}
+	buf = append(buf, entry.Key...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(entry.Value)))
+	buf = append(buf, entry.Value...)
+	binary.LittleEndian.PutUint32(buf[start:], checksum(buf[start+4:]))
+	return buf
+}
+
+// readWALEntry decodes a single WAL record. It returns ErrCorrupt if the
+// record doesn't match its checksum, or holds a key or value length past the
+// reader's limits or the data left, before allocating it.
+func readWALEntry(reader *recordReader) (*WALEntry, error) {
+	var sum uint32
+	if err := binary.Read(reader, binary.LittleEndian, &sum); err != nil {
+		return nil, err
+	}
+
+	// opType(1) + timestamp(8) + keyLen(4)
+	var header [13]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, noEOF(err)
+	}
+	entry := &WALEntry{
+		OpType:    header[0] &^ walExpires,
+		Timestamp: int64(binary.LittleEndian.Uint64(header[1:])),
+	}
+	keyLen := binary.LittleEndian.Uint32(header[9:])
+	crc := checksum(header[:])
+
+	if header[0]&walExpires != 0 {
+		var expires [8]byte
+		if _, err := io.ReadFull(reader, expires[:]); err != nil {
+			return nil, noEOF(err)
+		}
+		entry.ExpiresAt = int64(binary.LittleEndian.Uint64(expires[:]))
+		crc = crc32.Update(crc, crcTable, expires[:])
+	}
+
+	// key + valueLen(4)
+	if err := reader.checkKey(keyLen); err != nil {
+		return nil, err
+	}
+	keyBytes := make([]byte, keyLen+4)
+	if _, err := io.ReadFull(reader, keyBytes); err != nil {
+		return nil, noEOF(err)
+	}
+	entry.Key = string(keyBytes[:keyLen])
+	valueLen := binary.LittleEndian.Uint32(keyBytes[keyLen:])
+
+	if err := reader.checkValue(valueLen, valueLen); err != nil {
+		return nil, err
+	}
+	entry.Value = make([]byte, valueLen)
+	if _, err := io.ReadFull(reader, entry.Value); err != nil {
+		return nil, noEOF(err)
+	}
+
+	crc = crc32.Update(crc, crcTable, keyBytes)
+	if crc32.Update(crc, crcTable, entry.Value) != sum {
+		return nil, ErrCorrupt
+	}
+	return entry, nil
+}
+
+// readLegacyWALEntry decodes a record of the wal.log of versions before
+// segments: opType(1) + timestamp(8) + keyLen(4) + key + valueLen(4) + value,
+// without a checksum
+func readLegacyWALEntry(reader *recordReader) (*WALEntry, error) {
+	// opType(1) + timestamp(8) + keyLen(4)
+	var header [13]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	entry := &WALEntry{
+		OpType:    header[0],
+		Timestamp: int64(binary.LittleEndian.Uint64(header[1:])),
+	}
+	if entry.OpType != OpTypePut && entry.OpType != OpTypeDelete {
+		return nil, ErrCorrupt
+	}
 
-	if _, err := w.file.Seek(0, 0); err != nil {
+	keyLen := binary.LittleEndian.Uint32(header[9:])
+	if err := reader.checkKey(keyLen); err != nil {
+		return nil, err
+	}
+	keyBytes := make([]byte, keyLen+4)
+	if _, err := io.ReadFull(reader, keyBytes); err != nil {
+		return nil, noEOF(err)
+	}
+	entry.Key = string(keyBytes[:keyLen])
+
+	valueLen := binary.LittleEndian.Uint32(keyBytes[keyLen:])
+	if err := reader.checkValue(valueLen, valueLen); err != nil {
+		return nil, err
+	}
+	entry.Value = make([]byte, valueLen)
+	if _, err := io.ReadFull(reader, entry.Value); err != nil {
+		return nil, noEOF(err)
+	}
+	return entry, nil
+}
+
+// upgradeLegacyWAL rewrites the entries of the wal.log in dataDir, from a
+// version before segments, as the first segment, and removes wal.log. A
+// torn tail is left out, as replay would cut it off.
+func upgradeLegacyWAL(fs FS, dataDir string, limits SizeLimits) error {
+	legacyPath := filepath.Join(dataDir, "wal.log")
+	file, err := fs.Open(legacyPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
 		return err
 	}
 
-	w.writer.Reset(w.file)
-	return nil
+	reader := newRecordReader(bufio.NewReader(file), info.Size(), limits)
+	buf := []byte(walMagic)
+	n := 0
+	for {
+		entry, err := readLegacyWALEntry(reader)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, ErrCorrupt) || err == io.ErrUnexpectedEOF {
+			slog.Warn("Discarding the rest of a WAL from an earlier version", "file", legacyPath, "entries", n, "err", err)
+			break
+		}
+		if err != nil {
+			return err
+		}
+		buf = appendWALRecord(buf, entry)
+		n++
+	}
+
+	path := walSegmentPath(dataDir, 1)
+	if err := writeFileFrom(fs, path+".tmp", bytes.NewReader(buf)); err != nil {
+		fs.Remove(path + ".tmp")
+		return err
+	}
+	if err := fs.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if err := fs.SyncDir(dataDir); err != nil {
+		return err
+	}
+	slog.Info("Upgraded a WAL from an earlier version", "file", legacyPath, "entries", n)
+	return fs.Remove(legacyPath)
 }
 
-// Close closes the WAL file
-func (w *WAL) Close() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// noEOF turns an EOF inside a record into io.ErrUnexpectedEOF, since only
+// the start of a record may legitimately be the end of a file
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
 
-	if err := w.writer.Flush(); err != nil {
+// Release deletes the segments up to and including segment through, once
+// the memtables they hold are flushed, archiving them first when an archive
+// is set. The active segment is never released.
+func (w *WAL) Release(through int64) error {
+	if err := w.archiveSegments(through); err != nil {
 		return err
 	}
-	return w.file.Close()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err := w.releaseLocked(through, 0)
+	return err
 }
 
-// Sync forces a sync to disk
-func (w *WAL) Sync() error {
+// Drain is like Release, but first returns the entries of the released
+// segments with sequence numbers from from onwards, so no entry is lost
+// between reading and deleting them
+func (w *WAL) Drain(through int64, from uint64) ([]*WALEntry, error) {
+	if err := w.archiveSegments(through); err != nil {
+		return nil, err
+	}
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	if err := w.writer.Flush(); err != nil {
-		return err
+	if from <= w.baseSeq {
+		from = w.baseSeq + 1
 	}
-	return w.file.Sync()
+	return w.releaseLocked(through, from)
 }
 
-// Size returns the current size of the WAL file
-func (w *WAL) Size() (int64, error) {
+// releaseLocked implements Release and Drain, returning the released entries
+// from from onwards unless from is 0. Caller holds w.mu.
+func (w *WAL) releaseLocked(through int64, from uint64) ([]*WALEntry, error) {
+	n := 0
+	for n < len(w.segments)-1 && w.segments[n].id <= through {
+		n++
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	released := w.segments[:n]
+
+	var entries []*WALEntry
+	if from > 0 {
+		var err error
+		if entries, err = w.readSegments(released, from, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	// Record where numbering resumes before the entries disappear; a crash in
+	// between renumbers the old entries rather than reusing their numbers
+	if last := released[n-1].lastSeq; last != w.baseSeq {
+		if err := writeBaseSeq(w.fs, w.seqPath, last); err != nil {
+			return nil, err
+		}
+		w.baseSeq = last
+	}
+
+	for _, seg := range released {
+		if err := w.fs.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		atomic.AddInt64(&w.size, -seg.size)
+	}
+	w.segments = w.segments[n:]
+
+	return entries, nil
+}
+
+// Opened reports whether the active segment was opened, which a deferred
+// WAL only does once written to
+func (w *WAL) Opened() bool {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	return w.file != nil
+}
 
-	stat, err := w.file.Stat()
-	if err != nil {
-		return 0, err
+// Close closes the active segment
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
 	}
-	return stat.Size(), nil
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	return w.file.Close()
 }
 
-// Rotate creates a new WAL file and returns the old one's path
-func (w *WAL) Rotate() (string, error) {
+// Sync forces a sync of the active segment to disk
+func (w *WAL) Sync() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// Flush and close current file
-	if err := w.writer.Flush(); err != nil {
-		return "", err
+	if w.file == nil {
+		return nil
 	}
-	if err := w.file.Close(); err != nil {
-		return "", err
+	if err := w.writer.Flush(); err != nil {
+		return err
 	}
+	return w.file.Sync()
+}
 
-	// Rename old file
-	oldPath := w.filePath
-	stat, err := w.file.Stat()
-	if err != nil {
-		return "", err
-	}
-	backupPath := fmt.Sprintf("%s.%d", w.filePath, stat.ModTime().Unix())
+// Flush hands buffered entries to the OS without waiting for them to reach
+// the disk
+func (w *WAL) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushLocked()
+}
 
-	// Create new file
-	file, err := os.OpenFile(oldPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
-	if err != nil {
-		return "", err
+// flushLocked writes out buffered entries, if the active segment was opened.
+// Caller holds w.mu.
+func (w *WAL) flushLocked() error {
+	if w.writer == nil {
+		return nil
 	}
+	return w.writer.Flush()
+}
 
-	w.file = file
-	w.writer = bufio.NewWriter(file)
+// Size returns the current size of the WAL, including buffered bytes
+func (w *WAL) Size() (int64, error) {
+	return atomic.LoadInt64(&w.size), nil
+}
 
-	return backupPath, nil
+// ActiveSize returns the size of the active segment, including buffered
+// bytes
+func (w *WAL) ActiveSize() int64 {
+	return atomic.LoadInt64(&w.activeSize)
 }
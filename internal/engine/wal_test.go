@@ -0,0 +1,165 @@
+package engine_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"escabelo/internal/engine"
+	"escabelo/internal/engine/enginetest"
+)
+
+// appendLegacyRecord appends a record of the wal.log written before WAL
+// segments: opType(1) + timestamp(8) + keyLen(4) + key + valueLen(4) + value
+func appendLegacyRecord(buf []byte, opType byte, key, value string) []byte {
+	buf = append(buf, opType)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(time.Now().UnixNano()))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(key)))
+	buf = append(buf, key...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(value)))
+	return append(buf, value...)
+}
+
+// TestLegacyWALUpgrade starts the engine on a data directory holding the
+// wal.log of a version before segments and checksums: the writes it holds
+// must survive, up to a torn tail, and stay once the engine restarts
+func TestLegacyWALUpgrade(t *testing.T) {
+	config := enginetest.Config(t)
+	var wal []byte
+	wal = appendLegacyRecord(wal, engine.OpTypePut, "kept", "v1")
+	wal = appendLegacyRecord(wal, engine.OpTypePut, "deleted", "v1")
+	wal = appendLegacyRecord(wal, engine.OpTypePut, "kept", "v2")
+	wal = appendLegacyRecord(wal, engine.OpTypeDelete, "deleted", "")
+	torn := appendLegacyRecord(nil, engine.OpTypePut, "torn", "v1")
+	wal = append(wal, torn[:len(torn)-1]...)
+	if err := os.WriteFile(filepath.Join(config.DataDir, "wal.log"), wal, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	eng := enginetest.NewEngine(t, config)
+	check := func() {
+		t.Helper()
+		if value, found, err := eng.Get("kept"); err != nil || !found || string(value) != "v2" {
+			t.Errorf("get kept = %q (found %v, err %v), want v2", value, found, err)
+		}
+		for _, key := range []string{"deleted", "torn"} {
+			if value, found, err := eng.Get(key); err != nil || found {
+				t.Errorf("get %s = %q (found %v, err %v), want not found", key, value, found, err)
+			}
+		}
+	}
+	check()
+	if _, err := os.Stat(filepath.Join(config.DataDir, "wal.log")); !os.IsNotExist(err) {
+		t.Errorf("wal.log still present after the upgrade: %v", err)
+	}
+
+	eng = enginetest.Reopen(t, eng, config)
+	check()
+}
+
+// walRecords returns n entries with fixed-size keys and values, so their
+// records all take walRecordSize bytes
+func walRecords(n int) []*engine.Entry {
+	entries := make([]*engine.Entry, n)
+	for i := range entries {
+		entries[i] = &engine.Entry{
+			Key:       fmt.Sprintf("key:%03d", i),
+			Value:     []byte(fmt.Sprintf("value-%03d", i)),
+			Timestamp: time.Now().UnixNano() + int64(i),
+		}
+	}
+	return entries
+}
+
+// Layout of a walRecords record, after the segment's 8-byte header:
+// crc(4) + opType(1) + timestamp(8) + keyLen(4) + key(7) + valueLen(4) +
+// value(9)
+const (
+	walHeaderSize = 8
+	walRecordSize = 4 + 1 + 8 + 4 + 7 + 4 + 9
+	walKeyLenAt   = 4 + 1 + 8
+	walValueLenAt = walKeyLenAt + 4 + 7
+	walValueAt    = walValueLenAt + 4
+)
+
+// TestWALCorruption damages a WAL record the ways a crash or a bad disk can,
+// then opens the engine on it: replay must keep the records before the
+// damage and drop the rest, instead of failing or panicking, and the WAL
+// must take writes again
+func TestWALCorruption(t *testing.T) {
+	const records, damagedRecords = 10, 6
+	cases := []struct {
+		name   string
+		damage func(wal []byte, record int) []byte
+	}{
+		{"flipped checksum byte", func(wal []byte, record int) []byte {
+			wal[record] ^= 0xff
+			return wal
+		}},
+		{"flipped value byte", func(wal []byte, record int) []byte {
+			wal[record+walValueAt] ^= 0x01
+			return wal
+		}},
+		{"truncated tail", func(wal []byte, record int) []byte {
+			return wal[:record+walRecordSize/2]
+		}},
+		{"key length past the segment", func(wal []byte, record int) []byte {
+			binary.LittleEndian.PutUint32(wal[record+walKeyLenAt:], 0xfffffffe)
+			return wal
+		}},
+		{"value length past the limit", func(wal []byte, record int) []byte {
+			binary.LittleEndian.PutUint32(wal[record+walValueLenAt:], 0xfffffff0)
+			return wal
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := enginetest.Config(t)
+			entries := walRecords(records)
+			enginetest.WriteWAL(t, config.DataDir, entries)
+
+			path := filepath.Join(config.DataDir, "wal-000001.log")
+			wal, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(wal) != walHeaderSize+records*walRecordSize {
+				t.Fatalf("WAL fixture is %d bytes, want %d", len(wal), walHeaderSize+records*walRecordSize)
+			}
+			wal = tc.damage(wal, walHeaderSize+damagedRecords*walRecordSize)
+			if err := os.WriteFile(path, wal, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			eng := enginetest.NewEngine(t, config)
+			check := func() {
+				t.Helper()
+				for i, entry := range entries {
+					value, found, err := eng.Get(entry.Key)
+					switch {
+					case err != nil:
+						t.Errorf("get %s: %v", entry.Key, err)
+					case i < damagedRecords && (!found || string(value) != string(entry.Value)):
+						t.Errorf("get %s = %q (found %v), want %q", entry.Key, value, found, entry.Value)
+					case i >= damagedRecords && found:
+						t.Errorf("get %s = %q, want the damaged record dropped", entry.Key, value)
+					}
+				}
+			}
+			check()
+
+			if err := eng.Put("after", []byte("v1")); err != nil {
+				t.Fatalf("put after replay: %v", err)
+			}
+			eng = enginetest.Reopen(t, eng, config)
+			check()
+			if value, found, err := eng.Get("after"); err != nil || !found || string(value) != "v1" {
+				t.Errorf("get after = %q (found %v, err %v), want v1", value, found, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// watchBuffer is how many changes a watcher can fall behind before it is
+// closed as overflowed
+const watchBuffer = 1024
+
+// Watcher receives the changes to keys with a prefix, in WAL order, as
+// they're appended. Changes is closed when the watcher is closed, or when it
+// fell more than watchBuffer changes behind, which Overflowed then reports.
+type Watcher struct {
+	Changes <-chan *WALEntry
+
+	prefix     string
+	changes    chan *WALEntry
+	hub        *watchHub
+	overflowed atomic.Bool
+	closed     bool // guarded by hub.mu
+}
+
+// Overflowed reports whether the watcher was closed for falling behind
+func (w *Watcher) Overflowed() bool {
+	return w.overflowed.Load()
+}
+
+// Close stops the watcher
+func (w *Watcher) Close() {
+	w.hub.remove(w)
+}
+
+// watchHub fans appended changes out to watchers. Publishing never blocks:
+// a watcher whose buffer is full is closed, and must resume from the WAL.
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*Watcher]struct{}
+	count    atomic.Int32
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*Watcher]struct{})}
+}
+
+// watch registers a watcher for keys with prefix
+func (h *watchHub) watch(prefix string) *Watcher {
+	changes := make(chan *WALEntry, watchBuffer)
+	w := &Watcher{Changes: changes, prefix: prefix, changes: changes, hub: h}
+
+	h.mu.Lock()
+	h.watchers[w] = struct{}{}
+	h.count.Add(1)
+	h.mu.Unlock()
+	return w
+}
+
+// remove unregisters a watcher and closes its channel
+func (h *watchHub) remove(w *Watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(w)
+}
+
+func (h *watchHub) removeLocked(w *Watcher) {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	delete(h.watchers, w)
+	h.count.Add(-1)
+	close(w.changes)
+}
+
+// publish hands entries to the watchers of their keys. Callers publish in
+// append order.
+func (h *watchHub) publish(entries ...*WALEntry) {
+	if h == nil || h.count.Load() == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Key, w.prefix) {
+				continue
+			}
+			select {
+			case w.changes <- entry:
+			default:
+				w.overflowed.Store(true)
+				h.removeLocked(w)
+			}
+			if w.closed {
+				break
+			}
+		}
+	}
+}
+
+// Watch returns a watcher for the changes to keys with prefix appended to
+// the WAL from now on, including those applied by replication and repair
+func (e *Engine) Watch(prefix string) *Watcher {
+	return e.watches.watch(prefix)
+}
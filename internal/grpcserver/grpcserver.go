@@ -0,0 +1,268 @@
+// Package grpcserver serves the gRPC API defined in proto/escabelo.proto
+// alongside the TCP server, for typed clients in any language
+package grpcserver
+
+import (
+	"context"
+	"escabelo/internal/engine"
+	"escabelo/internal/server"
+	pb "escabelo/pkg/escabelopb"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// scanPageSize is how many pairs Scan reads from the engine at a time, so a
+// long scan streams in bounded memory
+const scanPageSize = 1000
+
+// Server serves the KV service. Reads go straight to the store; writes run
+// through the TCP server so they update indexes, are audited, mirrored and
+// acknowledged by replicas like writes over TCP.
+type Server struct {
+	pb.UnimplementedKVServer
+
+	store  engine.Store
+	tcp    *server.Server
+	server *grpc.Server
+}
+
+// roleKey is the context key of the role a call authenticated as
+type roleKey struct{}
+
+// New creates a gRPC server over store, writing through tcp
+func New(store engine.Store, tcp *server.Server) *Server {
+	s := &Server{store: store, tcp: tcp}
+	// A request carries at most a key and a value, plus framing
+	limits := store.Limits()
+	s.server = grpc.NewServer(
+		grpc.MaxRecvMsgSize(limits.MaxKeySize+int(limits.MaxValueSize)+4096),
+		grpc.UnaryInterceptor(s.authUnary),
+		grpc.StreamInterceptor(s.authStream),
+	)
+	pb.RegisterKVServer(s.server, s)
+	return s
+}
+
+// Start begins serving on addr in the background
+func (s *Server) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	slog.Info("gRPC API listening", "addr", listener.Addr().String())
+	go func() {
+		if err := s.server.Serve(listener); err != nil {
+			slog.Error("gRPC server failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+// Stop waits for RPCs in flight to finish, then stops serving
+func (s *Server) Stop() {
+	s.server.GracefulStop()
+}
+
+// Get reads a key
+func (s *Server) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	if !server.ValidKey(req.Key) {
+		return nil, status.Error(codes.InvalidArgument, "invalid key format")
+	}
+	if owner := s.tcp.Moved(req.Key); owner != "" {
+		return nil, status.Error(codes.FailedPrecondition, "moved "+owner)
+	}
+	value, version, found, err := s.store.GetVersion(req.Key)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !found {
+		return nil, status.Error(codes.NotFound, "key not found")
+	}
+	if engine.IsHash(value) {
+		return nil, status.Error(codes.FailedPrecondition, "key holds a hash")
+	}
+	return &pb.GetResponse{Value: value, Version: version}, nil
+}
+
+// Put writes a key-value pair
+func (s *Server) Put(ctx context.Context, req *pb.PutRequest) (*pb.PutResponse, error) {
+	if !server.ValidKey(req.Key) {
+		return nil, status.Error(codes.InvalidArgument, "invalid key format")
+	}
+	cmd := &server.Command{Type: server.CmdWrite, Key: req.Key, Value: req.Value, WithVersion: true}
+	resp := s.tcp.Exec(client(ctx), role(ctx), cmd)
+	if err := responseError(resp); err != nil {
+		return nil, err
+	}
+	version, _ := strconv.ParseInt(strings.TrimPrefix(resp, "success "), 10, 64)
+	return &pb.PutResponse{Version: version}, nil
+}
+
+// Delete writes a tombstone for a key
+func (s *Server) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	if !server.ValidKey(req.Key) {
+		return nil, status.Error(codes.InvalidArgument, "invalid key format")
+	}
+	cmd := &server.Command{Type: server.CmdDelete, Key: req.Key, Exists: req.Exists}
+	if err := responseError(s.tcp.Exec(client(ctx), role(ctx), cmd)); err != nil {
+		return nil, err
+	}
+	return &pb.DeleteResponse{}, nil
+}
+
+// Scan streams the live pairs of a prefix or range, a page at a time
+func (s *Server) Scan(req *pb.ScanRequest, stream pb.KV_ScanServer) error {
+	start, end := req.Start, req.End
+	if req.Prefix != "" {
+		if start != "" || end != "" {
+			return status.Error(codes.InvalidArgument, "scan takes a prefix or a range, not both")
+		}
+		start, end = req.Prefix, engine.PrefixEnd(req.Prefix)
+	}
+	if req.Limit < 0 {
+		return status.Error(codes.InvalidArgument, "negative limit")
+	}
+
+	remaining := req.Limit
+	for {
+		page := scanPageSize
+		if remaining > 0 && remaining < int64(page) {
+			page = int(remaining)
+		}
+		pairs, err := s.store.RangeScan(stream.Context(), start, end, page)
+		if err != nil {
+			return status.FromContextError(err).Err()
+		}
+		for _, kv := range pairs {
+			if err := stream.Send(&pb.KeyValue{Key: kv.Key, Value: kv.Value}); err != nil {
+				return err
+			}
+		}
+		if remaining > 0 {
+			if remaining -= int64(len(pairs)); remaining == 0 {
+				return nil
+			}
+		}
+		if len(pairs) < page {
+			return nil
+		}
+		start = pairs[len(pairs)-1].Key + "\x00" // the smallest key after it
+	}
+}
+
+// Batch applies writes and deletes atomically
+func (s *Server) Batch(ctx context.Context, req *pb.BatchRequest) (*pb.BatchResponse, error) {
+	if len(req.Ops) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "batch requires at least one write or delete")
+	}
+	cmd := &server.Command{Type: server.CmdBatch}
+	for i, op := range req.Ops {
+		if !server.ValidKey(op.Key) {
+			return nil, status.Errorf(codes.InvalidArgument, "batch op %d: invalid key format", i+1)
+		}
+		if op.Delete {
+			cmd.Batch = append(cmd.Batch, &server.Command{Type: server.CmdDelete, Key: op.Key})
+		} else {
+			cmd.Batch = append(cmd.Batch, &server.Command{Type: server.CmdWrite, Key: op.Key, Value: op.Value})
+		}
+	}
+	if err := responseError(s.tcp.Exec(client(ctx), role(ctx), cmd)); err != nil {
+		return nil, err
+	}
+	return &pb.BatchResponse{}, nil
+}
+
+// Status reports engine statistics
+func (s *Server) Status(ctx context.Context, req *pb.StatusRequest) (*pb.StatusResponse, error) {
+	stats := s.store.GetStats()
+	return &pb.StatusResponse{
+		Writes:        stats.Writes,
+		Reads:         stats.Reads,
+		Deletes:       stats.Deletes,
+		Flushes:       stats.Flushes,
+		Compactions:   stats.Compactions,
+		MemtableSize:  stats.MemTableSize,
+		MemtableLimit: stats.MemTableLimit,
+		SstCount:      stats.SSTCount,
+		WalSize:       stats.WALSize,
+		DiskFree:      stats.DiskFree,
+		DiskFull:      stats.DiskFull,
+		Durability:    stats.Durability,
+	}, nil
+}
+
+// authenticate checks the "authorization" metadata of a call, like the
+// Authorization header of the REST gateway, and returns a context carrying
+// the role it grants. Status is served to anyone, like over TCP.
+func (s *Server) authenticate(ctx context.Context, method string) (context.Context, error) {
+	var header string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			header = values[0]
+		}
+	}
+	role, ok := s.tcp.AuthenticateHeader(header)
+	if !ok && method != pb.KV_Status_FullMethodName {
+		return nil, status.Error(codes.Unauthenticated, server.ErrAuthRequired.Error())
+	}
+	return context.WithValue(ctx, roleKey{}, role), nil
+}
+
+// authUnary authenticates unary calls
+func (s *Server) authUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := s.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authStream authenticates streaming calls. Scan only reads, which any role
+// may do, so the role needn't reach the handler.
+func (s *Server) authStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if _, err := s.authenticate(stream.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+// role returns the role a call authenticated as
+func role(ctx context.Context) string {
+	r, _ := ctx.Value(roleKey{}).(string)
+	return r
+}
+
+// client names the caller in the audit log, like a TCP connection that sent
+// "client grpc"
+func client(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return "grpc@" + p.Addr.String()
+	}
+	return "grpc"
+}
+
+// responseError turns a failed text response into a gRPC status
+func responseError(resp string) error {
+	switch {
+	case resp == "error":
+		return status.Error(codes.NotFound, "key not found")
+	case strings.HasPrefix(resp, "error: redirect "), strings.HasPrefix(resp, "error: moved "),
+		strings.HasPrefix(resp, "error: read-only"):
+		return status.Error(codes.FailedPrecondition, strings.TrimPrefix(resp, "error: "))
+	case strings.HasPrefix(resp, "error: permission denied"):
+		return status.Error(codes.PermissionDenied, strings.TrimPrefix(resp, "error: "))
+	case strings.HasPrefix(resp, "error: key too large"), strings.HasPrefix(resp, "error: value too large"):
+		return status.Error(codes.InvalidArgument, strings.TrimPrefix(resp, "error: "))
+	case strings.HasPrefix(resp, "error: "):
+		return status.Error(codes.Internal, strings.TrimPrefix(resp, "error: "))
+	}
+	return nil
+}
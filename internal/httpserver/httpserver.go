@@ -0,0 +1,302 @@
+// Package httpserver serves a JSON REST gateway alongside the TCP server,
+// for poking the store with curl and integrating with scripts
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"escabelo/internal/engine"
+	"escabelo/internal/server"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultListLimit and maxListLimit bound the pairs GET /keys returns
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 10000
+)
+
+// Server serves the REST gateway. Reads go straight to the store; writes run
+// through the TCP server so they update indexes, are audited, mirrored and
+// acknowledged by replicas like writes over TCP.
+type Server struct {
+	store  engine.Store
+	tcp    *server.Server
+	server *http.Server
+}
+
+// KeyValue is a key with its value, as JSON
+type KeyValue struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version int64  `json:"version,omitempty"`
+}
+
+// New creates a REST gateway over store, writing through tcp
+func New(store engine.Store, tcp *server.Server) *Server {
+	s := &Server{store: store, tcp: tcp}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /keys/{key}", s.getKey)
+	mux.HandleFunc("PUT /keys/{key}", s.putKey)
+	mux.HandleFunc("DELETE /keys/{key}", s.deleteKey)
+	mux.HandleFunc("GET /keys", s.listKeys)
+	mux.HandleFunc("GET /status", s.status)
+	s.server = &http.Server{Handler: s.authenticate(mux), ReadHeaderTimeout: 10 * time.Second}
+	return s
+}
+
+// roleKey is the context key of the role a request authenticated as
+type roleKey struct{}
+
+// authenticate checks the Authorization header of requests, "Bearer <token>"
+// or Basic, before passing them to next along with the role it grants.
+// GET /status is served to anyone, like status over TCP.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role, ok := s.tcp.AuthenticateHeader(r.Header.Get("Authorization"))
+		if !ok && !(r.Method == http.MethodGet && r.URL.Path == "/status") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="escabelo"`)
+			writeError(w, http.StatusUnauthorized, server.ErrAuthRequired.Error())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), roleKey{}, role)))
+	})
+}
+
+// role returns the role a request authenticated as
+func role(r *http.Request) string {
+	v, _ := r.Context().Value(roleKey{}).(string)
+	return v
+}
+
+// Start begins serving on addr in the background
+func (s *Server) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	slog.Info("HTTP gateway listening", "addr", listener.Addr().String())
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+// Stop waits up to timeout for requests in flight to finish, then stops
+// serving
+func (s *Server) Stop(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// getKey answers GET /keys/{key} with the key's value and version
+func (s *Server) getKey(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !server.ValidKey(key) {
+		writeError(w, http.StatusBadRequest, "invalid key format")
+		return
+	}
+	if owner := s.tcp.Moved(key); owner != "" {
+		writeError(w, http.StatusMisdirectedRequest, "moved "+owner)
+		return
+	}
+	value, version, found, err := s.store.GetVersion(key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "key not found")
+		return
+	}
+	if engine.IsHash(value) {
+		writeError(w, http.StatusConflict, "key holds a hash")
+		return
+	}
+	writeJSON(w, http.StatusOK, KeyValue{Key: key, Value: string(value), Version: version})
+}
+
+// putKey stores the request body as the key's value
+func (s *Server) putKey(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !server.ValidKey(key) {
+		writeError(w, http.StatusBadRequest, "invalid key format")
+		return
+	}
+	limit := s.store.Limits().MaxValueSize
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("value too large: over %d bytes", limit))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cmd := &server.Command{Type: server.CmdWrite, Key: key, Value: value, WithVersion: true}
+	if !ifMatch(w, r, cmd) {
+		return
+	}
+	resp := s.tcp.Exec(client(r), role(r), cmd)
+	if writeResponseError(w, resp) {
+		return
+	}
+	version, _ := strconv.ParseInt(strings.TrimPrefix(resp, "success "), 10, 64)
+	writeJSON(w, http.StatusOK, map[string]int64{"version": version})
+}
+
+// ifMatch makes cmd conditional on the version in the request's If-Match
+// header, if any, 0 meaning the key doesn't exist. It answers a malformed
+// header itself and returns false.
+func ifMatch(w http.ResponseWriter, r *http.Request, cmd *server.Command) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	version, err := strconv.ParseInt(strings.Trim(header, `"`), 10, 64)
+	if err != nil || version < 0 {
+		writeError(w, http.StatusBadRequest, "If-Match must be a version")
+		return false
+	}
+	cmd.CheckVersion = true
+	cmd.IfVersion = version
+	return true
+}
+
+// deleteKey writes a tombstone for the key, blind unless ?exists=true
+func (s *Server) deleteKey(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !server.ValidKey(key) {
+		writeError(w, http.StatusBadRequest, "invalid key format")
+		return
+	}
+	exists, _ := strconv.ParseBool(r.URL.Query().Get("exists"))
+
+	cmd := &server.Command{Type: server.CmdDelete, Key: key, Exists: exists}
+	if !ifMatch(w, r, cmd) {
+		return
+	}
+	if cmd.CheckVersion && exists {
+		writeError(w, http.StatusBadRequest, "exists and If-Match can't be combined")
+		return
+	}
+	if writeResponseError(w, s.tcp.Exec(client(r), role(r), cmd)) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listKeys answers GET /keys?prefix=&limit=&after= with a page of live pairs
+// in key order. "next" is set when more may follow: pass it as after.
+func (s *Server) listKeys(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix, after := query.Get("prefix"), query.Get("after")
+	limit := defaultListLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxListLimit {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be 1-%d", maxListLimit))
+			return
+		}
+		limit = n
+	}
+
+	start := prefix
+	if after != "" && after >= start {
+		start = after + "\x00" // the smallest key after it
+	}
+	pairs, err := s.store.RangeScan(r.Context(), start, engine.PrefixEnd(prefix), limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	items := make([]KeyValue, len(pairs))
+	for i, kv := range pairs {
+		items[i] = KeyValue{Key: kv.Key, Value: string(kv.Value)}
+	}
+	page := struct {
+		Items []KeyValue `json:"items"`
+		Next  string     `json:"next,omitempty"`
+	}{Items: items}
+	if len(pairs) == limit {
+		page.Next = pairs[len(pairs)-1].Key
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// status answers GET /status with the engine statistics
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	stats := s.store.GetStats()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"writes":         stats.Writes,
+		"reads":          stats.Reads,
+		"deletes":        stats.Deletes,
+		"flushes":        stats.Flushes,
+		"compactions":    stats.Compactions,
+		"memtable_size":  stats.MemTableSize,
+		"memtable_limit": stats.MemTableLimit,
+		"sst_count":      stats.SSTCount,
+		"wal_size":       stats.WALSize,
+		"disk_free":      stats.DiskFree,
+		"disk_full":      stats.DiskFull,
+		"durability":     stats.Durability,
+	})
+}
+
+// client names the caller in the audit log, like a TCP connection that sent
+// "client http"
+func client(r *http.Request) string {
+	return "http@" + r.RemoteAddr
+}
+
+// writeResponseError answers with the error of a failed text response,
+// reporting whether it did
+func writeResponseError(w http.ResponseWriter, resp string) bool {
+	switch {
+	case resp == "error":
+		writeError(w, http.StatusNotFound, "key not found")
+	case strings.HasPrefix(resp, "error: redirect "), strings.HasPrefix(resp, "error: moved "):
+		writeError(w, http.StatusMisdirectedRequest, strings.TrimPrefix(resp, "error: "))
+	case strings.HasPrefix(resp, "error: permission denied"):
+		writeError(w, http.StatusForbidden, strings.TrimPrefix(resp, "error: "))
+	case strings.HasPrefix(resp, "error: read-only"):
+		writeError(w, http.StatusServiceUnavailable, strings.TrimPrefix(resp, "error: "))
+	case strings.HasPrefix(resp, "error: conflict"):
+		writeError(w, http.StatusPreconditionFailed, strings.TrimPrefix(resp, "error: "))
+	case strings.HasPrefix(resp, "error: key too large"), strings.HasPrefix(resp, "error: value too large"):
+		writeError(w, http.StatusRequestEntityTooLarge, strings.TrimPrefix(resp, "error: "))
+	case strings.HasPrefix(resp, "error: "):
+		writeError(w, http.StatusInternalServerError, strings.TrimPrefix(resp, "error: "))
+	default:
+		return false
+	}
+	return true
+}
+
+// writeError answers with {"error": message}
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
+
+// writeJSON answers with v encoded as JSON
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("HTTP write failed", "err", err)
+	}
+}
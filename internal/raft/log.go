@@ -0,0 +1,320 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"escabelo/internal/engine"
+)
+
+// Entry is a record of the replicated log
+type Entry struct {
+	Index uint64
+	Term  uint64
+
+	// Changes are the mutations of a write the leader staged, with the
+	// versions they take. Every node applies them once committed.
+	Changes []*engine.Entry `json:",omitempty"`
+
+	// Peers, when set, is the new membership of the group. It takes effect
+	// as soon as the entry is appended, committed or not.
+	Peers []string `json:",omitempty"`
+}
+
+// logHeader is the first line of the log file: where the log starts after
+// compaction, and the membership as of that point
+type logHeader struct {
+	First     uint64 // index of the last entry compacted away
+	FirstTerm uint64
+	Peers     []string
+}
+
+// raftLog is the replicated log, kept in memory and persisted as one JSON
+// line per entry after a header. An empty dir keeps it in memory only.
+type raftLog struct {
+	dir     string
+	file    *os.File
+	header  logHeader
+	entries []*Entry // entries[i] has index header.First+1+i
+}
+
+// openLog loads the log in dir, starting a new one with peers as its
+// membership if there is none
+func openLog(dir string, peers []string) (*raftLog, error) {
+	l := &raftLog{dir: dir, header: logHeader{Peers: peers}}
+	if dir == "" {
+		return l, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(l.path())
+	if os.IsNotExist(err) {
+		return l, l.rewrite()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<30)
+	if !scanner.Scan() {
+		return l, l.rewrite()
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &l.header); err != nil {
+		return nil, fmt.Errorf("invalid raft log header: %w", err)
+	}
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn last line is an append that never completed
+			break
+		}
+		l.entries = append(l.entries, &entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, l.rewrite()
+}
+
+func (l *raftLog) path() string {
+	return filepath.Join(l.dir, "raft.log")
+}
+
+// first returns the index of the last compacted entry, 0 for none
+func (l *raftLog) first() uint64 {
+	return l.header.First
+}
+
+// last returns the index of the last entry
+func (l *raftLog) last() uint64 {
+	return l.header.First + uint64(len(l.entries))
+}
+
+// lastTerm returns the term of the last entry
+func (l *raftLog) lastTerm() uint64 {
+	return l.term(l.last())
+}
+
+// term returns the term of the entry at index, which must not precede
+// first
+func (l *raftLog) term(index uint64) uint64 {
+	if index == l.header.First {
+		return l.header.FirstTerm
+	}
+	return l.entries[index-l.header.First-1].Term
+}
+
+// entry returns the entry at index, which must be past first
+func (l *raftLog) entry(index uint64) *Entry {
+	return l.entries[index-l.header.First-1]
+}
+
+// slice returns a copy of up to max entries from index on
+func (l *raftLog) slice(index uint64, max int) []*Entry {
+	start := int(index - l.header.First - 1)
+	end := min(len(l.entries), start+max)
+	if start >= end {
+		return nil
+	}
+	return append([]*Entry(nil), l.entries[start:end]...)
+}
+
+// peers returns the membership set by the last configuration entry
+func (l *raftLog) peers() []string {
+	return l.peersAt(l.last())
+}
+
+// peersAt returns the membership as of the entry at index
+func (l *raftLog) peersAt(index uint64) []string {
+	for i := int(index-l.header.First) - 1; i >= 0; i-- {
+		if l.entries[i].Peers != nil {
+			return l.entries[i].Peers
+		}
+	}
+	return l.header.Peers
+}
+
+// configIndex returns the index of the last configuration entry, or first
+// if the log holds none
+func (l *raftLog) configIndex() uint64 {
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if l.entries[i].Peers != nil {
+			return l.entries[i].Index
+		}
+	}
+	return l.header.First
+}
+
+// append adds entries to the end of the log and syncs them
+func (l *raftLog) append(entries ...*Entry) error {
+	l.entries = append(l.entries, entries...)
+	if l.file == nil {
+		return nil
+	}
+
+	writer := bufio.NewWriter(l.file)
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		writer.Write(data)
+		writer.WriteByte('\n')
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// truncate drops the entries from index on
+func (l *raftLog) truncate(index uint64) error {
+	l.entries = l.entries[:index-l.header.First-1]
+	return l.rewrite()
+}
+
+// compact drops the entries up to and including index
+func (l *raftLog) compact(index uint64) error {
+	dropped := index - l.header.First
+	l.header = logHeader{First: index, FirstTerm: l.term(index), Peers: l.peersAt(index)}
+	l.entries = append([]*Entry(nil), l.entries[dropped:]...)
+	return l.rewrite()
+}
+
+// reset empties the log, restarting it after index, of term, with peers as
+// its membership
+func (l *raftLog) reset(index, term uint64, peers []string) error {
+	l.header = logHeader{First: index, FirstTerm: term, Peers: peers}
+	l.entries = nil
+	return l.rewrite()
+}
+
+// rewrite replaces the log file with the log's contents, through a synced
+// temporary file, and reopens it for appending
+func (l *raftLog) rewrite() error {
+	if l.dir == "" {
+		return nil
+	}
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+
+	tmpPath := l.path() + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	header, _ := json.Marshal(l.header)
+	writer.Write(header)
+	writer.WriteByte('\n')
+	for _, entry := range l.entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(data)
+		writer.WriteByte('\n')
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, l.path()); err != nil {
+		return err
+	}
+
+	l.file, err = os.OpenFile(l.path(), os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// close closes the log file
+func (l *raftLog) close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// hardState is the state a node persists besides its log: its term, the
+// candidate it voted for in that term, and the last entry it applied
+type hardState struct {
+	term     uint64
+	votedFor string
+	applied  uint64
+}
+
+// loadState reads the state persisted in dir, if any
+func loadState(dir string) (hardState, error) {
+	var state hardState
+	if dir == "" {
+		return state, nil
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "raft.state"))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	// Format: "<term> <applied> [voted-for]"
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return state, fmt.Errorf("invalid raft state %q", data)
+	}
+	if state.term, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+		return state, fmt.Errorf("invalid raft state: %w", err)
+	}
+	if state.applied, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+		return state, fmt.Errorf("invalid raft state: %w", err)
+	}
+	if len(fields) > 2 {
+		state.votedFor = fields[2]
+	}
+	return state, nil
+}
+
+// saveState atomically persists state in dir
+func saveState(dir string, state hardState) error {
+	if dir == "" {
+		return nil
+	}
+	path := filepath.Join(dir, "raft.state")
+	tmpPath := path + ".tmp"
+	data := fmt.Sprintf("%d %d %s\n", state.term, state.applied, state.votedFor)
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,994 @@
+// Package raft replicates a store's writes across a group of nodes with the
+// Raft consensus algorithm. The leader stages each write without applying
+// it and proposes the staged changes as a log entry; once a majority has
+// persisted the entry it is committed, and every node, the leader included,
+// applies its changes.
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"escabelo/internal/cluster"
+	"escabelo/internal/engine"
+)
+
+var (
+	// ErrNotLeader is returned for requests only the leader can serve
+	ErrNotLeader = errors.New("not the raft leader")
+
+	// ErrMembershipChange is returned while a membership change hasn't
+	// committed yet, as changes are made one node at a time
+	ErrMembershipChange = errors.New("membership change in progress")
+
+	// ErrStopped is returned for RPCs received once the node stopped
+	ErrStopped = errors.New("raft node stopped")
+)
+
+// Role is a node's part in the group
+type Role string
+
+const (
+	Follower  Role = "follower"
+	Candidate Role = "candidate"
+	Leader    Role = "leader"
+)
+
+const (
+	// appendBatch bounds the log entries sent in one append, and
+	// applyBatch those applied at once
+	appendBatch = 100
+	applyBatch  = 100
+
+	// logRetain is how many applied entries are kept for followers that
+	// fall behind; the log is compacted once twice as many pile up
+	logRetain = 10000
+
+	// snapshotTimeout bounds a follower's catch-up from the leader's data
+	snapshotTimeout = 30 * time.Second
+)
+
+// Config holds the configuration of a node
+type Config struct {
+	// Self is the address of this node's data listener, which peers send
+	// RPCs to and followers catch up from
+	Self string
+
+	// Peers is the initial membership, Self included, used when the node
+	// starts with no log. A node joining an existing group starts with the
+	// group's members and no Self, and waits to be added.
+	Peers []string
+
+	// Dir persists the log and the node's term and vote (empty keeps them
+	// in memory)
+	Dir string
+
+	// ElectionTimeout is how long a follower waits without hearing from a
+	// leader before standing for election, randomized up to twice as long.
+	// The leader sends heartbeats every HeartbeatInterval.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+
+	// Token, when set, authenticates RPCs with peers that require it
+	Token string
+
+	Store engine.Store
+}
+
+// Hooks are called as a node applies committed changes
+type Hooks struct {
+	// Applied is called with the key of every applied change
+	Applied func(key string)
+
+	// Repaired is called after the node caught up from the leader's data,
+	// which changed keys without calling Applied
+	Repaired func()
+}
+
+// PeerStatus is the leader's view of a peer's replication
+type PeerStatus struct {
+	Addr        string
+	Match       uint64
+	Next        uint64
+	LastContact time.Time
+}
+
+// Status describes a node
+type Status struct {
+	Self       string
+	Role       Role
+	Term       uint64
+	Leader     string
+	Commit     uint64
+	Applied    uint64
+	FirstIndex uint64
+	LastIndex  uint64
+	Members    []string
+
+	// Peers is set on the leader
+	Peers []PeerStatus
+}
+
+// progress is the leader's replication state for a peer
+type progress struct {
+	next    uint64
+	match   uint64
+	contact time.Time
+
+	kick chan struct{}
+	stop chan struct{}
+}
+
+// Node is a member of a Raft group
+type Node struct {
+	config Config
+	hooks  Hooks
+
+	mu      sync.Mutex
+	log     *raftLog
+	hard    hardState
+	role    Role
+	leader  string
+	commit  uint64
+	contact time.Time     // when a leader was last heard from or a vote granted
+	timeout time.Duration // this term's randomized election timeout
+	conns   map[string]*peerConn
+	rng     *rand.Rand
+
+	// installing is set while catching up from the leader's data, and
+	// resets counts the times the log restarted after one
+	installing bool
+	resets     uint64
+
+	// Leader state: peers' progress, when leadership began, and a channel
+	// closed when it ends
+	progress    map[string]*progress
+	leaderSince time.Time
+	leaderStop  chan struct{}
+
+	// proposeMu serializes proposals, so each write is staged on top of
+	// every earlier one
+	proposeMu sync.Mutex
+
+	changed chan struct{} // closed and replaced when commit, applied or role changes
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewNode opens the log and state in config.Dir. The node does nothing until
+// started.
+func NewNode(config Config) (*Node, error) {
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = time.Second
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = config.ElectionTimeout / 10
+	}
+	if len(config.Peers) == 0 {
+		config.Peers = []string{config.Self}
+	}
+	peers := slices.Clone(config.Peers)
+	sort.Strings(peers)
+
+	log, err := openLog(config.Dir, peers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft log: %w", err)
+	}
+	hard, err := loadState(config.Dir)
+	if err != nil {
+		log.close()
+		return nil, err
+	}
+	// A compacted log starts past what was applied before a crash
+	hard.applied = min(max(hard.applied, log.first()), log.last())
+
+	n := &Node{
+		config:  config,
+		log:     log,
+		hard:    hard,
+		role:    Follower,
+		commit:  hard.applied,
+		contact: time.Now(),
+		conns:   make(map[string]*peerConn),
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		changed: make(chan struct{}),
+		stopCh:  make(chan struct{}),
+	}
+	n.timeout = n.randomTimeout()
+	return n, nil
+}
+
+// Start runs elections and applies committed entries, calling hooks
+func (n *Node) Start(hooks Hooks) {
+	n.hooks = hooks
+	n.wg.Add(2)
+	go n.run()
+	go n.applyLoop()
+}
+
+// Stop stops the node, stepping down if it leads
+func (n *Node) Stop() error {
+	n.mu.Lock()
+	close(n.stopCh)
+	if n.role == Leader {
+		n.stopLeadingLocked()
+	}
+	n.mu.Unlock()
+	n.wg.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, conn := range n.conns {
+		conn.close()
+	}
+	return n.log.close()
+}
+
+// stoppedLocked reports whether the node stopped. Caller holds n.mu.
+func (n *Node) stoppedLocked() bool {
+	select {
+	case <-n.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Self returns the node's address
+func (n *Node) Self() string {
+	return n.config.Self
+}
+
+// IsLeader reports whether the node leads the group
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == Leader
+}
+
+// Leader returns the address of the leader, or "" if none is known
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// Status returns the node's state
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	status := Status{
+		Self:       n.config.Self,
+		Role:       n.role,
+		Term:       n.hard.term,
+		Leader:     n.leader,
+		Commit:     n.commit,
+		Applied:    n.hard.applied,
+		FirstIndex: n.log.first(),
+		LastIndex:  n.log.last(),
+		Members:    slices.Clone(n.log.peers()),
+	}
+	for _, addr := range status.Members {
+		if p, ok := n.progress[addr]; ok {
+			status.Peers = append(status.Peers, PeerStatus{Addr: addr, Match: p.match, Next: p.next, LastContact: p.contact})
+		}
+	}
+	return status
+}
+
+// Propose runs write against a stage of the store and proposes the
+// changes it staged, returning once they committed and were applied here.
+// write reports whether its changes should be proposed, so a write that
+// fails proposes nothing. Writes are proposed one at a time, each staged
+// once every earlier entry was applied, so it reads the writes before it.
+// A write that times out or loses leadership may still commit later.
+func (n *Node) Propose(write func(stage *engine.Stage) bool, timeout time.Duration) error {
+	n.proposeMu.Lock()
+	defer n.proposeMu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	n.mu.Lock()
+	if n.role != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	term := n.hard.term
+	last := n.log.last()
+	n.mu.Unlock()
+	if err := n.waitApplied(last, term, timer.C); err != nil {
+		return err
+	}
+
+	stage := n.config.Store.Stage()
+	if !write(stage) || len(stage.Entries()) == 0 {
+		return nil
+	}
+
+	n.mu.Lock()
+	if n.role != Leader || n.hard.term != term {
+		n.mu.Unlock()
+		return fmt.Errorf("%w: leadership lost before the write was proposed", ErrNotLeader)
+	}
+	entry := &Entry{Index: n.log.last() + 1, Term: term, Changes: stage.Entries()}
+	if err := n.log.append(entry); err != nil {
+		n.mu.Unlock()
+		return fmt.Errorf("failed to append to raft log: %w", err)
+	}
+	n.maybeCommitLocked()
+	n.kickPeersLocked()
+	n.mu.Unlock()
+
+	return n.waitApplied(entry.Index, term, timer.C)
+}
+
+// waitApplied blocks until the entry at index of term was applied, or the
+// leadership of term ends or expired fires first
+func (n *Node) waitApplied(index, term uint64, expired <-chan time.Time) error {
+	for {
+		n.mu.Lock()
+		if n.hard.applied >= index && index >= n.log.first() && n.log.term(index) == term {
+			n.mu.Unlock()
+			return nil
+		}
+		if n.role != Leader || n.hard.term != term {
+			n.mu.Unlock()
+			return fmt.Errorf("%w: leadership lost before the write committed", ErrNotLeader)
+		}
+		changed := n.changed
+		n.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-expired:
+			return errors.New("commit timeout: write not yet persisted by a majority")
+		}
+	}
+}
+
+// AddPeer adds the node at addr to the group, returning once the change
+// committed. The new node catches up from the leader as a member.
+func (n *Node) AddPeer(addr string) error {
+	return n.changePeers(addr, true)
+}
+
+// RemovePeer removes the node at addr from the group, returning once the
+// change committed. A leader removing itself steps down then.
+func (n *Node) RemovePeer(addr string) error {
+	return n.changePeers(addr, false)
+}
+
+// changePeers appends a configuration entry adding or removing addr and
+// waits for it to commit
+func (n *Node) changePeers(addr string, add bool) error {
+	n.mu.Lock()
+	if n.role != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	if n.log.configIndex() > n.commit {
+		n.mu.Unlock()
+		return ErrMembershipChange
+	}
+
+	peers := slices.Clone(n.log.peers())
+	member := slices.Contains(peers, addr)
+	switch {
+	case add && member:
+		n.mu.Unlock()
+		return fmt.Errorf("%s is already a member", addr)
+	case !add && !member:
+		n.mu.Unlock()
+		return fmt.Errorf("%s is not a member", addr)
+	case add:
+		peers = append(peers, addr)
+		sort.Strings(peers)
+	default:
+		peers = slices.DeleteFunc(peers, func(peer string) bool { return peer == addr })
+		if len(peers) == 0 {
+			n.mu.Unlock()
+			return errors.New("can't remove the last member")
+		}
+	}
+
+	term := n.hard.term
+	entry := &Entry{Index: n.log.last() + 1, Term: term, Peers: peers}
+	if err := n.log.append(entry); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	if add {
+		n.startReplicatorLocked(addr)
+	} else if p, ok := n.progress[addr]; ok {
+		close(p.stop)
+		delete(n.progress, addr)
+	}
+	n.maybeCommitLocked()
+	n.kickPeersLocked()
+	n.mu.Unlock()
+
+	slog.Info("Raft membership change proposed", "peers", peers)
+	return n.waitIndex(entry.Index, term, 10*n.config.ElectionTimeout)
+}
+
+// waitIndex blocks until the entry at index commits while term's leadership
+// lasts, or the timeout passes
+func (n *Node) waitIndex(index, term uint64, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		n.mu.Lock()
+		if n.hard.term != term || (n.role != Leader && n.commit < index) {
+			n.mu.Unlock()
+			return fmt.Errorf("%w: leadership lost before the change committed", ErrNotLeader)
+		}
+		if n.commit >= index {
+			n.mu.Unlock()
+			return nil
+		}
+		changed := n.changed
+		n.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return errors.New("commit timeout: change not yet persisted by a majority")
+		}
+	}
+}
+
+// HandleVote answers a candidate's vote request
+func (n *Node) HandleVote(req *VoteRequest) (*VoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stoppedLocked() {
+		return nil, ErrStopped
+	}
+	if req.Term < n.hard.term {
+		return &VoteResponse{Term: n.hard.term}, nil
+	}
+	// A node with a live leader ignores candidates, so a removed or
+	// partitioned node can't disrupt the group by starting elections
+	if req.Term > n.hard.term && (n.role == Leader || n.leader != "" && time.Since(n.contact) < n.config.ElectionTimeout) {
+		return &VoteResponse{Term: n.hard.term}, nil
+	}
+	if req.Term > n.hard.term {
+		n.stepDownLocked(req.Term)
+	}
+
+	lastTerm := n.log.lastTerm()
+	upToDate := req.LastTerm > lastTerm || req.LastTerm == lastTerm && req.LastIndex >= n.log.last()
+	if !upToDate || (n.hard.votedFor != "" && n.hard.votedFor != req.Candidate) {
+		return &VoteResponse{Term: n.hard.term}, nil
+	}
+
+	n.hard.votedFor = req.Candidate
+	if err := saveState(n.config.Dir, n.hard); err != nil {
+		return nil, fmt.Errorf("failed to persist vote: %w", err)
+	}
+	n.contact = time.Now()
+	return &VoteResponse{Term: n.hard.term, Granted: true}, nil
+}
+
+// HandleAppend answers the leader's append request
+func (n *Node) HandleAppend(req *AppendRequest) (*AppendResponse, error) {
+	n.mu.Lock()
+	if n.stoppedLocked() {
+		n.mu.Unlock()
+		return nil, ErrStopped
+	}
+	if req.Term < n.hard.term {
+		defer n.mu.Unlock()
+		return &AppendResponse{Term: n.hard.term, Last: n.log.last()}, nil
+	}
+	if req.Term > n.hard.term || n.role != Follower {
+		n.stepDownLocked(req.Term)
+	}
+	n.leader = req.Leader
+	n.contact = time.Now()
+
+	if n.installing {
+		defer n.mu.Unlock()
+		return &AppendResponse{Term: n.hard.term, Last: n.log.last()}, nil
+	}
+	if req.Snapshot {
+		n.installing = true
+		n.mu.Unlock()
+		return n.installSnapshot(req)
+	}
+	defer n.mu.Unlock()
+	return n.appendLocked(req), nil
+}
+
+// appendLocked appends the leader's entries to the log, dropping any that
+// conflict with them. Caller holds n.mu.
+func (n *Node) appendLocked(req *AppendRequest) *AppendResponse {
+	fail := &AppendResponse{Term: n.hard.term, Last: n.log.last()}
+	if req.PrevIndex > n.log.last() {
+		return fail
+	}
+
+	prev, entries := req.PrevIndex, req.Entries
+	if prev < n.log.first() {
+		// Entries up to first were committed and compacted away here
+		skip := min(uint64(len(entries)), n.log.first()-prev)
+		prev, entries = prev+skip, entries[skip:]
+	} else if n.log.term(prev) != req.PrevTerm {
+		fail.Last = prev - 1
+		return fail
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= n.log.last() {
+			if n.log.term(entry.Index) == entry.Term {
+				continue
+			}
+			if err := n.log.truncate(entry.Index); err != nil {
+				slog.Error("Failed to truncate raft log", "err", err)
+				return fail
+			}
+		}
+		if err := n.log.append(entries[i:]...); err != nil {
+			slog.Error("Failed to append to raft log", "err", err)
+			return fail
+		}
+		break
+	}
+
+	match := prev + uint64(len(entries))
+	if commit := min(req.Commit, match); commit > n.commit {
+		n.commit = commit
+		n.notifyLocked()
+	}
+	return &AppendResponse{Term: n.hard.term, Success: true, Match: match}
+}
+
+// installSnapshot catches up from the leader's data, then restarts the log
+// after the last entry the leader applied. Entries the leader applied during
+// the repair are applied again from the log, which is harmless as applying
+// a change twice keeps the newer version.
+func (n *Node) installSnapshot(req *AppendRequest) (*AppendResponse, error) {
+	slog.Warn("Raft follower fell behind the leader's log, catching up from its data", "leader", req.Leader)
+	result, err := cluster.Repair(n.config.Store, req.Leader, n.config.Token, cluster.DefaultMerkleDepth, snapshotTimeout)
+	if err == nil && result.EntriesApplied > 0 && n.hooks.Repaired != nil {
+		n.hooks.Repaired()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.installing = false
+	n.contact = time.Now()
+	if n.stoppedLocked() {
+		return nil, ErrStopped
+	}
+	if err != nil {
+		slog.Error("Raft catch-up failed", "leader", req.Leader, "err", err)
+		return &AppendResponse{Term: n.hard.term, Last: n.log.last()}, nil
+	}
+	if n.hard.term != req.Term {
+		return &AppendResponse{Term: n.hard.term, Last: n.log.last()}, nil
+	}
+
+	if err := n.log.reset(req.PrevIndex, req.PrevTerm, req.Peers); err != nil {
+		return nil, fmt.Errorf("failed to reset log: %w", err)
+	}
+	n.commit = req.PrevIndex
+	n.hard.applied = req.PrevIndex
+	n.resets++
+	if err := saveState(n.config.Dir, n.hard); err != nil {
+		slog.Error("Failed to persist raft state", "err", err)
+	}
+	n.notifyLocked()
+
+	slog.Info("Raft follower caught up", "leader", req.Leader, "index", req.PrevIndex,
+		"divergent_buckets", result.DivergentBuckets, "applied", result.EntriesApplied)
+	return &AppendResponse{Term: n.hard.term, Success: true, Match: req.PrevIndex}, nil
+}
+
+// run starts elections when the leader goes quiet, and steps a leader down
+// when it loses contact with a majority
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		if n.role == Leader {
+			n.checkQuorumLocked()
+			n.mu.Unlock()
+			continue
+		}
+		elect := n.isVoterLocked() && !n.installing && time.Since(n.contact) >= n.timeout
+		n.mu.Unlock()
+		if elect {
+			n.startElection()
+		}
+	}
+}
+
+// checkQuorumLocked steps the leader down if a majority hasn't answered it
+// within an election timeout, so a partitioned leader stops taking writes.
+// Caller holds n.mu.
+func (n *Node) checkQuorumLocked() {
+	if time.Since(n.leaderSince) < n.config.ElectionTimeout {
+		return
+	}
+	voters := n.log.peers()
+	heard := 0
+	for _, addr := range voters {
+		if addr == n.config.Self {
+			heard++
+		} else if p, ok := n.progress[addr]; ok && time.Since(p.contact) < n.config.ElectionTimeout {
+			heard++
+		}
+	}
+	if heard < len(voters)/2+1 {
+		slog.Warn("Raft leader lost contact with a majority, stepping down", "term", n.hard.term)
+		n.stepDownLocked(n.hard.term)
+	}
+}
+
+// startElection stands for election in a new term
+func (n *Node) startElection() {
+	n.mu.Lock()
+	n.hard.term++
+	n.hard.votedFor = n.config.Self
+	n.role = Candidate
+	n.leader = ""
+	n.contact = time.Now()
+	n.timeout = n.randomTimeout()
+	if err := saveState(n.config.Dir, n.hard); err != nil {
+		n.mu.Unlock()
+		slog.Error("Failed to persist raft state", "err", err)
+		return
+	}
+	term := n.hard.term
+	req := &VoteRequest{Term: term, Candidate: n.config.Self, LastIndex: n.log.last(), LastTerm: n.log.lastTerm()}
+	voters := slices.Clone(n.log.peers())
+	needed := len(voters)/2 + 1
+	results := make(chan *VoteResponse, len(voters))
+	for _, addr := range voters {
+		if addr == n.config.Self {
+			continue
+		}
+		conn := n.connLocked(addr)
+		go func() {
+			resp := &VoteResponse{}
+			if err := conn.call("vote", req, resp, n.config.ElectionTimeout); err != nil {
+				slog.Debug("Raft vote request failed", "peer", conn.addr, "err", err)
+			}
+			results <- resp
+		}()
+	}
+	n.mu.Unlock()
+	slog.Info("Raft election started", "term", term)
+
+	votes := 1
+	for i := 1; ; i++ {
+		if votes == needed {
+			n.mu.Lock()
+			if n.role == Candidate && n.hard.term == term {
+				n.becomeLeaderLocked()
+			}
+			n.mu.Unlock()
+		}
+		if i == len(voters) {
+			return
+		}
+
+		resp := <-results
+		if resp.Term > term {
+			n.mu.Lock()
+			if resp.Term > n.hard.term {
+				n.stepDownLocked(resp.Term)
+			}
+			n.mu.Unlock()
+			return
+		}
+		if resp.Granted {
+			votes++
+		}
+	}
+}
+
+// becomeLeaderLocked takes over as leader, replicating to every peer.
+// Caller holds n.mu.
+func (n *Node) becomeLeaderLocked() {
+	n.role = Leader
+	n.leader = n.config.Self
+	n.leaderSince = time.Now()
+	n.leaderStop = make(chan struct{})
+	n.progress = make(map[string]*progress)
+	for _, addr := range n.log.peers() {
+		if addr != n.config.Self {
+			n.startReplicatorLocked(addr)
+		}
+	}
+
+	// An entry of its own term lets the leader commit earlier ones
+	if err := n.log.append(&Entry{Index: n.log.last() + 1, Term: n.hard.term}); err != nil {
+		slog.Error("Failed to append to raft log", "err", err)
+	}
+	n.maybeCommitLocked()
+	n.notifyLocked()
+	slog.Info("Raft leader elected", "term", n.hard.term, "self", n.config.Self)
+}
+
+// stopLeadingLocked ends the leadership. Caller holds n.mu.
+func (n *Node) stopLeadingLocked() {
+	close(n.leaderStop)
+	n.progress = nil
+	n.role = Follower
+	n.notifyLocked()
+}
+
+// stepDownLocked becomes a follower, moving to term if it's newer. Caller
+// holds n.mu.
+func (n *Node) stepDownLocked(term uint64) {
+	if term > n.hard.term {
+		n.hard.term = term
+		n.hard.votedFor = ""
+		n.leader = ""
+		if err := saveState(n.config.Dir, n.hard); err != nil {
+			slog.Error("Failed to persist raft state", "err", err)
+		}
+	}
+	if n.role == Leader {
+		n.stopLeadingLocked()
+		n.leader = ""
+	}
+	n.role = Follower
+	n.contact = time.Now()
+	n.timeout = n.randomTimeout()
+}
+
+// startReplicatorLocked starts replicating to the peer at addr. Caller
+// holds n.mu.
+func (n *Node) startReplicatorLocked(addr string) {
+	p := &progress{
+		next:    n.log.last() + 1,
+		contact: time.Now(),
+		kick:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	n.progress[addr] = p
+	n.wg.Add(1)
+	go n.replicate(addr, p, n.hard.term, n.leaderStop)
+}
+
+// replicate sends the log to a peer until the leadership ends or the peer
+// is removed, with heartbeats while there's nothing to send
+func (n *Node) replicate(addr string, p *progress, term uint64, leaderStop chan struct{}) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		if n.sendAppend(addr, p, term) {
+			n.mu.Lock()
+			behind := n.role == Leader && n.hard.term == term && p.next <= n.log.last()
+			n.mu.Unlock()
+			if behind {
+				continue
+			}
+		}
+
+		select {
+		case <-n.stopCh:
+			return
+		case <-leaderStop:
+			return
+		case <-p.stop:
+			return
+		case <-p.kick:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendAppend sends the peer the entries it lacks, or a snapshot if the log
+// no longer holds them. It reports whether the peer answered.
+func (n *Node) sendAppend(addr string, p *progress, term uint64) bool {
+	n.mu.Lock()
+	if n.role != Leader || n.hard.term != term {
+		n.mu.Unlock()
+		return false
+	}
+	req := &AppendRequest{Term: term, Leader: n.config.Self, Commit: n.commit}
+	timeout := n.config.ElectionTimeout
+	if p.next <= n.log.first() {
+		// The leader's data holds exactly the entries it applied
+		req.Snapshot = true
+		req.PrevIndex = n.hard.applied
+		req.PrevTerm = n.log.term(n.hard.applied)
+		req.Peers = n.log.peersAt(n.hard.applied)
+		timeout = snapshotTimeout + n.config.ElectionTimeout
+	} else {
+		req.PrevIndex = p.next - 1
+		req.PrevTerm = n.log.term(req.PrevIndex)
+		req.Entries = n.log.slice(p.next, appendBatch)
+	}
+	conn := n.connLocked(addr)
+	n.mu.Unlock()
+
+	resp := &AppendResponse{}
+	err := conn.call("append", req, resp, timeout)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil {
+		slog.Debug("Raft append failed", "peer", addr, "err", err)
+		return false
+	}
+	if resp.Term > n.hard.term {
+		n.stepDownLocked(resp.Term)
+		return false
+	}
+	if n.role != Leader || n.hard.term != term {
+		return false
+	}
+	p.contact = time.Now()
+
+	if resp.Success {
+		p.match = max(p.match, resp.Match)
+		p.next = p.match + 1
+		n.maybeCommitLocked()
+		return true
+	}
+	if !req.Snapshot {
+		p.next = max(1, min(req.PrevIndex, resp.Last+1))
+	}
+	return false
+}
+
+// maybeCommitLocked advances the commit index to the last entry of the
+// current term a majority persisted. Caller holds n.mu.
+func (n *Node) maybeCommitLocked() {
+	voters := n.log.peers()
+	matches := make([]uint64, 0, len(voters))
+	for _, addr := range voters {
+		if addr == n.config.Self {
+			matches = append(matches, n.log.last())
+		} else if p, ok := n.progress[addr]; ok {
+			matches = append(matches, p.match)
+		} else {
+			matches = append(matches, 0)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+
+	index := matches[len(matches)/2]
+	if index <= n.commit || n.log.term(index) != n.hard.term {
+		return
+	}
+	n.commit = index
+	n.notifyLocked()
+
+	// A leader removed from the group leads until its removal commits
+	if !n.isVoterLocked() && n.log.configIndex() <= n.commit {
+		slog.Info("Raft leader removed from the group, stepping down")
+		n.stepDownLocked(n.hard.term)
+	}
+}
+
+// applyLoop applies committed entries to the store
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		changed := n.changed
+		resets := n.resets
+		var entries []*Entry
+		if n.hard.applied < n.commit {
+			entries = n.log.slice(n.hard.applied+1, int(min(n.commit-n.hard.applied, applyBatch)))
+		}
+		n.mu.Unlock()
+
+		if len(entries) == 0 {
+			select {
+			case <-n.stopCh:
+				return
+			case <-changed:
+			}
+			continue
+		}
+
+		if err := n.apply(entries); err != nil {
+			slog.Error("Failed to apply raft entries", "err", err)
+			select {
+			case <-n.stopCh:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		n.mu.Lock()
+		if n.resets == resets {
+			n.hard.applied = entries[len(entries)-1].Index
+			if err := saveState(n.config.Dir, n.hard); err != nil {
+				slog.Error("Failed to persist raft state", "err", err)
+			}
+			if n.hard.applied-n.log.first() >= 2*logRetain {
+				if err := n.log.compact(n.hard.applied - logRetain); err != nil {
+					slog.Error("Failed to compact raft log", "err", err)
+				}
+			}
+		}
+		n.notifyLocked()
+		n.mu.Unlock()
+	}
+}
+
+// apply applies the changes of committed entries, each entry's at once
+func (n *Node) apply(entries []*Entry) error {
+	for _, entry := range entries {
+		if len(entry.Changes) == 0 {
+			continue
+		}
+		if err := n.config.Store.ApplyBatch(entry.Changes); err != nil {
+			return fmt.Errorf("apply entry %d: %w", entry.Index, err)
+		}
+		if n.hooks.Applied != nil {
+			for _, change := range entry.Changes {
+				n.hooks.Applied(change.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// isVoterLocked reports whether the node is a member. Caller holds n.mu.
+func (n *Node) isVoterLocked() bool {
+	return slices.Contains(n.log.peers(), n.config.Self)
+}
+
+// connLocked returns the connection to the peer at addr. Caller holds n.mu.
+func (n *Node) connLocked(addr string) *peerConn {
+	conn, ok := n.conns[addr]
+	if !ok {
+		conn = &peerConn{addr: addr, token: n.config.Token}
+		n.conns[addr] = conn
+	}
+	return conn
+}
+
+// kickPeersLocked wakes every replicator. Caller holds n.mu.
+func (n *Node) kickPeersLocked() {
+	for _, p := range n.progress {
+		select {
+		case p.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// notifyLocked wakes everything waiting on a commit or role change. Caller
+// holds n.mu.
+func (n *Node) notifyLocked() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// randomTimeout returns an election timeout between one and two
+// ElectionTimeouts, so nodes rarely stand for election at once
+func (n *Node) randomTimeout() time.Duration {
+	return n.config.ElectionTimeout + time.Duration(n.rng.Int63n(int64(n.config.ElectionTimeout)))
+}
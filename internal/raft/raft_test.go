@@ -0,0 +1,280 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"escabelo/internal/engine"
+)
+
+// testNode is a member of a test group, answering its peers' RPCs on a
+// listener of its own as a server's data listener does
+type testNode struct {
+	node     *Node
+	store    *engine.MemStore
+	listener net.Listener
+	stopOnce sync.Once
+}
+
+// startGroup starts a group of n members keeping their logs in memory
+func startGroup(t *testing.T, n int) []*testNode {
+	t.Helper()
+	listeners := make([]net.Listener, n)
+	addrs := make([]string, n)
+	for i := range listeners {
+		listeners[i] = listen(t)
+		addrs[i] = listeners[i].Addr().String()
+	}
+
+	group := make([]*testNode, n)
+	for i := range group {
+		group[i] = startNode(t, listeners[i], addrs)
+	}
+	return group
+}
+
+// listen opens a listener for a member on a free port
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+// startNode starts a member answering on listener, whose log starts with
+// peers as the membership
+func startNode(t *testing.T, listener net.Listener, peers []string) *testNode {
+	t.Helper()
+	store := engine.NewMemStore(engine.Config{MaxVersions: 1})
+	node, err := NewNode(Config{
+		Self:            listener.Addr().String(),
+		Peers:           peers,
+		ElectionTimeout: 150 * time.Millisecond,
+		Store:           store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn := &testNode{node: node, store: store, listener: listener}
+	go tn.serve()
+	node.Start(Hooks{})
+	t.Cleanup(tn.stop)
+	return tn
+}
+
+// serve accepts peer connections until the listener is closed
+func (tn *testNode) serve() {
+	for {
+		conn, err := tn.listener.Accept()
+		if err != nil {
+			return
+		}
+		go tn.handle(conn)
+	}
+}
+
+// handle answers the "raft vote <json>" and "raft append <json>" commands
+// of a connection
+func (tn *testNode) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\r')
+		if err != nil {
+			return
+		}
+		kind, data, _ := strings.Cut(strings.TrimPrefix(strings.TrimSuffix(line, "\r"), "raft "), " ")
+
+		var resp any
+		switch kind {
+		case "vote":
+			var req VoteRequest
+			if err = json.Unmarshal([]byte(data), &req); err == nil {
+				resp, err = tn.node.HandleVote(&req)
+			}
+		case "append":
+			var req AppendRequest
+			if err = json.Unmarshal([]byte(data), &req); err == nil {
+				resp, err = tn.node.HandleAppend(&req)
+			}
+		default:
+			err = fmt.Errorf("unknown raft command: %s", kind)
+		}
+
+		reply := fmt.Sprintf("error: %v", err)
+		if err == nil {
+			encoded, _ := json.Marshal(resp)
+			reply = string(encoded)
+		}
+		if _, err := conn.Write([]byte(reply + "\r")); err != nil {
+			return
+		}
+	}
+}
+
+// stop stops the node and its listener, once
+func (tn *testNode) stop() {
+	tn.stopOnce.Do(func() {
+		tn.listener.Close()
+		tn.node.Stop()
+	})
+}
+
+// waitLeader returns the member of group leading it, once there is one
+func waitLeader(t *testing.T, group []*testNode) *testNode {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, tn := range group {
+			if tn.node.IsLeader() {
+				return tn
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader elected after 10s")
+	return nil
+}
+
+// put proposes a write of key through tn
+func put(tn *testNode, key, value string) error {
+	return tn.node.Propose(func(stage *engine.Stage) bool {
+		return stage.Put(key, []byte(value)) == nil
+	}, 5*time.Second)
+}
+
+// waitValue waits until every member of group applied key with value
+func waitValue(t *testing.T, group []*testNode, key, value string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for _, tn := range group {
+		for {
+			got, found, err := tn.store.Get(key)
+			if err != nil {
+				t.Fatalf("get %s on %s: %v", key, tn.node.Self(), err)
+			}
+			if found && string(got) == value {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("get %s on %s = %q (found %v) after 10s, want %q", key, tn.node.Self(), got, found, value)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// TestReplicatesCommittedWrites checks that a group elects one leader, that
+// followers refuse proposals, and that a write the leader commits is
+// applied by every member
+func TestReplicatesCommittedWrites(t *testing.T) {
+	group := startGroup(t, 3)
+	leader := waitLeader(t, group)
+
+	for _, tn := range group {
+		if tn != leader {
+			if err := put(tn, "key", "follower"); !errors.Is(err, ErrNotLeader) {
+				t.Errorf("propose on follower %s: %v, want ErrNotLeader", tn.node.Self(), err)
+			}
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := put(leader, fmt.Sprintf("key:%02d", i), fmt.Sprintf("v%d", i)); err != nil {
+			t.Fatalf("propose key:%02d: %v", i, err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		waitValue(t, group, fmt.Sprintf("key:%02d", i), fmt.Sprintf("v%d", i))
+	}
+	for _, tn := range group {
+		if got := tn.node.Leader(); got != leader.node.Self() {
+			t.Errorf("%s takes %q for the leader, want %s", tn.node.Self(), got, leader.node.Self())
+		}
+	}
+}
+
+// TestFailover stops the leader: the remaining majority must elect a new
+// one, which keeps the writes committed before and takes new ones
+func TestFailover(t *testing.T) {
+	group := startGroup(t, 3)
+	leader := waitLeader(t, group)
+	if err := put(leader, "before", "v1"); err != nil {
+		t.Fatalf("propose before: %v", err)
+	}
+	waitValue(t, group, "before", "v1")
+
+	leader.stop()
+	var survivors []*testNode
+	for _, tn := range group {
+		if tn != leader {
+			survivors = append(survivors, tn)
+		}
+	}
+	next := waitLeader(t, survivors)
+	if err := put(next, "after", "v1"); err != nil {
+		t.Fatalf("propose after failover: %v", err)
+	}
+	waitValue(t, survivors, "before", "v1")
+	waitValue(t, survivors, "after", "v1")
+}
+
+// TestMembershipChange adds a member, which must catch up on the writes
+// made before it joined, then removes another: the group keeps committing
+// writes across both changes
+func TestMembershipChange(t *testing.T) {
+	group := startGroup(t, 3)
+	leader := waitLeader(t, group)
+	if err := put(leader, "before", "v1"); err != nil {
+		t.Fatalf("propose before: %v", err)
+	}
+
+	var members []string
+	for _, tn := range group {
+		members = append(members, tn.node.Self())
+	}
+	joining := startNode(t, listen(t), members)
+	if err := leader.node.AddPeer(joining.node.Self()); err != nil {
+		t.Fatalf("add %s: %v", joining.node.Self(), err)
+	}
+	group = append(group, joining)
+	if err := put(leader, "added", "v1"); err != nil {
+		t.Fatalf("propose after adding a member: %v", err)
+	}
+	waitValue(t, group, "before", "v1")
+	waitValue(t, group, "added", "v1")
+
+	var removed *testNode
+	for _, tn := range group {
+		if tn != leader && tn != joining {
+			removed = tn
+			break
+		}
+	}
+	if err := leader.node.RemovePeer(removed.node.Self()); err != nil {
+		t.Fatalf("remove %s: %v", removed.node.Self(), err)
+	}
+	removed.stop()
+	var remaining []*testNode
+	for _, tn := range group {
+		if tn != removed {
+			remaining = append(remaining, tn)
+		}
+	}
+	if err := put(leader, "removed", "v1"); err != nil {
+		t.Fatalf("propose after removing a member: %v", err)
+	}
+	waitValue(t, remaining, "removed", "v1")
+	if members := leader.node.Status().Members; len(members) != 3 {
+		t.Errorf("members after the changes = %v, want 3", members)
+	}
+}
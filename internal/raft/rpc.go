@@ -0,0 +1,132 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"escabelo/internal/cluster"
+)
+
+// VoteRequest asks a node for its vote in an election
+type VoteRequest struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+// VoteResponse answers a VoteRequest
+type VoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+// AppendRequest replicates log entries from the leader, or with no entries
+// is a heartbeat. With Snapshot set it instead tells a follower that fell
+// behind the leader's log to catch up from the leader's data, then restart
+// its log after PrevIndex with membership Peers.
+type AppendRequest struct {
+	Term      uint64
+	Leader    string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []*Entry `json:",omitempty"`
+	Commit    uint64
+
+	Snapshot bool     `json:",omitempty"`
+	Peers    []string `json:",omitempty"`
+}
+
+// AppendResponse answers an AppendRequest. On success Match is the last
+// index known to match the leader's log; otherwise Last hints where the
+// follower's log ends.
+type AppendResponse struct {
+	Term    uint64
+	Success bool
+	Match   uint64
+	Last    uint64
+}
+
+// peerConn is a connection to a peer's data listener, over which RPCs are
+// sent as text protocol commands: "raft vote <json>" and
+// "raft append <json>", answered with JSON
+type peerConn struct {
+	mu     sync.Mutex
+	addr   string
+	token  string
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// call sends an RPC and decodes its response, redialing if the connection
+// was lost. A failed call closes the connection.
+func (p *peerConn) call(kind string, req, resp any, timeout time.Duration) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		conn, err := net.DialTimeout("tcp", p.addr, timeout)
+		if err != nil {
+			return err
+		}
+		reader := bufio.NewReaderSize(conn, 64*1024)
+		if p.token != "" {
+			conn.SetDeadline(time.Now().Add(timeout))
+			if err := cluster.Authenticate(conn, reader, p.token); err != nil {
+				conn.Close()
+				return err
+			}
+		}
+		p.conn, p.reader = conn, reader
+	}
+
+	p.conn.SetDeadline(time.Now().Add(timeout))
+	line, err := p.roundTrip(fmt.Sprintf("raft %s %s\r", kind, data))
+	if err != nil {
+		p.closeLocked()
+		return err
+	}
+	if strings.HasPrefix(line, "error") {
+		// The peer may be shutting down, and it can't until its
+		// connections close
+		p.closeLocked()
+		return fmt.Errorf("peer rejected raft %s: %s", kind, line)
+	}
+	return json.Unmarshal([]byte(line), resp)
+}
+
+// roundTrip writes a command and reads its response. Caller holds p.mu.
+func (p *peerConn) roundTrip(cmd string) (string, error) {
+	if _, err := p.conn.Write([]byte(cmd)); err != nil {
+		return "", err
+	}
+	resp, err := p.reader.ReadString('\r')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(resp, "\r"), nil
+}
+
+// close closes the connection, if open
+func (p *peerConn) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeLocked()
+}
+
+func (p *peerConn) closeLocked() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn, p.reader = nil, nil
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// listenFDsStart is the first inherited descriptor (after stdin, stdout
+	// and stderr)
+	listenFDsStart = 3
+
+	// adminFDName marks the inherited descriptor used as the admin listener
+	adminFDName = "admin"
+)
+
+// InheritedListeners returns the listeners passed by a process manager using
+// the LISTEN_FDS protocol (systemd socket activation). Descriptors named
+// "admin" in LISTEN_FDNAMES are returned separately. It returns no listeners
+// when none were passed to this process. The variables are unset so child
+// processes don't inherit them.
+func InheritedListeners() (data []net.Listener, admin net.Listener, err error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil, nil
+	}
+
+	var names []string
+	if env := os.Getenv("LISTEN_FDNAMES"); env != "" {
+		names = strings.Split(env, ":")
+	}
+
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		// FileListener dups the descriptor
+		file.Close()
+		if err != nil {
+			closeAll(data, admin)
+			return nil, nil, fmt.Errorf("inherited descriptor %d (%s) is not a listener: %w", fd, name, err)
+		}
+
+		if name == adminFDName && admin == nil {
+			admin = listener
+		} else {
+			data = append(data, listener)
+		}
+	}
+	return data, admin, nil
+}
+
+// closeAll closes the listeners collected so far
+func closeAll(data []net.Listener, admin net.Listener) {
+	for _, listener := range data {
+		listener.Close()
+	}
+	if admin != nil {
+		admin.Close()
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditConfig holds audit log configuration
+type AuditConfig struct {
+	// Path is the active audit log file; rotated files get a numeric
+	// suffix (path.1 is the most recent)
+	Path string
+
+	// MaxSize rotates the log once it grows past this many bytes
+	MaxSize int64
+
+	// MaxFiles bounds the rotated files kept; older ones are removed
+	MaxFiles int
+}
+
+// AuditRecord is a single audited write
+type AuditRecord struct {
+	Timestamp int64 // unix nanoseconds
+	Client    string
+	Op        string
+	Key       string
+}
+
+// String formats the record as a log line
+func (r AuditRecord) String() string {
+	return fmt.Sprintf("%d %s %s %s", r.Timestamp, r.Client, r.Op, r.Key)
+}
+
+// AuditLog is an append-only log of the writes performed by clients,
+// kept separately from the WAL and never truncated by the engine
+type AuditLog struct {
+	config AuditConfig
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+}
+
+// NewAuditLog opens (or creates) the audit log for appending
+func NewAuditLog(config AuditConfig) (*AuditLog, error) {
+	if config.MaxSize <= 0 {
+		config.MaxSize = 64 * 1024 * 1024
+	}
+	if config.MaxFiles <= 0 {
+		config.MaxFiles = 10
+	}
+
+	a := &AuditLog{config: config}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// open opens the active file, picking up its current size
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// Record appends a write performed by a client
+func (a *AuditLog) Record(client, op, key string) error {
+	line := AuditRecord{
+		Timestamp: time.Now().UnixNano(),
+		Client:    client,
+		Op:        op,
+		Key:       key,
+	}.String() + "\n"
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.size > 0 && a.size+int64(len(line)) > a.config.MaxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.WriteString(line)
+	a.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("audit log write failed: %w", err)
+	}
+	return nil
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest, and starts a new
+// active file. Requires a.mu held.
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	}
+
+	os.Remove(a.rotatedPath(a.config.MaxFiles))
+	for i := a.config.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(a.rotatedPath(i), a.rotatedPath(i+1))
+	}
+	if err := os.Rename(a.config.Path, a.rotatedPath(1)); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	return a.open()
+}
+
+// rotatedPath returns the path of the n-th most recent rotated file
+func (a *AuditLog) rotatedPath(n int) string {
+	return a.config.Path + "." + strconv.Itoa(n)
+}
+
+// Query returns the most recent records, oldest first, optionally limited
+// to a single key
+func (a *AuditLog) Query(key string, limit int) ([]AuditRecord, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var records []AuditRecord
+	paths := make([]string, 0, a.config.MaxFiles+1)
+	for i := a.config.MaxFiles; i >= 1; i-- {
+		paths = append(paths, a.rotatedPath(i))
+	}
+	paths = append(paths, a.config.Path)
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			record, ok := parseAuditRecord(scanner.Text())
+			if !ok || (key != "" && record.Key != key) {
+				continue
+			}
+			records = append(records, record)
+			if len(records) > limit {
+				records = records[1:]
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+	}
+
+	return records, nil
+}
+
+// Close closes the active file
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// parseAuditRecord parses a log line written by Record
+func parseAuditRecord(line string) (AuditRecord, bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return AuditRecord{}, false
+	}
+	ts, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return AuditRecord{}, false
+	}
+	return AuditRecord{Timestamp: ts, Client: fields[1], Op: fields[2], Key: fields[3]}, true
+}
+
+// auditOp returns the audited operation name of a successful write command
+func auditOp(cmd *Command) string {
+	if cmd.Type == CmdWrite {
+		return "put"
+	}
+	return cmd.Type
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Roles a credential grants. Read-only connections may run any command that
+// doesn't mutate the keyspace or the server.
+const (
+	RoleReadOnly  = "read-only"
+	RoleReadWrite = "read-write"
+)
+
+// ErrAuthRequired is returned for commands sent before authenticating, when
+// the server requires it
+var ErrAuthRequired = errors.New("authentication required")
+
+// Auth holds the credentials a server accepts: bare tokens, sent as
+// "auth <token>", and users, sent as "auth <user> <password>"
+type Auth struct {
+	tokens map[string]string
+	users  map[string]authUser
+}
+
+// authUser is a user's password, or its SHA-256 digest, and role
+type authUser struct {
+	password string
+	digest   []byte
+	role     string
+}
+
+// NewAuth creates an empty set of credentials, which accepts nobody
+func NewAuth() *Auth {
+	return &Auth{tokens: make(map[string]string), users: make(map[string]authUser)}
+}
+
+// LoadAuthFile reads credentials from a file, one per line:
+//
+//	token <token> [read-only|read-write]
+//	user <name> <password> [read-only|read-write]
+//
+// The role defaults to read-write. A password written as "sha256:<hex>" is
+// compared against the digest of the password sent. Blank lines and lines
+// starting with '#' are ignored.
+func LoadAuthFile(path string) (*Auth, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open auth file: %w", err)
+	}
+	defer file.Close()
+
+	a := NewAuth()
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if err := a.addLine(fields); err != nil {
+			return nil, fmt.Errorf("auth file line %d: %w", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read auth file: %w", err)
+	}
+	return a, nil
+}
+
+// addLine adds the credential of an auth file line
+func (a *Auth) addLine(fields []string) error {
+	role := RoleReadWrite
+	switch fields[0] {
+	case "token":
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("format: token <token> [role]")
+		}
+		if len(fields) == 3 {
+			role = fields[2]
+		}
+		return a.AddToken(fields[1], role)
+
+	case "user":
+		if len(fields) < 3 || len(fields) > 4 {
+			return fmt.Errorf("format: user <name> <password> [role]")
+		}
+		if len(fields) == 4 {
+			role = fields[3]
+		}
+		return a.AddUser(fields[1], fields[2], role)
+	}
+	return fmt.Errorf("unknown credential type %q", fields[0])
+}
+
+// AddToken accepts a token granting role
+func (a *Auth) AddToken(token, role string) error {
+	if err := validRole(role); err != nil {
+		return err
+	}
+	a.tokens[token] = role
+	return nil
+}
+
+// AddUser accepts a user, whose password may be given as "sha256:<hex>"
+func (a *Auth) AddUser(name, password, role string) error {
+	if err := validRole(role); err != nil {
+		return err
+	}
+	user := authUser{password: password, role: role}
+	if hexDigest, ok := strings.CutPrefix(password, "sha256:"); ok {
+		digest, err := hex.DecodeString(hexDigest)
+		if err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("invalid sha256 password digest")
+		}
+		user.digest = digest
+	}
+	a.users[name] = user
+	return nil
+}
+
+// Token returns the role granted by a token
+func (a *Auth) Token(token string) (string, bool) {
+	role := ""
+	for candidate, r := range a.tokens {
+		// Compare against every token so timing doesn't reveal a match
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			role = r
+		}
+	}
+	return role, role != ""
+}
+
+// User returns the role granted to a user with the given password
+func (a *Auth) User(name, password string) (string, bool) {
+	user, ok := a.users[name]
+	if !ok {
+		return "", false
+	}
+	if user.digest != nil {
+		sum := sha256.Sum256([]byte(password))
+		ok = subtle.ConstantTimeCompare(sum[:], user.digest) == 1
+	} else {
+		ok = subtle.ConstantTimeCompare([]byte(user.password), []byte(password)) == 1
+	}
+	if !ok {
+		return "", false
+	}
+	return user.role, true
+}
+
+// validRole checks a role name
+func validRole(role string) error {
+	if role != RoleReadOnly && role != RoleReadWrite {
+		return fmt.Errorf("unknown role %q (want %s or %s)", role, RoleReadOnly, RoleReadWrite)
+	}
+	return nil
+}
+
+// Authenticate returns the role granted by a token, or by a user and
+// password when user is set. It grants read-write when auth is disabled.
+func (s *Server) Authenticate(user, secret string) (string, bool) {
+	if s.config.Auth == nil {
+		return RoleReadWrite, true
+	}
+	if user != "" {
+		return s.config.Auth.User(user, secret)
+	}
+	return s.config.Auth.Token(secret)
+}
+
+// AuthenticateHeader returns the role granted by an HTTP-style
+// Authorization header: "Bearer <token>", or "Basic" with a base64 encoded
+// "user:password". Like Authenticate, it grants read-write when auth is
+// disabled.
+func (s *Server) AuthenticateHeader(header string) (string, bool) {
+	if s.config.Auth == nil {
+		return RoleReadWrite, true
+	}
+	scheme, credentials, _ := strings.Cut(header, " ")
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		return s.Authenticate("", credentials)
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return "", false
+		}
+		user, password, ok := strings.Cut(string(decoded), ":")
+		if !ok || user == "" {
+			return "", false
+		}
+		return s.Authenticate(user, password)
+	}
+	return "", false
+}
+
+// AuthRequired reports whether clients must authenticate
+func (s *Server) AuthRequired() bool {
+	return s.config.Auth != nil
+}
+
+// Authorize checks that a connection holding role, "" until it has
+// authenticated, may run a command. Unauthenticated connections may only
+// check the server's status and authenticate; read-only ones may run
+// anything but writes and administrative commands.
+func (s *Server) Authorize(role string, cmd *Command) error {
+	if s.config.Auth == nil {
+		return nil
+	}
+	switch cmd.Type {
+	case CmdStatus, CmdAuth, CmdHello:
+		return nil
+	}
+	if role == "" {
+		return ErrAuthRequired
+	}
+	if role == RoleReadOnly && (cmd.IsWrite() || cmd.IsAdmin() || cmd.Type == CmdAck || cmd.Type == CmdGossip ||
+		cmd.Type == CmdRaft && cmd.Args[0] != "status" || cmd.Type == CmdIndex && cmd.Args[0] != "list") {
+		return fmt.Errorf("permission denied: %s is not allowed for %s connections", cmd.Type, role)
+	}
+	return nil
+}
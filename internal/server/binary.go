@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"escabelo/internal/engine"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+)
+
+// binaryMagic starts every frame at protocol level 3, so a client or server
+// that lost track of the framing fails fast instead of misreading data
+const binaryMagic byte = 0xE5
+
+// Binary request opcodes
+const (
+	opText   byte = 0 // value holds a text command, answered as at level 1
+	opGet    byte = 1
+	opPut    byte = 2
+	opDelete byte = 3 // blind, like "delete <key>"
+)
+
+// Binary response statuses
+const (
+	statusOK       byte = 0
+	statusNotFound byte = 1
+	statusError    byte = 2 // the body holds the error message
+)
+
+// binaryRequest is a decoded level 3 request frame
+type binaryRequest struct {
+	op    byte
+	id    uint32
+	key   string
+	value []byte
+}
+
+// readBinaryFrame reads a level 3 request frame, skipping the key and value
+// of one past limit bytes and returning its ID with errCommandTooLarge.
+// Format: magic(1) + opcode(1) + id(4) + keyLen(4) + valueLen(4) + key + value,
+// big-endian
+func readBinaryFrame(reader *bufio.Reader, limit int64) (*binaryRequest, error) {
+	var header [14]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != binaryMagic {
+		return nil, fmt.Errorf("bad frame magic 0x%02x", header[0])
+	}
+	keyLen := binary.BigEndian.Uint32(header[6:10])
+	valueLen := binary.BigEndian.Uint32(header[10:14])
+	id := binary.BigEndian.Uint32(header[2:6])
+	if size := int64(keyLen) + int64(valueLen); size > limit {
+		if _, err := reader.Discard(int(size)); err != nil {
+			return nil, err
+		}
+		return &binaryRequest{id: id}, fmt.Errorf("%w: %d bytes (max %d)", errCommandTooLarge, size, limit)
+	}
+
+	payload := make([]byte, keyLen+valueLen)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	return &binaryRequest{
+		op:    header[1],
+		id:    id,
+		key:   string(payload[:keyLen]),
+		value: payload[keyLen:],
+	}, nil
+}
+
+// writeBinaryFrame writes and flushes a level 3 response frame.
+// Format: magic(1) + status(1) + id(4) + length(4) + body, big-endian
+func writeBinaryFrame(writer *bufio.Writer, id uint32, status byte, body []byte) error {
+	var header [10]byte
+	header[0] = binaryMagic
+	header[1] = status
+	binary.BigEndian.PutUint32(header[2:6], id)
+	binary.BigEndian.PutUint32(header[6:10], uint32(len(body)))
+	if _, err := writer.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := writer.Write(body); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// textStatus maps a text response onto a binary status and body
+func textStatus(response string) (byte, []byte) {
+	switch {
+	case response == "error":
+		return statusNotFound, nil
+	case strings.HasPrefix(response, "error: "):
+		return statusError, []byte(strings.TrimPrefix(response, "error: "))
+	}
+	return statusOK, []byte(response)
+}
+
+// serveBinary serves a connection after hello switched it to level 3. Keys
+// and values are length-prefixed, so values may hold any bytes, "\r" and "|"
+// included. Requests run concurrently and are answered in completion order,
+// as at level 2.
+func (s *Server) serveBinary(sess *session, conn net.Conn, admin bool, reader *bufio.Reader, writer *bufio.Writer) {
+	var (
+		writeMu sync.Mutex
+		running sync.WaitGroup
+	)
+	slots := make(chan struct{}, maxInFlight)
+	defer running.Wait()
+
+	// A connection waiting on its own requests isn't idle
+	busy := func() bool { return len(slots) > 0 }
+
+	respond := func(id uint32, status byte, body []byte) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if err := writeBinaryFrame(writer, id, status, body); err != nil {
+			slog.Warn("Write failed", "remote", conn.RemoteAddr().String(), "err", err)
+		}
+	}
+
+	for {
+		if err := s.awaitRequest(conn, reader, busy); err != nil {
+			readError(conn, err)
+			return
+		}
+
+		req, err := readBinaryFrame(reader, s.maxCommandSize())
+		if errors.Is(err, errCommandTooLarge) {
+			respond(req.id, statusError, []byte(err.Error()))
+			continue
+		}
+		if err != nil {
+			readError(conn, err)
+			return
+		}
+
+		cmd, line, err := binaryCommand(req)
+		if err != nil {
+			respond(req.id, statusError, []byte(err.Error()))
+			continue
+		}
+
+		if err := s.checkPlane(cmd, admin); err != nil {
+			respond(req.id, statusError, []byte(err.Error()))
+			continue
+		}
+
+		if err := s.Authorize(sess.role, cmd); err != nil {
+			respond(req.id, statusError, []byte(err.Error()))
+			continue
+		}
+
+		if response, ok := s.sessionCommand(sess, conn, cmd); ok {
+			status, body := textStatus(response)
+			respond(req.id, status, body)
+			continue
+		}
+
+		snapshot := *sess
+		slots <- struct{}{}
+		running.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				running.Done()
+			}()
+			status, body := s.runBinary(&snapshot, req.op, cmd, line)
+			respond(req.id, status, body)
+		}()
+	}
+}
+
+// binaryCommand turns a request into the command it runs, along with its
+// text form for mirroring: empty when the value can't be sent as text
+func binaryCommand(req *binaryRequest) (*Command, string, error) {
+	if req.op == opText {
+		line := string(req.value)
+		cmd, err := ParseCommand(line)
+		return cmd, line, err
+	}
+
+	// Keys are length-framed, so any key goes
+	if !ValidKey(req.key) {
+		return nil, "", fmt.Errorf("invalid key format")
+	}
+	switch req.op {
+	case opGet:
+		return &Command{Type: CmdRead, Key: req.key}, "read " + escapeKey(req.key), nil
+	case opPut:
+		cmd := &Command{Type: CmdWrite, Key: req.key, Value: req.value}
+		return cmd, cmd.Line(), nil
+	case opDelete:
+		cmd := &Command{Type: CmdDelete, Key: req.key}
+		return cmd, cmd.Line(), nil
+	}
+	return nil, "", fmt.Errorf("unknown opcode %d", req.op)
+}
+
+// runBinary executes a binary request's command. Gets answer with the raw
+// value rather than a text response, which couldn't tell a value of "error"
+// from a missing key.
+func (s *Server) runBinary(sess *session, op byte, cmd *Command, line string) (byte, []byte) {
+	if op != opGet {
+		return textStatus(s.runCommand(sess, cmd, line))
+	}
+	if response, routed := s.route(sess, cmd, line); routed {
+		return textStatus(response)
+	}
+
+	if s.config.Mirror != nil && sess.keyspace == s.data && shouldMirror(cmd, s.config.MirrorReads) {
+		s.config.Mirror.Send(line)
+	}
+	value, found, err := sess.keyspace.store.Get(cmd.Key)
+	if err != nil {
+		return statusError, []byte(err.Error())
+	}
+	if !found {
+		return statusNotFound, nil
+	}
+	if engine.IsHash(value) {
+		return statusError, []byte("key holds a hash, use hget or hgetall")
+	}
+	return statusOK, value
+}
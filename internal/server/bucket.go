@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+	"escabelo/internal/engine"
+)
+
+// keyspace is a bucket data commands run against, with the hash, counter,
+// string and document views over its store
+type keyspace struct {
+	name      string
+	store     engine.Store
+	hashes    *engine.Hashes
+	counters  *engine.Counters
+	strings   *engine.Strings
+	documents *engine.Documents
+}
+
+func newKeyspace(name string, store engine.Store) *keyspace {
+	return &keyspace{
+		name:      name,
+		store:     store,
+		hashes:    engine.NewHashes(store),
+		counters:  engine.NewCounters(store),
+		strings:   engine.NewStrings(store),
+		documents: engine.NewDocuments(store),
+	}
+}
+
+// auditKey names key in the audit log, escaped as the text protocol carries
+// it: keys of buckets other than the default one are prefixed with
+// "<bucket>/", which escaped keys can't contain
+func (ks *keyspace) auditKey(key string) string {
+	if ks.name == engine.DefaultBucket {
+		return escapeKey(key)
+	}
+	return ks.name + "/" + escapeKey(key)
+}
+
+// bucket returns the keyspace of the bucket called name, opening it on
+// first use. Buckets other than the default one aren't replicated, so
+// replicas and Raft members only serve the default bucket.
+func (s *Server) bucket(name string) (*keyspace, error) {
+	if name == engine.DefaultBucket {
+		return s.data, nil
+	}
+	if s.config.Raft != nil || s.config.LeaderAddr != "" {
+		return nil, errors.New("buckets aren't replicated: only the default bucket is served")
+	}
+
+	s.bucketsMu.Lock()
+	defer s.bucketsMu.Unlock()
+	if ks, ok := s.buckets[name]; ok {
+		return ks, nil
+	}
+	store, err := s.engine.OpenBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	ks := newKeyspace(name, store)
+	s.buckets[name] = ks
+	return ks, nil
+}
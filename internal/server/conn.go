@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats counts client connections
+type ConnStats struct {
+	Active   int64 // connections open now, admin ones included
+	Rejected int64 // connections refused past MaxConnections
+}
+
+// connCounter tracks open connections against MaxConnections
+type connCounter struct {
+	active   int64
+	rejected int64
+}
+
+// admit counts a new connection, refusing it if it would exceed max (0
+// admits any). Admin connections are always admitted, so operators can get
+// in while clients hold every slot.
+func (c *connCounter) admit(max int, admin bool) bool {
+	active := atomic.AddInt64(&c.active, 1)
+	if admin || max <= 0 || active <= int64(max) {
+		return true
+	}
+	atomic.AddInt64(&c.active, -1)
+	atomic.AddInt64(&c.rejected, 1)
+	return false
+}
+
+// release uncounts a closed connection
+func (c *connCounter) release() {
+	atomic.AddInt64(&c.active, -1)
+}
+
+// stats returns the connection counts
+func (c *connCounter) stats() ConnStats {
+	return ConnStats{
+		Active:   atomic.LoadInt64(&c.active),
+		Rejected: atomic.LoadInt64(&c.rejected),
+	}
+}
+
+// ConnStats returns the connection counts
+func (s *Server) ConnStats() ConnStats {
+	return s.conns.stats()
+}
+
+// reject refuses a connection past MaxConnections, telling the client why
+func (s *Server) reject(conn net.Conn) {
+	slog.Warn("Rejecting connection", "remote", conn.RemoteAddr().String(), "max_connections", s.config.MaxConnections)
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("error: too many connections\r"))
+	conn.Close()
+}
+
+// deadlineWriter gives every write to a connection WriteTimeout to
+// complete, so a client that stops reading can't block its handler forever
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.conn.Write(p)
+}
+
+// connWriter returns the writer responses to conn go through
+func (s *Server) connWriter(conn net.Conn) io.Writer {
+	if s.config.WriteTimeout <= 0 {
+		return conn
+	}
+	return deadlineWriter{conn: conn, timeout: s.config.WriteTimeout}
+}
+
+// awaitRequest waits up to IdleTimeout for the next request to start
+// arriving, then gives it ReadTimeout to arrive whole. A framed connection
+// isn't idle while busy reports requests of its own still running. A
+// connection timing out is logged and reported as io.EOF, so callers close
+// it quietly.
+func (s *Server) awaitRequest(conn net.Conn, reader *bufio.Reader, busy func() bool) error {
+	idle := s.config.IdleTimeout
+	if reader.Buffered() == 0 && (idle > 0 || s.config.ReadTimeout > 0) {
+		for {
+			var deadline time.Time
+			if idle > 0 {
+				deadline = time.Now().Add(idle)
+			}
+			conn.SetReadDeadline(deadline)
+			_, err := reader.Peek(1)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				return err
+			}
+			if busy == nil || !busy() {
+				slog.Info("Closing idle connection", "remote", conn.RemoteAddr().String(), "idle", idle)
+				return io.EOF
+			}
+		}
+	}
+
+	switch {
+	case s.config.ReadTimeout > 0:
+		conn.SetReadDeadline(time.Now().Add(s.config.ReadTimeout))
+	case idle > 0:
+		conn.SetReadDeadline(time.Time{})
+	}
+	return nil
+}
+
+// readError reports a failed read, unless the client just went away
+func readError(conn net.Conn, err error) {
+	switch {
+	case err == io.EOF:
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		slog.Info("Closing connection: request not received within the read timeout", "remote", conn.RemoteAddr().String())
+	default:
+		slog.Warn("Read failed", "remote", conn.RemoteAddr().String(), "err", err)
+	}
+}
+
+// commandOverhead is what a command may carry besides its key and value:
+// the command name, flags and separators
+const commandOverhead = 4096
+
+// errCommandTooLarge is returned when a client sends a command longer than
+// the store's key and value limits allow. The command is skipped without
+// being buffered, so the connection carries on with the next one.
+var errCommandTooLarge = errors.New("command too large")
+
+// maxCommandSize bounds the bytes of a command read off a connection
+func (s *Server) maxCommandSize() int64 {
+	limits := s.engine.Limits()
+	return int64(limits.MaxKeySize) + limits.MaxValueSize + commandOverhead
+}
+
+// readLine reads a text command up to and including its "\r", returning
+// errCommandTooLarge once it's past limit bytes
+func readLine(reader *bufio.Reader, limit int64) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\r')
+		if int64(len(line)+len(chunk)) > limit {
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\r')
+			}
+			if err != nil {
+				return "", err
+			}
+			return "", fmt.Errorf("%w: over %d bytes", errCommandTooLarge, limit)
+		}
+		if err != bufio.ErrBufferFull {
+			if line == nil {
+				return string(chunk), err
+			}
+			return string(append(line, chunk...)), err
+		}
+		line = append(line, chunk...)
+	}
+}
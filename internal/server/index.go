@@ -0,0 +1,89 @@
+package server
+
+import (
+	"escabelo/internal/engine"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// loadIndexes declares the indexes created with "index create" before the
+// last restart, rebuilding them from the store. Indexes that no longer
+// build are logged and skipped.
+func (s *Server) loadIndexes() error {
+	defs, err := s.engine.IndexDefs()
+	if err != nil {
+		return fmt.Errorf("failed to load index definitions: %w", err)
+	}
+	for _, def := range defs {
+		if s.configuredIndex(def.Name) {
+			slog.Warn("Index declared with -index too, ignoring the saved one", "index", def.Name)
+			continue
+		}
+		if err := s.indexes.Define(def); err != nil {
+			slog.Error("Index rebuild failed", "index", def.Name, "err", err)
+			continue
+		}
+		slog.Info("Index built", "index", def.Name, "prefix", def.Prefix)
+	}
+	return nil
+}
+
+// configuredIndex reports whether name was declared with Config.Indexes
+func (s *Server) configuredIndex(name string) bool {
+	for _, def := range s.config.Indexes {
+		if def.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// indexCommand executes index create, drop and list. Created indexes are
+// saved with the store, so they're rebuilt after a restart; those declared
+// with Config.Indexes can't be dropped.
+func (s *Server) indexCommand(cmd *Command) string {
+	if cmd.Args[0] == "list" {
+		defs := s.indexes.Defs()
+		lines := make([]string, len(defs))
+		for i, def := range defs {
+			lines[i] = def.String()
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	s.indexDefsMu.Lock()
+	defer s.indexDefsMu.Unlock()
+
+	switch cmd.Args[0] {
+	case "create":
+		def, err := engine.ParseIndexDef(cmd.Args[1])
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		if err := s.indexes.Define(def); err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		slog.Info("Index created", "index", def.Name, "prefix", def.Prefix)
+
+	case "drop":
+		if s.configuredIndex(cmd.Key) {
+			return fmt.Sprintf("error: index %s is declared with -index", cmd.Key)
+		}
+		if !s.indexes.Drop(cmd.Key) {
+			return fmt.Sprintf("error: unknown index: %s", cmd.Key)
+		}
+		slog.Info("Index dropped", "index", cmd.Key)
+	}
+
+	var saved []engine.IndexDef
+	for _, def := range s.indexes.Defs() {
+		if !s.configuredIndex(def.Name) {
+			saved = append(saved, def)
+		}
+	}
+	if err := s.engine.SaveIndexDefs(saved); err != nil {
+		return fmt.Sprintf("error: failed to save index definitions: %v", err)
+	}
+	return "success"
+}
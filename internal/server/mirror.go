@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MirrorConfig holds shadow traffic mirroring configuration
+type MirrorConfig struct {
+	// Addr is the secondary server receiving mirrored commands
+	Addr string
+
+	// QueueSize bounds the commands waiting to be mirrored; further
+	// commands are dropped rather than slowing down clients
+	QueueSize int
+
+	// Timeout bounds connecting to and waiting on the secondary
+	Timeout time.Duration
+
+	// Token, when set, authenticates the connection to the secondary
+	Token string
+}
+
+// MirrorStats counts mirrored traffic
+type MirrorStats struct {
+	Sent    int64 // commands answered by the secondary
+	Dropped int64 // commands dropped because the queue was full
+	Failed  int64 // commands lost to connection errors
+}
+
+// Mirror asynchronously replays commands against a secondary server
+type Mirror struct {
+	config MirrorConfig
+	queue  chan string
+	stopCh chan struct{}
+	doneCh chan struct{}
+
+	sent    int64
+	dropped int64
+	failed  int64
+}
+
+// NewMirror creates a mirror for the given configuration
+func NewMirror(config MirrorConfig) *Mirror {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 10000
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	return &Mirror{
+		config: config,
+		queue:  make(chan string, config.QueueSize),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+}
+
+// Start begins forwarding queued commands
+func (m *Mirror) Start() {
+	go m.run()
+}
+
+// Stop stops forwarding; queued commands are discarded
+func (m *Mirror) Stop() {
+	close(m.stopCh)
+	<-m.doneCh
+}
+
+// Addr returns the secondary server address
+func (m *Mirror) Addr() string {
+	return m.config.Addr
+}
+
+// Send queues a command line for mirroring without blocking
+func (m *Mirror) Send(line string) {
+	select {
+	case m.queue <- line:
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+	}
+}
+
+// Stats returns the mirroring counters
+func (m *Mirror) Stats() MirrorStats {
+	return MirrorStats{
+		Sent:    atomic.LoadInt64(&m.sent),
+		Dropped: atomic.LoadInt64(&m.dropped),
+		Failed:  atomic.LoadInt64(&m.failed),
+	}
+}
+
+// run forwards commands one at a time, reconnecting after failures
+func (m *Mirror) run() {
+	defer close(m.doneCh)
+
+	var conn net.Conn
+	var reader *bufio.Reader
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		var line string
+		select {
+		case line = <-m.queue:
+		case <-m.stopCh:
+			return
+		}
+
+		if conn == nil {
+			c, err := net.DialTimeout("tcp", m.config.Addr, m.config.Timeout)
+			if err != nil {
+				atomic.AddInt64(&m.failed, 1)
+				// Back off; commands queued meanwhile are dropped once full
+				select {
+				case <-time.After(time.Second):
+				case <-m.stopCh:
+					return
+				}
+				continue
+			}
+			conn = c
+			reader = bufio.NewReader(conn)
+			if m.config.Token != "" {
+				if err := m.authenticate(conn, reader); err != nil {
+					atomic.AddInt64(&m.failed, 1)
+					slog.Warn("Mirror failed", "addr", m.config.Addr, "err", err)
+					conn.Close()
+					conn = nil
+					continue
+				}
+			}
+			slog.Info("Mirroring traffic", "addr", m.config.Addr)
+		}
+
+		if err := m.forward(conn, reader, line); err != nil {
+			atomic.AddInt64(&m.failed, 1)
+			slog.Warn("Mirror failed", "addr", m.config.Addr, "err", err)
+			conn.Close()
+			conn = nil
+			continue
+		}
+		atomic.AddInt64(&m.sent, 1)
+	}
+}
+
+// authenticate sends the configured token to the secondary
+func (m *Mirror) authenticate(conn net.Conn, reader *bufio.Reader) error {
+	conn.SetDeadline(time.Now().Add(m.config.Timeout))
+	if _, err := conn.Write([]byte("auth " + m.config.Token + "\r")); err != nil {
+		return err
+	}
+	resp, err := reader.ReadString('\r')
+	if err != nil {
+		return err
+	}
+	if resp = strings.TrimSuffix(resp, "\r"); resp != "success" {
+		return fmt.Errorf("authentication failed: %s", resp)
+	}
+	return nil
+}
+
+// forward sends one command and discards its response
+func (m *Mirror) forward(conn net.Conn, reader *bufio.Reader, line string) error {
+	conn.SetDeadline(time.Now().Add(m.config.Timeout))
+	if _, err := conn.Write([]byte(line + "\r")); err != nil {
+		return err
+	}
+
+	_, err := reader.ReadString('\r')
+	return err
+}
+
+// shouldMirror reports whether a command line is mirrored
+func shouldMirror(cmd *Command, mirrorReads bool) bool {
+	if cmd.IsWrite() {
+		return true
+	}
+	if !mirrorReads {
+		return false
+	}
+
+	// reads and keys separate their results with '\r', like the response
+	// terminator, so their responses can't be framed and they aren't mirrored
+	switch cmd.Type {
+	case CmdRead, CmdMRead, CmdCount, CmdDBSize, CmdStrlen, CmdGetRange, CmdMeta, CmdHistory, CmdHGet, CmdHGetAll, CmdJGet, CmdQueryRange, CmdFind:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// maxInFlight bounds the requests of a multiplexed connection executing at
+// once; reading stops until one completes
+const maxInFlight = 128
+
+// readFrame reads a multiplexed frame, skipping the payload of one past limit
+// bytes and returning its ID with errCommandTooLarge.
+// Format: id(4) + length(4) + payload, big-endian
+func readFrame(reader *bufio.Reader, limit int64) (uint32, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	id := binary.BigEndian.Uint32(header[0:4])
+	length := binary.BigEndian.Uint32(header[4:8])
+	if int64(length) > limit {
+		if _, err := reader.Discard(int(length)); err != nil {
+			return 0, nil, err
+		}
+		return id, nil, fmt.Errorf("%w: %d bytes (max %d)", errCommandTooLarge, length, limit)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, nil, err
+	}
+	return id, payload, nil
+}
+
+// writeFrame writes and flushes a multiplexed frame
+func writeFrame(writer *bufio.Writer, id uint32, payload string) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], id)
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(payload)))
+	if _, err := writer.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := writer.WriteString(payload); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// serveMultiplexed serves a connection after hello switched it to level 2.
+// Each frame carries a command and a client-assigned ID; commands run
+// concurrently and their responses carry the same ID, in completion order,
+// so slow commands don't hold back fast ones. Session commands still run in
+// order, and each command sees the session as it was when it was read.
+func (s *Server) serveMultiplexed(sess *session, conn net.Conn, admin bool, reader *bufio.Reader, writer *bufio.Writer) {
+	var (
+		writeMu sync.Mutex
+		running sync.WaitGroup
+	)
+	slots := make(chan struct{}, maxInFlight)
+	defer running.Wait()
+
+	// A connection waiting on its own requests isn't idle
+	busy := func() bool { return len(slots) > 0 }
+
+	respond := func(id uint32, response string) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if err := writeFrame(writer, id, response); err != nil {
+			slog.Warn("Write failed", "remote", conn.RemoteAddr().String(), "err", err)
+		}
+	}
+
+	for {
+		if err := s.awaitRequest(conn, reader, busy); err != nil {
+			readError(conn, err)
+			return
+		}
+
+		id, payload, err := readFrame(reader, s.maxCommandSize())
+		if errors.Is(err, errCommandTooLarge) {
+			respond(id, fmt.Sprintf("error: %v", err))
+			continue
+		}
+		if err != nil {
+			readError(conn, err)
+			return
+		}
+
+		line := string(payload)
+		cmd, err := ParseCommand(line)
+		if err != nil {
+			respond(id, fmt.Sprintf("error: %v", err))
+			continue
+		}
+
+		if err := s.checkPlane(cmd, admin); err != nil {
+			respond(id, fmt.Sprintf("error: %v", err))
+			continue
+		}
+
+		if err := s.Authorize(sess.role, cmd); err != nil {
+			respond(id, fmt.Sprintf("error: %v", err))
+			continue
+		}
+
+		if response, ok := s.sessionCommand(sess, conn, cmd); ok {
+			respond(id, response)
+			continue
+		}
+
+		snapshot := *sess
+		slots <- struct{}{}
+		running.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				running.Done()
+			}()
+			respond(id, s.runCommand(&snapshot, cmd, line))
+		}()
+	}
+}
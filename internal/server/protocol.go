@@ -2,8 +2,12 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Command represents a parsed command
@@ -12,20 +16,260 @@ type Command struct {
 	Key    string
 	Value  []byte
 	Prefix string
+	Args   []string
+
+	// AsOf requests the value as it was at this time (unix nanoseconds)
+	AsOf int64
+
+	// TTL is how long from now an expire command's key lives
+	TTL time.Duration
+
+	// Delta is what incr adds to a counter, or decr subtracts
+	Delta int64
+
+	// Prefix scan paging options
+	Limit    int
+	After    string
+	WithKeys bool
+
+	// WithScores returns index scores along with queryrange keys
+	WithScores bool
+
+	// WithVersion returns the version of the value read, or assigned by a
+	// write
+	WithVersion bool
+
+	// Sync fsyncs the WAL before a write is acknowledged, whatever the
+	// engine's durability mode
+	Sync bool
+
+	// Exists makes a delete look the key up first and report whether it
+	// existed, rather than writing the tombstone blind
+	Exists bool
+
+	// CheckVersion makes a write or delete conditional on the key being at
+	// version IfVersion, 0 meaning the key doesn't exist
+	CheckVersion bool
+	IfVersion    int64
+
+	// Batch holds the write and delete commands of a batch
+	Batch []*Command
 }
 
 // CommandType constants
 const (
-	CmdRead   = "read"
-	CmdWrite  = "write"
-	CmdDelete = "delete"
-	CmdStatus = "status"
-	CmdKeys   = "keys"
-	CmdReads  = "reads"
+	CmdRead       = "read"
+	CmdWrite      = "write"
+	CmdDelete     = "delete"
+	CmdBatch      = "batch"
+	CmdStatus     = "status"
+	CmdKeys       = "keys"
+	CmdReads      = "reads"
+	CmdRole       = "role"
+	CmdReplStatus = "replication"
+	CmdCluster    = "cluster"
+	CmdGossip     = "gossip"
+	CmdMerkle     = "merkle"
+	CmdRepair     = "repair"
+	CmdHistory    = "history"
+	CmdUndelete   = "undelete"
+	CmdExpire     = "expire"
+	CmdIncr       = "incr"
+	CmdAppend     = "append"
+	CmdSetRange   = "setrange"
+	CmdDecr       = "decr"
+	CmdCount      = "count"
+	CmdDBSize     = "dbsize"
+	CmdScan       = "scan"
+	CmdStrlen     = "strlen"
+	CmdGetRange   = "getrange"
+	CmdMeta       = "meta"
+	CmdMRead      = "mread"
+	CmdTail       = "tail"
+	CmdAck        = "ack"
+	CmdWatch      = "watch"
+	CmdWAL        = "wal"
+	CmdClient     = "client"
+	CmdAuth       = "auth"
+	CmdAudit      = "audit"
+	CmdHello      = "hello"
+	CmdPing       = "ping"
+	CmdEcho       = "echo"
+	CmdHSet       = "hset"
+	CmdHGet       = "hget"
+	CmdHDel       = "hdel"
+	CmdHGetAll    = "hgetall"
+	CmdJGet       = "jget"
+	CmdJSet       = "jset"
+	CmdQueryRange = "queryrange"
+	CmdFind       = "find"
+	CmdIndex      = "index"
+	CmdAckLevel   = "acklevel"
+	CmdVersions   = "versions"
+	CmdPause      = "pause"
+	CmdResume     = "resume"
+	CmdCompact    = "compact"
+	CmdBackup     = "backup"
+	CmdRaft       = "raft"
+	CmdReadOnly   = "readonly"
+	CmdUse        = "use"
+	CmdBuckets    = "buckets"
+	CmdBegin      = "begin"
+	CmdCommit     = "commit"
+	CmdRollback   = "rollback"
 )
 
+const (
+	// ServerVersion is reported to clients by hello
+	ServerVersion = "1.0.0"
+
+	// MinProtocolVersion and MaxProtocolVersion bound the protocol levels a
+	// client can select with hello. Connections start at level 1, so clients
+	// that never send hello keep working as the protocol evolves.
+	MinProtocolVersion = 1
+	MaxProtocolVersion = 3
+
+	// ProtocolMultiplexed is the level that switches a connection to framed
+	// requests carrying IDs, answered out of order
+	ProtocolMultiplexed = 2
+
+	// ProtocolBinary is the level that switches a connection to binary
+	// frames with length-prefixed keys and values, multiplexed like level 2
+	ProtocolBinary = 3
+)
+
+const (
+	// defaultTailLimit and maxTailLimit bound the entries returned by tail
+	// and wal
+	defaultTailLimit = 100
+	maxTailLimit     = 10000
+
+	// defaultAuditLimit and maxAuditLimit bound the records returned by audit
+	defaultAuditLimit = 100
+	maxAuditLimit     = 10000
+)
+
+// IsWrite reports whether the command mutates the keyspace
+func (c *Command) IsWrite() bool {
+	switch c.Type {
+	case CmdWrite, CmdDelete, CmdUndelete, CmdExpire, CmdIncr, CmdDecr, CmdAppend, CmdSetRange, CmdHSet, CmdHDel, CmdJSet, CmdBatch:
+		return true
+	}
+	return false
+}
+
+// Writes returns the keyspace writes the command makes: the commands of a
+// batch, or the command itself
+func (c *Command) Writes() []*Command {
+	if c.Type == CmdBatch {
+		return c.Batch
+	}
+	return []*Command{c}
+}
+
+// Keys returns the keys of the keyspace the command reads or writes, which
+// decide where it runs in a sharded cluster, or nil for commands that don't
+// address keys, such as scans
+func (c *Command) Keys() []string {
+	switch c.Type {
+	case CmdRead, CmdWrite, CmdDelete, CmdUndelete, CmdExpire, CmdIncr, CmdDecr, CmdAppend, CmdSetRange,
+		CmdStrlen, CmdGetRange, CmdMeta, CmdHistory,
+		CmdHSet, CmdHGet, CmdHDel, CmdHGetAll, CmdJGet, CmdJSet:
+		return []string{c.Key}
+	case CmdMRead:
+		return c.Args
+	case CmdBatch:
+		keys := make([]string, len(c.Batch))
+		for i, op := range c.Batch {
+			keys[i] = op.Key
+		}
+		return keys
+	}
+	return nil
+}
+
+// Line returns the text form of a write, delete or batch built without
+// parsing one, or "" for other commands and values that can't be sent as text
+func (c *Command) Line() string {
+	switch c.Type {
+	case CmdWrite:
+		if strings.ContainsAny(string(c.Value), "\r\n") {
+			return ""
+		}
+		return "write " + c.versionFlag() + escapeKey(c.Key) + "|" + string(c.Value)
+	case CmdDelete:
+		if c.Exists {
+			return "delete exists " + escapeKey(c.Key)
+		}
+		return "delete " + c.versionFlag() + escapeKey(c.Key)
+	case CmdBatch:
+		lines := make([]string, len(c.Batch))
+		for i, op := range c.Batch {
+			if lines[i] = op.Line(); lines[i] == "" {
+				return ""
+			}
+		}
+		return "batch " + strings.Join(lines, "\n")
+	}
+	return ""
+}
+
+// versionFlag returns the IFVERSION flag of a conditional write or delete,
+// followed by a space, or ""
+func (c *Command) versionFlag() string {
+	if !c.CheckVersion {
+		return ""
+	}
+	return fmt.Sprintf("IFVERSION %d ", c.IfVersion)
+}
+
+// IsAdmin reports whether the command is administrative. With an admin
+// listener configured, these are only served there.
+func (c *Command) IsAdmin() bool {
+	switch c.Type {
+	case CmdAudit, CmdRepair, CmdPause, CmdResume, CmdCompact, CmdBackup, CmdReadOnly:
+		return true
+	case CmdRaft:
+		return c.Args[0] == "add" || c.Args[0] == "remove"
+	}
+	return false
+}
+
+// IsConnection reports whether the command only inspects the connection or
+// the server's health, and so is served on every listener
+func (c *Command) IsConnection() bool {
+	switch c.Type {
+	case CmdHello, CmdPing, CmdEcho, CmdClient, CmdAuth, CmdAckLevel, CmdVersions, CmdStatus, CmdRole, CmdReplStatus:
+		return true
+	case CmdRaft:
+		return c.Args[0] == "status"
+	}
+	return false
+}
+
 // ParseCommand parses a command from the protocol
-// Format: "read <key>" | "write <key>|<value>" | "delete <key>" | "status" | "keys" | "reads <prefix>"
+// Format:
+//
+//	"read <key> [ASOF <timestamp> | WITHVERSION]" | "mread <key> [key...]" | "history <key> [limit]" |
+//	"strlen <key>" | "getrange <key> <offset> <length>" | "meta <key>" |
+//	"write [SYNC] [IFVERSION <version>] <key>|<value>" | "delete [EXISTS | IFVERSION <version>] <key>" | "undelete <key>" |
+//	"batch <write or delete>[\n<write or delete>...]" | "append <key>|<data>" | "setrange <key> <offset>|<data>" |
+//	"status" | "replication status" | "keys [pattern]" |
+//	"reads <prefix> [LIMIT <n>] [AFTER <key>] [WITHKEYS]" |
+//	"count" | "count <prefix>" | "count <start> <end>" | "dbsize [prefix]" | "scan <start> <end> [limit]" | "role" |
+//	"cluster nodes|topology|local" | "cluster owner <key>" | "merkle <depth> [bucket]" | "repair <peer> [depth]" |
+//	"tail <consumer> [from-seq] [limit]" | "ack <consumer> <seq>" | "watch [prefix]" |
+//	"wal <from-seq> [limit]" | "use [bucket]" | "buckets" | "begin" | "commit" | "rollback" |
+//	"client <name>" | "auth <token>" | "auth <user> <password>" | "audit [KEY <key>] [LIMIT <n>]" | "hello [version]" |
+//	"ping [payload]" | "echo <msg>" |
+//	"hset <key> <field>|<value>" | "hget <key> <field>" | "hdel <key> <field>" | "hgetall <key>" |
+//	"jget <key> [path]" | "jset <key> <path>|<json>" | "jset <key> <path> <json>" |
+//	"queryrange <index> <min> <max> [LIMIT <n>] [WITHSCORES]" | "find <index> <value>" |
+//	"index create <name> <prefix> <path> numeric|lex" | "index drop <name>" | "index list" |
+//	"acklevel [leader|quorum|all]" | "versions [on|off]" |
+//	"pause compaction|flush|all" | "resume compaction|flush|all" | "compact [full]" |
+//	"backup <path>" | "readonly [on|off]" | "raft status" | "raft add <addr>" | "raft remove <addr>" |
+//	"raft vote <json>" | "raft append <json>"
 func ParseCommand(line string) (*Command, error) {
 	line = strings.TrimSpace(line)
 	if line == "" {
@@ -40,17 +284,431 @@ func ParseCommand(line string) (*Command, error) {
 		return &Command{Type: CmdStatus}, nil
 
 	case CmdKeys:
-		return &Command{Type: CmdKeys}, nil
+		if len(parts) < 2 {
+			return &Command{Type: CmdKeys}, nil
+		}
+		args := strings.Fields(parts[1])
+		cmd := &Command{Type: CmdKeys}
+		if len(args) > 0 && !isScanOption(args[0]) {
+			if !decodePattern(&args[0]) {
+				return nil, fmt.Errorf("invalid pattern format")
+			}
+			cmd.Prefix = args[0]
+			args = args[1:]
+		}
+		if err := parseScanOptions(cmd, args); err != nil {
+			return nil, err
+		}
+		if cmd.WithKeys {
+			return nil, fmt.Errorf("keys doesn't take WITHKEYS")
+		}
+		return cmd, nil
+
+	case CmdRole:
+		return &Command{Type: CmdRole}, nil
+
+	case CmdReplStatus:
+		if len(parts) < 2 || strings.ToLower(strings.TrimSpace(parts[1])) != "status" {
+			return nil, fmt.Errorf("replication format: replication status")
+		}
+		return &Command{Type: CmdReplStatus}, nil
+
+	case CmdPing:
+		if len(parts) < 2 {
+			return &Command{Type: CmdPing}, nil
+		}
+		return &Command{Type: CmdPing, Value: []byte(parts[1])}, nil
+
+	case CmdEcho:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("echo requires a message")
+		}
+		// Don't trim the message, echo it back as sent
+		return &Command{Type: CmdEcho, Value: []byte(parts[1])}, nil
+
+	case CmdCluster:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("cluster format: cluster nodes|topology|owner <key>|local")
+		}
+		args := strings.Fields(parts[1])
+		switch sub := strings.ToLower(args[0]); sub {
+		case "nodes", "topology", "local":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("cluster %s takes no arguments", sub)
+			}
+			return &Command{Type: CmdCluster, Args: []string{sub}}, nil
+		case "owner":
+			if len(args) != 2 || !decodeKey(&args[1]) {
+				return nil, fmt.Errorf("cluster owner requires a key")
+			}
+			return &Command{Type: CmdCluster, Key: args[1], Args: []string{sub}}, nil
+		}
+		return nil, fmt.Errorf("cluster format: cluster nodes|topology|owner <key>|local")
+
+	case CmdGossip:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("gossip requires a digest")
+		}
+		return &Command{Type: CmdGossip, Value: []byte(strings.TrimSpace(parts[1]))}, nil
+
+	case CmdMerkle:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("merkle format: merkle <depth> [bucket]")
+		}
+		args := strings.Fields(parts[1])
+		if len(args) > 2 {
+			return nil, fmt.Errorf("merkle format: merkle <depth> [bucket]")
+		}
+		for _, arg := range args {
+			if _, err := strconv.Atoi(arg); err != nil {
+				return nil, fmt.Errorf("invalid merkle argument: %s", arg)
+			}
+		}
+		return &Command{Type: CmdMerkle, Args: args}, nil
+
+	case CmdRepair:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("repair format: repair <peer> [depth]")
+		}
+		args := strings.Fields(parts[1])
+		if len(args) > 2 {
+			return nil, fmt.Errorf("repair format: repair <peer> [depth]")
+		}
+		if len(args) == 2 {
+			if _, err := strconv.Atoi(args[1]); err != nil {
+				return nil, fmt.Errorf("invalid repair depth: %s", args[1])
+			}
+		}
+		return &Command{Type: CmdRepair, Args: args}, nil
 
 	case CmdRead:
 		if len(parts) < 2 {
 			return nil, fmt.Errorf("read requires a key")
 		}
+		args := strings.Fields(parts[1])
+		withVersion := len(args) == 2 && strings.EqualFold(args[1], "withversion")
+		if len(args) != 1 && !withVersion && (len(args) != 3 || !strings.EqualFold(args[1], "asof")) {
+			return nil, fmt.Errorf("read format: read <key> [ASOF <timestamp> | WITHVERSION]")
+		}
+		key := args[0]
+		if !decodeKey(&key) {
+			return nil, fmt.Errorf("invalid key format")
+		}
+		cmd := &Command{Type: CmdRead, Key: key, WithVersion: withVersion}
+		if len(args) == 3 {
+			asOf, err := parseTimestamp(args[2])
+			if err != nil {
+				return nil, err
+			}
+			cmd.AsOf = asOf
+		}
+		return cmd, nil
+
+	case CmdTail:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("tail format: tail <consumer> [from-seq] [limit]")
+		}
+		args := strings.Fields(parts[1])
+		if len(args) > 3 {
+			return nil, fmt.Errorf("tail format: tail <consumer> [from-seq] [limit]")
+		}
+		if !isValidKey(args[0]) {
+			return nil, fmt.Errorf("invalid consumer name")
+		}
+		cmd := &Command{Type: CmdTail, Key: args[0], Limit: defaultTailLimit}
+		if len(args) >= 2 {
+			from, err := strconv.ParseUint(args[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sequence number: %s", args[1])
+			}
+			cmd.Args = []string{strconv.FormatUint(from, 10)}
+		}
+		if len(args) == 3 {
+			limit, err := strconv.Atoi(args[2])
+			if err != nil || limit <= 0 || limit > maxTailLimit {
+				return nil, fmt.Errorf("invalid tail limit: %s", args[2])
+			}
+			cmd.Limit = limit
+		}
+		return cmd, nil
+
+	case CmdWAL:
+		args := []string{}
+		if len(parts) == 2 {
+			args = strings.Fields(parts[1])
+		}
+		if len(args) < 1 || len(args) > 2 {
+			return nil, fmt.Errorf("wal format: wal <from-seq> [limit]")
+		}
+		from, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil || from == 0 {
+			return nil, fmt.Errorf("invalid sequence number: %s", args[0])
+		}
+		cmd := &Command{Type: CmdWAL, Args: []string{args[0]}, Limit: defaultTailLimit}
+		if len(args) == 2 {
+			limit, err := strconv.Atoi(args[1])
+			if err != nil || limit <= 0 || limit > maxTailLimit {
+				return nil, fmt.Errorf("invalid wal limit: %s", args[1])
+			}
+			cmd.Limit = limit
+		}
+		return cmd, nil
+
+	case CmdUse:
+		if len(parts) < 2 {
+			return &Command{Type: CmdUse}, nil
+		}
+		return &Command{Type: CmdUse, Key: strings.TrimSpace(parts[1])}, nil
+
+	case CmdBuckets, CmdBegin, CmdCommit, CmdRollback:
+		if len(parts) > 1 && strings.TrimSpace(parts[1]) != "" {
+			return nil, fmt.Errorf("%s takes no arguments", cmdType)
+		}
+		return &Command{Type: cmdType}, nil
+
+	case CmdWatch:
+		if len(parts) < 2 {
+			return &Command{Type: CmdWatch}, nil
+		}
+		prefix := strings.TrimSpace(parts[1])
+		if prefix != "" && !decodeKey(&prefix) {
+			return nil, fmt.Errorf("invalid prefix format")
+		}
+		return &Command{Type: CmdWatch, Prefix: prefix}, nil
+
+	case CmdAck:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("ack format: ack <consumer> <seq>")
+		}
+		args := strings.Fields(parts[1])
+		if len(args) != 2 {
+			return nil, fmt.Errorf("ack format: ack <consumer> <seq>")
+		}
+		if !isValidKey(args[0]) {
+			return nil, fmt.Errorf("invalid consumer name")
+		}
+		if _, err := strconv.ParseUint(args[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid sequence number: %s", args[1])
+		}
+		return &Command{Type: CmdAck, Key: args[0], Args: args[1:]}, nil
+
+	case CmdHello:
+		if len(parts) < 2 {
+			return &Command{Type: CmdHello}, nil
+		}
+		version := strings.TrimSpace(parts[1])
+		if _, err := strconv.Atoi(version); err != nil {
+			return nil, fmt.Errorf("invalid protocol version: %s", version)
+		}
+		return &Command{Type: CmdHello, Args: []string{version}}, nil
+
+	case CmdAckLevel:
+		if len(parts) < 2 {
+			return &Command{Type: CmdAckLevel}, nil
+		}
+		level := strings.ToLower(strings.TrimSpace(parts[1]))
+		if !isAckLevel(level) {
+			return nil, fmt.Errorf("acklevel format: acklevel [leader|quorum|all]")
+		}
+		return &Command{Type: CmdAckLevel, Args: []string{level}}, nil
+
+	case CmdPause, CmdResume:
+		target := ""
+		if len(parts) == 2 {
+			target = strings.ToLower(strings.TrimSpace(parts[1]))
+		}
+		switch target {
+		case "compaction", "flush", "all":
+			return &Command{Type: cmdType, Args: []string{target}}, nil
+		}
+		return nil, fmt.Errorf("%s format: %s compaction|flush|all", cmdType, cmdType)
+
+	case CmdCompact:
+		if len(parts) < 2 {
+			return &Command{Type: CmdCompact}, nil
+		}
+		if strings.ToLower(strings.TrimSpace(parts[1])) != "full" {
+			return nil, fmt.Errorf("compact format: compact [full]")
+		}
+		return &Command{Type: CmdCompact, Args: []string{"full"}}, nil
+
+	case CmdBackup:
+		if len(parts) < 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("backup format: backup <path>")
+		}
+		return &Command{Type: CmdBackup, Args: []string{strings.TrimSpace(parts[1])}}, nil
+
+	case CmdFind:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("find format: find <index> <value>")
+		}
+		// The value is the rest of the line, so terms can hold spaces
+		args := strings.SplitN(strings.TrimSpace(parts[1]), " ", 2)
+		if len(args) < 2 || args[1] == "" {
+			return nil, fmt.Errorf("find format: find <index> <value>")
+		}
+		if !isValidKey(args[0]) {
+			return nil, fmt.Errorf("invalid index name")
+		}
+		return &Command{Type: CmdFind, Key: args[0], Args: args[1:]}, nil
+
+	case CmdIndex:
+		args := []string{}
+		if len(parts) == 2 {
+			args = strings.Fields(parts[1])
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("index format: index create <name> <prefix> <path> numeric|lex | index drop <name> | index list")
+		}
+		sub := strings.ToLower(args[0])
+		switch {
+		case (sub == "create" && len(args) == 5 || sub == "drop" && len(args) == 2) && !isValidKey(args[1]):
+			return nil, fmt.Errorf("invalid index name")
+		case sub == "create" && len(args) == 5:
+			// Args: the subcommand, then the declaration as -index takes it
+			return &Command{Type: CmdIndex, Key: args[1], Args: []string{sub, strings.Join(args[1:], ",")}}, nil
+		case sub == "drop" && len(args) == 2:
+			return &Command{Type: CmdIndex, Key: args[1], Args: []string{sub}}, nil
+		case sub == "list" && len(args) == 1:
+			return &Command{Type: CmdIndex, Args: []string{sub}}, nil
+		}
+		return nil, fmt.Errorf("index format: index create <name> <prefix> <path> numeric|lex | index drop <name> | index list")
+
+	case CmdRaft:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("raft format: raft status|add <addr>|remove <addr>")
+		}
+		args := strings.SplitN(strings.TrimSpace(parts[1]), " ", 2)
+		sub := strings.ToLower(args[0])
+		switch sub {
+		case "status":
+			if len(args) > 1 {
+				return nil, fmt.Errorf("raft format: raft status")
+			}
+			return &Command{Type: CmdRaft, Args: []string{sub}}, nil
+		case "add", "remove", "vote", "append":
+			if len(args) < 2 || strings.TrimSpace(args[1]) == "" {
+				return nil, fmt.Errorf("raft %s requires an argument", sub)
+			}
+			return &Command{Type: CmdRaft, Args: []string{sub, strings.TrimSpace(args[1])}}, nil
+		}
+		return nil, fmt.Errorf("unknown raft command: %s", args[0])
+
+	case CmdVersions, CmdReadOnly:
+		if len(parts) < 2 {
+			return &Command{Type: cmdType}, nil
+		}
+		mode := strings.ToLower(strings.TrimSpace(parts[1]))
+		if mode != "on" && mode != "off" {
+			return nil, fmt.Errorf("%s format: %s [on|off]", cmdType, cmdType)
+		}
+		return &Command{Type: cmdType, Args: []string{mode}}, nil
+
+	case CmdClient:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("client format: client <name>")
+		}
+		name := strings.TrimSpace(parts[1])
+		if !isValidKey(name) {
+			return nil, fmt.Errorf("invalid client name")
+		}
+		return &Command{Type: CmdClient, Key: name}, nil
+
+	case CmdAuth:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("auth format: auth <token> | auth <user> <password>")
+		}
+		args := strings.Fields(parts[1])
+		if len(args) == 0 || len(args) > 2 {
+			return nil, fmt.Errorf("auth format: auth <token> | auth <user> <password>")
+		}
+		return &Command{Type: CmdAuth, Args: args}, nil
+
+	case CmdAudit:
+		cmd := &Command{Type: CmdAudit, Limit: defaultAuditLimit}
+		if len(parts) < 2 {
+			return cmd, nil
+		}
+		args := strings.Fields(parts[1])
+		for i := 0; i < len(args); i += 2 {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("audit format: audit [KEY <key>] [LIMIT <n>]")
+			}
+			switch strings.ToLower(args[i]) {
+			case "key":
+				if !decodeKey(&args[i+1]) {
+					return nil, fmt.Errorf("invalid key format")
+				}
+				cmd.Key = args[i+1]
+			case "limit":
+				limit, err := strconv.Atoi(args[i+1])
+				if err != nil || limit <= 0 || limit > maxAuditLimit {
+					return nil, fmt.Errorf("invalid audit limit: %s", args[i+1])
+				}
+				cmd.Limit = limit
+			default:
+				return nil, fmt.Errorf("audit format: audit [KEY <key>] [LIMIT <n>]")
+			}
+		}
+		return cmd, nil
+
+	case CmdMRead:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("mread requires at least one key")
+		}
+		keys := strings.Fields(parts[1])
+		for i := range keys {
+			if !decodeKey(&keys[i]) {
+				return nil, fmt.Errorf("invalid key format")
+			}
+		}
+		return &Command{Type: CmdMRead, Args: keys}, nil
+
+	case CmdStrlen, CmdMeta:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("%s requires a key", cmdType)
+		}
 		key := strings.TrimSpace(parts[1])
-		if !isValidKey(key) {
+		if !decodeKey(&key) {
+			return nil, fmt.Errorf("invalid key format")
+		}
+		return &Command{Type: cmdType, Key: key}, nil
+
+	case CmdGetRange:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("getrange format: getrange <key> <offset> <length>")
+		}
+		args := strings.Fields(parts[1])
+		if len(args) != 3 {
+			return nil, fmt.Errorf("getrange format: getrange <key> <offset> <length>")
+		}
+		if !decodeKey(&args[0]) {
 			return nil, fmt.Errorf("invalid key format")
 		}
-		return &Command{Type: CmdRead, Key: key}, nil
+		for _, arg := range args[1:] {
+			if n, err := strconv.ParseInt(arg, 10, 64); err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid getrange offset or length: %s", arg)
+			}
+		}
+		return &Command{Type: CmdGetRange, Key: args[0], Args: args[1:]}, nil
+
+	case CmdHistory:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("history requires a key")
+		}
+		args := strings.Fields(parts[1])
+		if len(args) > 2 {
+			return nil, fmt.Errorf("history format: history <key> [limit]")
+		}
+		if !decodeKey(&args[0]) {
+			return nil, fmt.Errorf("invalid key format")
+		}
+		if len(args) == 2 {
+			if limit, err := strconv.Atoi(args[1]); err != nil || limit <= 0 {
+				return nil, fmt.Errorf("invalid history limit: %s", args[1])
+			}
+		}
+		return &Command{Type: CmdHistory, Key: args[0], Args: args[1:]}, nil
 
 	case CmdWrite:
 		if len(parts) < 2 {
@@ -59,57 +717,499 @@ func ParseCommand(line string) (*Command, error) {
 		// Split by pipe: "key|value"
 		kvParts := strings.SplitN(parts[1], "|", 2)
 		if len(kvParts) < 2 {
-			return nil, fmt.Errorf("write format: write <key>|<value>")
+			return nil, fmt.Errorf("write format: write [SYNC] [IFVERSION <version>] <key>|<value>")
 		}
-		key := strings.TrimSpace(kvParts[0])
-		value := kvParts[1] // Don't trim value, preserve whitespace
+		// Don't trim value, preserve whitespace
+		cmd := &Command{Type: CmdWrite, Value: []byte(kvParts[1])}
+		if err := parseWriteFlags(cmd, kvParts[0]); err != nil {
+			return nil, err
+		}
+		return cmd, nil
+
+	case CmdHSet:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("hset format: hset <key> <field>|<value>")
+		}
+		// Split by pipe: "key field|value"
+		kvParts := strings.SplitN(parts[1], "|", 2)
+		args := strings.Fields(kvParts[0])
+		if len(kvParts) < 2 || len(args) != 2 {
+			return nil, fmt.Errorf("hset format: hset <key> <field>|<value>")
+		}
+		if !decodeKey(&args[0]) {
+			return nil, fmt.Errorf("invalid key format")
+		}
+		if !isValidKey(args[1]) {
+			return nil, fmt.Errorf("invalid field format")
+		}
+		return &Command{Type: CmdHSet, Key: args[0], Args: args[1:], Value: []byte(kvParts[1])}, nil
 
-		if !isValidKey(key) {
+	case CmdHGet, CmdHDel:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("%s format: %s <key> <field>", cmdType, cmdType)
+		}
+		args := strings.Fields(parts[1])
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s format: %s <key> <field>", cmdType, cmdType)
+		}
+		if !decodeKey(&args[0]) {
 			return nil, fmt.Errorf("invalid key format")
 		}
-		return &Command{Type: CmdWrite, Key: key, Value: []byte(value)}, nil
+		if !isValidKey(args[1]) {
+			return nil, fmt.Errorf("invalid field format")
+		}
+		return &Command{Type: cmdType, Key: args[0], Args: args[1:]}, nil
+
+	case CmdJGet:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("jget format: jget <key> [path]")
+		}
+		args := strings.Fields(parts[1])
+		if len(args) > 2 {
+			return nil, fmt.Errorf("jget format: jget <key> [path]")
+		}
+		if !decodeKey(&args[0]) {
+			return nil, fmt.Errorf("invalid key format")
+		}
+		cmd := &Command{Type: CmdJGet, Key: args[0], Args: []string{"$"}}
+		if len(args) == 2 {
+			cmd.Args[0] = args[1]
+		}
+		return cmd, nil
+
+	case CmdJSet:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("jset format: jset <key> <path>|<json> or jset <key> <path> <json>")
+		}
+		// Split by the first pipe: "key path|json". Keys and paths hold no
+		// spaces or pipes, so a pipe after more than two words belongs to
+		// the JSON of "key path json".
+		kvParts := strings.SplitN(parts[1], "|", 2)
+		args := strings.Fields(kvParts[0])
+		if len(kvParts) < 2 || len(args) != 2 {
+			args = strings.SplitN(strings.TrimSpace(parts[1]), " ", 3)
+			if len(args) != 3 || strings.TrimSpace(args[2]) == "" {
+				return nil, fmt.Errorf("jset format: jset <key> <path>|<json> or jset <key> <path> <json>")
+			}
+			kvParts = []string{"", args[2]}
+		}
+		if !decodeKey(&args[0]) {
+			return nil, fmt.Errorf("invalid key format")
+		}
+		return &Command{Type: CmdJSet, Key: args[0], Args: args[1:2], Value: []byte(kvParts[1])}, nil
+
+	case CmdQueryRange:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("queryrange format: queryrange <index> <min> <max> [LIMIT <n>] [WITHSCORES]")
+		}
+		args := strings.Fields(parts[1])
+		if len(args) < 3 {
+			return nil, fmt.Errorf("queryrange format: queryrange <index> <min> <max> [LIMIT <n>] [WITHSCORES]")
+		}
+		if !isValidKey(args[0]) {
+			return nil, fmt.Errorf("invalid index name")
+		}
+		cmd := &Command{Type: CmdQueryRange, Key: args[0], Args: args[1:3]}
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "LIMIT":
+				if i+1 >= len(args) {
+					return nil, fmt.Errorf("LIMIT requires a value")
+				}
+				limit, err := strconv.Atoi(args[i+1])
+				if err != nil || limit <= 0 {
+					return nil, fmt.Errorf("invalid limit: %s", args[i+1])
+				}
+				cmd.Limit = limit
+				i++
+			case "WITHSCORES":
+				cmd.WithScores = true
+			default:
+				return nil, fmt.Errorf("unknown option: %s", args[i])
+			}
+		}
+		return cmd, nil
+
+	case CmdHGetAll:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("hgetall requires a key")
+		}
+		key := strings.TrimSpace(parts[1])
+		if !decodeKey(&key) {
+			return nil, fmt.Errorf("invalid key format")
+		}
+		return &Command{Type: CmdHGetAll, Key: key}, nil
+
+	case CmdBatch:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("batch requires at least one write or delete")
+		}
+		// One command per line, so values in a batch can't hold newlines
+		cmd := &Command{Type: CmdBatch}
+		for i, line := range strings.Split(parts[1], "\n") {
+			op, err := ParseCommand(line)
+			if err != nil {
+				return nil, fmt.Errorf("batch command %d: %w", i+1, err)
+			}
+			if op.Type != CmdWrite && op.Type != CmdDelete {
+				return nil, fmt.Errorf("batch command %d: only write and delete can be batched", i+1)
+			}
+			if op.Exists {
+				return nil, fmt.Errorf("batch command %d: batched deletes are always blind", i+1)
+			}
+			if op.CheckVersion {
+				return nil, fmt.Errorf("batch command %d: batched commands can't be conditional", i+1)
+			}
+			cmd.Batch = append(cmd.Batch, op)
+		}
+		return cmd, nil
 
 	case CmdDelete:
 		if len(parts) < 2 {
 			return nil, fmt.Errorf("delete requires a key")
 		}
+		cmd := &Command{Type: CmdDelete}
+		if err := parseWriteFlags(cmd, parts[1]); err != nil {
+			return nil, err
+		}
+		if cmd.Exists && cmd.CheckVersion {
+			return nil, fmt.Errorf("delete takes EXISTS or IFVERSION, not both")
+		}
+		return cmd, nil
+
+	case CmdCount:
+		// Without arguments, count estimates every key
+		if len(parts) < 2 || strings.TrimSpace(parts[1]) == "" {
+			return &Command{Type: CmdCount}, nil
+		}
+		args := strings.Fields(parts[1])
+		if len(args) > 2 {
+			return nil, fmt.Errorf("count format: count [<prefix> | <start> <end>]")
+		}
+		for i := range args {
+			if !decodeKey(&args[i]) {
+				return nil, fmt.Errorf("invalid key format")
+			}
+		}
+		if len(args) == 1 {
+			return &Command{Type: CmdCount, Prefix: args[0]}, nil
+		}
+		return &Command{Type: CmdCount, Args: args}, nil
+
+	case CmdDBSize:
+		args := []string{}
+		if len(parts) == 2 {
+			args = strings.Fields(parts[1])
+		}
+		if len(args) > 1 {
+			return nil, fmt.Errorf("dbsize format: dbsize [prefix]")
+		}
+		if len(args) == 1 {
+			if !decodeKey(&args[0]) {
+				return nil, fmt.Errorf("invalid key format")
+			}
+			return &Command{Type: CmdDBSize, Prefix: args[0]}, nil
+		}
+		return &Command{Type: CmdDBSize}, nil
+
+	case CmdScan:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("scan format: scan <start> <end> [limit]")
+		}
+		args := strings.Fields(parts[1])
+		if len(args) < 2 || len(args) > 3 {
+			return nil, fmt.Errorf("scan format: scan <start> <end> [limit]")
+		}
+		if !decodeKey(&args[0]) || !decodeKey(&args[1]) {
+			return nil, fmt.Errorf("invalid key format")
+		}
+		cmd := &Command{Type: CmdScan, Args: args[:2]}
+		if len(args) == 3 {
+			limit, err := strconv.Atoi(args[2])
+			if err != nil || limit <= 0 {
+				return nil, fmt.Errorf("invalid limit: %s", args[2])
+			}
+			cmd.Limit = limit
+		}
+		return cmd, nil
+
+	case CmdUndelete:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("undelete requires a key")
+		}
 		key := strings.TrimSpace(parts[1])
-		if !isValidKey(key) {
+		if !decodeKey(&key) {
+			return nil, fmt.Errorf("invalid key format")
+		}
+		return &Command{Type: CmdUndelete, Key: key}, nil
+
+	case CmdExpire:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("expire format: expire <key> <seconds>")
+		}
+		args := strings.Fields(parts[1])
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expire format: expire <key> <seconds>")
+		}
+		if !decodeKey(&args[0]) {
+			return nil, fmt.Errorf("invalid key format")
+		}
+		seconds, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || seconds <= 0 || seconds > int64(math.MaxInt64/time.Second) {
+			return nil, fmt.Errorf("invalid seconds: %s", args[1])
+		}
+		return &Command{Type: CmdExpire, Key: args[0], TTL: time.Duration(seconds) * time.Second}, nil
+
+	case CmdIncr, CmdDecr:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("%s format: %s <key> [delta]", cmdType, cmdType)
+		}
+		args := strings.Fields(parts[1])
+		if len(args) == 0 || len(args) > 2 {
+			return nil, fmt.Errorf("%s format: %s <key> [delta]", cmdType, cmdType)
+		}
+		if !decodeKey(&args[0]) {
+			return nil, fmt.Errorf("invalid key format")
+		}
+		delta := int64(1)
+		if len(args) == 2 {
+			var err error
+			// decr negates its delta, which MinInt64 can't be
+			if delta, err = strconv.ParseInt(args[1], 10, 64); err != nil || delta == math.MinInt64 {
+				return nil, fmt.Errorf("invalid delta: %s", args[1])
+			}
+		}
+		if cmdType == CmdDecr {
+			delta = -delta
+		}
+		return &Command{Type: cmdType, Key: args[0], Delta: delta}, nil
+
+	case CmdAppend:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("append format: append <key>|<data>")
+		}
+		kvParts := strings.SplitN(parts[1], "|", 2)
+		if len(kvParts) < 2 {
+			return nil, fmt.Errorf("append format: append <key>|<data>")
+		}
+		key := strings.TrimSpace(kvParts[0])
+		if !decodeKey(&key) {
+			return nil, fmt.Errorf("invalid key format")
+		}
+		return &Command{Type: CmdAppend, Key: key, Value: []byte(kvParts[1])}, nil
+
+	case CmdSetRange:
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("setrange format: setrange <key> <offset>|<data>")
+		}
+		kvParts := strings.SplitN(parts[1], "|", 2)
+		args := strings.Fields(kvParts[0])
+		if len(kvParts) < 2 || len(args) != 2 {
+			return nil, fmt.Errorf("setrange format: setrange <key> <offset>|<data>")
+		}
+		if !decodeKey(&args[0]) {
 			return nil, fmt.Errorf("invalid key format")
 		}
-		return &Command{Type: CmdDelete, Key: key}, nil
+		if offset, err := strconv.ParseInt(args[1], 10, 64); err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid offset: %s", args[1])
+		}
+		return &Command{Type: CmdSetRange, Key: args[0], Args: args[1:], Value: []byte(kvParts[1])}, nil
 
 	case CmdReads:
 		if len(parts) < 2 {
 			return nil, fmt.Errorf("reads requires a prefix")
 		}
-		prefix := strings.TrimSpace(parts[1])
-		if !isValidKey(prefix) {
+		args := strings.Fields(parts[1])
+		if len(args) == 0 || !decodeKey(&args[0]) {
 			return nil, fmt.Errorf("invalid prefix format")
 		}
-		return &Command{Type: CmdReads, Prefix: prefix}, nil
+		cmd := &Command{Type: CmdReads, Prefix: args[0]}
+		if err := parseScanOptions(cmd, args[1:]); err != nil {
+			return nil, err
+		}
+		return cmd, nil
 
 	default:
 		return nil, fmt.Errorf("unknown command: %s", cmdType)
 	}
 }
 
+// ValidKey reports whether key can be stored through every frontend: any
+// non-empty key, the text protocol escaping bytes that aren't key characters
+func ValidKey(key string) bool {
+	return key != ""
+}
+
 // isValidKey validates key format: ([a-z] | [A-Z] | [0-9] | "." | "-" | ":" | "_")+
 func isValidKey(key string) bool {
 	if len(key) == 0 {
 		return false
 	}
-	for _, ch := range key {
-		if !((ch >= 'a' && ch <= 'z') ||
-			(ch >= 'A' && ch <= 'Z') ||
-			(ch >= '0' && ch <= '9') ||
-			ch == '.' || ch == '-' || ch == ':' || ch == '_') {
+	for i := 0; i < len(key); i++ {
+		if !isKeyChar(key[i]) {
 			return false
 		}
 	}
 	return true
 }
 
+// isKeyChar reports whether ch can appear unescaped in a key
+func isKeyChar(ch byte) bool {
+	return (ch >= 'a' && ch <= 'z') ||
+		(ch >= 'A' && ch <= 'Z') ||
+		(ch >= '0' && ch <= '9') ||
+		ch == '.' || ch == '-' || ch == ':' || ch == '_'
+}
+
+// decodeKey replaces a key as the text protocol carries it, key characters
+// with any other byte escaped as %XX, with the key it stands for. It reports
+// false for malformed keys.
+func decodeKey(key *string) bool {
+	if !strings.Contains(*key, "%") {
+		return isValidKey(*key)
+	}
+	var decoded strings.Builder
+	for i := 0; i < len(*key); i++ {
+		ch := (*key)[i]
+		if ch == '%' && i+2 < len(*key) {
+			b, err := strconv.ParseUint((*key)[i+1:i+3], 16, 8)
+			if err != nil {
+				return false
+			}
+			decoded.WriteByte(byte(b))
+			i += 2
+			continue
+		}
+		if !isKeyChar(ch) {
+			return false
+		}
+		decoded.WriteByte(ch)
+	}
+	*key = decoded.String()
+	return true
+}
+
+// escapeKey returns key as the text protocol carries it, the inverse of
+// decodeKey
+func escapeKey(key string) string {
+	if isValidKey(key) {
+		return key
+	}
+	var escaped strings.Builder
+	for i := 0; i < len(key); i++ {
+		if isKeyChar(key[i]) {
+			escaped.WriteByte(key[i])
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", key[i])
+		}
+	}
+	return escaped.String()
+}
+
+// escapeValue returns value with "%", "\r" and "\n" escaped as %XX, so a
+// value can't break the lines of a response listing several; other bytes
+// are kept as they are. It's decoded as keys are.
+func escapeValue(value []byte) string {
+	if !bytes.ContainsAny(value, "%\r\n") {
+		return string(value)
+	}
+	var escaped strings.Builder
+	for _, b := range value {
+		if b == '%' || b == '\r' || b == '\n' {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		} else {
+			escaped.WriteByte(b)
+		}
+	}
+	return escaped.String()
+}
+
+// parseScanOptions parses "[LIMIT <n>] [AFTER <key>] [WITHKEYS]" in any order
+func parseScanOptions(cmd *Command, args []string) error {
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "LIMIT":
+			if i+1 >= len(args) {
+				return fmt.Errorf("LIMIT requires a value")
+			}
+			limit, err := strconv.Atoi(args[i+1])
+			if err != nil || limit <= 0 {
+				return fmt.Errorf("invalid limit: %s", args[i+1])
+			}
+			cmd.Limit = limit
+			i++
+		case "AFTER":
+			if i+1 >= len(args) {
+				return fmt.Errorf("AFTER requires a key")
+			}
+			if !decodeKey(&args[i+1]) {
+				return fmt.Errorf("invalid key format")
+			}
+			cmd.After = args[i+1]
+			i++
+		case "WITHKEYS":
+			cmd.WithKeys = true
+		default:
+			return fmt.Errorf("unknown option: %s", args[i])
+		}
+	}
+	return nil
+}
+
+// isScanOption reports whether arg names a scan option rather than a key or
+// pattern
+func isScanOption(arg string) bool {
+	switch strings.ToUpper(arg) {
+	case "LIMIT", "AFTER", "WITHKEYS":
+		return true
+	}
+	return false
+}
+
+// decodePattern replaces a glob pattern as the text protocol carries it, key
+// characters, %XX escapes and "*", "?", "[", "]" and "^", with the pattern
+// it stands for: escaped bytes are matched literally, so "%2A" matches "*"
+// rather than any run of bytes. It reports false for malformed patterns.
+func decodePattern(pattern *string) bool {
+	if len(*pattern) == 0 {
+		return false
+	}
+	var decoded strings.Builder
+	for i := 0; i < len(*pattern); i++ {
+		ch := (*pattern)[i]
+		switch {
+		case ch == '%' && i+2 < len(*pattern):
+			b, err := strconv.ParseUint((*pattern)[i+1:i+3], 16, 8)
+			if err != nil {
+				return false
+			}
+			if !isKeyChar(byte(b)) {
+				decoded.WriteByte('\\')
+			}
+			decoded.WriteByte(byte(b))
+			i += 2
+		case isKeyChar(ch) || strings.IndexByte("*?[]^", ch) >= 0:
+			decoded.WriteByte(ch)
+		default:
+			return false
+		}
+	}
+	*pattern = decoded.String()
+	return true
+}
+
+// parseTimestamp accepts unix nanoseconds or an RFC3339 time
+func parseTimestamp(s string) (int64, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp: %s (use unix nanoseconds or RFC3339)", s)
+	}
+	return t.UnixNano(), nil
+}
+
 // ParseCommands parses multiple commands separated by \r
 func ParseCommands(reader *bufio.Reader) ([]*Command, error) {
 	var commands []*Command
@@ -137,3 +1237,35 @@ func ParseCommands(reader *bufio.Reader) ([]*Command, error) {
 		commands = append(commands, cmd)
 	}
 }
+
+// parseWriteFlags sets the key of a write or delete from args, and the
+// flags before it: SYNC for writes, EXISTS for deletes and IFVERSION
+// <version> for both. Keys hold no spaces, so only flags can precede them.
+func parseWriteFlags(cmd *Command, args string) error {
+	words := strings.Fields(args)
+	if len(words) == 0 || !decodeKey(&words[len(words)-1]) {
+		return fmt.Errorf("invalid key format")
+	}
+	cmd.Key = words[len(words)-1]
+
+	flags := words[:len(words)-1]
+	for i := 0; i < len(flags); i++ {
+		switch {
+		case cmd.Type == CmdWrite && strings.EqualFold(flags[i], "sync"):
+			cmd.Sync = true
+		case cmd.Type == CmdDelete && strings.EqualFold(flags[i], "exists"):
+			cmd.Exists = true
+		case strings.EqualFold(flags[i], "ifversion") && i+1 < len(flags):
+			version, err := strconv.ParseInt(flags[i+1], 10, 64)
+			if err != nil || version < 0 {
+				return fmt.Errorf("invalid version: %s", flags[i+1])
+			}
+			cmd.CheckVersion = true
+			cmd.IfVersion = version
+			i++
+		default:
+			return fmt.Errorf("invalid %s flag: %s", cmd.Type, flags[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"escabelo/internal/engine/enginetest"
+	"escabelo/pkg/client"
+)
+
+// arbitraryKeys are keys holding bytes the text protocol can't carry as
+// they are
+var arbitraryKeys = []string{
+	"plain:key_1.a-b",
+	"with space",
+	"100%",
+	"a|b",
+	"line\nbreak\r",
+	"ünïcode",
+	"\x00\xff",
+}
+
+// TestKeyEscaping checks that escaped keys only hold key characters and
+// escapes, decode back to the key, and are escaped the same way by clients
+func TestKeyEscaping(t *testing.T) {
+	for _, key := range arbitraryKeys {
+		escaped := escapeKey(key)
+		for i := 0; i < len(escaped); i++ {
+			if !isKeyChar(escaped[i]) && escaped[i] != '%' {
+				t.Errorf("escapeKey(%q) = %q, holds %q", key, escaped, escaped[i])
+				break
+			}
+		}
+		if clientEscaped := client.EscapeKey(key); clientEscaped != escaped {
+			t.Errorf("client.EscapeKey(%q) = %q, server escapes %q", key, clientEscaped, escaped)
+		}
+
+		decoded := escaped
+		if !decodeKey(&decoded) || decoded != key {
+			t.Errorf("decodeKey(%q) = %q, want %q", escaped, decoded, key)
+		}
+		if unescaped, err := client.UnescapeKey(escaped); err != nil || unescaped != key {
+			t.Errorf("client.UnescapeKey(%q) = %q (err %v), want %q", escaped, unescaped, err, key)
+		}
+	}
+}
+
+// TestDecodeKeyMalformed checks that keys with unescaped bytes or broken
+// escapes are rejected
+func TestDecodeKeyMalformed(t *testing.T) {
+	for _, key := range []string{"", "a b", "a|b", "ü", "%zz", "a%4", "a%"} {
+		decoded := key
+		if decodeKey(&decoded) {
+			t.Errorf("decodeKey(%q) = %q, want malformed", key, decoded)
+		}
+	}
+}
+
+// TestEscapeValue checks that only "%" and line breaks are escaped in
+// values, and that clients decode them back
+func TestEscapeValue(t *testing.T) {
+	cases := []struct {
+		value, escaped string
+	}{
+		{"plain value|with pipe", "plain value|with pipe"},
+		{"line 1\nline 2", "line 1%0Aline 2"},
+		{"crlf\r\n", "crlf%0D%0A"},
+		{"100%", "100%25"},
+		{"%0A", "%250A"},
+	}
+	for _, tc := range cases {
+		if got := escapeValue([]byte(tc.value)); got != tc.escaped {
+			t.Errorf("escapeValue(%q) = %q, want %q", tc.value, got, tc.escaped)
+		}
+		if got, err := client.UnescapeKey(tc.escaped); err != nil || got != tc.value {
+			t.Errorf("client.UnescapeKey(%q) = %q (err %v), want %q", tc.escaped, got, err, tc.value)
+		}
+	}
+}
+
+// TestDecodePattern checks that escaped bytes of a pattern match literally
+// while glob characters keep their meaning
+func TestDecodePattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		want    string
+		ok      bool
+	}{
+		{"user:*", "user:*", true},
+		{"a%2A*", `a\**`, true},
+		{"a%20b?", `a\ b?`, true},
+		{"[ab]%5B", `[ab]\[`, true},
+		{"%61*", "a*", true},
+		{"", "", false},
+		{"a b", "", false},
+		{"a|*", "", false},
+		{"a%zz", "", false},
+	}
+	for _, tc := range cases {
+		got := tc.pattern
+		ok := decodePattern(&got)
+		if ok != tc.ok || (ok && got != tc.want) {
+			t.Errorf("decodePattern(%q) = %q, %v, want %q, %v", tc.pattern, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+// TestParseEscapedKeys checks that commands carry the keys their escapes
+// stand for, and are written back with them escaped
+func TestParseEscapedKeys(t *testing.T) {
+	cmd, err := ParseCommand("read a%20b%7Cc")
+	if err != nil || cmd.Key != "a b|c" {
+		t.Fatalf("parse read = %+v (err %v), want key %q", cmd, err, "a b|c")
+	}
+
+	cmd, err = ParseCommand("write a%7Cb|v|w")
+	if err != nil || cmd.Key != "a|b" || string(cmd.Value) != "v|w" {
+		t.Fatalf("parse write = %+v (err %v), want key %q and value %q", cmd, err, "a|b", "v|w")
+	}
+	if line := cmd.Line(); line != "write a%7Cb|v|w" {
+		t.Errorf("write line = %q, want %q", line, "write a%7Cb|v|w")
+	}
+
+	for _, line := range []string{"read a%zz", "read ü", "write a b|v"} {
+		if cmd, err := ParseCommand(line); err == nil {
+			t.Errorf("parse %q = %+v, want an error", line, cmd)
+		}
+	}
+}
+
+// TestArbitraryKeysEndToEnd stores values holding line breaks under keys
+// of arbitrary bytes, and reads them back through responses that list
+// one and several values
+func TestArbitraryKeysEndToEnd(t *testing.T) {
+	addr := startServer(t, Config{}, enginetest.NewEngine(t, enginetest.Config(t)))
+	conn := dial(t, addr)
+
+	values := make(map[string]string)
+	for i, key := range arbitraryKeys {
+		value := fmt.Sprintf("value %d = 100%%\nline 2", i)
+		if err := conn.Put(key, []byte(value)); err != nil {
+			t.Fatalf("put %q: %v", key, err)
+		}
+		values[key] = value
+	}
+
+	for key, value := range values {
+		if got, err := conn.Get(key); err != nil || string(got) != value {
+			t.Errorf("get %q = %q (err %v), want %q", key, got, err, value)
+		}
+	}
+
+	got, err := conn.MultiGet(arbitraryKeys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range values {
+		if string(got[key]) != value {
+			t.Errorf("mread %q = %q, want %q", key, got[key], value)
+		}
+	}
+
+	if err := conn.HSet("hash key", "field", []byte("x\ny%")); err != nil {
+		t.Fatal(err)
+	}
+	fields, err := conn.HGetAll("hash key")
+	if err != nil || len(fields) != 1 || string(fields["field"]) != "x\ny%" {
+		t.Errorf("hgetall = %q (err %v), want field = %q", fields, err, "x\ny%")
+	}
+
+	changes, err := conn.ReadWAL(1, len(arbitraryKeys))
+	if err != nil || len(changes) != len(arbitraryKeys) {
+		t.Fatalf("wal = %d changes (err %v), want %d", len(changes), err, len(arbitraryKeys))
+	}
+	for _, change := range changes {
+		if string(change.Value) != values[change.Key] {
+			t.Errorf("wal change of %q = %q, want %q", change.Key, change.Value, values[change.Key])
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"escabelo/internal/engine"
+	"escabelo/internal/raft"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// raftCommand executes a raft command: the group's status, membership
+// changes on the leader, and the RPCs members send each other
+func (s *Server) raftCommand(cmd *Command) string {
+	node := s.config.Raft
+	if node == nil {
+		return "error: raft mode disabled"
+	}
+
+	switch cmd.Args[0] {
+	case "status":
+		return raftStatus(node.Status())
+
+	case "add", "remove":
+		var err error
+		if cmd.Args[0] == "add" {
+			err = node.AddPeer(cmd.Args[1])
+		} else {
+			err = node.RemovePeer(cmd.Args[1])
+		}
+		if errors.Is(err, raft.ErrNotLeader) && !node.IsLeader() {
+			return s.redirect()
+		}
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return "success"
+
+	case "vote":
+		var req raft.VoteRequest
+		if err := json.Unmarshal([]byte(cmd.Args[1]), &req); err != nil {
+			return fmt.Sprintf("error: invalid vote request: %v", err)
+		}
+		resp, err := node.HandleVote(&req)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return encodeRaftResponse(resp)
+
+	case "append":
+		var req raft.AppendRequest
+		if err := json.Unmarshal([]byte(cmd.Args[1]), &req); err != nil {
+			return fmt.Sprintf("error: invalid append request: %v", err)
+		}
+		resp, err := node.HandleAppend(&req)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return encodeRaftResponse(resp)
+	}
+	return fmt.Sprintf("error: unknown raft command: %s", cmd.Args[0])
+}
+
+// raftStatus formats the lines of "raft status": the node's own state, then
+// on the leader each peer's replication progress
+func raftStatus(status raft.Status) string {
+	lines := []string{fmt.Sprintf("raft self=%s role=%s term=%d leader=%s commit=%d applied=%d first_index=%d last_index=%d members=%s",
+		status.Self, status.Role, status.Term, status.Leader, status.Commit, status.Applied,
+		status.FirstIndex, status.LastIndex, strings.Join(status.Members, ","))}
+	for _, peer := range status.Peers {
+		lines = append(lines, fmt.Sprintf("peer %s match=%d next=%d lag=%d last_contact_ms=%d",
+			peer.Addr, peer.Match, peer.Next, status.LastIndex-min(peer.Match, status.LastIndex),
+			sinceMillis(peer.LastContact)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// encodeRaftResponse encodes an RPC response as JSON
+func encodeRaftResponse(resp any) string {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	return string(data)
+}
+
+// raftWrite runs a write on a stage of the store and proposes what it
+// staged, answering once the group committed it and this member applied it,
+// which is when the write takes effect here as everywhere else. write
+// returns the write's response and whether it succeeded, as only
+// successful writes are proposed. A write that times out may still commit.
+func (s *Server) raftWrite(start time.Time, write func(stage *engine.Stage) (string, bool)) string {
+	var response string
+	proposed := false
+	err := s.config.Raft.Propose(func(stage *engine.Stage) bool {
+		response, proposed = write(stage)
+		return proposed
+	}, s.config.WriteAckTimeout)
+	if errors.Is(err, raft.ErrNotLeader) && response == "" && !s.config.Raft.IsLeader() {
+		return s.redirect()
+	}
+	if proposed {
+		s.acks.record(AckQuorum, time.Since(start), err != nil)
+	}
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	return response
+}
+
+// raftApplied updates indexes for a committed change as it is applied
+func (s *Server) raftApplied(key string) {
+	if err := s.indexes.Update(key); err != nil {
+		slog.Error("Index update failed", "key", key, "err", err)
+	}
+}
+
+// raftRepaired rebuilds indexes after catching up from the leader's data,
+// as repaired entries bypass Update
+func (s *Server) raftRepaired() {
+	if err := s.indexes.Rebuild(); err != nil {
+		slog.Error("Index rebuild after catch-up failed", "err", err)
+	}
+}
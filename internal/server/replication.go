@@ -0,0 +1,383 @@
+package server
+
+import (
+	"errors"
+	"escabelo/internal/cluster"
+	"escabelo/internal/engine"
+	"escabelo/pkg/client"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Write acknowledgement levels
+const (
+	AckLeader = "leader" // acknowledged once applied on the leader
+	AckQuorum = "quorum" // ... and persisted by a majority of the nodes
+	AckAll    = "all"    // ... and persisted by every replica
+)
+
+// replicaBatch bounds the entries a replica pulls per tail
+const replicaBatch = 1000
+
+// AckLevels lists the acknowledgement levels in order
+var AckLevels = []string{AckLeader, AckQuorum, AckAll}
+
+// isAckLevel reports whether s names an acknowledgement level
+func isAckLevel(s string) bool {
+	for _, level := range AckLevels {
+		if s == level {
+			return true
+		}
+	}
+	return false
+}
+
+// AckStats reports the writes acknowledged at one level
+type AckStats struct {
+	Level    string
+	Writes   int64
+	Timeouts int64
+	Total    time.Duration // summed latency, including the wait for replicas
+	Max      time.Duration
+}
+
+// ackTracker follows the WAL positions acknowledged by replicas, so writes
+// can wait until enough of them have persisted an entry
+type ackTracker struct {
+	replicas []string
+
+	mu      sync.Mutex
+	acked   map[string]uint64
+	changed chan struct{} // closed and replaced on every advance
+	stats   map[string]*AckStats
+}
+
+// newAckTracker creates a tracker for the replicas' consumer names
+func newAckTracker(replicas []string) *ackTracker {
+	t := &ackTracker{
+		replicas: replicas,
+		acked:    make(map[string]uint64),
+		changed:  make(chan struct{}),
+		stats:    make(map[string]*AckStats),
+	}
+	for _, level := range AckLevels {
+		t.stats[level] = &AckStats{Level: level}
+	}
+	return t
+}
+
+// isReplica reports whether consumer is one of the tracked replicas
+func (t *ackTracker) isReplica(consumer string) bool {
+	for _, replica := range t.replicas {
+		if replica == consumer {
+			return true
+		}
+	}
+	return false
+}
+
+// needed returns the replica acknowledgements a level requires. A quorum is
+// a majority of the leader plus its replicas, the leader counting as one.
+func (t *ackTracker) needed(level string) int {
+	switch level {
+	case AckQuorum:
+		return (len(t.replicas) + 1) / 2
+	case AckAll:
+		return len(t.replicas)
+	}
+	return 0
+}
+
+// advance records that a replica persisted every entry up to seq
+func (t *ackTracker) advance(consumer string, seq uint64) {
+	if !t.isReplica(consumer) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if seq > t.acked[consumer] {
+		t.acked[consumer] = seq
+		close(t.changed)
+		t.changed = make(chan struct{})
+	}
+}
+
+// count returns the replicas that persisted seq, and a channel closed on
+// the next advance
+func (t *ackTracker) count(seq uint64) (int, <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, replica := range t.replicas {
+		if t.acked[replica] >= seq {
+			n++
+		}
+	}
+	return n, t.changed
+}
+
+// wait blocks until the level is satisfied for seq or the timeout passes,
+// returning the replicas that acknowledged it
+func (t *ackTracker) wait(seq uint64, level string, timeout time.Duration) (int, error) {
+	needed := t.needed(level)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		n, changed := t.count(seq)
+		if n >= needed {
+			return n, nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return n, fmt.Errorf("ack timeout: %d of %d replicas persisted the write", n, needed)
+		}
+	}
+}
+
+// record adds a write's latency to its level's stats
+func (t *ackTracker) record(level string, latency time.Duration, timedOut bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := t.stats[level]
+	stats.Writes++
+	if timedOut {
+		stats.Timeouts++
+	}
+	stats.Total += latency
+	if latency > stats.Max {
+		stats.Max = latency
+	}
+}
+
+// Stats returns the per-level acknowledgement stats
+func (t *ackTracker) Stats() []AckStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := make([]AckStats, len(AckLevels))
+	for i, level := range AckLevels {
+		stats[i] = *t.stats[level]
+	}
+	return stats
+}
+
+// followState is a replica's progress following its leader
+type followState struct {
+	mu sync.Mutex
+
+	// applied is the leader sequence number of the last change applied and
+	// acknowledged, contact when a tail last succeeded, and caughtUp when
+	// one last returned everything the leader had
+	applied  uint64
+	contact  time.Time
+	caughtUp time.Time
+
+	// catchUps counts the times the replica fell behind the leader's WAL
+	// and caught up from its data instead
+	catchUps int64
+}
+
+// replicationStatus returns the lines of "replication status": on a leader
+// its last sequence number and each WAL consumer's position and lag in
+// entries, on a following replica its position and how long ago it last
+// had every change
+func (s *Server) replicationStatus() string {
+	if s.IsReplica() {
+		if s.config.ReplicaName == "" {
+			return fmt.Sprintf("replica leader=%s following=false", s.leaderAddr())
+		}
+		f := &s.following
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return fmt.Sprintf("replica leader=%s consumer=%s applied=%d lag_ms=%d last_contact_ms=%d catch_ups=%d",
+			s.config.LeaderAddr, s.config.ReplicaName, f.applied, sinceMillis(f.caughtUp),
+			sinceMillis(f.contact), f.catchUps)
+	}
+
+	last := s.engine.LastSeq()
+	consumers := s.engine.Consumers()
+	names := make([]string, 0, len(consumers))
+	for name := range consumers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{fmt.Sprintf("leader last_seq=%d", last)}
+	for _, name := range names {
+		acked := consumers[name]
+		lines = append(lines, fmt.Sprintf("consumer %s acked=%d lag=%d replica=%t",
+			name, acked, last-min(acked, last), s.acks.isReplica(name)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sinceMillis returns the milliseconds since t, or -1 if t is zero
+func sinceMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return -1
+	}
+	return time.Since(t).Milliseconds()
+}
+
+// follow pulls the leader's WAL into the local store as the consumer named
+// ReplicaName, acknowledging each batch once applied so the leader can
+// release writes waiting for replicas
+func (s *Server) follow() {
+	defer close(s.followDone)
+
+	var conn *client.Client
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		if conn == nil {
+			c, err := s.dialLeader()
+			if err != nil {
+				slog.Warn("Replica failed to reach leader", "leader", s.config.LeaderAddr, "err", err)
+				if !s.sleep(time.Second) {
+					return
+				}
+				continue
+			}
+			conn = c
+			slog.Info("Replicating", "leader", s.config.LeaderAddr, "consumer", s.config.ReplicaName)
+		}
+
+		applied, err := s.pull(conn)
+		if err != nil {
+			slog.Error("Replication failed", "leader", s.config.LeaderAddr, "err", err)
+			conn.Close()
+			conn = nil
+			if !s.sleep(time.Second) {
+				return
+			}
+			continue
+		}
+		if applied == 0 && !s.sleep(s.config.ReplicaPollInterval) {
+			return
+		}
+	}
+}
+
+// dialLeader connects to the leader, authenticating with PeerToken if set
+func (s *Server) dialLeader() (*client.Client, error) {
+	conn, err := client.Dial(s.config.LeaderAddr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if s.config.PeerToken != "" {
+		if err := conn.Auth(s.config.PeerToken); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// pull applies one batch of the leader's changes and acknowledges it
+func (s *Server) pull(conn *client.Client) (int, error) {
+	changes, err := conn.Tail(s.config.ReplicaName, 0, replicaBatch)
+	var serverErr *client.ServerError
+	if errors.As(err, &serverErr) && strings.HasPrefix(serverErr.Message, engine.ErrWALTruncated.Error()) {
+		return s.catchUp(conn)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	f := &s.following
+	f.mu.Lock()
+	f.contact = time.Now()
+	if len(changes) < replicaBatch {
+		f.caughtUp = f.contact
+	}
+	f.mu.Unlock()
+	if len(changes) == 0 {
+		return 0, nil
+	}
+
+	for _, change := range changes {
+		entry := &engine.Entry{
+			Key:       change.Key,
+			Value:     change.Value,
+			Timestamp: change.Timestamp,
+			Deleted:   change.Deleted,
+			ExpiresAt: change.ExpiresAt,
+		}
+		if _, err := s.engine.ApplyEntry(entry); err != nil {
+			return 0, fmt.Errorf("apply %s: %w", change.Key, err)
+		}
+		if err := s.indexes.Update(change.Key); err != nil {
+			slog.Error("Index update failed", "key", change.Key, "err", err)
+		}
+	}
+
+	last := changes[len(changes)-1].Seq
+	if err := conn.Ack(s.config.ReplicaName, last); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	f.applied = last
+	f.mu.Unlock()
+	return len(changes), nil
+}
+
+// catchUp brings a replica that fell behind the leader's WAL up to date
+// from the leader's data: it repairs every key that differs, then skips
+// its WAL position ahead to where the repair started. Changes made during
+// the repair are tailed again, which is harmless as applying an entry
+// twice keeps the newer version.
+func (s *Server) catchUp(conn *client.Client) (int, error) {
+	slog.Warn("Replica fell behind the leader's WAL, catching up from its data", "leader", s.config.LeaderAddr)
+
+	lines, err := conn.ReplicationStatus()
+	if err != nil {
+		return 0, err
+	}
+	var last uint64
+	if _, err := fmt.Sscanf(lines[0], "leader last_seq=%d", &last); err != nil {
+		return 0, fmt.Errorf("unexpected replication status: %s", lines[0])
+	}
+
+	result, err := cluster.Repair(s.engine, s.config.LeaderAddr, s.config.PeerToken, cluster.DefaultMerkleDepth, 30*time.Second)
+	if err != nil {
+		return 0, fmt.Errorf("catch-up failed: %w", err)
+	}
+	// Repaired entries bypass Update, so indexes are rebuilt
+	if result.EntriesApplied > 0 {
+		if err := s.indexes.Rebuild(); err != nil {
+			slog.Error("Index rebuild after catch-up failed", "err", err)
+		}
+	}
+	if err := conn.Ack(s.config.ReplicaName, last); err != nil {
+		return 0, err
+	}
+
+	f := &s.following
+	f.mu.Lock()
+	f.applied = last
+	f.catchUps++
+	f.mu.Unlock()
+
+	slog.Info("Replica caught up", "leader", s.config.LeaderAddr, "seq", last,
+		"divergent_buckets", result.DivergentBuckets, "applied", result.EntriesApplied)
+	return result.EntriesApplied, nil
+}
+
+// sleep waits for d, returning false if the server stops meanwhile
+func (s *Server) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-s.stopCh:
+		return false
+	}
+}
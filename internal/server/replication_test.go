@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"escabelo/internal/engine"
+	"escabelo/internal/engine/enginetest"
+	"escabelo/pkg/client"
+)
+
+// waitReplicated waits until the replica at addr serves every key of want
+// with its value, and no key of gone
+func waitReplicated(t *testing.T, addr string, want map[string]string, gone []string) {
+	t.Helper()
+	conn := dial(t, addr)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mismatch := ""
+		for key, value := range want {
+			if got, err := conn.Get(key); err != nil || string(got) != value {
+				mismatch = fmt.Sprintf("get %s = %q (err %v), want %q", key, got, err, value)
+				break
+			}
+		}
+		for _, key := range gone {
+			if mismatch != "" {
+				break
+			}
+			if got, err := conn.Get(key); !errors.Is(err, client.ErrNotFound) {
+				mismatch = fmt.Sprintf("get %s = %q (err %v), want not found", key, got, err)
+			}
+		}
+		if mismatch == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("replica not caught up after 10s: %s", mismatch)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestReplicaFollowsLeader checks that a replica applies the leader's
+// writes and deletes, redirects writes sent to it, and shows up as a
+// consumer in the leader's replication status
+func TestReplicaFollowsLeader(t *testing.T) {
+	leaderAddr := startServer(t, Config{}, enginetest.NewEngine(t, enginetest.Config(t)))
+	replicaAddr := startServer(t, Config{LeaderAddr: leaderAddr, ReplicaName: "replica1"},
+		enginetest.NewEngine(t, enginetest.Config(t)))
+
+	leader := dial(t, leaderAddr)
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key, value := fmt.Sprintf("key:%03d", i), fmt.Sprintf("value-%03d", i)
+		if err := leader.Put(key, []byte(value)); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+		want[key] = value
+	}
+	if err := leader.Put("multiline", []byte("line 1\nline 2")); err != nil {
+		t.Fatal(err)
+	}
+	want["multiline"] = "line 1\nline 2"
+	var gone []string
+	for i := 0; i < 100; i += 10 {
+		key := fmt.Sprintf("key:%03d", i)
+		if err := leader.Delete(key); err != nil {
+			t.Fatalf("delete %s: %v", key, err)
+		}
+		delete(want, key)
+		gone = append(gone, key)
+	}
+	waitReplicated(t, replicaAddr, want, gone)
+
+	replica := dial(t, replicaAddr)
+	var serverErr *client.ServerError
+	if err := replica.Put("key:000", []byte("replica")); !errors.As(err, &serverErr) || serverErr.Message != "redirect "+leaderAddr {
+		t.Errorf("put on the replica: %v, want redirect %s", err, leaderAddr)
+	}
+
+	lines, err := leader.ReplicationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, line := range lines[1:] {
+		found = found || strings.HasPrefix(line, "consumer replica1 ")
+	}
+	if !strings.HasPrefix(lines[0], "leader last_seq=") || !found {
+		t.Errorf("leader replication status = %q, want consumer replica1 listed", lines)
+	}
+}
+
+// TestReplicaCatchUp starts a replica whose WAL position the leader has
+// already released: the replica must catch up from the leader's data,
+// then keep following its WAL
+func TestReplicaCatchUp(t *testing.T) {
+	leaderEngine := enginetest.NewEngine(t, enginetest.Config(t))
+	leaderAddr := startServer(t, Config{}, leaderEngine)
+	leader := dial(t, leaderAddr)
+
+	// Register the replica's consumer at the start of the WAL, then write
+	// until the segments holding its next entry are flushed and released
+	if _, err := leaderEngine.TailWAL("replica1", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key:%04d", i)
+		if err := leader.Put(key, []byte(value)); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+		want[key] = value
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := leaderEngine.ReadWAL(1, 1); errors.Is(err, engine.ErrWALTruncated) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("leader WAL not released after 10s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	replicaAddr := startServer(t, Config{LeaderAddr: leaderAddr, ReplicaName: "replica1"},
+		enginetest.NewEngine(t, enginetest.Config(t)))
+	waitReplicated(t, replicaAddr, want, nil)
+
+	if err := leader.Put("after", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	waitReplicated(t, replicaAddr, map[string]string{"after": "v1"}, nil)
+
+	lines, err := dial(t, replicaAddr).ReplicationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(lines[0], " catch_ups=1") {
+		t.Errorf("replica replication status = %q, want catch_ups=1", lines[0])
+	}
+}
@@ -2,84 +2,371 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"escabelo/internal/cluster"
 	"escabelo/internal/engine"
+	"escabelo/internal/raft"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Config holds server configuration
+type Config struct {
+	// Addrs are the data listener addresses (IPv4 or IPv6, e.g. ":8080",
+	// "[::1]:8080")
+	Addrs []string
+
+	// AdminAddr, when set, starts a listener that serves only administrative
+	// commands; data listeners then reject them, so both planes can be
+	// firewalled separately
+	AdminAddr string
+
+	// Indexes declares sorted secondary indexes, built on Start and
+	// queried with queryrange and find. Indexes created with "index create"
+	// are saved with the store and built on Start as well.
+	Indexes []engine.IndexDef
+
+	// Listeners and AdminListener are already-open listeners, e.g. inherited
+	// from a process manager, served alongside Addrs and AdminAddr
+	Listeners     []net.Listener
+	AdminListener net.Listener
+
+	// LeaderAddr marks this node as a replica of the given leader.
+	// Replicas serve reads but redirect writes to the leader.
+	LeaderAddr string
+
+	// ReplicaName, on a replica, pulls the leader's WAL into the local store
+	// under this consumer name every ReplicaPollInterval while idle
+	ReplicaName         string
+	ReplicaPollInterval time.Duration
+
+	// Replicas, on a leader, names the replicas' consumers. Writes are held
+	// until the connection's ack level is met, up to WriteAckTimeout.
+	Replicas        []string
+	WriteAck        string
+	WriteAckTimeout time.Duration
+
+	// Raft, when set, makes the server a member of a Raft group: only the
+	// group's leader serves writes, acknowledging them once a majority of
+	// the members persisted them, and the others redirect writes to it
+	Raft *raft.Node
+
+	// ReadOnly starts the server rejecting writes, as "readonly on" does, to
+	// serve a restored backup or a replica without risk of modifying it
+	ReadOnly bool
+
+	// Membership enables the cluster commands when set
+	Membership *cluster.Membership
+
+	// Sharding, with Membership, partitions keys across the live members by
+	// consistent hashing over ShardVirtualNodes points per node: commands for
+	// keys another node owns are answered with "error: moved <addr>"
+	// (ShardRedirect) or forwarded to it (ShardProxy)
+	Sharding          string
+	ShardVirtualNodes int
+
+	// Mirror, when set, receives a copy of every write command, and of
+	// reads too with MirrorReads
+	Mirror      *Mirror
+	MirrorReads bool
+
+	// Audit, when set, records every successful write command along with
+	// the client that issued it
+	Audit *AuditLog
+
+	// Auth, when set, requires connections to authenticate with auth before
+	// running anything but status
+	Auth *Auth
+
+	// PeerToken is sent with auth to the leader when following it, and to
+	// peers on repair, for nodes that require authentication
+	PeerToken string
+
+	// CommandTimeout cancels scans (keys, reads, scan, count) that run longer
+	// than this (0 disables)
+	CommandTimeout time.Duration
+
+	// MaxConnections refuses data connections past this many open ones
+	// (0 disables); admin connections are always accepted
+	MaxConnections int
+
+	// IdleTimeout closes connections that send no request for this long,
+	// ReadTimeout those that take longer than this to send a whole request
+	// once it has started arriving, and WriteTimeout those that take longer
+	// than this to accept a write of a response (0 disables each)
+	IdleTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
 // Server handles TCP connections
 type Server struct {
-	engine   *engine.Engine
-	listener net.Listener
-	addr     string
-	wg       sync.WaitGroup
-	stopCh   chan struct{}
+	engine  engine.Store
+	data    *keyspace // the default bucket
+	indexes *engine.Indexes
+	acks    *ackTracker
+
+	// indexDefsMu serializes index create and drop with saving the result
+	indexDefsMu sync.Mutex
+
+	shards    *shardRouter
+	readOnly  atomic.Bool
+	conns     connCounter
+	listeners []net.Listener
+	config    Config
+	wg        sync.WaitGroup
+	stopCh    chan struct{}
+
+	followDone chan struct{}
+	following  followState
+
+	bucketsMu sync.Mutex
+	buckets   map[string]*keyspace
+}
+
+// session is the per-connection state
+type session struct {
+	// client identifies the connection in the audit log; "client <name>"
+	// prefixes the remote address with a name
+	client string
+
+	// proto is the protocol level selected with hello
+	proto int
+
+	// ack is the acknowledgement level of writes, set with acklevel
+	ack string
+
+	// versions makes successful writes answer with the version they
+	// assigned, set with "versions on"
+	versions bool
+
+	// role is what the connection authenticated as with auth, RoleReadOnly
+	// or RoleReadWrite; "" until it has
+	role string
+
+	// local serves commands for keys other nodes own here, set with
+	// "cluster local" by nodes forwarding commands
+	local bool
+
+	// keyspace is the bucket data commands run against, picked with use
+	keyspace *keyspace
+
+	// txn is the transaction opened with begin, on text connections
+	txn *txnState
 }
 
 // NewServer creates a new TCP server
-func NewServer(addr string, eng *engine.Engine) *Server {
-	return &Server{
-		engine: eng,
-		addr:   addr,
-		stopCh: make(chan struct{}),
+func NewServer(config Config, eng engine.Store) *Server {
+	if config.WriteAck == "" {
+		config.WriteAck = AckLeader
+	}
+	if config.WriteAckTimeout <= 0 {
+		config.WriteAckTimeout = 5 * time.Second
+	}
+	if config.ReplicaPollInterval <= 0 {
+		config.ReplicaPollInterval = 10 * time.Millisecond
+	}
+	var shards *shardRouter
+	if config.Membership != nil && config.Sharding != "" && config.Sharding != ShardOff {
+		shards = newShardRouter(config.Membership, config.Sharding, config.ShardVirtualNodes, config.PeerToken)
+	}
+	s := &Server{
+		engine:  eng,
+		data:    newKeyspace(engine.DefaultBucket, eng),
+		indexes: engine.NewIndexes(eng),
+		acks:    newAckTracker(config.Replicas),
+		shards:  shards,
+		config:  config,
+		stopCh:  make(chan struct{}),
+		buckets: make(map[string]*keyspace),
+	}
+	s.readOnly.Store(config.ReadOnly)
+	return s
+}
+
+// IsReplica reports whether the server is running as a read-only replica,
+// or is a Raft member that doesn't lead the group
+func (s *Server) IsReplica() bool {
+	if s.config.Raft != nil {
+		return !s.config.Raft.IsLeader()
+	}
+	return s.config.LeaderAddr != ""
+}
+
+// leaderAddr returns the address replicas redirect writes to, "" while a
+// Raft group has no leader
+func (s *Server) leaderAddr() string {
+	if s.config.Raft != nil {
+		return s.config.Raft.Leader()
 	}
+	return s.config.LeaderAddr
 }
 
-// Start begins listening for connections
+// redirect answers a write sent to a replica
+func (s *Server) redirect() string {
+	leader := s.leaderAddr()
+	if leader == "" {
+		return "error: no leader elected"
+	}
+	return fmt.Sprintf("error: redirect %s", leader)
+}
+
+// Start begins serving the configured listeners, then listening on every
+// data address and the admin address
 func (s *Server) Start() error {
-	listener, err := net.Listen("tcp", s.addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	for _, def := range s.config.Indexes {
+		if err := s.indexes.Define(def); err != nil {
+			return err
+		}
+		slog.Info("Index built", "index", def.Name, "prefix", def.Prefix)
+	}
+	if err := s.loadIndexes(); err != nil {
+		return err
 	}
 
-	s.listener = listener
-	log.Printf("Server listening on %s", s.addr)
+	for _, listener := range s.config.Listeners {
+		s.serve(listener, false)
+	}
+	if s.config.AdminListener != nil {
+		s.serve(s.config.AdminListener, true)
+	}
+
+	for _, addr := range s.config.Addrs {
+		if err := s.listen(addr, false); err != nil {
+			s.closeListeners()
+			return err
+		}
+	}
+	if s.config.AdminAddr != "" {
+		if err := s.listen(s.config.AdminAddr, true); err != nil {
+			s.closeListeners()
+			return err
+		}
+	}
 
-	go s.acceptLoop()
+	if s.IsReplica() && s.config.ReplicaName != "" {
+		s.followDone = make(chan struct{})
+		go s.follow()
+	}
+	if s.config.Raft != nil {
+		s.config.Raft.Start(raft.Hooks{Applied: s.raftApplied, Repaired: s.raftRepaired})
+	}
+	return nil
+}
+
+// listen starts accepting connections on addr
+func (s *Server) listen(addr string, admin bool) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	s.serve(listener, admin)
 	return nil
 }
 
+// serve accepts connections on an open listener
+func (s *Server) serve(listener net.Listener, admin bool) {
+	s.listeners = append(s.listeners, listener)
+
+	if admin {
+		slog.Info("Admin listening", "addr", listener.Addr().String())
+	} else {
+		slog.Info("Server listening", "addr", listener.Addr().String())
+	}
+	go s.acceptLoop(listener, admin)
+}
+
 // acceptLoop accepts incoming connections
-func (s *Server) acceptLoop() {
+func (s *Server) acceptLoop(listener net.Listener, admin bool) {
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-s.stopCh:
 				return
 			default:
-				log.Printf("Accept error: %v", err)
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Error("Accept failed", "err", err)
 				continue
 			}
 		}
 
+		if !s.conns.admit(s.config.MaxConnections, admin) {
+			s.reject(conn)
+			continue
+		}
+
 		s.wg.Add(1)
-		go s.handleConnection(conn)
+		go s.handleConnection(conn, admin)
+	}
+}
+
+// closeListeners stops accepting connections
+func (s *Server) closeListeners() {
+	for _, listener := range s.listeners {
+		listener.Close()
 	}
 }
 
 // handleConnection processes a client connection
-func (s *Server) handleConnection(conn net.Conn) {
+func (s *Server) handleConnection(conn net.Conn, admin bool) {
 	defer s.wg.Done()
+	defer s.conns.release()
 	defer conn.Close()
 
-	log.Printf("New connection from %s", conn.RemoteAddr())
+	slog.Debug("New connection", "remote", conn.RemoteAddr().String(), "admin", admin)
+
+	sess := &session{
+		client:   conn.RemoteAddr().String(),
+		proto:    MinProtocolVersion,
+		ack:      s.config.WriteAck,
+		keyspace: s.data,
+	}
+
+	// A transaction left open is rolled back
+	defer func() {
+		if sess.txn != nil {
+			sess.txn.txn.Rollback()
+		}
+	}()
 
 	// Use larger buffers for better throughput
-	reader := bufio.NewReaderSize(conn, 64*1024) // 64KB read buffer
-	writer := bufio.NewWriterSize(conn, 64*1024) // 64KB write buffer
+	reader := bufio.NewReaderSize(conn, 64*1024)               // 64KB read buffer
+	writer := bufio.NewWriterSize(s.connWriter(conn), 64*1024) // 64KB write buffer
 
 	for {
+		// Pipelined commands are answered together: responses are flushed
+		// once no other complete command is waiting
+		if !commandBuffered(reader) {
+			if err := writer.Flush(); err != nil {
+				slog.Warn("Write failed", "remote", conn.RemoteAddr().String(), "err", err)
+				return
+			}
+		}
+
+		if err := s.awaitRequest(conn, reader, nil); err != nil {
+			readError(conn, err)
+			return
+		}
+
 		// Read until \r separator
-		line, err := reader.ReadString('\r')
+		line, err := readLine(reader, s.maxCommandSize())
+		if errors.Is(err, errCommandTooLarge) {
+			s.writeResponse(writer, fmt.Sprintf("error: %v", err))
+			continue
+		}
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("Read error: %v", err)
-			}
+			readError(conn, err)
 			return
 		}
 
@@ -96,16 +383,381 @@ func (s *Server) handleConnection(conn net.Conn) {
 			continue
 		}
 
-		response := s.executeCommand(cmd)
-		s.writeResponse(writer, response)
+		if err := s.checkPlane(cmd, admin); err != nil {
+			s.writeResponse(writer, fmt.Sprintf("error: %v", err))
+			continue
+		}
+
+		if err := s.Authorize(sess.role, cmd); err != nil {
+			s.writeResponse(writer, fmt.Sprintf("error: %v", err))
+			continue
+		}
+
+		if response, ok := s.txnCommand(sess, cmd); ok {
+			s.writeResponse(writer, response)
+			continue
+		}
+
+		if response, ok := s.sessionCommand(sess, conn, cmd); ok {
+			s.writeResponse(writer, response)
+			// hello is answered before the framing changes, even if frames
+			// were pipelined behind it
+			switch sess.proto {
+			case ProtocolMultiplexed:
+				writer.Flush()
+				s.serveMultiplexed(sess, conn, admin, reader, writer)
+				return
+			case ProtocolBinary:
+				writer.Flush()
+				s.serveBinary(sess, conn, admin, reader, writer)
+				return
+			}
+			continue
+		}
+
+		if cmd.Type == CmdWatch {
+			if !s.serveWatch(conn, sess.keyspace.store, reader, writer, cmd.Prefix) {
+				return
+			}
+			continue
+		}
+
+		s.writeResponse(writer, s.runCommand(sess, cmd, line))
 	}
 }
 
+// runCommand executes an engine command for a session: it routes commands
+// for keys another node owns there, otherwise mirrors it, and after a
+// successful write updates indexes, records it in the audit log and waits
+// for replicas. Only the default bucket is mirrored, indexed and replicated.
+// Raft members run writes through the group instead (see raftWrite).
+func (s *Server) runCommand(sess *session, cmd *Command, line string) string {
+	if sess.versions && cmd.IsWrite() {
+		cmd.WithVersion = true
+	}
+
+	if response, routed := s.route(sess, cmd, line); routed {
+		return response
+	}
+
+	ks := sess.keyspace
+	mirror := s.config.Mirror != nil && ks == s.data && shouldMirror(cmd, s.config.MirrorReads)
+	if mirror && line != "" && !cmd.CheckVersion {
+		s.config.Mirror.Send(line)
+	}
+
+	start := time.Now()
+	var response string
+	if s.config.Raft != nil && ks == s.data && cmd.IsWrite() {
+		response = s.raftWrite(start, func(stage *engine.Stage) (string, bool) {
+			response := s.executeCommand(newKeyspace(engine.DefaultBucket, stage), cmd)
+			return response, isSuccess(cmd, response)
+		})
+	} else {
+		response = s.executeCommand(ks, cmd)
+	}
+	if cmd.IsWrite() && isSuccess(cmd, response) {
+		// The mirror's versions differ from ours, so conditional writes are
+		// mirrored once applied, without their condition
+		if mirror && cmd.CheckVersion {
+			write := *cmd
+			write.CheckVersion = false
+			if line := write.Line(); line != "" {
+				s.config.Mirror.Send(line)
+			}
+		}
+		response = s.afterWrite(sess, ks, cmd, start, response)
+	}
+	return response
+}
+
+// afterWrite updates indexes, records the audit log and waits for replicas
+// once a write succeeded, returning its final response. A Raft member's
+// write already committed, and is indexed as it is applied.
+func (s *Server) afterWrite(sess *session, ks *keyspace, cmd *Command, start time.Time, response string) string {
+	replicated := ks == s.data && s.config.Raft == nil
+	for _, write := range cmd.Writes() {
+		if replicated {
+			if err := s.indexes.Update(write.Key); err != nil {
+				slog.Error("Index update failed", "key", write.Key, "err", err)
+			}
+		}
+		if s.config.Audit != nil {
+			if err := s.config.Audit.Record(sess.client, auditOp(write), ks.auditKey(write.Key)); err != nil {
+				slog.Error("Audit log write failed", "err", err)
+			}
+		}
+	}
+	if replicated {
+		response = s.awaitReplicas(sess, start, response)
+	}
+	return response
+}
+
+// Exec runs a command on behalf of another frontend, such as the gRPC API,
+// as a connection named client that authenticated as role would at the
+// default ack level: writes are mirrored when they can be sent as text,
+// update indexes, are audited and wait for replicas. It returns the
+// command's text response.
+func (s *Server) Exec(client, role string, cmd *Command) string {
+	if err := s.Authorize(role, cmd); err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	sess := &session{
+		client:   client,
+		proto:    MinProtocolVersion,
+		ack:      s.config.WriteAck,
+		role:     role,
+		keyspace: s.data,
+	}
+	return s.runCommand(sess, cmd, cmd.Line())
+}
+
+// isSuccess reports whether a write succeeded: "success", or
+// "success <version>" for a versioned write. Counter updates answer with the
+// new value instead, so anything but an error is a success for them.
+func isSuccess(cmd *Command, response string) bool {
+	switch cmd.Type {
+	case CmdIncr, CmdDecr, CmdAppend, CmdSetRange:
+		return !strings.HasPrefix(response, "error")
+	}
+	return response == "success" || strings.HasPrefix(response, "success ")
+}
+
+// writeResult formats the response of a write that assigned a version
+func writeResult(cmd *Command, version int64) string {
+	if cmd.WithVersion {
+		return fmt.Sprintf("success %d", version)
+	}
+	return "success"
+}
+
+// awaitReplicas holds a successful write until the session's ack level is
+// met. The write stays applied on the leader when replicas time out.
+func (s *Server) awaitReplicas(sess *session, start time.Time, response string) string {
+	if len(s.config.Replicas) == 0 {
+		return response
+	}
+	_, err := s.acks.wait(s.engine.LastSeq(), sess.ack, s.config.WriteAckTimeout)
+	s.acks.record(sess.ack, time.Since(start), err != nil)
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	return response
+}
+
+// hasAdmin reports whether an admin listener is configured
+func (s *Server) hasAdmin() bool {
+	return s.config.AdminAddr != "" || s.config.AdminListener != nil
+}
+
+// checkPlane rejects commands that aren't served on the listener a
+// connection arrived on. Without an admin listener, data listeners serve
+// every command.
+func (s *Server) checkPlane(cmd *Command, admin bool) error {
+	if admin {
+		if !cmd.IsAdmin() && !cmd.IsConnection() {
+			return fmt.Errorf("%s is not served on the admin port", cmd.Type)
+		}
+		return nil
+	}
+	if s.hasAdmin() && cmd.IsAdmin() {
+		return fmt.Errorf("%s is only served on the admin port", cmd.Type)
+	}
+	return nil
+}
+
+// sessionCommand executes commands that act on the connection rather than
+// the engine. It reports false for any other command.
+func (s *Server) sessionCommand(sess *session, conn net.Conn, cmd *Command) (string, bool) {
+	switch cmd.Type {
+	case CmdClient:
+		sess.client = cmd.Key + "@" + conn.RemoteAddr().String()
+		return "success", true
+
+	case CmdAuth:
+		user, secret := "", cmd.Args[0]
+		if len(cmd.Args) == 2 {
+			user, secret = cmd.Args[0], cmd.Args[1]
+		}
+		role, ok := s.Authenticate(user, secret)
+		if !ok {
+			slog.Warn("Failed authentication", "remote", conn.RemoteAddr().String())
+			return "error: invalid credentials", true
+		}
+		sess.role = role
+		return "success", true
+
+	case CmdAckLevel:
+		if len(cmd.Args) == 0 {
+			return sess.ack, true
+		}
+		sess.ack = cmd.Args[0]
+		return "success", true
+
+	case CmdVersions:
+		if len(cmd.Args) == 0 {
+			if sess.versions {
+				return "on", true
+			}
+			return "off", true
+		}
+		sess.versions = cmd.Args[0] == "on"
+		return "success", true
+
+	case CmdUse:
+		if cmd.Key == "" {
+			return sess.keyspace.name, true
+		}
+		ks, err := s.bucket(cmd.Key)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err), true
+		}
+		sess.keyspace = ks
+		return "success", true
+
+	case CmdCluster:
+		if cmd.Args[0] != "local" {
+			return "", false
+		}
+		sess.local = true
+		return "success", true
+
+	case CmdHello:
+		if len(cmd.Args) == 1 {
+			version, _ := strconv.Atoi(cmd.Args[0])
+			if version < MinProtocolVersion || version > MaxProtocolVersion {
+				return fmt.Sprintf("error: unsupported protocol version %d (supported %d-%d)",
+					version, MinProtocolVersion, MaxProtocolVersion), true
+			}
+			// Framing can't be switched once selected
+			if sess.proto >= ProtocolMultiplexed && version != sess.proto {
+				return "error: connection is framed", true
+			}
+			sess.proto = version
+		}
+		// Text commands are answered in order, so clients can pipeline; level
+		// 2 frames them with request IDs, and level 3 frames length-prefixed
+		// keys and values
+		return fmt.Sprintf("escabelo version=%s proto=%d min_proto=%d max_proto=%d pipelining=true binary=true auth=%t",
+			ServerVersion, sess.proto, MinProtocolVersion, MaxProtocolVersion, s.AuthRequired()), true
+	}
+	return "", false
+}
+
+// commandContext returns the context bounding a command's execution time
+func (s *Server) commandContext() (context.Context, context.CancelFunc) {
+	if s.config.CommandTimeout <= 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), s.config.CommandTimeout)
+}
+
+// scanError formats the error of a cancellable command
+func (s *Server) scanError(cmd *Command, err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("Command timed out", "command", cmd.Type, "timeout", s.config.CommandTimeout)
+		return "error: timeout"
+	}
+	return fmt.Sprintf("error: %v", err)
+}
+
+// rejectWrite returns the response to a write the server doesn't accept
+// now, or "": replicas only accept commands that don't mutate state, and a
+// read-only server none
+func (s *Server) rejectWrite() string {
+	if s.IsReplica() {
+		return s.redirect()
+	}
+	if s.readOnly.Load() {
+		return "error: read-only: writes are disabled"
+	}
+	return ""
+}
+
 // executeCommand executes a parsed command
-func (s *Server) executeCommand(cmd *Command) string {
+func (s *Server) executeCommand(ks *keyspace, cmd *Command) string {
+	if cmd.IsWrite() {
+		if response := s.rejectWrite(); response != "" {
+			return response
+		}
+	}
+
+	ctx, cancel := s.commandContext()
+	defer cancel()
+
 	switch cmd.Type {
 	case CmdRead:
-		value, found, err := s.engine.Get(cmd.Key)
+		var value []byte
+		var found bool
+		var err error
+		var version int64
+		switch {
+		case cmd.AsOf != 0:
+			value, found, err = ks.store.GetAsOf(cmd.Key, cmd.AsOf)
+		case cmd.WithVersion:
+			value, version, found, err = ks.store.GetVersion(cmd.Key)
+		default:
+			value, found, err = ks.store.Get(cmd.Key)
+		}
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		if !found {
+			return "error"
+		}
+		if engine.IsHash(value) {
+			return "error: key holds a hash, use hget or hgetall"
+		}
+		if cmd.WithVersion {
+			return strconv.FormatInt(version, 10) + "|" + string(value)
+		}
+		return string(value)
+
+	case CmdHSet:
+		version, err := ks.hashes.Set(cmd.Key, cmd.Args[0], cmd.Value)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return writeResult(cmd, version)
+
+	case CmdHGet:
+		value, found, err := ks.hashes.Get(cmd.Key, cmd.Args[0])
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		if !found {
+			return "error"
+		}
+		return string(value)
+
+	case CmdHDel:
+		deleted, err := ks.hashes.Delete(cmd.Key, cmd.Args[0])
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		if !deleted {
+			return "error"
+		}
+		return "success"
+
+	case CmdHGetAll:
+		fields, found, err := ks.hashes.GetAll(cmd.Key)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		if !found {
+			return "error"
+		}
+		// One "field|value" line per field, in field order
+		lines := make([]string, len(fields))
+		for i, f := range fields {
+			lines[i] = escapeKey(f.Field) + "|" + escapeValue(f.Value)
+		}
+		return strings.Join(lines, "\n")
+
+	case CmdJGet:
+		value, found, err := ks.documents.Get(cmd.Key, cmd.Args[0])
 		if err != nil {
 			return fmt.Sprintf("error: %v", err)
 		}
@@ -114,14 +766,237 @@ func (s *Server) executeCommand(cmd *Command) string {
 		}
 		return string(value)
 
+	case CmdJSet:
+		version, err := ks.documents.Set(cmd.Key, cmd.Args[0], cmd.Value)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return writeResult(cmd, version)
+
+	case CmdQueryRange:
+		if ks != s.data {
+			return "error: indexes only cover the default bucket"
+		}
+		indexType, ok := s.indexes.Type(cmd.Key)
+		if !ok {
+			return fmt.Sprintf("error: unknown index: %s", cmd.Key)
+		}
+		entries, err := s.indexes.Range(cmd.Key, cmd.Args[0], cmd.Args[1], cmd.Limit)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		// One key per line in index order, "key|score" with WITHSCORES
+		lines := make([]string, len(entries))
+		for i, entry := range entries {
+			switch {
+			case !cmd.WithScores:
+				lines[i] = escapeKey(entry.Key)
+			case indexType == engine.IndexNumeric:
+				lines[i] = escapeKey(entry.Key) + "|" + strconv.FormatFloat(entry.Score, 'f', -1, 64)
+			default:
+				lines[i] = escapeKey(entry.Key) + "|" + entry.Term
+			}
+		}
+		return strings.Join(lines, "\n")
+
+	case CmdFind:
+		if ks != s.data {
+			return "error: indexes only cover the default bucket"
+		}
+		entries, err := s.indexes.Find(cmd.Key, cmd.Args[0], 0)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		keys := make([]string, len(entries))
+		for i, entry := range entries {
+			keys[i] = escapeKey(entry.Key)
+		}
+		return strings.Join(keys, "\n")
+
+	case CmdIndex:
+		if ks != s.data {
+			return "error: indexes only cover the default bucket"
+		}
+		return s.indexCommand(cmd)
+
+	case CmdStrlen:
+		size, found, err := ks.store.ValueSize(cmd.Key)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		if !found {
+			return "error"
+		}
+		return strconv.FormatInt(size, 10)
+
+	case CmdGetRange:
+		offset, _ := strconv.ParseInt(cmd.Args[0], 10, 64)
+		length, _ := strconv.ParseInt(cmd.Args[1], 10, 64)
+		value, found, err := ks.store.GetRange(cmd.Key, offset, length)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		if !found {
+			return "error"
+		}
+		return string(value)
+
+	case CmdMeta:
+		meta, found, err := ks.store.Meta(cmd.Key)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		if !found {
+			return "error"
+		}
+		ttl := int64(-1)
+		if meta.TTL >= 0 {
+			ttl = int64(meta.TTL / time.Millisecond)
+		}
+		return fmt.Sprintf("timestamp=%d size=%d versions=%d ttl_ms=%d layer=%s",
+			meta.Timestamp, meta.Size, meta.Versions, ttl, meta.Layer)
+
+	case CmdTail:
+		var from uint64
+		if len(cmd.Args) == 1 {
+			from, _ = strconv.ParseUint(cmd.Args[0], 10, 64)
+		}
+		entries, err := s.engine.TailWAL(cmd.Key, from, cmd.Limit)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		lines := make([]string, len(entries))
+		for i, entry := range entries {
+			lines[i] = changeLine(entry)
+		}
+		return strings.Join(lines, "\n")
+
+	case CmdWatch:
+		return "error: watch is only served on text connections"
+
+	case CmdBegin, CmdCommit, CmdRollback:
+		return "error: transactions are only served on text connections"
+
+	case CmdWAL:
+		from, _ := strconv.ParseUint(cmd.Args[0], 10, 64)
+		entries, err := s.engine.ReadWAL(from, cmd.Limit)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		lines := make([]string, len(entries))
+		for i, entry := range entries {
+			lines[i] = changeLine(entry)
+		}
+		return strings.Join(lines, "\n")
+
+	case CmdAck:
+		seq, _ := strconv.ParseUint(cmd.Args[0], 10, 64)
+		if err := s.engine.AckWAL(cmd.Key, seq); err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		s.acks.advance(cmd.Key, seq)
+		return "success"
+
+	case CmdAudit:
+		if s.config.Audit == nil {
+			return "error: audit log disabled"
+		}
+		records, err := s.config.Audit.Query(escapeKey(cmd.Key), cmd.Limit)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		lines := make([]string, len(records))
+		for i, record := range records {
+			lines[i] = record.String()
+		}
+		return strings.Join(lines, "\n")
+
+	case CmdMRead:
+		values, err := ks.store.MultiGet(cmd.Args)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+
+		// One "key|value" line per key found, in request order
+		var lines []string
+		for _, key := range cmd.Args {
+			if value, ok := values[key]; ok {
+				lines = append(lines, escapeKey(key)+"|"+escapeValue(value))
+			}
+		}
+		return strings.Join(lines, "\n")
+
+	case CmdHistory:
+		limit := 0
+		if len(cmd.Args) == 1 {
+			limit, _ = strconv.Atoi(cmd.Args[0])
+		}
+		versions, err := ks.store.History(cmd.Key, limit)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		if len(versions) == 0 {
+			return "error"
+		}
+		lines := make([]string, len(versions))
+		for i, version := range versions {
+			if version.Deleted {
+				lines[i] = fmt.Sprintf("%d delete", version.Timestamp)
+			} else {
+				lines[i] = fmt.Sprintf("%d put %s", version.Timestamp, escapeValue(version.Value))
+			}
+		}
+		return strings.Join(lines, "\n")
+
 	case CmdWrite:
-		if err := s.engine.Put(cmd.Key, cmd.Value); err != nil {
+		var version int64
+		var err error
+		if cmd.CheckVersion {
+			version, err = ks.store.PutIfVersion(cmd.Key, cmd.Value, cmd.IfVersion)
+		} else {
+			version, err = ks.store.PutVersion(cmd.Key, cmd.Value)
+		}
+		if err != nil {
 			return fmt.Sprintf("error: %v", err)
 		}
+		if cmd.Sync {
+			if err := ks.store.Sync(); err != nil {
+				return fmt.Sprintf("error: %v", err)
+			}
+		}
+		return writeResult(cmd, version)
+
+	case CmdBatch:
+		ops := make([]engine.BatchOp, len(cmd.Batch))
+		sync := false
+		for i, op := range cmd.Batch {
+			ops[i] = engine.BatchOp{Key: op.Key, Value: op.Value, Delete: op.Type == CmdDelete}
+			sync = sync || op.Sync
+		}
+		if err := ks.store.WriteBatch(ops); err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		if sync {
+			if err := ks.store.Sync(); err != nil {
+				return fmt.Sprintf("error: %v", err)
+			}
+		}
 		return "success"
 
 	case CmdDelete:
-		deleted, err := s.engine.Delete(cmd.Key)
+		if cmd.CheckVersion {
+			if err := ks.store.DeleteIfVersion(cmd.Key, cmd.IfVersion); err != nil {
+				return fmt.Sprintf("error: %v", err)
+			}
+			return "success"
+		}
+		if !cmd.Exists {
+			if err := ks.store.DeleteBlind(cmd.Key); err != nil {
+				return fmt.Sprintf("error: %v", err)
+			}
+			return "success"
+		}
+		deleted, err := ks.store.Delete(cmd.Key)
 		if err != nil {
 			return fmt.Sprintf("error: %v", err)
 		}
@@ -130,53 +1005,325 @@ func (s *Server) executeCommand(cmd *Command) string {
 		}
 		return "success"
 
+	case CmdUndelete:
+		restored, err := ks.store.Undelete(cmd.Key)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		if !restored {
+			return "error"
+		}
+		return "success"
+
+	case CmdExpire:
+		expiring, err := ks.store.Expire(cmd.Key, cmd.TTL)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		if !expiring {
+			return "error"
+		}
+		return "success"
+
+	case CmdIncr, CmdDecr:
+		value, version, err := ks.counters.Incr(cmd.Key, cmd.Delta)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		if cmd.WithVersion {
+			return strconv.FormatInt(version, 10) + "|" + strconv.FormatInt(value, 10)
+		}
+		return strconv.FormatInt(value, 10)
+
+	case CmdAppend, CmdSetRange:
+		var length, version int64
+		var err error
+		if cmd.Type == CmdAppend {
+			length, version, err = ks.strings.Append(cmd.Key, cmd.Value)
+		} else {
+			offset, _ := strconv.ParseInt(cmd.Args[0], 10, 64)
+			length, version, err = ks.strings.SetRange(cmd.Key, offset, cmd.Value)
+		}
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		if cmd.WithVersion {
+			return strconv.FormatInt(version, 10) + "|" + strconv.FormatInt(length, 10)
+		}
+		return strconv.FormatInt(length, 10)
+
 	case CmdStatus:
 		stats := s.engine.GetStats()
-		return fmt.Sprintf("well going our operation\nwrites=%d reads=%d deletes=%d flushes=%d memtable_size=%d sst_count=%d wal_size=%d",
-			stats.Writes, stats.Reads, stats.Deletes, stats.Flushes, stats.MemTableSize, stats.SSTCount, stats.WALSize)
+		lines := []string{
+			"well going our operation",
+			fmt.Sprintf("writes=%d reads=%d deletes=%d flushes=%d memtable_size=%d memtable_limit=%d sst_count=%d wal_size=%d disk_free=%d disk_full=%t disk_usage=%d disk_budget=%d write_delays=%d write_stalls=%d hint_bytes=%d compaction_paused=%t flush_paused=%t durability=%s block_cache_hits=%d block_cache_misses=%d block_cache_evictions=%d block_cache_size=%d open_files=%d file_opens=%d bytes_flushed=%d bytes_compacted=%d io_throttled=%t io_throttle_wait_ms=%d background_jobs=%d",
+				stats.Writes, stats.Reads, stats.Deletes, stats.Flushes, stats.MemTableSize, stats.MemTableLimit, stats.SSTCount, stats.WALSize,
+				stats.DiskFree, stats.DiskFull, stats.DiskUsage, stats.DiskBudget, stats.WriteDelays, stats.WriteStalls, stats.HintBytes,
+				stats.CompactionPaused, stats.FlushPaused, stats.Durability, stats.BlockCacheHits, stats.BlockCacheMisses,
+				stats.BlockCacheEvictions, stats.BlockCacheSize, stats.OpenFiles, stats.FileOpens,
+				stats.BytesFlushed, stats.BytesCompacted, stats.IOThrottled, stats.IOThrottleWait.Milliseconds(), stats.BackgroundJobs),
+		}
 
-	case CmdKeys:
-		keys, err := s.engine.Keys()
+		cs := s.conns.stats()
+		lines = append(lines, fmt.Sprintf("connections active=%d rejected=%d max=%d",
+			cs.Active, cs.Rejected, s.config.MaxConnections))
+
+		if s.config.Mirror != nil {
+			ms := s.config.Mirror.Stats()
+			lines = append(lines, fmt.Sprintf("mirror addr=%s sent=%d dropped=%d failed=%d",
+				s.config.Mirror.Addr(), ms.Sent, ms.Dropped, ms.Failed))
+		}
+
+		if len(s.config.Replicas) > 0 {
+			for _, as := range s.acks.Stats() {
+				var avg time.Duration
+				if as.Writes > 0 {
+					avg = as.Total / time.Duration(as.Writes)
+				}
+				lines = append(lines, fmt.Sprintf("ack level=%s writes=%d timeouts=%d avg_us=%d max_us=%d",
+					as.Level, as.Writes, as.Timeouts, avg.Microseconds(), as.Max.Microseconds()))
+			}
+		}
+
+		for _, idx := range s.indexes.Stats() {
+			lines = append(lines, fmt.Sprintf("index name=%s prefix=%s path=%s type=%s entries=%d",
+				idx.Name, idx.Prefix, idx.Path, idx.Type, idx.Entries))
+		}
+
+		// One line per SST file, newest first
+		for _, sst := range s.engine.GetSSTableStats() {
+			lines = append(lines, fmt.Sprintf("sstable id=%d size=%d entries=%d min_key=%s max_key=%s age_s=%d reads=%d hits=%d",
+				sst.ID, sst.Size, sst.EntryCount, escapeKey(sst.MinKey), escapeKey(sst.MaxKey), int64(sst.Age.Seconds()), sst.Reads, sst.Hits))
+		}
+		return strings.Join(lines, "\n")
+
+	case CmdPing:
+		if len(cmd.Value) == 0 {
+			return "pong"
+		}
+		return "pong " + string(cmd.Value)
+
+	case CmdEcho:
+		return string(cmd.Value)
+
+	case CmdRole:
+		if s.IsReplica() {
+			return fmt.Sprintf("replica %s", s.leaderAddr())
+		}
+		return "leader"
+
+	case CmdReplStatus:
+		return s.replicationStatus()
+
+	case CmdRaft:
+		return s.raftCommand(cmd)
+
+	case CmdCluster:
+		return s.clusterCommand(cmd)
+
+	case CmdGossip:
+		if s.config.Membership == nil {
+			return "error: cluster mode disabled"
+		}
+		if err := s.config.Membership.Merge(string(cmd.Value)); err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return s.config.Membership.Digest()
+
+	case CmdMerkle:
+		depth, _ := strconv.Atoi(cmd.Args[0])
+		if len(cmd.Args) == 1 {
+			tree, err := s.engine.MerkleTree(depth)
+			if err != nil {
+				return fmt.Sprintf("error: %v", err)
+			}
+			return cluster.EncodeMerkleTree(tree)
+		}
+		bucket, _ := strconv.Atoi(cmd.Args[1])
+		entries, err := s.engine.BucketEntries(depth, bucket)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return cluster.EncodeEntries(entries)
+
+	case CmdRepair:
+		// Raft members only change through the log, so they don't take
+		// another node's newer entries
+		if s.config.Raft != nil {
+			return "error: repair isn't supported in raft mode"
+		}
+		depth := cluster.DefaultMerkleDepth
+		if len(cmd.Args) == 2 {
+			depth, _ = strconv.Atoi(cmd.Args[1])
+		}
+		result, err := cluster.Repair(s.engine, cmd.Args[0], s.config.PeerToken, depth, 30*time.Second)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		// Repaired entries bypass Update, so indexes are rebuilt
+		if result.EntriesApplied > 0 {
+			if err := s.indexes.Rebuild(); err != nil {
+				slog.Error("Index rebuild after repair failed", "err", err)
+			}
+		}
+		return fmt.Sprintf("repaired divergent_buckets=%d received=%d applied=%d",
+			result.DivergentBuckets, result.EntriesReceived, result.EntriesApplied)
+
+	case CmdPause:
+		target := cmd.Args[0]
+		if target != "flush" {
+			s.engine.PauseCompaction()
+		}
+		if target != "compaction" {
+			s.engine.PauseFlush()
+		}
+		return "success"
+
+	case CmdResume:
+		target := cmd.Args[0]
+		if target != "flush" {
+			s.engine.ResumeCompaction()
+		}
+		if target != "compaction" {
+			s.engine.ResumeFlush()
+		}
+		return "success"
+
+	case CmdBuckets:
+		names, err := s.engine.Buckets()
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return strings.Join(names, "\n")
+
+	case CmdReadOnly:
+		if len(cmd.Args) == 0 {
+			if s.readOnly.Load() {
+				return "on"
+			}
+			return "off"
+		}
+		on := cmd.Args[0] == "on"
+		if s.readOnly.Swap(on) != on {
+			slog.Info("Read-only mode changed", "read_only", on)
+		}
+		return "success"
+
+	case CmdCompact:
+		merged, err := s.engine.CompactNow(len(cmd.Args) > 0)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return fmt.Sprintf("compacted files=%d", merged)
+
+	case CmdBackup:
+		info, err := s.engine.Backup(cmd.Args[0])
 		if err != nil {
 			return fmt.Sprintf("error: %v", err)
 		}
+		return fmt.Sprintf("backup seq=%d ssts=%d wal_segments=%d bytes=%d",
+			info.Seq, info.SSTs, info.WALSegments, info.Bytes)
+
+	case CmdKeys:
+		opts := engine.ScanOptions{Limit: cmd.Limit, After: cmd.After}
+		keys, err := ks.store.KeysMatching(ctx, cmd.Prefix, opts)
+		if err != nil {
+			return s.scanError(cmd, err)
+		}
 		if len(keys) == 0 {
 			return ""
 		}
+		for i, key := range keys {
+			keys[i] = escapeKey(key)
+		}
 		return strings.Join(keys, "\r")
 
 	case CmdReads:
-		values, err := s.engine.PrefixScan(cmd.Prefix)
+		opts := engine.ScanOptions{Limit: cmd.Limit, After: cmd.After}
+		pairs, err := ks.store.PrefixScanWithOptions(ctx, cmd.Prefix, opts)
 		if err != nil {
-			return fmt.Sprintf("error: %v", err)
+			return s.scanError(cmd, err)
 		}
-		if len(values) == 0 {
+		if len(pairs) == 0 {
 			return ""
 		}
-		strValues := make([]string, len(values))
-		for i, v := range values {
-			strValues[i] = string(v)
+		strValues := make([]string, len(pairs))
+		for i, kv := range pairs {
+			if cmd.WithKeys {
+				strValues[i] = escapeKey(kv.Key) + "|" + escapeValue(kv.Value)
+			} else {
+				strValues[i] = escapeValue(kv.Value)
+			}
 		}
 		return strings.Join(strValues, "\r")
 
+	case CmdScan:
+		pairs, err := ks.store.RangeScan(ctx, cmd.Args[0], cmd.Args[1], cmd.Limit)
+		if err != nil {
+			return s.scanError(cmd, err)
+		}
+		if len(pairs) == 0 {
+			return ""
+		}
+		strValues := make([]string, len(pairs))
+		for i, kv := range pairs {
+			strValues[i] = escapeKey(kv.Key) + "|" + escapeValue(kv.Value)
+		}
+		return strings.Join(strValues, "\r")
+
+	case CmdCount:
+		var count int64
+		var err error
+		switch {
+		case cmd.Prefix == "" && len(cmd.Args) == 0:
+			count = ks.store.EstimateKeys("").Keys
+		case len(cmd.Args) == 2:
+			count, err = ks.store.CountRange(ctx, cmd.Args[0], cmd.Args[1])
+		default:
+			count, err = ks.store.CountPrefix(ctx, cmd.Prefix)
+		}
+		if err != nil {
+			return s.scanError(cmd, err)
+		}
+		return strconv.FormatInt(count, 10)
+
+	case CmdDBSize:
+		estimate := ks.store.EstimateKeys(cmd.Prefix)
+		return fmt.Sprintf("keys=%d bytes=%d", estimate.Keys, estimate.Bytes)
+
 	default:
 		return "error: unknown command"
 	}
 }
 
-// writeResponse writes a response to the client
+// writeResponse buffers a response to the client, flushed by the
+// connection loop
 func (s *Server) writeResponse(writer *bufio.Writer, response string) {
 	writer.WriteString(response)
 	writer.WriteString("\r")
-	writer.Flush()
+}
+
+// commandBuffered reports whether reader holds a whole command that can run
+// without waiting on the client
+func commandBuffered(reader *bufio.Reader) bool {
+	buffered, _ := reader.Peek(reader.Buffered())
+	return bytes.IndexByte(buffered, '\r') >= 0
 }
 
 // Stop gracefully shuts down the server
 func (s *Server) Stop() error {
 	close(s.stopCh)
-
-	if s.listener != nil {
-		s.listener.Close()
+	s.closeListeners()
+	if s.followDone != nil {
+		<-s.followDone
+	}
+	if s.config.Raft != nil {
+		if err := s.config.Raft.Stop(); err != nil {
+			slog.Error("Raft shutdown failed", "err", err)
+		}
+	}
+	if s.shards != nil {
+		s.shards.close()
 	}
 
 	s.wg.Wait()
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"escabelo/internal/engine"
+	"escabelo/pkg/client"
+)
+
+// startServer serves store on a free local port until the test ends,
+// returning its address
+func startServer(t *testing.T, config Config, store engine.Store) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Listeners = append(config.Listeners, listener)
+
+	s := NewServer(config, store)
+	if err := s.Start(); err != nil {
+		listener.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop() })
+	return listener.Addr().String()
+}
+
+// dial connects a client to addr, closed when the test ends
+func dial(t *testing.T, addr string) *client.Client {
+	t.Helper()
+	conn, err := client.Dial(addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"errors"
+	"escabelo/internal/cluster"
+	"escabelo/pkg/client"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sharding modes: how a node answers a command for keys another node owns
+const (
+	ShardOff      = "off"
+	ShardRedirect = "redirect"
+	ShardProxy    = "proxy"
+)
+
+// ShardModes lists the valid sharding modes
+var ShardModes = []string{ShardOff, ShardRedirect, ShardProxy}
+
+const (
+	// ringRefresh is how long a ring built from the membership is reused
+	ringRefresh = 100 * time.Millisecond
+
+	// proxyIdle is how long a proxy connection to a peer stays open unused.
+	// Peers can't shut down while it's open.
+	proxyIdle = 5 * time.Second
+
+	proxyTimeout = 5 * time.Second
+)
+
+// shardRouter partitions the keyspace across the live members of the
+// cluster by consistent hashing, and forwards commands to the nodes that
+// own their keys
+type shardRouter struct {
+	membership   *cluster.Membership
+	mode         string
+	virtualNodes int
+	token        string
+
+	mu        sync.Mutex
+	ring      *client.Ring
+	members   []string
+	refreshed time.Time
+	peers     map[string]*proxyConn
+	stopCh    chan struct{}
+}
+
+// proxyConn is a connection commands are forwarded over
+type proxyConn struct {
+	client   *client.Client
+	lastUsed time.Time
+}
+
+func newShardRouter(membership *cluster.Membership, mode string, virtualNodes int, token string) *shardRouter {
+	if virtualNodes <= 0 {
+		virtualNodes = 160
+	}
+	r := &shardRouter{
+		membership:   membership,
+		mode:         mode,
+		virtualNodes: virtualNodes,
+		token:        token,
+		peers:        make(map[string]*proxyConn),
+		stopCh:       make(chan struct{}),
+	}
+	go r.closeIdle()
+	return r
+}
+
+// ringLocked returns the ring over the members that aren't dead, rebuilt
+// when it's older than ringRefresh. Caller holds r.mu.
+func (r *shardRouter) ringLocked() *client.Ring {
+	if r.ring != nil && time.Since(r.refreshed) < ringRefresh {
+		return r.ring
+	}
+	var members []string
+	for _, node := range r.membership.Nodes() {
+		if node.State != cluster.StateDead {
+			members = append(members, node.Addr)
+		}
+	}
+	if r.ring == nil || !slices.Equal(members, r.members) {
+		if r.ring != nil {
+			slog.Info("Shard ring changed", "members", strings.Join(members, ","))
+		}
+		r.ring = client.NewRing(members, r.virtualNodes)
+		r.members = members
+	}
+	r.refreshed = time.Now()
+	return r.ring
+}
+
+// owner returns the address of the node owning key
+func (r *shardRouter) owner(key string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ringLocked().Node(key)
+}
+
+// forward sends a command line to the node at addr and returns its response
+func (r *shardRouter) forward(addr, line string) string {
+	cl, err := r.peer(addr)
+	if err == nil {
+		var resp string
+		if resp, err = cl.Do(line); err == nil {
+			return resp
+		}
+	}
+	var serverErr *client.ServerError
+	if errors.As(err, &serverErr) {
+		return "error: " + serverErr.Message
+	}
+	r.drop(addr)
+	return fmt.Sprintf("error: proxy to %s failed: %v", addr, err)
+}
+
+// peer returns the connection to the node at addr, opening one that serves
+// keys locally whoever owns them, so forwarded commands never loop
+func (r *shardRouter) peer(addr string) (*client.Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if conn, ok := r.peers[addr]; ok {
+		conn.lastUsed = time.Now()
+		return conn.client, nil
+	}
+
+	cl, err := client.Dial(addr, proxyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if r.token != "" {
+		if err := cl.Auth(r.token); err != nil {
+			cl.Close()
+			return nil, err
+		}
+	}
+	if _, err := cl.Do("cluster local"); err != nil {
+		cl.Close()
+		return nil, err
+	}
+	r.peers[addr] = &proxyConn{client: cl, lastUsed: time.Now()}
+	return cl, nil
+}
+
+// drop closes the connection to addr after a failure
+func (r *shardRouter) drop(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if conn, ok := r.peers[addr]; ok {
+		conn.client.Close()
+		delete(r.peers, addr)
+	}
+}
+
+// closeIdle closes proxy connections unused for proxyIdle until the router
+// is closed
+func (r *shardRouter) closeIdle() {
+	ticker := time.NewTicker(proxyIdle / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		for addr, conn := range r.peers {
+			if time.Since(conn.lastUsed) >= proxyIdle {
+				conn.client.Close()
+				delete(r.peers, addr)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// close closes every proxy connection
+func (r *shardRouter) close() {
+	close(r.stopCh)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for addr, conn := range r.peers {
+		conn.client.Close()
+		delete(r.peers, addr)
+	}
+}
+
+// route sends a command for keys another node owns to that node: it's
+// answered with "error: moved <addr>", or in proxy mode with the owner's
+// response. It reports false for commands this node serves itself.
+func (s *Server) route(sess *session, cmd *Command, line string) (string, bool) {
+	if s.shards == nil || sess.local {
+		return "", false
+	}
+	keys := cmd.Keys()
+	if len(keys) == 0 {
+		return "", false
+	}
+
+	owner := s.shards.owner(keys[0])
+	for _, key := range keys[1:] {
+		if s.shards.owner(key) != owner {
+			return "error: keys belong to different nodes", true
+		}
+	}
+	if owner == "" || owner == s.config.Membership.Self() {
+		return "", false
+	}
+
+	// Commands without a text form can't be forwarded, nor can versioned
+	// writes, which the owner would answer without the version, nor commands
+	// for other buckets than the default one proxy connections use
+	if s.shards.mode == ShardProxy && line != "" && !cmd.WithVersion && sess.keyspace == s.data {
+		return s.shards.forward(owner, line), true
+	}
+	return fmt.Sprintf("error: moved %s", owner), true
+}
+
+// Moved returns the address of the node owning key if sharding places it on
+// another node, for frontends that read the store directly, or ""
+func (s *Server) Moved(key string) string {
+	if s.shards == nil {
+		return ""
+	}
+	if owner := s.shards.owner(key); owner != s.config.Membership.Self() {
+		return owner
+	}
+	return ""
+}
+
+// clusterCommand executes a cluster command: the gossiped membership, the
+// shard ring's topology, and the owner of a key
+func (s *Server) clusterCommand(cmd *Command) string {
+	membership := s.config.Membership
+	if membership == nil {
+		return "error: cluster mode disabled"
+	}
+
+	switch cmd.Args[0] {
+	case "nodes":
+		nodes := membership.Nodes()
+		lines := make([]string, len(nodes))
+		for i, node := range nodes {
+			lines[i] = fmt.Sprintf("%s %s heartbeat=%d last_seen_ms=%d",
+				node.Addr, node.State, node.Heartbeat, time.Since(node.LastSeen).Milliseconds())
+		}
+		return strings.Join(lines, "\n")
+
+	case "topology":
+		if s.shards == nil {
+			return "error: sharding disabled"
+		}
+		s.shards.mu.Lock()
+		shares := s.shards.ringLocked().Shares()
+		s.shards.mu.Unlock()
+
+		nodes := membership.Nodes()
+		lines := []string{fmt.Sprintf("sharding mode=%s self=%s virtual_nodes=%d",
+			s.shards.mode, membership.Self(), s.shards.virtualNodes)}
+		for _, node := range nodes {
+			if node.State == cluster.StateDead {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s %s share=%.4f", node.Addr, node.State, shares[node.Addr]))
+		}
+		return strings.Join(lines, "\n")
+
+	case "owner":
+		if s.shards == nil {
+			return "error: sharding disabled"
+		}
+		return s.shards.owner(cmd.Key)
+	}
+	return fmt.Sprintf("error: unknown cluster command: %s", cmd.Args[0])
+}
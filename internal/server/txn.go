@@ -0,0 +1,165 @@
+package server
+
+import (
+	"escabelo/internal/engine"
+	"fmt"
+	"time"
+)
+
+// txnState is the transaction a text connection opened with begin
+type txnState struct {
+	txn *engine.Txn
+	ks  *keyspace
+
+	// writes are the write and delete commands buffered so far, mirrored,
+	// audited and indexed as a batch on commit
+	writes []*Command
+}
+
+// txnCommand executes begin, commit and rollback, and the commands of a
+// connection with a transaction open: reads see the transaction's snapshot
+// and its own writes, writes and deletes are buffered until commit, and
+// other commands addressing keys are refused. It reports false for commands
+// that run as usual.
+func (s *Server) txnCommand(sess *session, cmd *Command) (string, bool) {
+	switch cmd.Type {
+	case CmdBegin:
+		if sess.txn != nil {
+			return "error: transaction already open", true
+		}
+		sess.txn = &txnState{txn: sess.keyspace.store.Begin(), ks: sess.keyspace}
+		return "success", true
+
+	case CmdCommit:
+		if sess.txn == nil {
+			return "error: no transaction open", true
+		}
+		return s.commitTxn(sess), true
+
+	case CmdRollback:
+		if sess.txn == nil {
+			return "error: no transaction open", true
+		}
+		sess.txn.txn.Rollback()
+		sess.txn = nil
+		return "success", true
+	}
+
+	t := sess.txn
+	if t == nil {
+		return "", false
+	}
+
+	switch cmd.Type {
+	case CmdRead:
+		if cmd.AsOf != 0 || cmd.WithVersion {
+			return "error: ASOF and WITHVERSION aren't supported in a transaction", true
+		}
+		if response := s.txnMoved(sess, cmd.Key); response != "" {
+			return response, true
+		}
+		value, found, err := t.txn.Get(cmd.Key)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err), true
+		}
+		if !found {
+			return "error", true
+		}
+		if engine.IsHash(value) {
+			return "error: key holds a hash, use hget or hgetall", true
+		}
+		return string(value), true
+
+	case CmdWrite, CmdDelete:
+		if cmd.CheckVersion {
+			return "error: IFVERSION isn't supported in a transaction", true
+		}
+		if response := s.rejectWrite(); response != "" {
+			return response, true
+		}
+		if response := s.txnMoved(sess, cmd.Key); response != "" {
+			return response, true
+		}
+		var err error
+		if cmd.Type == CmdWrite {
+			err = t.txn.Put(cmd.Key, cmd.Value)
+		} else {
+			err = t.txn.Delete(cmd.Key)
+		}
+		if err != nil {
+			return fmt.Sprintf("error: %v", err), true
+		}
+		// Deletes are buffered blind, whether or not the key exists
+		write := *cmd
+		write.Exists = false
+		t.writes = append(t.writes, &write)
+		return "queued", true
+
+	case CmdUse:
+		return "error: can't switch buckets in a transaction", true
+
+	case CmdHello:
+		if len(cmd.Args) > 0 {
+			return "error: can't switch framing in a transaction", true
+		}
+		return "", false
+
+	case CmdKeys, CmdReads, CmdScan, CmdCount, CmdDBSize, CmdQueryRange, CmdFind, CmdWatch:
+		return fmt.Sprintf("error: %s isn't supported in a transaction", cmd.Type), true
+	}
+	if cmd.IsWrite() || len(cmd.Keys()) > 0 {
+		return fmt.Sprintf("error: %s isn't supported in a transaction", cmd.Type), true
+	}
+	return "", false
+}
+
+// txnMoved answers a transaction's command for a key another node owns
+// with where it belongs, since transactions can't span nodes, or returns ""
+func (s *Server) txnMoved(sess *session, key string) string {
+	if sess.local {
+		return ""
+	}
+	if owner := s.Moved(key); owner != "" {
+		return "error: moved " + owner
+	}
+	return ""
+}
+
+// commitTxn commits the connection's transaction and closes it. Committed
+// writes are mirrored, indexed, audited and wait for replicas as a batch.
+func (s *Server) commitTxn(sess *session) string {
+	t := sess.txn
+	sess.txn = nil
+	if len(t.writes) == 0 {
+		t.txn.Rollback()
+		return "success"
+	}
+	if response := s.rejectWrite(); response != "" {
+		t.txn.Rollback()
+		return response
+	}
+
+	batch := &Command{Type: CmdBatch, Batch: t.writes}
+	start := time.Now()
+	if s.config.Raft != nil && t.ks == s.data {
+		response := s.raftWrite(start, func(stage *engine.Stage) (string, bool) {
+			if err := stage.CommitTxn(t.txn); err != nil {
+				return fmt.Sprintf("error: %v", err), false
+			}
+			return "success", true
+		})
+		// Proposals that never ran the commit leave the transaction open
+		t.txn.Rollback()
+		if response != "success" {
+			return response
+		}
+	} else if err := t.txn.Commit(); err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if s.config.Mirror != nil && t.ks == s.data {
+		if line := batch.Line(); line != "" {
+			s.config.Mirror.Send(line)
+		}
+	}
+	return s.afterWrite(sess, t.ks, batch, start, "success")
+}
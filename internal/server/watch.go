@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bufio"
+	"escabelo/internal/engine"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// serveWatch streams the changes to keys with prefix in a store to a text
+// connection, after answering with the last sequence number before them,
+// until the client sends "unwatch", which returns the connection to
+// commands. It reports false once the connection should close.
+func (s *Server) serveWatch(conn net.Conn, store engine.Store, reader *bufio.Reader, writer *bufio.Writer, prefix string) bool {
+	last := store.LastSeq()
+	watcher := store.Watch(prefix)
+	defer watcher.Close()
+
+	s.writeResponse(writer, fmt.Sprintf("watching %d", last))
+	if err := writer.Flush(); err != nil {
+		return false
+	}
+
+	// The client may stay quiet for as long as it watches
+	conn.SetReadDeadline(time.Time{})
+
+	// Lines sent while watching are read in the background; the reader is
+	// handed back once "unwatch" arrives
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			line, err := reader.ReadString('\r')
+			if err != nil {
+				readErr <- err
+				return
+			}
+			line = strings.TrimSuffix(line, "\r")
+			select {
+			case lines <- line:
+			case <-done:
+				return
+			}
+			if line == "unwatch" {
+				return
+			}
+		}
+	}()
+
+	changes := watcher.Changes
+	for {
+		select {
+		case entry, ok := <-changes:
+			if !ok {
+				// Only an overflow closes the watcher here. The stream stops
+				// until the client unwatches, and it can catch up with tail.
+				changes = nil
+				s.writeResponse(writer, fmt.Sprintf("error: watch fell behind after seq %d", last))
+				break
+			}
+			last = entry.Seq
+			s.writeResponse(writer, changeLine(entry))
+
+		case line := <-lines:
+			if line == "unwatch" {
+				s.writeResponse(writer, "unwatched")
+				return true
+			}
+			if line != "" {
+				s.writeResponse(writer, "error: only unwatch is accepted while watching")
+			}
+
+		case err := <-readErr:
+			readError(conn, err)
+			return false
+
+		case <-s.stopCh:
+			return false
+		}
+
+		// Changes arriving together are flushed together
+		if len(changes) > 0 {
+			continue
+		}
+		if err := writer.Flush(); err != nil {
+			slog.Warn("Write failed", "remote", conn.RemoteAddr().String(), "err", err)
+			return false
+		}
+	}
+}
+
+// changeLine formats a WAL entry as tail and watch list it
+func changeLine(entry *engine.WALEntry) string {
+	switch {
+	case entry.OpType == engine.OpTypeDelete:
+		return fmt.Sprintf("%d %d delete %s", entry.Seq, entry.Timestamp, escapeKey(entry.Key))
+	case entry.ExpiresAt != 0:
+		return fmt.Sprintf("%d %d putex %s %d %s", entry.Seq, entry.Timestamp, escapeKey(entry.Key), entry.ExpiresAt, escapeValue(entry.Value))
+	}
+	return fmt.Sprintf("%d %d put %s %s", entry.Seq, entry.Timestamp, escapeKey(entry.Key), escapeValue(entry.Value))
+}
@@ -0,0 +1,1118 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when the requested key does not exist
+var ErrNotFound = errors.New("key not found")
+
+// Client is a connection to a single escabelo server. It is safe for
+// concurrent use; requests wait for each other unless the connection is
+// multiplexed.
+type Client struct {
+	mu     sync.Mutex
+	addr   string
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	// mux is set once Hello selects ProtocolMultiplexed or ProtocolBinary
+	mux *mux
+
+	// versions is set once writes answer with their version
+	versions bool
+}
+
+// Dial connects to the server at addr
+func Dial(addr string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		addr:   addr,
+		conn:   conn,
+		reader: bufio.NewReaderSize(conn, 64*1024),
+		writer: bufio.NewWriterSize(conn, 64*1024),
+	}, nil
+}
+
+// Addr returns the server address
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// Get reads the value for a key
+func (c *Client) Get(key string) ([]byte, error) {
+	if m := c.binaryMux(); m != nil {
+		return c.doBinary(m, opGet, key, nil)
+	}
+	resp, err := c.do("read " + EscapeKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if resp == "error" {
+		return nil, ErrNotFound
+	}
+	return []byte(resp), nil
+}
+
+// GetRange reads up to length bytes of a key's value, starting at offset
+func (c *Client) GetRange(key string, offset, length int64) ([]byte, error) {
+	resp, err := c.do(fmt.Sprintf("getrange %s %d %d", EscapeKey(key), offset, length))
+	if err != nil {
+		return nil, err
+	}
+	if resp == "error" {
+		return nil, ErrNotFound
+	}
+	return []byte(resp), nil
+}
+
+// MultiGet reads several keys in one round trip. Keys that don't exist are
+// absent from the result.
+func (c *Client) MultiGet(keys ...string) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	escaped := make([]string, len(keys))
+	for i, key := range keys {
+		escaped[i] = EscapeKey(key)
+	}
+	resp, err := c.do("mread " + strings.Join(escaped, " "))
+	if err != nil {
+		return nil, err
+	}
+	if resp == "" {
+		return values, nil
+	}
+
+	for _, line := range strings.Split(resp, "\n") {
+		kv := strings.SplitN(line, "|", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("unexpected response: %s", line)
+		}
+		key, err := UnescapeKey(kv[0])
+		if err != nil {
+			return nil, err
+		}
+		value, err := UnescapeKey(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		values[key] = []byte(value)
+	}
+	return values, nil
+}
+
+// Put writes a key-value pair. Unless the connection speaks ProtocolBinary,
+// the value can't hold "\r".
+func (c *Client) Put(key string, value []byte) error {
+	if m := c.binaryMux(); m != nil {
+		resp, err := c.doBinary(m, opPut, key, value)
+		if err != nil {
+			return err
+		}
+		_, err = parseWriteResult(string(resp))
+		return err
+	}
+	resp, err := c.do(fmt.Sprintf("write %s|%s", EscapeKey(key), value))
+	if err != nil {
+		return err
+	}
+	_, err = parseWriteResult(resp)
+	return err
+}
+
+// Delete removes a key, returning ErrNotFound if it doesn't exist
+func (c *Client) Delete(key string) error {
+	resp, err := c.do("delete exists " + EscapeKey(key))
+	if err != nil {
+		return err
+	}
+	if resp == "error" {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteBlind removes key without checking that it exists, which saves the
+// server a lookup
+func (c *Client) DeleteBlind(key string) error {
+	if m := c.binaryMux(); m != nil {
+		_, err := c.doBinary(m, opDelete, key, nil)
+		return err
+	}
+	resp, err := c.do("delete " + EscapeKey(key))
+	if err != nil {
+		return err
+	}
+	if resp != "success" {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	return nil
+}
+
+// Expire makes key expire ttl from now, rounded down to whole seconds
+func (c *Client) Expire(key string, ttl time.Duration) error {
+	resp, err := c.do(fmt.Sprintf("expire %s %d", EscapeKey(key), int64(ttl/time.Second)))
+	if err != nil {
+		return err
+	}
+	if resp == "error" {
+		return ErrNotFound
+	}
+	if resp != "success" {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	return nil
+}
+
+// Incr atomically adds delta to the integer stored at key, which counts as
+// 0 if missing, and returns the new value. Use a negative delta to decrement.
+func (c *Client) Incr(key string, delta int64) (int64, error) {
+	resp, err := c.do(fmt.Sprintf("incr %s %d", EscapeKey(key), delta))
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseInt(resp, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected response: %s", resp)
+	}
+	return value, nil
+}
+
+// Append adds data to the end of the value at key, returning its new length
+func (c *Client) Append(key string, data []byte) (int64, error) {
+	return c.lengthCommand(fmt.Sprintf("append %s|%s", EscapeKey(key), data))
+}
+
+// SetRange overwrites the value at key with data starting at offset,
+// returning its new length
+func (c *Client) SetRange(key string, offset int64, data []byte) (int64, error) {
+	return c.lengthCommand(fmt.Sprintf("setrange %s %d|%s", EscapeKey(key), offset, data))
+}
+
+// lengthCommand sends a command answering with a value's new length, or
+// "<version>|<length>" once versions are on
+func (c *Client) lengthCommand(cmd string) (int64, error) {
+	resp, err := c.do(cmd)
+	if err != nil {
+		return 0, err
+	}
+	if _, length, ok := strings.Cut(resp, "|"); ok {
+		resp = length
+	}
+	length, err := strconv.ParseInt(resp, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected response: %s", resp)
+	}
+	return length, nil
+}
+
+// BatchOp is one write or delete of a batch
+type BatchOp struct {
+	Key    string
+	Value  []byte
+	Delete bool
+}
+
+// Batch applies ops atomically in a single request. Values can't hold
+// newlines, which separate the ops.
+func (c *Client) Batch(ops []BatchOp) error {
+	lines := make([]string, len(ops))
+	for i, op := range ops {
+		if op.Delete {
+			lines[i] = "delete " + EscapeKey(op.Key)
+		} else {
+			lines[i] = fmt.Sprintf("write %s|%s", EscapeKey(op.Key), op.Value)
+		}
+	}
+	resp, err := c.do("batch " + strings.Join(lines, "\n"))
+	if err != nil {
+		return err
+	}
+	if resp != "success" {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	return nil
+}
+
+// PutVersion writes a key-value pair and returns the version it was assigned.
+// It switches the connection to versioned write responses on first use.
+func (c *Client) PutVersion(key string, value []byte) (int64, error) {
+	if err := c.enableVersions(); err != nil {
+		return 0, err
+	}
+	resp, err := c.do(fmt.Sprintf("write %s|%s", EscapeKey(key), value))
+	if err != nil {
+		return 0, err
+	}
+	return parseWriteResult(resp)
+}
+
+// PutIfVersion writes a key-value pair only if the key is at version, as
+// GetVersion or PutVersion returned it, or doesn't exist for version 0. It
+// returns the new version, or ErrConflict.
+func (c *Client) PutIfVersion(key string, value []byte, version int64) (int64, error) {
+	if err := c.enableVersions(); err != nil {
+		return 0, err
+	}
+	resp, err := c.do(fmt.Sprintf("write IFVERSION %d %s|%s", version, EscapeKey(key), value))
+	if err != nil {
+		return 0, conflictError(err)
+	}
+	return parseWriteResult(resp)
+}
+
+// DeleteIfVersion removes key only if it is at version, or returns
+// ErrConflict
+func (c *Client) DeleteIfVersion(key string, version int64) error {
+	resp, err := c.do(fmt.Sprintf("delete IFVERSION %d %s", version, EscapeKey(key)))
+	if err != nil {
+		return conflictError(err)
+	}
+	if resp != "success" {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	return nil
+}
+
+// conflictError wraps a server's conflict error in ErrConflict
+func conflictError(err error) error {
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) && strings.HasPrefix(serverErr.Message, "conflict:") {
+		return fmt.Errorf("%w: %s", ErrConflict, serverErr.Message)
+	}
+	return err
+}
+
+// GetVersion reads the value for a key along with its version
+func (c *Client) GetVersion(key string) ([]byte, int64, error) {
+	resp, err := c.do("read " + EscapeKey(key) + " WITHVERSION")
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp == "error" {
+		return nil, 0, ErrNotFound
+	}
+	// Format: "<version>|<value>"
+	parts := strings.SplitN(resp, "|", 2)
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("unexpected response: %s", resp)
+	}
+	version, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unexpected response: %s", resp)
+	}
+	return []byte(parts[1]), version, nil
+}
+
+// enableVersions turns on versioned write responses for the connection
+func (c *Client) enableVersions() error {
+	c.mu.Lock()
+	enabled := c.versions
+	c.mu.Unlock()
+	if enabled {
+		return nil
+	}
+
+	resp, err := c.do("versions on")
+	if err != nil {
+		return err
+	}
+	if resp != "success" {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	c.mu.Lock()
+	c.versions = true
+	c.mu.Unlock()
+	return nil
+}
+
+// parseWriteResult parses a write response, returning the assigned version
+// when the connection has versioned responses on, or 0
+func parseWriteResult(resp string) (int64, error) {
+	if resp == "success" {
+		return 0, nil
+	}
+	if v, ok := strings.CutPrefix(resp, "success "); ok {
+		if version, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return version, nil
+		}
+	}
+	return 0, fmt.Errorf("unexpected response: %s", resp)
+}
+
+// HSet sets a field of the hash stored at key
+func (c *Client) HSet(key, field string, value []byte) error {
+	resp, err := c.do(fmt.Sprintf("hset %s %s|%s", EscapeKey(key), field, value))
+	if err != nil {
+		return err
+	}
+	_, err = parseWriteResult(resp)
+	return err
+}
+
+// HGet reads a field of the hash stored at key
+func (c *Client) HGet(key, field string) ([]byte, error) {
+	resp, err := c.do(fmt.Sprintf("hget %s %s", EscapeKey(key), field))
+	if err != nil {
+		return nil, err
+	}
+	if resp == "error" {
+		return nil, ErrNotFound
+	}
+	return []byte(resp), nil
+}
+
+// HDel removes a field of the hash stored at key
+func (c *Client) HDel(key, field string) error {
+	resp, err := c.do(fmt.Sprintf("hdel %s %s", EscapeKey(key), field))
+	if err != nil {
+		return err
+	}
+	if resp == "error" {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// HGetAll reads every field of the hash stored at key
+func (c *Client) HGetAll(key string) (map[string][]byte, error) {
+	resp, err := c.do("hgetall " + EscapeKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if resp == "error" {
+		return nil, ErrNotFound
+	}
+
+	fields := make(map[string][]byte)
+	for _, line := range strings.Split(resp, "\n") {
+		kv := strings.SplitN(line, "|", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("unexpected response: %s", line)
+		}
+		field, err := UnescapeKey(kv[0])
+		if err != nil {
+			return nil, err
+		}
+		value, err := UnescapeKey(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		fields[field] = []byte(value)
+	}
+	return fields, nil
+}
+
+// JGet returns the JSON value at path ("$" for the whole document) in the
+// document stored at key
+func (c *Client) JGet(key, path string) ([]byte, error) {
+	resp, err := c.do(fmt.Sprintf("jget %s %s", EscapeKey(key), path))
+	if err != nil {
+		return nil, err
+	}
+	if resp == "error" {
+		return nil, ErrNotFound
+	}
+	return []byte(resp), nil
+}
+
+// JSet replaces the value at path in the document stored at key with a JSON
+// value
+func (c *Client) JSet(key, path string, value []byte) error {
+	resp, err := c.do(fmt.Sprintf("jset %s %s|%s", EscapeKey(key), path, value))
+	if err != nil {
+		return err
+	}
+	_, err = parseWriteResult(resp)
+	return err
+}
+
+// QueryRange returns up to limit keys (0 for all) of an index whose score
+// or term is in [min, max], in index order. "-inf" and "+inf" leave a bound
+// open.
+func (c *Client) QueryRange(index, min, max string, limit int) ([]string, error) {
+	cmd := fmt.Sprintf("queryrange %s %s %s", index, min, max)
+	if limit > 0 {
+		cmd += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	resp, err := c.do(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if resp == "" {
+		return nil, nil
+	}
+	return unescapeKeys(strings.Split(resp, "\n"))
+}
+
+// Find returns the keys of an index whose term (or score) equals value, in
+// key order
+func (c *Client) Find(index, value string) ([]string, error) {
+	resp, err := c.do(fmt.Sprintf("find %s %s", index, value))
+	if err != nil {
+		return nil, err
+	}
+	if resp == "" {
+		return nil, nil
+	}
+	return unescapeKeys(strings.Split(resp, "\n"))
+}
+
+// CreateIndex declares an index on the server, like -index
+// name,prefix,path,type, and builds it. The server keeps it across restarts.
+func (c *Client) CreateIndex(name, prefix, path, indexType string) error {
+	return c.indexCommand(fmt.Sprintf("index create %s %s %s %s", name, prefix, path, indexType))
+}
+
+// DropIndex removes an index created with CreateIndex
+func (c *Client) DropIndex(name string) error {
+	return c.indexCommand("index drop " + name)
+}
+
+func (c *Client) indexCommand(cmd string) error {
+	resp, err := c.do(cmd)
+	if err != nil {
+		return err
+	}
+	if resp != "success" {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	return nil
+}
+
+// Do sends a raw text protocol command and returns its response. Error
+// responses are returned as a *ServerError.
+func (c *Client) Do(cmd string) (string, error) {
+	return c.do(cmd)
+}
+
+// DBSize estimates the keys starting with prefix ("" for every key) and the
+// bytes they take, from the server's statistics rather than a scan
+func (c *Client) DBSize(prefix string) (keys, bytes int64, err error) {
+	resp, err := c.do(strings.TrimSpace("dbsize " + EscapeKey(prefix)))
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := fmt.Sscanf(resp, "keys=%d bytes=%d", &keys, &bytes); err != nil {
+		return 0, 0, fmt.Errorf("unexpected response: %s", resp)
+	}
+	return keys, bytes, nil
+}
+
+// Status returns the raw status line reported by the server
+func (c *Client) Status() (string, error) {
+	return c.do("status")
+}
+
+// Ping checks that the server is responsive and returns the round-trip time
+func (c *Client) Ping() (time.Duration, error) {
+	start := time.Now()
+	resp, err := c.do("ping")
+	if err != nil {
+		return 0, err
+	}
+	if resp != "pong" {
+		return 0, fmt.Errorf("unexpected response: %s", resp)
+	}
+	return time.Since(start), nil
+}
+
+// Auth authenticates the connection with a token, for servers that require
+// it (ServerInfo.AuthRequired)
+func (c *Client) Auth(token string) error {
+	return c.auth("auth " + token)
+}
+
+// AuthUser authenticates the connection as a user
+func (c *Client) AuthUser(user, password string) error {
+	return c.auth("auth " + user + " " + password)
+}
+
+// auth sends an auth command
+func (c *Client) auth(cmd string) error {
+	resp, err := c.do(cmd)
+	if err != nil {
+		return err
+	}
+	if resp != "success" {
+		return fmt.Errorf("authentication failed: %s", strings.TrimPrefix(resp, "error: "))
+	}
+	return nil
+}
+
+// SetAckLevel sets how many replicas must persist this connection's writes
+// before they're acknowledged: "leader", "quorum" or "all"
+func (c *Client) SetAckLevel(level string) error {
+	resp, err := c.do("acklevel " + level)
+	if err != nil {
+		return err
+	}
+	if resp != "success" {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	return nil
+}
+
+// Use switches this connection to a bucket, created on first use; data
+// commands then read and write its keys. "default" switches back.
+func (c *Client) Use(bucket string) error {
+	resp, err := c.do("use " + bucket)
+	if err != nil {
+		return err
+	}
+	if resp != "success" {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	return nil
+}
+
+// Buckets returns the names of the server's buckets, "default" first
+func (c *Client) Buckets() ([]string, error) {
+	resp, err := c.do("buckets")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(resp, "\n"), nil
+}
+
+// ErrConflict is returned by Txn.Commit when another write changed a key
+// the transaction writes after it began, and by PutIfVersion and
+// DeleteIfVersion when the key isn't at the expected version
+var ErrConflict = errors.New("conflict")
+
+// Txn is a transaction opened with Begin. It belongs to the connection, so
+// the Client mustn't be used by others until it's committed or rolled back.
+type Txn struct {
+	c *Client
+}
+
+// Begin opens a transaction on the connection. Its reads see the store as
+// of Begin plus its own writes, which the server buffers until Commit.
+// Transactions need a text connection: not one Hello made multiplexed.
+func (c *Client) Begin() (*Txn, error) {
+	resp, err := c.do("begin")
+	if err != nil {
+		return nil, err
+	}
+	if resp != "success" {
+		return nil, fmt.Errorf("unexpected response: %s", resp)
+	}
+	return &Txn{c: c}, nil
+}
+
+// Get reads the value for a key as the transaction sees it
+func (t *Txn) Get(key string) ([]byte, error) {
+	resp, err := t.c.do("read " + EscapeKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if resp == "error" {
+		return nil, ErrNotFound
+	}
+	return []byte(resp), nil
+}
+
+// Put buffers a write of key
+func (t *Txn) Put(key string, value []byte) error {
+	return t.queue(fmt.Sprintf("write %s|%s", EscapeKey(key), value))
+}
+
+// Delete buffers a delete of key
+func (t *Txn) Delete(key string) error {
+	return t.queue("delete " + EscapeKey(key))
+}
+
+func (t *Txn) queue(cmd string) error {
+	resp, err := t.c.do(cmd)
+	if err != nil {
+		return err
+	}
+	if resp != "queued" {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	return nil
+}
+
+// Commit applies the transaction's writes atomically, or returns
+// ErrConflict and applies none of them
+func (t *Txn) Commit() error {
+	resp, err := t.c.do("commit")
+	if err != nil {
+		return conflictError(err)
+	}
+	if resp != "success" {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	return nil
+}
+
+// Rollback discards the transaction's writes
+func (t *Txn) Rollback() error {
+	resp, err := t.c.do("rollback")
+	if err != nil {
+		return err
+	}
+	if resp != "success" {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	return nil
+}
+
+// Pause pauses background work on the server: "compaction", "flush" or
+// "all". It returns once any compaction or flush in progress has finished.
+func (c *Client) Pause(target string) error {
+	resp, err := c.do("pause " + target)
+	if err != nil {
+		return err
+	}
+	if resp != "success" {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	return nil
+}
+
+// Resume resumes background work paused with Pause
+func (c *Client) Resume(target string) error {
+	resp, err := c.do("resume " + target)
+	if err != nil {
+		return err
+	}
+	if resp != "success" {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	return nil
+}
+
+// SetReadOnly makes the server reject writes, or accept them again
+func (c *Client) SetReadOnly(on bool) error {
+	mode := "off"
+	if on {
+		mode = "on"
+	}
+	resp, err := c.do("readonly " + mode)
+	if err != nil {
+		return err
+	}
+	if resp != "success" {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	return nil
+}
+
+// ReadOnly reports whether the server rejects writes
+func (c *Client) ReadOnly() (bool, error) {
+	resp, err := c.do("readonly")
+	if err != nil {
+		return false, err
+	}
+	switch resp {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected response: %s", resp)
+}
+
+// Compact runs a compaction cycle on the server now, or merges every SST
+// file into one with full, and returns the number of files merged
+func (c *Client) Compact(full bool) (int, error) {
+	cmd := "compact"
+	if full {
+		cmd += " full"
+	}
+	resp, err := c.do(cmd)
+	if err != nil {
+		return 0, err
+	}
+	merged, err := strconv.Atoi(strings.TrimPrefix(resp, "compacted files="))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected response: %s", resp)
+	}
+	return merged, nil
+}
+
+// BackupInfo describes a backup taken by the server
+type BackupInfo struct {
+	Seq         int64
+	SSTs        int
+	WALSegments int
+	Bytes       int64
+}
+
+// Backup has the server write a consistent snapshot of its data to path on
+// its own filesystem: a directory, or a tar archive if path ends in ".tar"
+func (c *Client) Backup(path string) (*BackupInfo, error) {
+	resp, err := c.do("backup " + path)
+	if err != nil {
+		return nil, err
+	}
+	info := &BackupInfo{}
+	if _, err := fmt.Sscanf(resp, "backup seq=%d ssts=%d wal_segments=%d bytes=%d",
+		&info.Seq, &info.SSTs, &info.WALSegments, &info.Bytes); err != nil {
+		return nil, fmt.Errorf("unexpected response: %s", resp)
+	}
+	return info, nil
+}
+
+// Role returns the replication role reported by the server
+func (c *Client) Role() (string, error) {
+	return c.do("role")
+}
+
+// ServerInfo describes a server and the protocol level negotiated with it
+type ServerInfo struct {
+	Version     string
+	Protocol    int
+	MinProtocol int
+	MaxProtocol int
+
+	Pipelining   bool
+	Binary       bool
+	AuthRequired bool
+}
+
+// Hello reports the server version and features. A non-zero version selects
+// that protocol level for the connection; 0 keeps the current one. Selecting
+// ProtocolMultiplexed lets concurrent requests share the connection, each
+// answered as soon as it completes; ProtocolBinary does too, and lets Get and
+// Put carry values holding any bytes.
+func (c *Client) Hello(version int) (*ServerInfo, error) {
+	cmd := "hello"
+	if version != 0 {
+		cmd = fmt.Sprintf("hello %d", version)
+	}
+
+	// The switch to multiplexing happens before any other request can be
+	// written, since the server reads frames right after this response
+	var info *ServerInfo
+	_, err := c.doThen(cmd, func(resp string) error {
+		var err error
+		if info, err = parseServerInfo(resp); err != nil {
+			return err
+		}
+		if info.Protocol >= ProtocolMultiplexed && c.mux == nil {
+			c.startMux(info.Protocol == ProtocolBinary)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// parseServerInfo parses a hello response.
+// Format: "escabelo key=value ...". Unknown keys are ignored so newer servers
+// can report more.
+func parseServerInfo(resp string) (*ServerInfo, error) {
+	fields := strings.Fields(resp)
+	if len(fields) == 0 || fields[0] != "escabelo" {
+		return nil, fmt.Errorf("unexpected response: %s", resp)
+	}
+	info := &ServerInfo{}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("unexpected response: %s", resp)
+		}
+		var err error
+		switch kv[0] {
+		case "version":
+			info.Version = kv[1]
+		case "proto":
+			info.Protocol, err = strconv.Atoi(kv[1])
+		case "min_proto":
+			info.MinProtocol, err = strconv.Atoi(kv[1])
+		case "max_proto":
+			info.MaxProtocol, err = strconv.Atoi(kv[1])
+		case "pipelining":
+			info.Pipelining, err = strconv.ParseBool(kv[1])
+		case "binary":
+			info.Binary, err = strconv.ParseBool(kv[1])
+		case "auth":
+			info.AuthRequired, err = strconv.ParseBool(kv[1])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unexpected response: %s", resp)
+		}
+	}
+	return info, nil
+}
+
+// Change is a committed mutation read from the server's WAL
+type Change struct {
+	Seq       uint64
+	Timestamp int64
+	Deleted   bool
+	Key       string
+	Value     []byte
+
+	// ExpiresAt is when the written value expires (unix nanoseconds), or 0
+	// if it never does
+	ExpiresAt int64
+}
+
+// ReplicationStatus returns the lines of "replication status": the leader's
+// last sequence number and its WAL consumers' positions, or a replica's
+// progress following its leader
+func (c *Client) ReplicationStatus() ([]string, error) {
+	resp, err := c.do("replication status")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(resp, "\n"), nil
+}
+
+// Tail returns up to limit changes for consumer starting at sequence number
+// from, or after the consumer's last acknowledged change when from is 0
+func (c *Client) Tail(consumer string, from uint64, limit int) ([]Change, error) {
+	resp, err := c.do(fmt.Sprintf("tail %s %d %d", consumer, from, limit))
+	if err != nil {
+		return nil, err
+	}
+	return parseChanges(resp)
+}
+
+// ReadWAL returns up to limit changes starting at sequence number from,
+// without registering a consumer. Servers with a WAL archive serve changes
+// already released from their WAL too.
+func (c *Client) ReadWAL(from uint64, limit int) ([]Change, error) {
+	resp, err := c.do(fmt.Sprintf("wal %d %d", from, limit))
+	if err != nil {
+		return nil, err
+	}
+	return parseChanges(resp)
+}
+
+// parseChanges parses the lines of a tail or wal response
+func parseChanges(resp string) ([]Change, error) {
+	if resp == "" {
+		return nil, nil
+	}
+	lines := strings.Split(resp, "\n")
+	changes := make([]Change, 0, len(lines))
+	for _, line := range lines {
+		change, err := parseChange(line)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// parseChange parses a change as tail and watch list it
+func parseChange(line string) (Change, error) {
+	// Format: "<seq> <ts> put <key> <value>",
+	// "<seq> <ts> putex <key> <expiresAt> <value>" or "<seq> <ts> delete <key>"
+	fields := strings.SplitN(line, " ", 5)
+	if len(fields) < 4 {
+		return Change{}, fmt.Errorf("unexpected response: %s", line)
+	}
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return Change{}, fmt.Errorf("unexpected response: %s", line)
+	}
+	ts, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return Change{}, fmt.Errorf("unexpected response: %s", line)
+	}
+
+	key, err := UnescapeKey(fields[3])
+	if err != nil {
+		return Change{}, err
+	}
+	change := Change{Seq: seq, Timestamp: ts, Key: key}
+	switch {
+	case fields[2] == "delete":
+		change.Deleted = true
+	case fields[2] == "put" && len(fields) == 5:
+		value, err := UnescapeKey(fields[4])
+		if err != nil {
+			return Change{}, err
+		}
+		change.Value = []byte(value)
+	case fields[2] == "put":
+		change.Value = []byte{}
+	case fields[2] == "putex" && len(fields) == 5:
+		rest := strings.SplitN(fields[4], " ", 2)
+		if change.ExpiresAt, err = strconv.ParseInt(rest[0], 10, 64); err != nil {
+			return Change{}, fmt.Errorf("unexpected response: %s", line)
+		}
+		change.Value = []byte{}
+		if len(rest) == 2 {
+			value, err := UnescapeKey(rest[1])
+			if err != nil {
+				return Change{}, err
+			}
+			change.Value = []byte(value)
+		}
+	default:
+		return Change{}, fmt.Errorf("unexpected response: %s", line)
+	}
+	return change, nil
+}
+
+// Watch streams the changes to keys with prefix made from now on to fn, in
+// order, until fn returns an error, which Watch returns. start is called
+// first with the sequence number the changes follow. A watch that fell
+// behind returns a *ServerError; Tail can catch up from the last change
+// seen. The connection serves nothing else while watching.
+func (c *Client) Watch(prefix string, start func(seq uint64), fn func(Change) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mux != nil {
+		return fmt.Errorf("watch requires a text connection")
+	}
+
+	if _, err := c.writer.WriteString("watch " + EscapeKey(prefix) + "\r"); err != nil {
+		return err
+	}
+	if err := c.writer.Flush(); err != nil {
+		return err
+	}
+	resp, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if msg, ok := strings.CutPrefix(resp, "error: "); ok {
+		return &ServerError{Message: msg}
+	}
+	seq, err := strconv.ParseUint(strings.TrimPrefix(resp, "watching "), 10, 64)
+	if err != nil {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	if start != nil {
+		start(seq)
+	}
+
+	var watchErr error
+	for watchErr == nil {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if msg, ok := strings.CutPrefix(line, "error: "); ok {
+			watchErr = &ServerError{Message: msg}
+			break
+		}
+		change, err := parseChange(line)
+		if err != nil {
+			return err
+		}
+		watchErr = fn(change)
+	}
+
+	// Changes sent before the server reads unwatch are skipped
+	if _, err := c.writer.WriteString("unwatch\r"); err != nil {
+		return err
+	}
+	if err := c.writer.Flush(); err != nil {
+		return err
+	}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "unwatched" {
+			return watchErr
+		}
+	}
+}
+
+// readLine reads one response. Caller holds c.mu.
+func (c *Client) readLine() (string, error) {
+	resp, err := c.reader.ReadString('\r')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(resp, "\r"), nil
+}
+
+// Ack acknowledges every change up to seq for consumer
+func (c *Client) Ack(consumer string, seq uint64) error {
+	resp, err := c.do(fmt.Sprintf("ack %s %d", consumer, seq))
+	if err != nil {
+		return err
+	}
+	if resp != "success" {
+		return fmt.Errorf("unexpected response: %s", resp)
+	}
+	return nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.Close()
+}
+
+// do sends a single command and reads its response
+func (c *Client) do(cmd string) (string, error) {
+	return c.doThen(cmd, nil)
+}
+
+// doThen is like do, but on a text connection runs then on the response
+// before any other request is sent
+func (c *Client) doThen(cmd string, then func(resp string) error) (string, error) {
+	c.mu.Lock()
+	if m := c.mux; m != nil {
+		c.mu.Unlock()
+		resp, err := c.doMultiplexed(m, cmd)
+		if err == nil && then != nil {
+			err = then(resp)
+		}
+		return resp, err
+	}
+	defer c.mu.Unlock()
+
+	if _, err := c.writer.WriteString(cmd + "\r"); err != nil {
+		return "", err
+	}
+	if err := c.writer.Flush(); err != nil {
+		return "", err
+	}
+
+	resp, err := c.reader.ReadString('\r')
+	if err != nil {
+		return "", err
+	}
+	resp = strings.TrimSuffix(resp, "\r")
+
+	if strings.HasPrefix(resp, "error: ") {
+		return "", &ServerError{Message: strings.TrimPrefix(resp, "error: ")}
+	}
+	if then != nil {
+		if err := then(resp); err != nil {
+			return "", err
+		}
+	}
+	return resp, nil
+}
+
+// ServerError is an error reported by the server
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "server: " + e.Message
+}
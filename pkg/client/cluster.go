@@ -0,0 +1,306 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoNodes is returned when no cluster node is available
+var ErrNoNodes = errors.New("no available nodes")
+
+// ClusterConfig holds cluster client configuration
+type ClusterConfig struct {
+	Addrs        []string
+	VirtualNodes int
+	DialTimeout  time.Duration
+
+	// RetryInterval is how long a failed node stays out of the ring
+	// before the client tries it again
+	RetryInterval time.Duration
+
+	// Token, when set, authenticates every connection with Auth
+	Token string
+}
+
+// Cluster routes keys across several independent servers
+type Cluster struct {
+	mu      sync.Mutex
+	config  ClusterConfig
+	clients map[string]*Client
+	down    map[string]time.Time
+	ring    *Ring
+}
+
+// NewCluster creates a cluster client. Connections are opened lazily.
+func NewCluster(config ClusterConfig) (*Cluster, error) {
+	if len(config.Addrs) == 0 {
+		return nil, fmt.Errorf("cluster requires at least one address")
+	}
+	if config.VirtualNodes <= 0 {
+		config.VirtualNodes = 160
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = 5 * time.Second
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = 10 * time.Second
+	}
+
+	c := &Cluster{
+		config:  config,
+		clients: make(map[string]*Client),
+		down:    make(map[string]time.Time),
+	}
+	c.ring = NewRing(config.Addrs, config.VirtualNodes)
+
+	return c, nil
+}
+
+// NodeFor returns the address currently responsible for key
+func (c *Cluster) NodeFor(key string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.refreshLocked()
+	return c.ring.Node(key)
+}
+
+// Get reads the value for a key from its owning node
+func (c *Cluster) Get(key string) ([]byte, error) {
+	var value []byte
+	err := c.withClient(key, func(cl *Client) error {
+		var err error
+		value, err = cl.Get(key)
+		return err
+	})
+	return value, err
+}
+
+// MultiGet reads several keys with one mread per owning node, sent to the
+// nodes in parallel. Keys that don't exist are absent from the result. Keys
+// of a node that fails are retried on their next owner.
+func (c *Cluster) MultiGet(keys ...string) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(keys))
+	pending := keys
+	for attempt := 0; len(pending) > 0 && attempt < len(c.config.Addrs); attempt++ {
+		groups := make(map[string][]string)
+		c.mu.Lock()
+		c.refreshLocked()
+		for _, key := range pending {
+			addr := c.ring.Node(key)
+			if addr == "" {
+				c.mu.Unlock()
+				return nil, ErrNoNodes
+			}
+			groups[addr] = append(groups[addr], key)
+		}
+		c.mu.Unlock()
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		var retry []string
+		var firstErr error
+		for addr, group := range groups {
+			wg.Add(1)
+			go func(addr string, group []string) {
+				defer wg.Done()
+				found, err := c.multiGetAt(addr, group)
+
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					for key, value := range found {
+						values[key] = value
+					}
+				case isApplicationError(err):
+					if firstErr == nil {
+						firstErr = err
+					}
+				default:
+					retry = append(retry, group...)
+				}
+			}(addr, group)
+		}
+		wg.Wait()
+
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		pending = retry
+	}
+	if len(pending) > 0 {
+		return nil, ErrNoNodes
+	}
+	return values, nil
+}
+
+// multiGetAt reads keys from the node at addr, taking it out of the ring if
+// that fails on the network
+func (c *Cluster) multiGetAt(addr string, keys []string) (map[string][]byte, error) {
+	cl, err := c.clientAt(addr)
+	if err != nil {
+		return nil, err
+	}
+	values, err := cl.MultiGet(keys...)
+	if err != nil && !isApplicationError(err) {
+		c.markDown(addr)
+	}
+	return values, err
+}
+
+// Put writes a key-value pair to its owning node
+func (c *Cluster) Put(key string, value []byte) error {
+	return c.withClient(key, func(cl *Client) error {
+		return cl.Put(key, value)
+	})
+}
+
+// Delete removes a key from its owning node
+func (c *Cluster) Delete(key string) error {
+	return c.withClient(key, func(cl *Client) error {
+		return cl.Delete(key)
+	})
+}
+
+// Close closes all open connections
+func (c *Cluster) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var firstErr error
+	for addr, cl := range c.clients {
+		if err := cl.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(c.clients, addr)
+	}
+	return firstErr
+}
+
+// withClient runs fn against the node owning key. Network failures take
+// the node out of the ring and the request is retried on the next owner. A
+// sharded server that doesn't own key answers "moved <addr>", and the
+// request is retried once at that address.
+func (c *Cluster) withClient(key string, fn func(*Client) error) error {
+	for attempt := 0; attempt < len(c.config.Addrs); attempt++ {
+		cl, err := c.clientFor(key)
+		if err != nil {
+			return err
+		}
+
+		err = fn(cl)
+		var serverErr *ServerError
+		if errors.As(err, &serverErr) {
+			if owner, ok := strings.CutPrefix(serverErr.Message, "moved "); ok {
+				if cl, err = c.clientAt(owner); err != nil {
+					return err
+				}
+				err = fn(cl)
+			}
+		}
+		if err == nil || isApplicationError(err) {
+			return err
+		}
+
+		c.markDown(cl.Addr())
+	}
+	return ErrNoNodes
+}
+
+// clientFor returns a connected client for the node owning key
+func (c *Cluster) clientFor(key string) (*Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		c.refreshLocked()
+		addr := c.ring.Node(key)
+		if addr == "" {
+			return nil, ErrNoNodes
+		}
+
+		if cl, err := c.clientAtLocked(addr); err == nil {
+			return cl, nil
+		}
+	}
+}
+
+// clientAt returns a connected client for the node at addr
+func (c *Cluster) clientAt(addr string) (*Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clientAtLocked(addr)
+}
+
+// clientAtLocked is clientAt with c.mu held. A node that can't be dialed is
+// taken out of the ring.
+func (c *Cluster) clientAtLocked(addr string) (*Client, error) {
+	if cl, ok := c.clients[addr]; ok {
+		return cl, nil
+	}
+
+	cl, err := Dial(addr, c.config.DialTimeout)
+	if err != nil {
+		c.markDownLocked(addr)
+		return nil, err
+	}
+	if c.config.Token != "" {
+		if err := cl.Auth(c.config.Token); err != nil {
+			cl.Close()
+			return nil, err
+		}
+	}
+	c.clients[addr] = cl
+	return cl, nil
+}
+
+// markDown removes a node from the ring after a failure
+func (c *Cluster) markDown(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.markDownLocked(addr)
+}
+
+func (c *Cluster) markDownLocked(addr string) {
+	if cl, ok := c.clients[addr]; ok {
+		cl.Close()
+		delete(c.clients, addr)
+	}
+	c.down[addr] = time.Now()
+	c.rebuildLocked()
+}
+
+// refreshLocked brings nodes back into the ring once their retry interval passed
+func (c *Cluster) refreshLocked() {
+	changed := false
+	for addr, since := range c.down {
+		if time.Since(since) >= c.config.RetryInterval {
+			delete(c.down, addr)
+			changed = true
+		}
+	}
+	if changed {
+		c.rebuildLocked()
+	}
+}
+
+// rebuildLocked recomputes the ring from the currently healthy nodes
+func (c *Cluster) rebuildLocked() {
+	nodes := make([]string, 0, len(c.config.Addrs))
+	for _, addr := range c.config.Addrs {
+		if _, isDown := c.down[addr]; !isDown {
+			nodes = append(nodes, addr)
+		}
+	}
+	c.ring = NewRing(nodes, c.config.VirtualNodes)
+}
+
+// isApplicationError reports whether err came from the server rather than the network
+func isApplicationError(err error) bool {
+	var serverErr *ServerError
+	return errors.Is(err, ErrNotFound) || errors.As(err, &serverErr)
+}
@@ -0,0 +1,185 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GroupConfig holds Raft group client configuration
+type GroupConfig struct {
+	// Addrs are the members' data addresses
+	Addrs       []string
+	DialTimeout time.Duration
+
+	// ElectionWait is how long to wait before retrying while the group has
+	// no leader
+	ElectionWait time.Duration
+
+	// Token, when set, authenticates every connection with Auth
+	Token string
+}
+
+// Group talks to the members of a Raft group. Requests go to one member
+// at a time: writes redirected by a follower move to the leader, and a
+// member that fails on the network is swapped for the next one, so the
+// client rides through a leader failover.
+type Group struct {
+	mu      sync.Mutex
+	config  GroupConfig
+	current *Client
+	next    int
+}
+
+// NewGroup creates a group client. Connections are opened lazily.
+func NewGroup(config GroupConfig) (*Group, error) {
+	if len(config.Addrs) == 0 {
+		return nil, fmt.Errorf("group requires at least one address")
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = 5 * time.Second
+	}
+	if config.ElectionWait <= 0 {
+		config.ElectionWait = 500 * time.Millisecond
+	}
+	return &Group{config: config}, nil
+}
+
+// Addr returns the address of the member requests currently go to, "" if
+// none is connected
+func (g *Group) Addr() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.current == nil {
+		return ""
+	}
+	return g.current.Addr()
+}
+
+// Get reads the value for a key from the current member, which may lag
+// the leader if it's a follower
+func (g *Group) Get(key string) ([]byte, error) {
+	var value []byte
+	err := g.withClient(func(cl *Client) error {
+		var err error
+		value, err = cl.Get(key)
+		return err
+	})
+	return value, err
+}
+
+// Put writes a key-value pair through the leader
+func (g *Group) Put(key string, value []byte) error {
+	return g.withClient(func(cl *Client) error {
+		return cl.Put(key, value)
+	})
+}
+
+// Delete removes a key through the leader
+func (g *Group) Delete(key string) error {
+	return g.withClient(func(cl *Client) error {
+		return cl.Delete(key)
+	})
+}
+
+// Close closes the open connection
+func (g *Group) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.current == nil {
+		return nil
+	}
+	err := g.current.Close()
+	g.current = nil
+	return err
+}
+
+// withClient runs fn against the current member, following redirects to
+// the leader and moving on to other members after network failures
+func (g *Group) withClient(fn func(*Client) error) error {
+	var lastErr error = ErrNoNodes
+	for attempt := 0; attempt < 3*len(g.config.Addrs); attempt++ {
+		cl, err := g.client()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		err = fn(cl)
+		var serverErr *ServerError
+		if errors.As(err, &serverErr) {
+			if leader, ok := strings.CutPrefix(serverErr.Message, "redirect "); ok {
+				lastErr = err
+				g.switchTo(cl, leader)
+				continue
+			}
+			if strings.HasPrefix(serverErr.Message, "no leader elected") ||
+				strings.HasPrefix(serverErr.Message, "not the raft leader") {
+				lastErr = err
+				time.Sleep(g.config.ElectionWait)
+				continue
+			}
+		}
+		if err == nil || isApplicationError(err) {
+			return err
+		}
+
+		lastErr = err
+		g.drop(cl)
+	}
+	return lastErr
+}
+
+// client returns a connection to the current member, dialing the next one
+// if there is none
+func (g *Group) client() (*Client, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.current != nil {
+		return g.current, nil
+	}
+
+	addr := g.config.Addrs[g.next%len(g.config.Addrs)]
+	g.next++
+	return g.dialLocked(addr)
+}
+
+// dialLocked connects to addr as the current member. Caller holds g.mu.
+func (g *Group) dialLocked(addr string) (*Client, error) {
+	cl, err := Dial(addr, g.config.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if g.config.Token != "" {
+		if err := cl.Auth(g.config.Token); err != nil {
+			cl.Close()
+			return nil, err
+		}
+	}
+	g.current = cl
+	return cl, nil
+}
+
+// switchTo makes the leader at addr the current member in place of cl
+func (g *Group) switchTo(cl *Client, addr string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.current != cl {
+		return
+	}
+	cl.Close()
+	g.current = nil
+	g.dialLocked(addr)
+}
+
+// drop closes cl after a failure so the next request tries another member
+func (g *Group) drop(cl *Client) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.current == cl {
+		g.current = nil
+	}
+	cl.Close()
+}
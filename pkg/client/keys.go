@@ -0,0 +1,66 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EscapeKey returns key as the text protocol carries it: letters, digits,
+// ".", "-", ":" and "_" as they are, and any other byte as %XX. The client
+// escapes the keys it sends and unescapes those it receives, so methods
+// take and return keys as stored; EscapeKey is for commands sent with Do.
+func EscapeKey(key string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(key); i++ {
+		if isKeyChar(key[i]) {
+			escaped.WriteByte(key[i])
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", key[i])
+		}
+	}
+	return escaped.String()
+}
+
+// UnescapeKey returns the key an escaped key stands for
+func UnescapeKey(escaped string) (string, error) {
+	if !strings.Contains(escaped, "%") {
+		return escaped, nil
+	}
+	var key strings.Builder
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] != '%' {
+			key.WriteByte(escaped[i])
+			continue
+		}
+		if i+2 >= len(escaped) {
+			return "", fmt.Errorf("malformed key: %s", escaped)
+		}
+		b, err := strconv.ParseUint(escaped[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("malformed key: %s", escaped)
+		}
+		key.WriteByte(byte(b))
+		i += 2
+	}
+	return key.String(), nil
+}
+
+// unescapeKeys unescapes the keys of a response in place
+func unescapeKeys(keys []string) ([]string, error) {
+	for i, key := range keys {
+		var err error
+		if keys[i], err = UnescapeKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// isKeyChar reports whether ch can appear unescaped in a key
+func isKeyChar(ch byte) bool {
+	return (ch >= 'a' && ch <= 'z') ||
+		(ch >= 'A' && ch <= 'Z') ||
+		(ch >= '0' && ch <= '9') ||
+		ch == '.' || ch == '-' || ch == ':' || ch == '_'
+}
@@ -0,0 +1,232 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// ProtocolMultiplexed is the protocol level that lets a single connection
+// carry many requests at once; select it with Hello
+const ProtocolMultiplexed = 2
+
+// ProtocolBinary is the protocol level that frames keys and values with
+// their lengths, so values may hold any bytes. It is multiplexed like
+// ProtocolMultiplexed; select it with Hello.
+const ProtocolBinary = 3
+
+// binaryMagic starts every frame at ProtocolBinary
+const binaryMagic byte = 0xE5
+
+// Binary request opcodes
+const (
+	opText   byte = 0
+	opGet    byte = 1
+	opPut    byte = 2
+	opDelete byte = 3
+)
+
+// Binary response statuses
+const (
+	statusOK       byte = 0
+	statusNotFound byte = 1
+	statusError    byte = 2
+)
+
+// errClosed fails requests in flight when the connection is lost
+var errClosed = errors.New("connection closed")
+
+// frame is a response read from a framed connection. Level 2 frames only
+// carry a body, which holds the response as sent at level 1.
+type frame struct {
+	status byte
+	body   []byte
+}
+
+// mux routes framed responses back to the requests waiting for them
+type mux struct {
+	binary bool // ProtocolBinary rather than ProtocolMultiplexed framing
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan frame
+	err     error
+}
+
+// startMux switches the connection to framed requests. Caller holds c.mu.
+func (c *Client) startMux(binary bool) {
+	c.mux = &mux{binary: binary, pending: make(map[uint32]chan frame)}
+	go c.readFrames(c.mux, c.reader)
+}
+
+// binaryMux returns the connection's mux if it speaks ProtocolBinary
+func (c *Client) binaryMux() *mux {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mux != nil && c.mux.binary {
+		return c.mux
+	}
+	return nil
+}
+
+// readFrames delivers each response frame to the request with its ID until
+// the connection fails
+func (c *Client) readFrames(m *mux, reader *bufio.Reader) {
+	for {
+		id, resp, err := m.readFrame(reader)
+		if err != nil {
+			m.fail(err)
+			return
+		}
+
+		m.mu.Lock()
+		ch := m.pending[id]
+		delete(m.pending, id)
+		m.mu.Unlock()
+		if ch != nil {
+			ch <- resp
+		}
+	}
+}
+
+// readFrame reads a response frame.
+// Level 2: id(4) + length(4) + body. Level 3: magic(1) + status(1) + id(4) +
+// length(4) + body. Both big-endian.
+func (m *mux) readFrame(reader *bufio.Reader) (uint32, frame, error) {
+	var resp frame
+	header := make([]byte, 8)
+	if m.binary {
+		header = make([]byte, 10)
+	}
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, resp, err
+	}
+	if m.binary {
+		if header[0] != binaryMagic {
+			return 0, resp, fmt.Errorf("bad frame magic 0x%02x", header[0])
+		}
+		resp.status = header[1]
+		header = header[2:]
+	}
+	id := binary.BigEndian.Uint32(header[0:4])
+	resp.body = make([]byte, binary.BigEndian.Uint32(header[4:8]))
+	if _, err := io.ReadFull(reader, resp.body); err != nil {
+		return 0, resp, err
+	}
+	return id, resp, nil
+}
+
+// fail fails every pending request and the ones sent afterwards
+func (m *mux) fail(err error) {
+	if err == io.EOF {
+		err = errClosed
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+	for id, ch := range m.pending {
+		close(ch)
+		delete(m.pending, id)
+	}
+}
+
+// doMultiplexed sends a text command in a frame and waits for the response
+// carrying its ID. Other requests may be sent and answered meanwhile.
+func (c *Client) doMultiplexed(m *mux, cmd string) (string, error) {
+	resp, err := c.roundTrip(m, opText, "", []byte(cmd))
+	if err != nil {
+		return "", err
+	}
+	if m.binary {
+		// Level 3 splits errors and misses out of the text response
+		switch resp.status {
+		case statusNotFound:
+			return "error", nil
+		case statusError:
+			return "", &ServerError{Message: string(resp.body)}
+		}
+		return string(resp.body), nil
+	}
+	if body := string(resp.body); strings.HasPrefix(body, "error: ") {
+		return "", &ServerError{Message: strings.TrimPrefix(body, "error: ")}
+	}
+	return string(resp.body), nil
+}
+
+// doBinary sends a ProtocolBinary request and waits for its response,
+// turning a miss into ErrNotFound
+func (c *Client) doBinary(m *mux, op byte, key string, value []byte) ([]byte, error) {
+	resp, err := c.roundTrip(m, op, key, value)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.status {
+	case statusNotFound:
+		return nil, ErrNotFound
+	case statusError:
+		return nil, &ServerError{Message: string(resp.body)}
+	}
+	return resp.body, nil
+}
+
+// roundTrip sends a request frame and waits for the response carrying its
+// ID. Level 2 frames only carry value, the text command.
+func (c *Client) roundTrip(m *mux, op byte, key string, value []byte) (frame, error) {
+	ch := make(chan frame, 1)
+
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return frame{}, m.err
+	}
+	m.nextID++
+	id := m.nextID
+	m.pending[id] = ch
+	m.mu.Unlock()
+
+	var header []byte
+	if m.binary {
+		header = make([]byte, 14)
+		header[0] = binaryMagic
+		header[1] = op
+		binary.BigEndian.PutUint32(header[2:6], id)
+		binary.BigEndian.PutUint32(header[6:10], uint32(len(key)))
+		binary.BigEndian.PutUint32(header[10:14], uint32(len(value)))
+	} else {
+		header = make([]byte, 8)
+		binary.BigEndian.PutUint32(header[0:4], id)
+		binary.BigEndian.PutUint32(header[4:8], uint32(len(value)))
+		key = ""
+	}
+
+	c.mu.Lock()
+	_, err := c.writer.Write(header)
+	if err == nil {
+		_, err = c.writer.WriteString(key)
+	}
+	if err == nil {
+		_, err = c.writer.Write(value)
+	}
+	if err == nil {
+		err = c.writer.Flush()
+	}
+	c.mu.Unlock()
+	if err != nil {
+		m.mu.Lock()
+		delete(m.pending, id)
+		m.mu.Unlock()
+		return frame{}, err
+	}
+
+	resp, ok := <-ch
+	if !ok {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return frame{}, fmt.Errorf("request %d: %w", id, m.err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Pipeline queues commands to send in one go, so a batch of requests costs
+// one round trip instead of one each. On a text connection the server runs
+// them in order; once Hello selected ProtocolMultiplexed or ProtocolBinary
+// they run concurrently, so commands touching the same key may apply in any
+// order. Results always come back in the order commands were queued. Build
+// one with Client.Pipeline; it isn't safe for concurrent use.
+//
+// Commands are sent as text, so values can't hold "\r".
+type Pipeline struct {
+	c    *Client
+	cmds []pipelined
+}
+
+// pipelined is a queued command
+type pipelined struct {
+	cmd string
+
+	// notFound turns an "error" response into ErrNotFound
+	notFound bool
+}
+
+// PipelineResult is the answer to one pipelined command
+type PipelineResult struct {
+	// Value is the response: the value read by a Get, "success" (or
+	// "success <version>") for writes, the new value of a counter
+	Value []byte
+
+	// Err is ErrNotFound for a Get or Delete of a missing key, or a
+	// *ServerError
+	Err error
+}
+
+// Pipeline returns an empty pipeline on the connection
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Get queues a read of key
+func (p *Pipeline) Get(key string) {
+	p.cmds = append(p.cmds, pipelined{cmd: "read " + EscapeKey(key), notFound: true})
+}
+
+// Put queues a write
+func (p *Pipeline) Put(key string, value []byte) {
+	p.cmds = append(p.cmds, pipelined{cmd: fmt.Sprintf("write %s|%s", EscapeKey(key), value)})
+}
+
+// Delete queues a delete that fails with ErrNotFound if the key doesn't exist
+func (p *Pipeline) Delete(key string) {
+	p.cmds = append(p.cmds, pipelined{cmd: "delete exists " + EscapeKey(key), notFound: true})
+}
+
+// DeleteBlind queues a delete that doesn't check that the key exists
+func (p *Pipeline) DeleteBlind(key string) {
+	p.cmds = append(p.cmds, pipelined{cmd: "delete " + EscapeKey(key)})
+}
+
+// Incr queues an increment of the counter at key
+func (p *Pipeline) Incr(key string, delta int64) {
+	p.cmds = append(p.cmds, pipelined{cmd: fmt.Sprintf("incr %s %d", key, delta)})
+}
+
+// Do queues any text command, whose response is returned as is. On a text
+// connection, commands answering with several "\r"-separated results, such
+// as keys and reads, can't be told apart from the responses that follow
+// them and mustn't be pipelined.
+func (p *Pipeline) Do(cmd string) {
+	p.cmds = append(p.cmds, pipelined{cmd: cmd})
+}
+
+// Len returns the number of queued commands
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// Exec sends the queued commands and returns their results, in the order
+// they were queued, emptying the pipeline. The error is set when the
+// connection fails; failed commands only set their result's Err.
+func (p *Pipeline) Exec() ([]PipelineResult, error) {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+
+	var (
+		resps []string
+		errs  []error
+		err   error
+	)
+	p.c.mu.Lock()
+	if m := p.c.mux; m != nil {
+		p.c.mu.Unlock()
+		resps, errs, err = p.c.execMultiplexed(m, cmds)
+	} else {
+		resps, err = p.c.execText(cmds)
+		p.c.mu.Unlock()
+		errs = make([]error, len(resps))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]PipelineResult, len(cmds))
+	for i, resp := range resps {
+		switch {
+		case errs[i] != nil:
+			results[i].Err = errs[i]
+		case resp == "error" && cmds[i].notFound:
+			results[i].Err = ErrNotFound
+		case strings.HasPrefix(resp, "error: "):
+			results[i].Err = &ServerError{Message: strings.TrimPrefix(resp, "error: ")}
+		default:
+			results[i].Value = []byte(resp)
+		}
+	}
+	return results, nil
+}
+
+// execText writes the commands while reading their responses, so a long
+// pipeline can't deadlock with both sides' buffers full. Caller holds c.mu.
+func (c *Client) execText(cmds []pipelined) ([]string, error) {
+	written := make(chan error, 1)
+	go func() {
+		for _, cmd := range cmds {
+			if _, err := c.writer.WriteString(cmd.cmd + "\r"); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- c.writer.Flush()
+	}()
+
+	resps := make([]string, 0, len(cmds))
+	for range cmds {
+		resp, err := c.reader.ReadString('\r')
+		if err != nil {
+			// The connection is unusable: unblock the writer and wait for it
+			c.conn.Close()
+			<-written
+			return nil, err
+		}
+		resps = append(resps, strings.TrimSuffix(resp, "\r"))
+	}
+	if err := <-written; err != nil {
+		return nil, err
+	}
+	return resps, nil
+}
+
+// execMultiplexed sends the commands concurrently on a framed connection,
+// where each is answered on its own
+func (c *Client) execMultiplexed(m *mux, cmds []pipelined) ([]string, []error, error) {
+	resps := make([]string, len(cmds))
+	errs := make([]error, len(cmds))
+	var wg sync.WaitGroup
+	for i, cmd := range cmds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resps[i], errs[i] = c.doMultiplexed(m, cmd.cmd)
+		}()
+	}
+	wg.Wait()
+
+	// A lost connection fails every request the same way
+	m.mu.Lock()
+	err := m.err
+	m.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	return resps, errs, nil
+}
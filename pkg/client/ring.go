@@ -0,0 +1,78 @@
+package client
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// Ring maps keys to nodes using consistent hashing with virtual nodes
+type Ring struct {
+	virtualNodes int
+	hashes       []uint32
+	nodes        map[uint32]string
+}
+
+// NewRing creates a ring over the given nodes
+func NewRing(nodes []string, virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = 1
+	}
+
+	r := &Ring{
+		virtualNodes: virtualNodes,
+		hashes:       make([]uint32, 0, len(nodes)*virtualNodes),
+		nodes:        make(map[uint32]string, len(nodes)*virtualNodes),
+	}
+
+	for _, node := range nodes {
+		for i := 0; i < virtualNodes; i++ {
+			h := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+			r.hashes = append(r.hashes, h)
+			r.nodes[h] = node
+		}
+	}
+
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+
+	return r
+}
+
+// Node returns the node owning key, or "" if the ring is empty
+func (r *Ring) Node(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= h
+	})
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.nodes[r.hashes[i]]
+}
+
+// Shares returns the fraction of the hash space each node owns
+func (r *Ring) Shares() map[string]float64 {
+	shares := make(map[string]float64)
+	if len(r.hashes) == 0 {
+		return shares
+	}
+
+	// Each point owns the hashes after its predecessor, up to itself; the
+	// first point also owns the wrap-around past the last
+	prev := r.hashes[len(r.hashes)-1]
+	for _, h := range r.hashes {
+		span := h - prev // wraps for the first point
+		if len(r.hashes) == 1 {
+			span = ^uint32(0)
+		}
+		shares[r.nodes[h]] += float64(span) / (1 << 32)
+		prev = h
+	}
+	return shares
+}
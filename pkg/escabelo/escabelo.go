@@ -0,0 +1,193 @@
+// Package escabelo embeds the Escabelo LSM storage engine in a Go program,
+// without running the TCP server. A DB is a directory holding a WAL and SST
+// files; it is safe for concurrent use and must be closed to flush the
+// memtable.
+//
+//	db, err := escabelo.Open("./data", nil)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer db.Close()
+//
+//	db.Put("user:42", []byte("alice"))
+//	value, err := db.Get("user:42")
+//
+// Only one process may open a directory at a time. Background errors, such
+// as failed flushes and compactions, are logged with slog's default logger.
+package escabelo
+
+import (
+	"errors"
+	"escabelo/internal/engine"
+	"time"
+)
+
+// ErrNotFound is returned by Get for a key that doesn't exist
+var ErrNotFound = errors.New("key not found")
+
+// ErrDiskFull is returned for writes while free disk space is below
+// Options.MinFreeDiskBytes
+var ErrDiskFull = engine.ErrDiskFull
+
+// ErrKeyTooLarge and ErrValueTooLarge are returned for writes past
+// Options.MaxKeySize and Options.MaxValueSize
+var (
+	ErrKeyTooLarge   = engine.ErrKeyTooLarge
+	ErrValueTooLarge = engine.ErrValueTooLarge
+)
+
+// WAL durability modes
+const (
+	DurabilityAlways   = engine.DurabilityAlways   // fsync the WAL before each write returns
+	DurabilityInterval = engine.DurabilityInterval // fsync it every SyncInterval
+	DurabilityNever    = engine.DurabilityNever    // leave flushing to the OS
+)
+
+// Compression codecs for SST values
+const (
+	CompressionNone  = engine.CompressionNone
+	CompressionGzip  = engine.CompressionGzip
+	CompressionFlate = engine.CompressionFlate
+)
+
+// Compaction strategies
+const (
+	CompactionSizeTiered = engine.CompactionSizeTiered
+	CompactionLeveled    = engine.CompactionLeveled
+)
+
+// Options tunes a DB. The zero value, or nil, uses the defaults of the
+// escabelo server.
+type Options struct {
+	// MemTableSize is how many bytes of writes are buffered in memory before
+	// they're flushed to an SST (default 64MB)
+	MemTableSize int64
+
+	// Durability picks when the WAL is fsynced (default DurabilityInterval),
+	// and SyncInterval how often for DurabilityInterval (default 100ms)
+	Durability   string
+	SyncInterval time.Duration
+
+	// CompactionInterval is how often SSTs are compacted (default 5m), and
+	// CompactionStrategy how they're grouped (default CompactionSizeTiered)
+	CompactionInterval time.Duration
+	CompactionStrategy string
+
+	// Compression is the codec values of 256 bytes or more are compressed
+	// with in SSTs (default CompressionNone)
+	Compression string
+
+	// BlockCacheSize is how many bytes of SST blocks are cached for point
+	// lookups (default 32MB, negative disables the cache)
+	BlockCacheSize int64
+
+	// MaxOpenFiles is how many SST files are kept open between reads
+	// (default 512, negative opens a file per read)
+	MaxOpenFiles int
+
+	// MinFreeDiskBytes rejects writes with ErrDiskFull while free space in
+	// the directory is below it (0 disables the check)
+	MinFreeDiskBytes int64
+
+	// MaxKeySize and MaxValueSize bound the keys and values writes may carry
+	// (default 100KB and 64MB, values at most 4GB)
+	MaxKeySize   int
+	MaxValueSize int64
+}
+
+// DB is an open Escabelo database
+type DB struct {
+	engine *engine.Engine
+}
+
+// Open opens the database in dir, creating it if needed, and recovers any
+// writes left in its WAL. A nil opts uses the defaults.
+func Open(dir string, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	config := engine.Config{
+		DataDir:            dir,
+		MemTableMaxSize:    opts.MemTableSize,
+		Durability:         opts.Durability,
+		WALSyncInterval:    opts.SyncInterval,
+		CompactionInterval: opts.CompactionInterval,
+		CompactionStrategy: opts.CompactionStrategy,
+		Compression:        opts.Compression,
+		BlockCacheSize:     opts.BlockCacheSize,
+		MaxOpenFiles:       opts.MaxOpenFiles,
+		MaxVersions:        1,
+		MinFreeDiskBytes:   opts.MinFreeDiskBytes,
+		MaxKeySize:         opts.MaxKeySize,
+		MaxValueSize:       opts.MaxValueSize,
+	}
+	if config.MemTableMaxSize <= 0 {
+		config.MemTableMaxSize = 64 * 1024 * 1024
+	}
+	if config.WALSyncInterval <= 0 {
+		config.WALSyncInterval = 100 * time.Millisecond
+	}
+	if config.CompactionInterval <= 0 {
+		config.CompactionInterval = 5 * time.Minute
+	}
+	switch {
+	case config.BlockCacheSize == 0:
+		config.BlockCacheSize = 32 * 1024 * 1024
+	case config.BlockCacheSize < 0:
+		config.BlockCacheSize = 0
+	}
+	switch {
+	case config.MaxOpenFiles == 0:
+		config.MaxOpenFiles = 512
+	case config.MaxOpenFiles < 0:
+		config.MaxOpenFiles = 0
+	}
+
+	e, err := engine.NewEngine(config)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{engine: e}, nil
+}
+
+// Get returns the value of key, or ErrNotFound
+func (db *DB) Get(key string) ([]byte, error) {
+	value, found, err := db.engine.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+// Put sets the value of key
+func (db *DB) Put(key string, value []byte) error {
+	return db.engine.Put(key, value)
+}
+
+// Delete removes key. Deleting a missing key isn't an error.
+func (db *DB) Delete(key string) error {
+	return db.engine.DeleteBlind(key)
+}
+
+// Sync fsyncs the WAL, making every write so far durable whatever the
+// durability mode
+func (db *DB) Sync() error {
+	return db.engine.Sync()
+}
+
+// Backup copies a consistent snapshot of the database to path, a new
+// directory that can later be opened like any other, or a tar archive if
+// path ends in ".tar". Writes carry on while it runs.
+func (db *DB) Backup(path string) error {
+	_, err := db.engine.Backup(path)
+	return err
+}
+
+// Close flushes the memtable to disk and closes the database. It must not
+// be called while iterators are open.
+func (db *DB) Close() error {
+	return db.engine.Close()
+}
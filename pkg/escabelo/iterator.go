@@ -0,0 +1,119 @@
+package escabelo
+
+import (
+	"escabelo/internal/engine"
+)
+
+// IteratorOptions bound the keys an Iterator visits to [Start, End), or to
+// the keys starting with Prefix. Empty bounds leave that side open.
+type IteratorOptions struct {
+	Start  string
+	End    string
+	Prefix string
+}
+
+// Iterator walks live keys in order, forward or in reverse. It reads a
+// snapshot taken when it was created, so writes made while it runs aren't
+// seen. Close it once done.
+//
+//	it := db.NewIterator(escabelo.IteratorOptions{Prefix: "user:"})
+//	defer it.Close()
+//	for it.First(); it.Valid(); it.Next() {
+//		fmt.Printf("%s=%s\n", it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// An Iterator isn't safe for concurrent use.
+type Iterator struct {
+	it  *engine.Iterator
+	err error
+}
+
+// NewIterator returns an iterator over the keys in opts' bounds, positioned
+// before the first one: call First, Last or Seek
+func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
+	bounds := engine.IteratorOptions{Start: opts.Start, End: opts.End}
+	if opts.Prefix != "" {
+		if bounds.Start < opts.Prefix {
+			bounds.Start = opts.Prefix
+		}
+		if end := engine.PrefixEnd(opts.Prefix); end != "" && (bounds.End == "" || end < bounds.End) {
+			bounds.End = end
+		}
+	}
+	it, err := db.engine.NewIterator(bounds)
+	return &Iterator{it: it, err: err}
+}
+
+// First positions the iterator at the first key
+func (it *Iterator) First() {
+	if it.it != nil {
+		it.it.SeekToFirst()
+	}
+}
+
+// Last positions the iterator at the last key
+func (it *Iterator) Last() {
+	if it.it != nil {
+		it.it.SeekToLast()
+	}
+}
+
+// Seek positions the iterator at the first key >= key
+func (it *Iterator) Seek(key string) {
+	if it.it != nil {
+		it.it.Seek(key)
+	}
+}
+
+// Next moves to the following key
+func (it *Iterator) Next() {
+	if it.it != nil {
+		it.it.Next()
+	}
+}
+
+// Prev moves to the preceding key
+func (it *Iterator) Prev() {
+	if it.it != nil {
+		it.it.Prev()
+	}
+}
+
+// Valid reports whether the iterator is positioned at a key. It turns false
+// past either end and on errors; check Err to tell them apart.
+func (it *Iterator) Valid() bool {
+	return it.it != nil && it.it.Valid()
+}
+
+// Key returns the key at the current position
+func (it *Iterator) Key() string {
+	return it.it.Key()
+}
+
+// Value returns the value at the current position. It must not be modified,
+// and is only valid until the iterator moves.
+func (it *Iterator) Value() []byte {
+	return it.it.Value()
+}
+
+// Err returns the error that stopped the iterator, if any
+func (it *Iterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	if it.it != nil {
+		return it.it.Err()
+	}
+	return nil
+}
+
+// Close releases the iterator's snapshot and files
+func (it *Iterator) Close() {
+	if it.it != nil {
+		it.it.Close()
+		it.it = nil
+	}
+}